@@ -8,6 +8,7 @@ replace (
 )
 
 require (
+	github.com/aws/aws-sdk-go v1.34.12
 	github.com/go-logr/logr v1.2.0
 	github.com/hobbyfarm/ec2-operator v0.0.0-20210503053736-8f6f258f7b24
 	github.com/hobbyfarm/gargantua v1.0.0
@@ -16,11 +17,15 @@ require (
 	github.com/ibrokethecloud/k3s-operator v0.0.0-20210110055129-f26a2d855653
 	github.com/onsi/ginkgo v1.16.5
 	github.com/onsi/gomega v1.17.0
+	github.com/packethost/packngo v0.19.0
+	github.com/prometheus/client_golang v1.11.0
+	github.com/prometheus/client_model v0.2.0
 	github.com/sirupsen/logrus v1.8.1
+	golang.org/x/crypto v0.0.0-20210817164053-32db794688a5
 	gopkg.in/yaml.v2 v2.4.0
 	k8s.io/api v0.23.0
 	k8s.io/apimachinery v0.23.0
 	k8s.io/client-go v11.0.1-0.20190409021438-1a26190bd76a+incompatible
 	sigs.k8s.io/controller-runtime v0.11.0
-
+	sigs.k8s.io/yaml v1.3.0
 )
@@ -20,6 +20,7 @@ import (
 	"flag"
 	equinixv1alpha1 "github.com/hobbyfarm/metal-operator/pkg/api/v1alpha1"
 	"os"
+	"time"
 
 	ec2v1alpha1 "github.com/hobbyfarm/ec2-operator/pkg/api/v1alpha1"
 	dropletv1alpha1 "github.com/ibrokethecloud/droplet-operator/pkg/api/v1alpha1"
@@ -29,6 +30,7 @@ import (
 	ctrl "sigs.k8s.io/controller-runtime"
 	"sigs.k8s.io/controller-runtime/pkg/log/zap"
 
+	shimv1alpha1 "github.com/hobbyfarm/hf-shim-operator/pkg/api/v1alpha1"
 	"github.com/hobbyfarm/hf-shim-operator/pkg/controllers"
 
 	hfv1 "github.com/hobbyfarm/gargantua/pkg/apis/hobbyfarm.io/v1"
@@ -36,10 +38,17 @@ import (
 )
 
 var (
-	scheme     = runtime.NewScheme()
-	setupLog   = ctrl.Log.WithName("setup")
-	threads    int
-	metricPort int
+	scheme          = runtime.NewScheme()
+	setupLog        = ctrl.Log.WithName("setup")
+	threads         int
+	metricPort      int
+	teardownTimeout time.Duration
+	reaperInterval  time.Duration
+	reaperGrace     time.Duration
+	reaperDryRun    bool
+	warmPoolRefill  time.Duration
+	phoneHomeAddr   string
+	phoneHomeURL    string
 )
 
 func init() {
@@ -49,6 +58,7 @@ func init() {
 	_ = hfv1.AddToScheme(scheme)
 	_ = ec2v1alpha1.AddToScheme(scheme)
 	_ = equinixv1alpha1.AddToScheme(scheme)
+	_ = shimv1alpha1.AddToScheme(scheme)
 	// +kubebuilder:scaffold:scheme
 }
 
@@ -62,6 +72,19 @@ func main() {
 			"Enabling this will ensure there is only one active controller manager.")
 	flag.IntVar(&threads, "threads", 5, "concurrent reconciles to run")
 	flag.IntVar(&metricPort, "metricPort", 9443, "metric port to expose")
+	flag.DurationVar(&teardownTimeout, "teardown-timeout", 10*time.Minute,
+		"how long a deleted VM waits for its provider resources to be deleted before it is released")
+	flag.DurationVar(&reaperInterval, "reaper-interval", 10*time.Minute,
+		"how often to look for orphaned provider resources, 0 disables the reaper")
+	flag.DurationVar(&reaperGrace, "reaper-grace-period", 30*time.Minute,
+		"how long provider resources may exist without a VirtualMachine before they are orphans")
+	flag.BoolVar(&reaperDryRun, "reaper-dry-run", true, "report orphaned provider resources without deleting them")
+	flag.DurationVar(&warmPoolRefill, "warm-pool-interval", time.Minute,
+		"how often to refill the warm pools of the environments, 0 disables warm pools")
+	flag.StringVar(&phoneHomeAddr, "phone-home-addr", "",
+		"The address the phone home endpoint binds to, empty disables it.")
+	flag.StringVar(&phoneHomeURL, "phone-home-url", "",
+		"The url instances reach the phone home endpoint at, e.g. https://shim.example.com")
 	flag.Parse()
 
 	ctrl.SetLogger(zap.New(zap.UseDevMode(true)))
@@ -78,15 +101,53 @@ func main() {
 		os.Exit(1)
 	}
 
-	if err = (&controllers.VirtualMachineReconciler{
-		Client:  mgr.GetClient(),
-		Log:     ctrl.Log.WithName("controllers").WithName("VirtualMachine"),
-		Scheme:  mgr.GetScheme(),
-		Threads: threads,
-	}).SetupWithManager(mgr); err != nil {
+	reconciler := &controllers.VirtualMachineReconciler{
+		Client:          mgr.GetClient(),
+		Log:             ctrl.Log.WithName("controllers").WithName("VirtualMachine"),
+		Scheme:          mgr.GetScheme(),
+		Threads:         threads,
+		Recorder:        mgr.GetEventRecorderFor("hf-shim-operator"),
+		TeardownTimeout: teardownTimeout,
+		PhoneHomeURL:    phoneHomeURL,
+	}
+	if err = reconciler.SetupWithManager(mgr); err != nil {
 		setupLog.Error(err, "unable to create controller", "controller", "VirtualMachine")
 		os.Exit(1)
 	}
+
+	if reaperInterval > 0 {
+		if err = mgr.Add(&controllers.OrphanReaper{
+			Client:      mgr.GetClient(),
+			Log:         ctrl.Log.WithName("reaper"),
+			Recorder:    mgr.GetEventRecorderFor("hf-shim-reaper"),
+			Interval:    reaperInterval,
+			GracePeriod: reaperGrace,
+			DryRun:      reaperDryRun,
+		}); err != nil {
+			setupLog.Error(err, "unable to add orphan reaper")
+			os.Exit(1)
+		}
+	}
+
+	if warmPoolRefill > 0 {
+		if err = mgr.Add(&controllers.WarmPool{
+			Reconciler: reconciler,
+			Interval:   warmPoolRefill,
+		}); err != nil {
+			setupLog.Error(err, "unable to add warm pool")
+			os.Exit(1)
+		}
+	}
+
+	if len(phoneHomeAddr) > 0 {
+		if err = mgr.Add(&controllers.PhoneHome{
+			Reconciler: reconciler,
+			Addr:       phoneHomeAddr,
+		}); err != nil {
+			setupLog.Error(err, "unable to add phone home endpoint")
+			os.Exit(1)
+		}
+	}
 	// +kubebuilder:scaffold:builder
 
 	setupLog.Info("starting manager")
@@ -0,0 +1,212 @@
+/*
+
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package v1alpha1
+
+import (
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// Phase is a step of provisioning a hobbyfarm VirtualMachine
+type Phase string
+
+const (
+	PhasePending         Phase = "Pending"
+	PhaseSecretCreated   Phase = "SecretCreated"
+	PhaseKeyPairImported Phase = "KeyPairImported"
+	PhaseProvisioned     Phase = "Provisioned"
+	PhaseRunning         Phase = "Running"
+	PhaseRetrying        Phase = "Retrying"
+	PhaseFailed          Phase = "Failed"
+	PhaseRecycling       Phase = "Recycling"
+	PhaseStopping        Phase = "Stopping"
+	PhaseStopped         Phase = "Stopped"
+	PhaseResuming        Phase = "Resuming"
+	PhaseTerminating     Phase = "Terminating"
+)
+
+// Condition types of a VirtualMachineProvisioning
+const (
+	// ConditionKeyPairReady is true once the VM keypair is available to the provider
+	ConditionKeyPairReady = "KeyPairReady"
+	// ConditionInstanceProvisioned is true once the provider reports the instance as up
+	ConditionInstanceProvisioned = "InstanceProvisioned"
+	// ConditionReady is true once the VM passed its liveness check and can be handed to users
+	ConditionReady = "Ready"
+	// ConditionFailed is true once provisioning ran out of attempts
+	ConditionFailed = "Failed"
+	// ConditionDegraded is true while reconciling the VM fails
+	ConditionDegraded = "Degraded"
+	// ConditionExpiring is true while the VM is about to exceed its maximum lifetime or idle timeout
+	ConditionExpiring = "Expiring"
+	// ConditionInvalidConfig is true while the environment of the VM asks for a feature its provider does not support
+	ConditionInvalidConfig = "InvalidConfig"
+)
+
+// VirtualMachineProvisioningSpec defines the VirtualMachine being provisioned
+type VirtualMachineProvisioningSpec struct {
+	// VirtualMachine is the name of the hobbyfarm VirtualMachine in the same namespace
+	VirtualMachine string `json:"virtualMachine"`
+}
+
+// PhaseTransition records a phase change of a VirtualMachineProvisioning
+type PhaseTransition struct {
+	// +optional
+	From Phase `json:"from,omitempty"`
+	To   Phase `json:"to"`
+	// +optional
+	Reason string `json:"reason,omitempty"`
+	// +optional
+	Message string      `json:"message,omitempty"`
+	Time    metav1.Time `json:"time"`
+}
+
+// ChildReference points at an object backing the VirtualMachine
+type ChildReference struct {
+	APIVersion string `json:"apiVersion"`
+	Kind       string `json:"kind"`
+	Name       string `json:"name"`
+	// +optional
+	Namespace string `json:"namespace,omitempty"`
+}
+
+// Endpoints are the addresses a VirtualMachine is reached at
+type Endpoints struct {
+	// SSH is the host users connect to, it may differ from the public ip
+	// +optional
+	SSH string `json:"ssh,omitempty"`
+	// +optional
+	SSHUsername string `json:"sshUsername,omitempty"`
+	// SSHProxy is the jump host ssh connections to the VM are tunnelled through
+	// +optional
+	SSHProxy string `json:"sshProxy,omitempty"`
+	// +optional
+	PublicIP string `json:"publicIP,omitempty"`
+	// +optional
+	PrivateIP string `json:"privateIP,omitempty"`
+	// +optional
+	Hostname string `json:"hostname,omitempty"`
+	// +optional
+	WebSocket string `json:"webSocket,omitempty"`
+}
+
+// InstanceAddresses are the ip addresses of an instance
+type InstanceAddresses struct {
+	// +optional
+	PublicIP string `json:"publicIP,omitempty"`
+	// +optional
+	PrivateIP string `json:"privateIP,omitempty"`
+}
+
+// Timings records when the VirtualMachine reached the provisioning milestones
+type Timings struct {
+	// StartedAt is the start of the first provisioning attempt
+	// +optional
+	StartedAt *metav1.Time `json:"startedAt,omitempty"`
+	// AttemptStartedAt is the start of the current provisioning attempt
+	// +optional
+	AttemptStartedAt *metav1.Time `json:"attemptStartedAt,omitempty"`
+	// +optional
+	ProvisionedAt *metav1.Time `json:"provisionedAt,omitempty"`
+	// +optional
+	RunningAt *metav1.Time `json:"runningAt,omitempty"`
+	// ExpiresAt is the end of the maximum lifetime of the running VM
+	// +optional
+	ExpiresAt *metav1.Time `json:"expiresAt,omitempty"`
+	// IdleSince is the first idle check which found nobody using the VM, since it was last in use
+	// +optional
+	IdleSince *metav1.Time `json:"idleSince,omitempty"`
+	// PhonedHomeAt is when the instance called the phone home endpoint with the one-time token of the VM
+	// +optional
+	PhonedHomeAt *metav1.Time `json:"phonedHomeAt,omitempty"`
+}
+
+// VirtualMachineProvisioningStatus defines the observed provisioning state of a VirtualMachine
+type VirtualMachineProvisioningStatus struct {
+	// Provider is the environment provider the VirtualMachine is provisioned with
+	// +optional
+	Provider string `json:"provider,omitempty"`
+	// +optional
+	Environment string `json:"environment,omitempty"`
+	// +optional
+	Template string `json:"template,omitempty"`
+	// +optional
+	InstanceType string `json:"instanceType,omitempty"`
+	// Attempt is the current provisioning attempt, starting at 1
+	// +optional
+	Attempt int32 `json:"attempt,omitempty"`
+	// KeySecret is the secret in the provisioning namespace holding the ssh keypair
+	// +optional
+	KeySecret string `json:"keySecret,omitempty"`
+	// Children are the objects created by the provider
+	// +optional
+	Children []ChildReference `json:"children,omitempty"`
+	// ClaimedFrom is the warm pool VirtualMachine whose instance was claimed. The provider objects keep its name.
+	// +optional
+	ClaimedFrom string `json:"claimedFrom,omitempty"`
+	// +optional
+	Endpoints Endpoints `json:"endpoints,omitempty"`
+	// StartedAddresses are the addresses of an instance the shim started again after stopping it, for providers
+	// whose operator does not refresh them. They replace the addresses reported by the operator.
+	// +optional
+	StartedAddresses *InstanceAddresses `json:"startedAddresses,omitempty"`
+	// +optional
+	Timings Timings `json:"timings,omitempty"`
+	// +optional
+	Phase Phase `json:"phase,omitempty"`
+	// +optional
+	// +patchMergeKey=type
+	// +patchStrategy=merge
+	// +listType=map
+	// +listMapKey=type
+	Conditions []metav1.Condition `json:"conditions,omitempty" patchStrategy:"merge" patchMergeKey:"type"`
+	// History holds the latest phase transitions, oldest first
+	// +optional
+	History []PhaseTransition `json:"history,omitempty"`
+}
+
+// +kubebuilder:object:root=true
+// +kubebuilder:subresource:status
+// +kubebuilder:resource:shortName=vmp
+// +kubebuilder:printcolumn:name="VM",type=string,JSONPath=`.spec.virtualMachine`
+// +kubebuilder:printcolumn:name="Provider",type=string,JSONPath=`.status.provider`
+// +kubebuilder:printcolumn:name="Phase",type=string,JSONPath=`.status.phase`
+// +kubebuilder:printcolumn:name="Attempt",type=integer,JSONPath=`.status.attempt`
+// +kubebuilder:printcolumn:name="Endpoint",type=string,JSONPath=`.status.endpoints.ssh`
+// +kubebuilder:printcolumn:name="Ready",type=string,JSONPath=`.status.conditions[?(@.type=="Ready")].status`
+// +kubebuilder:printcolumn:name="Age",type=date,JSONPath=`.metadata.creationTimestamp`
+
+// VirtualMachineProvisioning is the provisioning state the shim keeps for a hobbyfarm VirtualMachine
+type VirtualMachineProvisioning struct {
+	metav1.TypeMeta   `json:",inline"`
+	metav1.ObjectMeta `json:"metadata,omitempty"`
+
+	Spec   VirtualMachineProvisioningSpec   `json:"spec,omitempty"`
+	Status VirtualMachineProvisioningStatus `json:"status,omitempty"`
+}
+
+// +kubebuilder:object:root=true
+
+// VirtualMachineProvisioningList contains a list of VirtualMachineProvisioning
+type VirtualMachineProvisioningList struct {
+	metav1.TypeMeta `json:",inline"`
+	metav1.ListMeta `json:"metadata,omitempty"`
+	Items           []VirtualMachineProvisioning `json:"items"`
+}
+
+func init() {
+	SchemeBuilder.Register(&VirtualMachineProvisioning{}, &VirtualMachineProvisioningList{})
+}
@@ -2,19 +2,123 @@ package controllers
 
 import (
 	"context"
-	b64 "encoding/base64"
+	"encoding/base64"
 	"fmt"
 	"strconv"
 
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/session"
+	awsec2 "github.com/aws/aws-sdk-go/service/ec2"
 	ec2v1alpha1 "github.com/hobbyfarm/ec2-operator/pkg/api/v1alpha1"
 	hfv1 "github.com/hobbyfarm/gargantua/pkg/apis/hobbyfarm.io/v1"
-	"github.com/hobbyfarm/hf-shim-operator/pkg/utils"
+	shimv1alpha1 "github.com/hobbyfarm/hf-shim-operator/pkg/api/v1alpha1"
 	v1 "k8s.io/api/core/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
 	"sigs.k8s.io/controller-runtime/pkg/controller/controllerutil"
 )
 
+func init() {
+	RegisterProvider("aws", func(r *VirtualMachineReconciler) Provider {
+		return &awsProvider{r: r}
+	})
+}
+
+// awsProvider launches VMs as ec2-operator Instances
+type awsProvider struct {
+	r *VirtualMachineReconciler
+}
+
+func (p *awsProvider) ImportKeyPair(ctx context.Context, vm *hfv1.VirtualMachine, env *hfv1.Environment,
+	pubKey string) (*hfv1.VirtualMachineStatus, error) {
+	if err := checkKeyType("aws", pubKey); err != nil {
+		return vm.Status.DeepCopy(), err
+	}
+	return p.r.createEC2ImportKeyPair(ctx, vm, env, pubKey)
+}
+
+func (p *awsProvider) CreateInstance(ctx context.Context, vm *hfv1.VirtualMachine, env *hfv1.Environment,
+	vmTemplate *hfv1.VirtualMachineTemplate) error {
+	return p.r.createEC2Instance(ctx, vm, env, vmTemplate)
+}
+
+func (p *awsProvider) FetchStatus(ctx context.Context, vm *hfv1.VirtualMachine) (*hfv1.VirtualMachineStatus, bool, error) {
+	return p.r.fetchEC2Instance(ctx, vm)
+}
+
+func (p *awsProvider) LivenessCheck(ctx context.Context, vm *hfv1.VirtualMachine) (bool, error) {
+	return p.RunCommand(ctx, vm, "uptime")
+}
+
+func (p *awsProvider) RunCommand(ctx context.Context, vm *hfv1.VirtualMachine, command string) (bool, error) {
+	instance := &ec2v1alpha1.Instance{}
+	if err := p.r.Get(ctx, types.NamespacedName{Name: vm.Name, Namespace: vm.Namespace}, instance); err != nil {
+		return false, err
+	}
+	return p.r.ec2LivenessCheck(ctx, vm, instance, command)
+}
+
+func (p *awsProvider) Teardown(ctx context.Context, vm *hfv1.VirtualMachine) (bool, error) {
+	return p.r.deleteChildren(ctx, p.children(vm)...)
+}
+
+// Stop powers the ec2 instance off. Instances of the ec2-operator have no power state, so the instance is stopped
+// through the ec2 api with the credentials of the Instance.
+func (p *awsProvider) Stop(ctx context.Context, vm *hfv1.VirtualMachine) (bool, error) {
+	instance, svc, err := p.r.ec2Client(ctx, vm)
+	if err != nil {
+		return false, err
+	}
+	described, err := describeEC2Instance(ctx, svc, instance)
+	if err != nil {
+		return false, err
+	}
+	switch aws.StringValue(described.State.Name) {
+	case awsec2.InstanceStateNameStopped:
+		return true, nil
+	case awsec2.InstanceStateNameRunning:
+		_, err = svc.StopInstancesWithContext(ctx, &awsec2.StopInstancesInput{
+			InstanceIds: aws.StringSlice([]string{instance.Status.InstanceID}),
+		})
+	}
+	return false, err
+}
+
+// Start powers the stopped ec2 instance on, and returns its new addresses once it runs. The ec2-operator does not
+// refresh the addresses of its Instance.
+func (p *awsProvider) Start(ctx context.Context, vm *hfv1.VirtualMachine) (bool,
+	*shimv1alpha1.InstanceAddresses, error) {
+	instance, svc, err := p.r.ec2Client(ctx, vm)
+	if err != nil {
+		return false, nil, err
+	}
+	described, err := describeEC2Instance(ctx, svc, instance)
+	if err != nil {
+		return false, nil, err
+	}
+	switch aws.StringValue(described.State.Name) {
+	case awsec2.InstanceStateNameRunning:
+		return true, &shimv1alpha1.InstanceAddresses{
+			PublicIP:  aws.StringValue(described.PublicIpAddress),
+			PrivateIP: aws.StringValue(described.PrivateIpAddress),
+		}, nil
+	case awsec2.InstanceStateNameStopped:
+		_, err = svc.StartInstancesWithContext(ctx, &awsec2.StartInstancesInput{
+			InstanceIds: aws.StringSlice([]string{instance.Status.InstanceID}),
+		})
+	}
+	return false, nil, err
+}
+
+func (p *awsProvider) children(vm *hfv1.VirtualMachine) []client.Object {
+	return []client.Object{
+		&ec2v1alpha1.Instance{ObjectMeta: metav1.ObjectMeta{Name: vm.Name, Namespace: vm.Namespace}},
+		&ec2v1alpha1.ImportKeyPair{ObjectMeta: metav1.ObjectMeta{Name: vm.Name, Namespace: vm.Namespace}},
+	}
+}
+
 func (r *VirtualMachineReconciler) createEC2ImportKeyPair(ctx context.Context, vm *hfv1.VirtualMachine,
 	env *hfv1.Environment, pubKey string) (status *hfv1.VirtualMachineStatus, err error) {
 	status = vm.Status.DeepCopy()
@@ -38,6 +142,7 @@ func (r *VirtualMachineReconciler) createEC2ImportKeyPair(ctx context.Context, v
 	}
 
 	if _, err = controllerutil.CreateOrUpdate(ctx, r.Client, keyPair, func() error {
+		setVMLabels(keyPair, vm)
 		keyPair.Spec.PublicKey = pubKey
 		keyPair.Spec.KeyName = vm.Name
 		keyPair.Spec.Secret = credSecret
@@ -53,7 +158,6 @@ func (r *VirtualMachineReconciler) createEC2ImportKeyPair(ctx context.Context, v
 		return status, err
 	}
 
-	vm.Annotations["importKeyPair"] = keyPair.Name
 	status.Status = importKeyPairCreated
 	return status, nil
 }
@@ -89,29 +193,31 @@ func (r *VirtualMachineReconciler) createEC2Instance(ctx context.Context, vm *hf
 		return fmt.Errorf("no ami specified for vm template in env spec")
 	}
 
-	cloudInit, _ := environment.Spec.TemplateMapping[vmTemplate.Name]["cloudInit"]
-
+	cloudInit, err := r.cloudInitUserData(ctx, vm, environment,
+		environment.Spec.TemplateMapping[vmTemplate.Name]["cloudInit"])
 	if err != nil {
-		return fmt.Errorf("error merging cloud init")
+		return fmt.Errorf("error merging cloud init: %v", err)
 	}
-
-	instanceType, ok := environment.Spec.TemplateMapping[vmTemplate.Name]["instanceType"]
-	if !ok {
-		instanceType = defaultInstanceType
+	// ec2 expects base64 encoded user data
+	if len(cloudInit) > 0 {
+		cloudInit = base64.StdEncoding.EncodeToString([]byte(cloudInit))
 	}
 
-	vm.Annotations[instanceTypeAnnotation] = instanceType
+	instanceType := templateInstanceType(environment, vmTemplate.Name)
 
 	securityGroup, ok := environment.Spec.EnvironmentSpecifics["vpc_security_group_id"]
 	if !ok {
 		return fmt.Errorf("no vpc_security_group_ip found in environment_specifics")
 	}
 
-	keyPair, ok := vm.Annotations["importKeyPair"]
-	if !ok {
-		return fmt.Errorf("no importKeyPair annotation found on vm object")
+	// instances trusting a certificate authority are launched without an imported keypair
+	keyName := vm.Name
+	if r.sshCAEnabled(environment) {
+		keyName = ""
 	}
+
 	if _, err = controllerutil.CreateOrUpdate(ctx, r.Client, instance, func() error {
+		setVMLabels(instance, vm)
 		instance.Spec.Secret = credSecret
 		instance.Spec.SubnetID = subnet
 		instance.Spec.ImageID = ami
@@ -120,7 +226,7 @@ func (r *VirtualMachineReconciler) createEC2Instance(ctx context.Context, vm *hf
 		instance.Spec.SecurityGroupIDS = []string{securityGroup}
 		instance.Spec.InstanceType = instanceType
 		instance.Spec.PublicIPAddress = true
-		instance.Spec.KeyName = keyPair
+		instance.Spec.KeyName = keyName
 		instance.Spec.DeleteVolumesOnTermination = true
 		rootDisk, ok := environment.Spec.TemplateMapping[vmTemplate.Name]["rootDiskSize"]
 		if ok {
@@ -140,6 +246,7 @@ func (r *VirtualMachineReconciler) createEC2Instance(ctx context.Context, vm *hf
 
 		return nil
 	}); err != nil {
+		childCreateErrors.WithLabelValues("aws", "Instance").Inc()
 		r.Log.Error(fmt.Errorf("Error creating instance "), instance.Name)
 		return err
 	}
@@ -148,70 +255,95 @@ func (r *VirtualMachineReconciler) createEC2Instance(ctx context.Context, vm *hf
 
 // Fetch EC2 Instance information //
 func (r *VirtualMachineReconciler) fetchEC2Instance(ctx context.Context,
-	vm *hfv1.VirtualMachine) (status *hfv1.VirtualMachineStatus, err error) {
+	vm *hfv1.VirtualMachine) (status *hfv1.VirtualMachineStatus, provisioned bool, err error) {
 	instance := &ec2v1alpha1.Instance{}
 	status = vm.Status.DeepCopy()
 	err = r.Get(ctx, types.NamespacedName{Name: vm.Name, Namespace: vm.Namespace}, instance)
 	if err != nil {
 		r.Log.Error(fmt.Errorf("Error fetching EC2 Instance: "), instance.Name)
-		return status, err
+		return status, false, err
 	}
-	if len(instance.Status.PublicIP) > 0 {
-		status.PublicIP = instance.Status.PublicIP
-		vm.Annotations["sshEndpoint"] = instance.Status.PublicIP
+	publicIP, privateIP, err := r.instanceAddresses(ctx, instance, instance.Status.PublicIP,
+		instance.Status.PrivateIP)
+	if err != nil {
+		return status, false, err
+	}
+	if len(publicIP) > 0 {
+		status.PublicIP = publicIP
+		vm.Annotations["sshEndpoint"] = publicIP
 	}
 
-	if len(instance.Status.PrivateIP) > 0 {
-		status.PrivateIP = instance.Status.PrivateIP
+	if len(privateIP) > 0 {
+		status.PrivateIP = privateIP
 	}
 
 	if len(instance.Status.InstanceID) > 0 {
 		status.Hostname = instance.Status.InstanceID
 	}
-	if instance.Status.Status == "provisioned" {
-		//perform VM liveness check before this is ready //
-		ready, err := r.ec2LivenessCheck(ctx, vm, instance)
-		if err != nil {
-			return status, err
-		}
-		if ready {
-			status.Status = hfv1.VmStatusRunning
-		}
-	}
 
-	if status.Status != hfv1.VmStatusRunning {
-		return status, fmt.Errorf("VM still not running")
-	}
-	return status, err
+	//perform VM liveness check before this is ready //
+	return status, instance.Status.Status == "provisioned", nil
 }
 
 func (r *VirtualMachineReconciler) ec2LivenessCheck(ctx context.Context, vm *hfv1.VirtualMachine,
-	instance *ec2v1alpha1.Instance) (ready bool, err error) {
-	keySecret := &v1.Secret{}
-	var username, address string
-	err = r.Get(ctx, types.NamespacedName{Name: vm.Spec.KeyPair, Namespace: vm.Namespace}, keySecret)
+	instance *ec2v1alpha1.Instance, command string) (ready bool, err error) {
+	publicIP, privateIP, err := r.instanceAddresses(ctx, instance, instance.Status.PublicIP,
+		instance.Status.PrivateIP)
 	if err != nil {
 		return ready, err
 	}
-	if len(vm.Spec.SshUsername) != 0 {
-		username = vm.Spec.SshUsername
+	var address string
+	if len(publicIP) > 0 {
+		address = publicIP + ":22"
+		vm.Annotations["sshEndpoint"] = publicIP
 	} else {
-		username = "ubuntu"
+		address = privateIP + ":22"
 	}
 
-	privKey, ok := keySecret.Data["private_key"]
-	if !ok {
-		return ready, fmt.Errorf("private_key not found in secret %s", keySecret.Name)
-	}
-	encodeKey := b64.StdEncoding.EncodeToString(privKey)
+	return r.sshLivenessCheck(ctx, vm, address, "ubuntu", command)
+}
 
-	if len(instance.Status.PublicIP) > 0 {
-		address = instance.Status.PublicIP + ":22"
-		vm.Annotations["sshEndpoint"] = instance.Status.PublicIP
-	} else {
-		address = instance.Status.PrivateIP + ":22"
+// ec2Client returns the ec2-operator Instance of vm, and an ec2 api client with the credentials of the Instance
+func (r *VirtualMachineReconciler) ec2Client(ctx context.Context,
+	vm *hfv1.VirtualMachine) (instance *ec2v1alpha1.Instance, svc *awsec2.EC2, err error) {
+	instance = &ec2v1alpha1.Instance{}
+	if err = r.Get(ctx, types.NamespacedName{Name: vm.Name, Namespace: vm.Namespace}, instance); err != nil {
+		return instance, svc, err
+	}
+	if len(instance.Status.InstanceID) == 0 {
+		return instance, svc, fmt.Errorf("ec2 instance %s has no instance id yet", instance.Name)
+	}
+	secret := &v1.Secret{}
+	if err = r.Get(ctx, types.NamespacedName{Name: instance.Spec.Secret, Namespace: instance.Namespace},
+		secret); err != nil {
+		return instance, svc, err
 	}
+	sess, err := session.NewSession(&aws.Config{
+		Credentials: credentials.NewStaticCredentials(string(secret.Data["aws_access_key"]),
+			string(secret.Data["aws_secret_key"]), ""),
+		Region: aws.String(instance.Spec.Region),
+	})
+	if err != nil {
+		return instance, svc, err
+	}
+	return instance, awsec2.New(sess), nil
+}
 
-	ready, err = utils.PerformLivenessCheck(address, username, encodeKey, "uptime")
-	return ready, err
+// describeEC2Instance returns the ec2 api description of instance
+func describeEC2Instance(ctx context.Context, svc *awsec2.EC2,
+	instance *ec2v1alpha1.Instance) (*awsec2.Instance, error) {
+	output, err := svc.DescribeInstancesWithContext(ctx, &awsec2.DescribeInstancesInput{
+		InstanceIds: aws.StringSlice([]string{instance.Status.InstanceID}),
+	})
+	if err != nil {
+		return nil, err
+	}
+	if len(output.Reservations) == 0 || len(output.Reservations[0].Instances) == 0 {
+		return nil, fmt.Errorf("ec2 instance %s not found", instance.Status.InstanceID)
+	}
+	described := output.Reservations[0].Instances[0]
+	if described.State == nil {
+		return nil, fmt.Errorf("ec2 instance %s has no state", instance.Status.InstanceID)
+	}
+	return described, nil
 }
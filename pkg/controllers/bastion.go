@@ -0,0 +1,101 @@
+package controllers
+
+import (
+	"context"
+	b64 "encoding/base64"
+	"fmt"
+	"net"
+
+	hfv1 "github.com/hobbyfarm/gargantua/pkg/apis/hobbyfarm.io/v1"
+	"github.com/hobbyfarm/hf-shim-operator/pkg/utils"
+	gossh "golang.org/x/crypto/ssh"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+)
+
+/*
+Info used from environment, ssh connections to instances are tunnelled through a jump host with bastion_host:
+bastion_host (optional, host or host:port of the jump host, port 22 by default)
+bastion_user (user on the jump host, needed with bastion_host)
+bastion_key_secret (secret in the namespace of the vm with the private_key of bastion_user, needed with bastion_host)
+bastion_host_key (optional, authorized_keys line of the host key of the jump host. it is not verified without one)
+*/
+
+const (
+	bastionHostKey      = "bastion_host"
+	bastionUserKey      = "bastion_user"
+	bastionKeySecretKey = "bastion_key_secret"
+	bastionHostKeyKey   = "bastion_host_key"
+
+	// annotations publishing the jump host on the vm, so the shell proxy can follow the path of the liveness check
+	sshProxyEndpointAnnotation  = "sshProxyEndpoint"
+	sshProxyUserAnnotation      = "sshProxyUser"
+	sshProxyKeySecretAnnotation = "sshProxyKeySecret"
+)
+
+// fetchBastion returns the jump host of env for vm, which is nil without bastion_host
+func (r *VirtualMachineReconciler) fetchBastion(ctx context.Context, vm *hfv1.VirtualMachine,
+	env *hfv1.Environment) (bastion *utils.Bastion, err error) {
+	specifics := env.Spec.EnvironmentSpecifics
+	host, ok := specifics[bastionHostKey]
+	if !ok {
+		return bastion, nil
+	}
+	if _, _, err := net.SplitHostPort(host); err != nil {
+		host = net.JoinHostPort(host, "22")
+	}
+	user, ok := specifics[bastionUserKey]
+	if !ok {
+		return bastion, fmt.Errorf("no %s found in env spec", bastionUserKey)
+	}
+	secretName, ok := specifics[bastionKeySecretKey]
+	if !ok {
+		return bastion, fmt.Errorf("no %s found in env spec", bastionKeySecretKey)
+	}
+
+	secret := &v1.Secret{}
+	if err = r.Get(ctx, types.NamespacedName{Name: secretName, Namespace: vm.Namespace}, secret); err != nil {
+		return bastion, err
+	}
+	privKey, ok := secret.Data["private_key"]
+	if !ok {
+		return bastion, fmt.Errorf("private_key not found in secret %s", secret.Name)
+	}
+
+	bastion = &utils.Bastion{
+		Address:    host,
+		User:       user,
+		PrivateKey: b64.StdEncoding.EncodeToString(privKey),
+	}
+	if hostKey, ok := specifics[bastionHostKeyKey]; ok {
+		key, _, _, _, err := gossh.ParseAuthorizedKey([]byte(hostKey))
+		if err != nil {
+			return bastion, fmt.Errorf("invalid %s in env spec: %v", bastionHostKeyKey, err)
+		}
+		bastion.HostKeyCallback = gossh.FixedHostKey(key)
+	}
+	return bastion, nil
+}
+
+// publishBastion publishes the jump host of env on the annotations of vm, and removes them when bastion is nil. vms
+// reached at address through a jump host get it as ssh endpoint when their provider published none.
+func publishBastion(vm *hfv1.VirtualMachine, env *hfv1.Environment, bastion *utils.Bastion, address string) {
+	if bastion == nil {
+		delete(vm.Annotations, sshProxyEndpointAnnotation)
+		delete(vm.Annotations, sshProxyUserAnnotation)
+		delete(vm.Annotations, sshProxyKeySecretAnnotation)
+		return
+	}
+	metav1.SetMetaDataAnnotation(&vm.ObjectMeta, sshProxyEndpointAnnotation, bastion.Address)
+	metav1.SetMetaDataAnnotation(&vm.ObjectMeta, sshProxyUserAnnotation, bastion.User)
+	metav1.SetMetaDataAnnotation(&vm.ObjectMeta, sshProxyKeySecretAnnotation,
+		env.Spec.EnvironmentSpecifics[bastionKeySecretKey])
+	if _, ok := vm.Annotations["sshEndpoint"]; !ok {
+		host, _, err := net.SplitHostPort(address)
+		if err != nil {
+			host = address
+		}
+		vm.Annotations["sshEndpoint"] = host
+	}
+}
@@ -0,0 +1,49 @@
+package controllers
+
+import (
+	"testing"
+
+	hfv1 "github.com/hobbyfarm/gargantua/pkg/apis/hobbyfarm.io/v1"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func TestBastion(t *testing.T) {
+	p := newFakeProvider()
+	p.register()
+	h := newHarness(t, fakeProviderName, map[string]string{
+		bastionHostKey:      "bastion.example.com",
+		bastionUserKey:      "jump",
+		bastionKeySecretKey: "bastion-key",
+	}, nil)
+	h.setLive(true)
+	h.step(secretCreated)
+	h.step(importKeyPairCreated)
+	h.step(hfv1.VmStatusProvisioned)
+	p.transition(testVMName, fakeInstanceProvisioned, "10.0.0.7")
+
+	// the liveness check can not run without the key of the bastion
+	if err := h.reconcile(); err == nil {
+		t.Fatal("expected the missing bastion key secret to fail the liveness check")
+	}
+	if err := h.r.Create(h.ctx, &v1.Secret{
+		ObjectMeta: metav1.ObjectMeta{Name: "bastion-key", Namespace: h.namespace},
+		Data:       map[string][]byte{"private_key": []byte("bastion private key")},
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	h.step(hfv1.VmStatusRunning)
+	if call := h.lastLivenessCall(); call.address != "10.0.0.7:22" || call.bastion != "jump@bastion.example.com:22" {
+		t.Fatalf("expected the liveness check to go through the bastion, got %+v", call)
+	}
+	vm := h.vm()
+	if vm.Annotations[sshProxyEndpointAnnotation] != "bastion.example.com:22" ||
+		vm.Annotations[sshProxyUserAnnotation] != "jump" ||
+		vm.Annotations[sshProxyKeySecretAnnotation] != "bastion-key" {
+		t.Fatalf("expected the bastion to be published on the vm, got %v", vm.Annotations)
+	}
+	if proxy := h.provisioning().Status.Endpoints.SSHProxy; proxy != "bastion.example.com:22" {
+		t.Fatalf("expected the bastion in the endpoints, got %q", proxy)
+	}
+}
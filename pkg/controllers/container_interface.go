@@ -0,0 +1,192 @@
+package controllers
+
+import (
+	"context"
+	"fmt"
+
+	hfv1 "github.com/hobbyfarm/gargantua/pkg/apis/hobbyfarm.io/v1"
+	shimv1alpha1 "github.com/hobbyfarm/hf-shim-operator/pkg/api/v1alpha1"
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/controller/controllerutil"
+)
+
+/*
+Info needed in env template mapping:
+image (an image running sshd on port 22)
+authorizedKeysPath (optional, directory the authorized_keys file is mounted in)
+cpu, memory (optional, resource limits of the container)
+*/
+
+const (
+	defaultAuthorizedKeysPath = "/root/.ssh"
+	defaultContainerUsername  = "root"
+	containerName             = "shell"
+	containerKeysVolume       = "authorized-keys"
+)
+
+func init() {
+	RegisterProvider("container", func(r *VirtualMachineReconciler) Provider {
+		return &containerProvider{r: r}
+	})
+}
+
+// containerProvider backs VMs with a Pod running sshd. The Pod runs next to the keypair secret, as the
+// public key is mounted from it as authorized_keys.
+type containerProvider struct {
+	r *VirtualMachineReconciler
+}
+
+// ImportKeyPair has no backend object to create, the public key is mounted from the keypair secret
+func (p *containerProvider) ImportKeyPair(ctx context.Context, vm *hfv1.VirtualMachine, env *hfv1.Environment,
+	pubKey string) (status *hfv1.VirtualMachineStatus, err error) {
+	status = vm.Status.DeepCopy()
+	status.Status = importKeyPairCreated
+	return status, nil
+}
+
+func (p *containerProvider) CreateInstance(ctx context.Context, vm *hfv1.VirtualMachine, env *hfv1.Environment,
+	vmTemplate *hfv1.VirtualMachineTemplate) (err error) {
+	mapping := env.Spec.TemplateMapping[vmTemplate.Name]
+	image, ok := mapping["image"]
+	if !ok {
+		return fmt.Errorf("no image specified for vm template in env spec")
+	}
+
+	keysPath, ok := mapping["authorizedKeysPath"]
+	if !ok {
+		keysPath = defaultAuthorizedKeysPath
+	}
+
+	limits := v1.ResourceList{}
+	for name, key := range map[v1.ResourceName]string{v1.ResourceCPU: "cpu", v1.ResourceMemory: "memory"} {
+		value, ok := mapping[key]
+		if !ok {
+			continue
+		}
+		quantity, err := resource.ParseQuantity(value)
+		if err != nil {
+			return fmt.Errorf("unable to parse %s: %v", key, err)
+		}
+		limits[name] = quantity
+	}
+
+	keyMode := int32(0600)
+	pod := &v1.Pod{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      vm.Name,
+			Namespace: provisionNS,
+		},
+	}
+	if _, err = controllerutil.CreateOrUpdate(ctx, p.r.Client, pod, func() error {
+		if !pod.CreationTimestamp.IsZero() {
+			// pod specs are immutable
+			return nil
+		}
+		pod.Labels = map[string]string{
+			vmLabel:          vm.Name,
+			vmNamespaceLabel: vm.Namespace,
+		}
+		pod.Spec.RestartPolicy = v1.RestartPolicyAlways
+		pod.Spec.Hostname = vm.Name
+		pod.Spec.Containers = []v1.Container{
+			{
+				Name:  containerName,
+				Image: image,
+				Ports: []v1.ContainerPort{
+					{
+						Name:          "ssh",
+						ContainerPort: 22,
+						Protocol:      v1.ProtocolTCP,
+					},
+				},
+				Resources: v1.ResourceRequirements{
+					Limits: limits,
+				},
+				VolumeMounts: []v1.VolumeMount{
+					{
+						Name:      containerKeysVolume,
+						MountPath: keysPath,
+						ReadOnly:  true,
+					},
+				},
+			},
+		}
+		pod.Spec.Volumes = []v1.Volume{
+			{
+				Name: containerKeysVolume,
+				VolumeSource: v1.VolumeSource{
+					Secret: &v1.SecretVolumeSource{
+						SecretName: vm.Spec.KeyPair,
+						Items: []v1.KeyToPath{
+							{
+								Key:  "public_key",
+								Path: "authorized_keys",
+								Mode: &keyMode,
+							},
+						},
+					},
+				},
+			},
+		}
+		if pod.Namespace != vm.Namespace {
+			return nil
+		}
+		if err := controllerutil.SetControllerReference(vm, pod, p.r.Scheme); err != nil {
+			p.r.Log.Error(err, "unable to set ownerReference for pod")
+			return err
+		}
+		return nil
+	}); err != nil {
+		p.r.Log.Error(fmt.Errorf("error creating pod "), pod.Name)
+		return err
+	}
+	return nil
+}
+
+func (p *containerProvider) FetchStatus(ctx context.Context, vm *hfv1.VirtualMachine) (status *hfv1.VirtualMachineStatus,
+	provisioned bool, err error) {
+	status = vm.Status.DeepCopy()
+	pod := &v1.Pod{}
+	if err = p.r.Get(ctx, types.NamespacedName{Name: vm.Name, Namespace: provisionNS}, pod); err != nil {
+		p.r.Log.Error(fmt.Errorf("error fetching pod: "), vm.Name)
+		return status, false, err
+	}
+
+	if len(pod.Status.PodIP) > 0 {
+		status.PrivateIP = pod.Status.PodIP
+		vm.Annotations["sshEndpoint"] = pod.Status.PodIP
+	}
+	status.Hostname = pod.Name
+
+	return status, pod.Status.Phase == v1.PodRunning && len(pod.Status.PodIP) > 0, nil
+}
+
+func (p *containerProvider) LivenessCheck(ctx context.Context, vm *hfv1.VirtualMachine) (bool, error) {
+	return p.RunCommand(ctx, vm, "uptime")
+}
+
+func (p *containerProvider) RunCommand(ctx context.Context, vm *hfv1.VirtualMachine, command string) (bool, error) {
+	pod := &v1.Pod{}
+	if err := p.r.Get(ctx, types.NamespacedName{Name: vm.Name, Namespace: provisionNS}, pod); err != nil {
+		return false, err
+	}
+	return p.r.sshLivenessCheck(ctx, vm, pod.Status.PodIP+":22", defaultContainerUsername, command)
+}
+
+func (p *containerProvider) Teardown(ctx context.Context, vm *hfv1.VirtualMachine) (bool, error) {
+	return p.r.deleteChildren(ctx, p.children(vm)...)
+}
+
+// Recycle deletes the pod, which CreateInstance launches again with the rotated keys mounted
+func (p *containerProvider) Recycle(ctx context.Context, vm *hfv1.VirtualMachine,
+	vmp *shimv1alpha1.VirtualMachineProvisioning) (bool, error) {
+	return p.r.deleteChildren(ctx, p.children(vm)...)
+}
+
+func (p *containerProvider) children(vm *hfv1.VirtualMachine) []client.Object {
+	return []client.Object{&v1.Pod{ObjectMeta: metav1.ObjectMeta{Name: vm.Name, Namespace: provisionNS}}}
+}
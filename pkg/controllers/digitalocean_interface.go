@@ -2,18 +2,131 @@ package controllers
 
 import (
 	"context"
-	b64 "encoding/base64"
 	"fmt"
 
 	hfv1 "github.com/hobbyfarm/gargantua/pkg/apis/hobbyfarm.io/v1"
-	"github.com/hobbyfarm/hf-shim-operator/pkg/utils"
+	shimv1alpha1 "github.com/hobbyfarm/hf-shim-operator/pkg/api/v1alpha1"
 	dropletv1alpha1 "github.com/ibrokethecloud/droplet-operator/pkg/api/v1alpha1"
+	"github.com/ibrokethecloud/droplet-operator/pkg/do"
 	v1 "k8s.io/api/core/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
 	"sigs.k8s.io/controller-runtime/pkg/controller/controllerutil"
 )
 
+// power states of droplets
+const (
+	dropletStatusActive = "active"
+	dropletStatusOff    = "off"
+)
+
+func init() {
+	RegisterProvider("digitalocean", func(r *VirtualMachineReconciler) Provider {
+		return &digitalOceanProvider{r: r}
+	})
+}
+
+// digitalOceanProvider launches VMs as droplet-operator Instances
+type digitalOceanProvider struct {
+	r *VirtualMachineReconciler
+}
+
+func (p *digitalOceanProvider) ImportKeyPair(ctx context.Context, vm *hfv1.VirtualMachine, env *hfv1.Environment,
+	pubKey string) (*hfv1.VirtualMachineStatus, error) {
+	if err := checkKeyType("digitalocean", pubKey); err != nil {
+		return vm.Status.DeepCopy(), err
+	}
+	return p.r.createDOImportKeyPair(ctx, vm, env, pubKey)
+}
+
+func (p *digitalOceanProvider) CreateInstance(ctx context.Context, vm *hfv1.VirtualMachine, env *hfv1.Environment,
+	vmTemplate *hfv1.VirtualMachineTemplate) error {
+	return p.r.createDropletInstance(ctx, vm, env, vmTemplate)
+}
+
+func (p *digitalOceanProvider) FetchStatus(ctx context.Context, vm *hfv1.VirtualMachine) (*hfv1.VirtualMachineStatus, bool, error) {
+	return p.r.fetchDOInstance(ctx, vm)
+}
+
+func (p *digitalOceanProvider) LivenessCheck(ctx context.Context, vm *hfv1.VirtualMachine) (bool, error) {
+	return p.RunCommand(ctx, vm, "uptime")
+}
+
+func (p *digitalOceanProvider) RunCommand(ctx context.Context, vm *hfv1.VirtualMachine, command string) (bool,
+	error) {
+	instance := &dropletv1alpha1.Instance{}
+	if err := p.r.Get(ctx, types.NamespacedName{Name: vm.Name, Namespace: vm.Namespace}, instance); err != nil {
+		return false, err
+	}
+	return p.r.doLivenessCheck(ctx, vm, instance, command)
+}
+
+func (p *digitalOceanProvider) Teardown(ctx context.Context, vm *hfv1.VirtualMachine) (bool, error) {
+	return p.r.deleteChildren(ctx, p.children(vm)...)
+}
+
+// Stop powers the droplet off. Instances of the droplet-operator have no power state, so the droplet is powered off
+// through the digitalocean api with the credentials of the Instance.
+func (p *digitalOceanProvider) Stop(ctx context.Context, vm *hfv1.VirtualMachine) (bool, error) {
+	instance, doClient, err := p.r.dropletClient(ctx, vm)
+	if err != nil {
+		return false, err
+	}
+	droplet, _, err := doClient.Droplets.Get(ctx, instance.Status.InstanceID)
+	if err != nil {
+		return false, err
+	}
+	// locked droplets are still executing an action
+	if droplet.Locked {
+		return false, nil
+	}
+	switch droplet.Status {
+	case dropletStatusOff:
+		return true, nil
+	case dropletStatusActive:
+		_, _, err = doClient.DropletActions.PowerOff(ctx, droplet.ID)
+	}
+	return false, err
+}
+
+// Start powers the droplet on, and returns its addresses once it is active. The droplet-operator does not refresh
+// the addresses of its Instance.
+func (p *digitalOceanProvider) Start(ctx context.Context, vm *hfv1.VirtualMachine) (bool,
+	*shimv1alpha1.InstanceAddresses, error) {
+	instance, doClient, err := p.r.dropletClient(ctx, vm)
+	if err != nil {
+		return false, nil, err
+	}
+	droplet, _, err := doClient.Droplets.Get(ctx, instance.Status.InstanceID)
+	if err != nil || droplet.Locked {
+		return false, nil, err
+	}
+	switch droplet.Status {
+	case dropletStatusActive:
+		addresses := &shimv1alpha1.InstanceAddresses{}
+		if addresses.PrivateIP, err = droplet.PrivateIPv4(); err != nil {
+			return false, nil, err
+		}
+		if !instance.Spec.PrivateNetworking {
+			if addresses.PublicIP, err = droplet.PublicIPv4(); err != nil {
+				return false, nil, err
+			}
+		}
+		return true, addresses, nil
+	case dropletStatusOff:
+		_, _, err = doClient.DropletActions.PowerOn(ctx, droplet.ID)
+	}
+	return false, nil, err
+}
+
+func (p *digitalOceanProvider) children(vm *hfv1.VirtualMachine) []client.Object {
+	return []client.Object{
+		&dropletv1alpha1.Instance{ObjectMeta: metav1.ObjectMeta{Name: vm.Name, Namespace: vm.Namespace}},
+		&dropletv1alpha1.ImportKeyPair{ObjectMeta: metav1.ObjectMeta{Name: vm.Name, Namespace: vm.Namespace}},
+	}
+}
+
 func (r *VirtualMachineReconciler) createDOImportKeyPair(ctx context.Context, vm *hfv1.VirtualMachine,
 	env *hfv1.Environment, pubKey string) (status *hfv1.VirtualMachineStatus, err error) {
 	status = vm.Status.DeepCopy()
@@ -31,6 +144,7 @@ func (r *VirtualMachineReconciler) createDOImportKeyPair(ctx context.Context, vm
 	}
 
 	if _, err = controllerutil.CreateOrUpdate(ctx, r.Client, keyPair, func() error {
+		setVMLabels(keyPair, vm)
 		keyPair.Spec.PublicKey = pubKey
 		keyPair.Spec.Secret = credSecret
 
@@ -43,7 +157,6 @@ func (r *VirtualMachineReconciler) createDOImportKeyPair(ctx context.Context, vm
 		return status, err
 	}
 
-	vm.Annotations["importKeyPair"] = keyPair.Name
 	status.Status = importKeyPairCreated
 	return status, nil
 }
@@ -67,20 +180,19 @@ func (r *VirtualMachineReconciler) createDropletInstance(ctx context.Context, vm
 		},
 	}
 
-	instanceType, ok := environment.Spec.TemplateMapping[vmTemplate.Name]["instanceType"]
-	if !ok {
-		instanceType = defaultDOInstanceType
-	}
-
-	vm.Annotations[instanceTypeAnnotation] = instanceType
+	instanceType := templateInstanceType(environment, vmTemplate.Name)
 
 	slug, ok := environment.Spec.TemplateMapping[vmTemplate.Name]["image"]
 	if !ok {
 		return fmt.Errorf("no image specified for vm template in env spec")
 	}
 	instance.Spec.Image.Slug = slug
-	cloudInit, ok := environment.Spec.TemplateMapping[vmTemplate.Name]["cloudInit"]
-	if ok {
+	cloudInit, err := r.cloudInitUserData(ctx, vm, environment,
+		environment.Spec.TemplateMapping[vmTemplate.Name]["cloudInit"])
+	if err != nil {
+		return fmt.Errorf("error merging cloud init: %v", err)
+	}
+	if len(cloudInit) > 0 {
 		instance.Spec.UserData = cloudInit
 	}
 
@@ -104,26 +216,29 @@ func (r *VirtualMachineReconciler) createDropletInstance(ctx context.Context, vm
 		instance.Spec.VPCUUID = vpcuuid
 	}
 
-	doKeyPair := &dropletv1alpha1.ImportKeyPair{}
-
-	err = r.Get(ctx, types.NamespacedName{Namespace: vm.Namespace, Name: vm.Annotations["importKeyPair"]}, doKeyPair)
-	if err != nil {
-		return err
-	}
+	// droplets trusting a certificate authority are created without an imported keypair
+	var dropletKeys []dropletv1alpha1.DropletCreateSSHKey
+	if !r.sshCAEnabled(environment) {
+		doKeyPair := &dropletv1alpha1.ImportKeyPair{}
 
-	if doKeyPair.Status.ID == 0 || len(doKeyPair.Status.FingerPrint) == 0 {
-		return fmt.Errorf("droplet importKeyPair not yet processed")
-	}
+		err = r.Get(ctx, types.NamespacedName{Namespace: vm.Namespace, Name: vm.Name}, doKeyPair)
+		if err != nil {
+			return err
+		}
 
-	var dropletKeys []dropletv1alpha1.DropletCreateSSHKey
+		if doKeyPair.Status.ID == 0 || len(doKeyPair.Status.FingerPrint) == 0 {
+			return fmt.Errorf("droplet importKeyPair not yet processed")
+		}
 
-	dropletKey := dropletv1alpha1.DropletCreateSSHKey{
-		ID:          doKeyPair.Status.ID,
-		Fingerprint: doKeyPair.Status.FingerPrint,
+		dropletKey := dropletv1alpha1.DropletCreateSSHKey{
+			ID:          doKeyPair.Status.ID,
+			Fingerprint: doKeyPair.Status.FingerPrint,
+		}
+		dropletKeys = append(dropletKeys, dropletKey)
 	}
-	dropletKeys = append(dropletKeys, dropletKey)
 
 	if _, err = controllerutil.CreateOrUpdate(ctx, r.Client, instance, func() error {
+		setVMLabels(instance, vm)
 		instance.Spec.Name = vm.Name
 		instance.Spec.Secret = credSecret
 		instance.Spec.Region = region
@@ -137,6 +252,7 @@ func (r *VirtualMachineReconciler) createDropletInstance(ctx context.Context, vm
 
 		return nil
 	}); err != nil {
+		childCreateErrors.WithLabelValues("digitalocean", "Instance").Inc()
 		r.Log.Error(fmt.Errorf("error creating instance "), instance.Name)
 		return err
 	}
@@ -146,71 +262,71 @@ func (r *VirtualMachineReconciler) createDropletInstance(ctx context.Context, vm
 
 // Fetch Droplet Instance information //
 func (r *VirtualMachineReconciler) fetchDOInstance(ctx context.Context,
-	vm *hfv1.VirtualMachine) (status *hfv1.VirtualMachineStatus, err error) {
+	vm *hfv1.VirtualMachine) (status *hfv1.VirtualMachineStatus, provisioned bool, err error) {
 	status = vm.Status.DeepCopy()
 	instance := &dropletv1alpha1.Instance{}
 	err = r.Get(ctx, types.NamespacedName{Name: vm.Name, Namespace: vm.Namespace}, instance)
 	if err != nil {
 		r.Log.Error(fmt.Errorf("Error fetching Droplet Instance: "), vm.Name)
-		return status, err
+		return status, false, err
+	}
+	publicIP, privateIP, err := r.instanceAddresses(ctx, instance, instance.Status.PublicIP,
+		instance.Status.PrivateIP)
+	if err != nil {
+		return status, false, err
 	}
 
-	if len(instance.Status.PublicIP) > 0 {
-		status.PublicIP = instance.Status.PublicIP
+	if len(publicIP) > 0 {
+		status.PublicIP = publicIP
 	}
 
-	if len(instance.Status.PrivateIP) > 0 {
-		status.PrivateIP = instance.Status.PrivateIP
+	if len(privateIP) > 0 {
+		status.PrivateIP = privateIP
 	}
 
 	if instance.Status.InstanceID > 0 {
 		status.Hostname = instance.Name
 	}
-	if instance.Status.Status == "provisioned" {
-		//perform VM liveness check before this is ready //
-		ready, err := r.doLivenessCheck(ctx, vm, instance)
-		if err != nil {
-			return status, err
-		}
-		if ready {
-			status.Status = hfv1.VmStatusRunning
-		}
-	}
 
-	if status.Status != hfv1.VmStatusRunning {
-		return status, fmt.Errorf("VM still not running")
-	}
-	return status, err
+	//perform VM liveness check before this is ready //
+	return status, instance.Status.Status == "provisioned", nil
 }
 
 // DO liveness check
 func (r *VirtualMachineReconciler) doLivenessCheck(ctx context.Context, vm *hfv1.VirtualMachine,
-	instance *dropletv1alpha1.Instance) (ready bool, err error) {
-	keySecret := &v1.Secret{}
-	var username, address string
-	err = r.Get(ctx, types.NamespacedName{Name: vm.Spec.KeyPair, Namespace: vm.Namespace}, keySecret)
+	instance *dropletv1alpha1.Instance, command string) (ready bool, err error) {
+	publicIP, privateIP, err := r.instanceAddresses(ctx, instance, instance.Status.PublicIP,
+		instance.Status.PrivateIP)
 	if err != nil {
 		return ready, err
 	}
-	if len(vm.Spec.SshUsername) != 0 {
-		username = vm.Spec.SshUsername
+	var address string
+	if len(publicIP) > 0 {
+		address = publicIP + ":22"
+		vm.Annotations["sshEndpoint"] = publicIP
 	} else {
-		username = "root"
+		address = privateIP + ":22"
 	}
 
-	privKey, ok := keySecret.Data["private_key"]
-	if !ok {
-		return ready, fmt.Errorf("private_key not found in secret %s", keySecret.Name)
-	}
-	encodeKey := b64.StdEncoding.EncodeToString(privKey)
+	return r.sshLivenessCheck(ctx, vm, address, "root", command)
+}
 
-	if len(instance.Status.PublicIP) > 0 {
-		address = instance.Status.PublicIP + ":22"
-		vm.Annotations["sshEndpoint"] = instance.Status.PublicIP
-	} else {
-		address = instance.Status.PrivateIP + ":22"
+// dropletClient returns the droplet-operator Instance of vm, and a digitalocean api client with the credentials of
+// the Instance
+func (r *VirtualMachineReconciler) dropletClient(ctx context.Context,
+	vm *hfv1.VirtualMachine) (instance *dropletv1alpha1.Instance, doClient *do.DOClient, err error) {
+	instance = &dropletv1alpha1.Instance{}
+	if err = r.Get(ctx, types.NamespacedName{Name: vm.Name, Namespace: vm.Namespace}, instance); err != nil {
+		return instance, doClient, err
 	}
-
-	ready, err = utils.PerformLivenessCheck(address, username, encodeKey, "uptime")
-	return ready, err
+	if instance.Status.InstanceID == 0 {
+		return instance, doClient, fmt.Errorf("droplet %s has no instance id yet", instance.Name)
+	}
+	secret := &v1.Secret{}
+	if err = r.Get(ctx, types.NamespacedName{Name: instance.Spec.Secret, Namespace: instance.Namespace},
+		secret); err != nil {
+		return instance, doClient, err
+	}
+	doClient, err = do.NewClient(secret)
+	return instance, doClient, err
 }
@@ -0,0 +1,146 @@
+package controllers
+
+import (
+	"context"
+	"fmt"
+	"sync"
+
+	hfv1 "github.com/hobbyfarm/gargantua/pkg/apis/hobbyfarm.io/v1"
+)
+
+const (
+	fakeProviderName = "fake"
+
+	fakeInstancePending     = "pending"
+	fakeInstanceProvisioned = "provisioned"
+	fakeInstanceFailed      = "failed"
+)
+
+// fakeProvider keeps its instances in memory. Tests move the instances through their states with transition.
+type fakeProvider struct {
+	sync.Mutex
+	r         *VirtualMachineReconciler
+	keys      map[string]string
+	instances map[string]*fakeInstance
+	createErr error
+	// teardownPending keeps instances around on teardown, as a stuck backing operator would
+	teardownPending bool
+}
+
+// fakeInstance is the in memory instance launched for a vm
+type fakeInstance struct {
+	status    string
+	publicIP  string
+	privateIP string
+	// startedIP is the public ip the instance gets when it is started again, which is not reported like the
+	// addresses of ec2 instances
+	startedIP string
+}
+
+func newFakeProvider() *fakeProvider {
+	return &fakeProvider{
+		keys:      make(map[string]string),
+		instances: make(map[string]*fakeInstance),
+	}
+}
+
+// register makes the provider available as the fake provider to reconcilers
+func (p *fakeProvider) register() {
+	RegisterProvider(fakeProviderName, func(r *VirtualMachineReconciler) Provider {
+		p.Lock()
+		defer p.Unlock()
+		p.r = r
+		return p
+	})
+}
+
+// transition moves the instance of vm to status, as the backing operator would
+func (p *fakeProvider) transition(vm string, status string, publicIP string) {
+	p.Lock()
+	defer p.Unlock()
+	instance, ok := p.instances[vm]
+	if !ok {
+		instance = &fakeInstance{}
+		p.instances[vm] = instance
+	}
+	instance.status = status
+	instance.publicIP = publicIP
+	instance.privateIP = publicIP
+}
+
+func (p *fakeProvider) instance(vm string) (*fakeInstance, bool) {
+	p.Lock()
+	defer p.Unlock()
+	instance, ok := p.instances[vm]
+	return instance, ok
+}
+
+func (p *fakeProvider) ImportKeyPair(ctx context.Context, vm *hfv1.VirtualMachine, env *hfv1.Environment,
+	pubKey string) (status *hfv1.VirtualMachineStatus, err error) {
+	p.Lock()
+	defer p.Unlock()
+	status = vm.Status.DeepCopy()
+	p.keys[vm.Name] = pubKey
+	status.Status = importKeyPairCreated
+	return status, nil
+}
+
+func (p *fakeProvider) CreateInstance(ctx context.Context, vm *hfv1.VirtualMachine, env *hfv1.Environment,
+	vmTemplate *hfv1.VirtualMachineTemplate) error {
+	p.Lock()
+	defer p.Unlock()
+	if p.createErr != nil {
+		return p.createErr
+	}
+	if _, ok := p.keys[vm.Name]; !ok {
+		return fmt.Errorf("no key imported for vm %s", vm.Name)
+	}
+	if _, ok := p.instances[vm.Name]; !ok {
+		p.instances[vm.Name] = &fakeInstance{status: fakeInstancePending}
+	}
+	return nil
+}
+
+func (p *fakeProvider) FetchStatus(ctx context.Context, vm *hfv1.VirtualMachine) (status *hfv1.VirtualMachineStatus,
+	provisioned bool, err error) {
+	p.Lock()
+	defer p.Unlock()
+	status = vm.Status.DeepCopy()
+	instance, ok := p.instances[vm.Name]
+	if !ok {
+		return status, false, fmt.Errorf("no instance found for vm %s", vm.Name)
+	}
+	if instance.status == fakeInstanceFailed {
+		return status, false, fmt.Errorf("instance for vm %s failed", vm.Name)
+	}
+	status.PublicIP, status.PrivateIP, err = p.r.instanceAddresses(ctx, vm, instance.publicIP, instance.privateIP)
+	status.Hostname = vm.Name
+	return status, instance.status == fakeInstanceProvisioned, err
+}
+
+func (p *fakeProvider) LivenessCheck(ctx context.Context, vm *hfv1.VirtualMachine) (bool, error) {
+	return p.RunCommand(ctx, vm, "uptime")
+}
+
+func (p *fakeProvider) RunCommand(ctx context.Context, vm *hfv1.VirtualMachine, command string) (bool, error) {
+	instance, ok := p.instance(vm.Name)
+	if !ok {
+		return false, fmt.Errorf("no instance found for vm %s", vm.Name)
+	}
+	publicIP, _, err := p.r.instanceAddresses(ctx, vm, instance.publicIP, instance.privateIP)
+	if err != nil {
+		return false, err
+	}
+	return p.r.sshLivenessCheck(ctx, vm, publicIP+":22", "ubuntu", command)
+}
+
+func (p *fakeProvider) Teardown(ctx context.Context, vm *hfv1.VirtualMachine) (bool, error) {
+	p.Lock()
+	defer p.Unlock()
+	if p.teardownPending {
+		return false, nil
+	}
+	delete(p.instances, vm.Name)
+	delete(p.keys, vm.Name)
+	return true, nil
+}
@@ -0,0 +1,85 @@
+package controllers
+
+import (
+	"context"
+	"time"
+
+	hfv1 "github.com/hobbyfarm/gargantua/pkg/apis/hobbyfarm.io/v1"
+	shimv1alpha1 "github.com/hobbyfarm/hf-shim-operator/pkg/api/v1alpha1"
+	v1 "k8s.io/api/core/v1"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/controller/controllerutil"
+)
+
+// finalizeVM tears down the provider resources of a deleted vm. The vm and its keypair secrets are released once
+// they are gone, or once the teardown timeout expired, in which case a warning event points at the resources
+// left behind.
+func (r *VirtualMachineReconciler) finalizeVM(ctx context.Context, vm *hfv1.VirtualMachine,
+	vmp *shimv1alpha1.VirtualMachineProvisioning) (ctrl.Result, error) {
+	if !controllerutil.ContainsFinalizer(vm, teardownFinalizer) {
+		return ctrl.Result{}, nil
+	}
+
+	providerName := r.vmProviderName(ctx, vm, vmp)
+	gone := true
+	if len(providerName) > 0 {
+		p, err := r.provider(providerName)
+		if err == nil {
+			gone, err = p.Teardown(ctx, instanceVM(vm, vmp))
+		}
+		if err != nil {
+			gone = false
+			r.providerEvent(ctx, vm, providerName, v1.EventTypeWarning, "TeardownFailed",
+				"error tearing down %s resources: %v", providerName, err)
+		}
+	}
+
+	if !gone {
+		timeout := r.TeardownTimeout
+		if timeout == 0 {
+			timeout = defaultTeardownTimeout
+		}
+		if time.Since(vm.DeletionTimestamp.Time) < timeout {
+			r.providerEvent(ctx, vm, providerName, v1.EventTypeNormal, "WaitingForTeardown",
+				"waiting for %s resources to be deleted", providerName)
+			return ctrl.Result{RequeueAfter: teardownRequeue}, nil
+		}
+		r.providerEvent(ctx, vm, providerName, v1.EventTypeWarning, "TeardownTimeout",
+			"%s resources still present after %s, releasing vm. they need to be removed manually",
+			providerName, timeout)
+	} else if len(providerName) > 0 {
+		r.providerEvent(ctx, vm, providerName, v1.EventTypeNormal, "TeardownComplete", "%s resources deleted",
+			providerName)
+	}
+
+	if err := r.releaseKeySecrets(ctx, vm); err != nil {
+		return ctrl.Result{}, err
+	}
+	controllerutil.RemoveFinalizer(vm, teardownFinalizer)
+	return ctrl.Result{}, r.Update(ctx, vm)
+}
+
+// vmProviderName returns the provider handling vm. vms deleted before the provider was recorded fall back to the
+// provider of their environment, as the keypair import may already have created resources.
+func (r *VirtualMachineReconciler) vmProviderName(ctx context.Context, vm *hfv1.VirtualMachine,
+	vmp *shimv1alpha1.VirtualMachineProvisioning) string {
+	if len(vmp.Status.Provider) > 0 {
+		return vmp.Status.Provider
+	}
+	if vm.Status.Status == hfv1.VmStatusRFP {
+		return ""
+	}
+	return r.environmentProvider(ctx, vm)
+}
+
+// environmentProvider returns the provider of the environment of vm
+func (r *VirtualMachineReconciler) environmentProvider(ctx context.Context, vm *hfv1.VirtualMachine) string {
+	if len(vm.Status.EnvironmentId) == 0 {
+		return ""
+	}
+	env, err := r.fetchEnvironment(ctx, vm.Status.EnvironmentId, vm.Namespace)
+	if err != nil {
+		return ""
+	}
+	return env.Spec.Provider
+}
@@ -0,0 +1,283 @@
+package controllers
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"text/template"
+
+	hfv1 "github.com/hobbyfarm/gargantua/pkg/apis/hobbyfarm.io/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/util/jsonpath"
+	"sigs.k8s.io/controller-runtime/pkg/controller/controllerutil"
+	"sigs.k8s.io/yaml"
+)
+
+/*
+Info needed in environment, each key can be overridden in the env template mapping:
+generic_api_version
+generic_kind
+generic_template (go template rendering the object body, without apiVersion, kind and metadata.name)
+generic_public_ip_path, generic_private_ip_path, generic_instance_id_path (optional jsonpath expressions)
+generic_ready_path (jsonpath expression)
+generic_ready_value (optional, defaults to true)
+*/
+
+const (
+	genericAPIVersion     = "generic_api_version"
+	genericKind           = "generic_kind"
+	genericTemplate       = "generic_template"
+	genericPublicIPPath   = "generic_public_ip_path"
+	genericPrivateIPPath  = "generic_private_ip_path"
+	genericInstanceIDPath = "generic_instance_id_path"
+	genericReadyPath      = "generic_ready_path"
+	genericReadyValue     = "generic_ready_value"
+	defaultGenericReady   = "true"
+	defaultGenericUser    = "ubuntu"
+)
+
+func init() {
+	RegisterProvider("generic", func(r *VirtualMachineReconciler) Provider {
+		return &genericProvider{r: r}
+	})
+}
+
+// genericProvider launches VMs as an arbitrary custom resource handled by another operator. The object is
+// rendered from a template in the environment, and its status is read through jsonpath expressions.
+type genericProvider struct {
+	r *VirtualMachineReconciler
+}
+
+// genericTemplateData is available to the object templates of the generic provider
+type genericTemplateData struct {
+	Name        string
+	Namespace   string
+	PublicKey   string
+	VM          *hfv1.VirtualMachine
+	Environment *hfv1.Environment
+	Template    *hfv1.VirtualMachineTemplate
+	Mapping     map[string]string
+}
+
+// genericSettings are the generic provider settings of an environment for a single vm template
+type genericSettings map[string]string
+
+var genericTemplateFuncs = template.FuncMap{
+	"b64enc": func(s string) string {
+		return base64.StdEncoding.EncodeToString([]byte(s))
+	},
+	"indent": func(spaces int, s string) string {
+		pad := strings.Repeat(" ", spaces)
+		return pad + strings.ReplaceAll(s, "\n", "\n"+pad)
+	},
+}
+
+// ImportKeyPair has no backend object to create, the public key is passed to the object template
+func (p *genericProvider) ImportKeyPair(ctx context.Context, vm *hfv1.VirtualMachine, env *hfv1.Environment,
+	pubKey string) (status *hfv1.VirtualMachineStatus, err error) {
+	status = vm.Status.DeepCopy()
+	status.Status = importKeyPairCreated
+	return status, nil
+}
+
+func (p *genericProvider) CreateInstance(ctx context.Context, vm *hfv1.VirtualMachine, env *hfv1.Environment,
+	vmTemplate *hfv1.VirtualMachineTemplate) (err error) {
+	settings := newGenericSettings(env, vmTemplate.Name)
+	instance, err := settings.object(vm)
+	if err != nil {
+		return err
+	}
+
+	body, ok := settings[genericTemplate]
+	if !ok {
+		return fmt.Errorf("no %s found in env spec", genericTemplate)
+	}
+	pubKey, err := p.r.vmPublicKey(ctx, vm)
+	if err != nil {
+		return err
+	}
+
+	tmpl, err := template.New(vm.Name).Funcs(genericTemplateFuncs).Option("missingkey=error").Parse(body)
+	if err != nil {
+		return fmt.Errorf("error parsing %s: %v", genericTemplate, err)
+	}
+	rendered := &bytes.Buffer{}
+	if err = tmpl.Execute(rendered, genericTemplateData{
+		Name:        vm.Name,
+		Namespace:   vm.Namespace,
+		PublicKey:   pubKey,
+		VM:          vm,
+		Environment: env,
+		Template:    vmTemplate,
+		Mapping:     env.Spec.TemplateMapping[vmTemplate.Name],
+	}); err != nil {
+		return fmt.Errorf("error rendering %s: %v", genericTemplate, err)
+	}
+
+	content := make(map[string]interface{})
+	jsonBody, err := yaml.YAMLToJSON(rendered.Bytes())
+	if err != nil {
+		return fmt.Errorf("error converting rendered %s: %v", genericTemplate, err)
+	}
+	if err = json.Unmarshal(jsonBody, &content); err != nil {
+		return fmt.Errorf("error converting rendered %s: %v", genericTemplate, err)
+	}
+
+	if _, err = controllerutil.CreateOrUpdate(ctx, p.r.Client, instance, func() error {
+		for key, value := range content {
+			if key == "metadata" || key == "apiVersion" || key == "kind" || key == "status" {
+				continue
+			}
+			instance.Object[key] = value
+		}
+		if metadata, ok := content["metadata"].(map[string]interface{}); ok {
+			labels, _, _ := unstructured.NestedStringMap(metadata, "labels")
+			annotations, _, _ := unstructured.NestedStringMap(metadata, "annotations")
+			instance.SetLabels(labels)
+			instance.SetAnnotations(annotations)
+		}
+		setVMLabels(instance, vm)
+		if err := controllerutil.SetControllerReference(vm, instance, p.r.Scheme); err != nil {
+			p.r.Log.Error(err, "unable to set ownerReference for generic instance")
+			return err
+		}
+		return nil
+	}); err != nil {
+		p.r.Log.Error(fmt.Errorf("error creating generic instance "), vm.Name)
+		return err
+	}
+	return nil
+}
+
+func (p *genericProvider) FetchStatus(ctx context.Context, vm *hfv1.VirtualMachine) (status *hfv1.VirtualMachineStatus,
+	provisioned bool, err error) {
+	status = vm.Status.DeepCopy()
+	settings, instance, err := p.fetchInstance(ctx, vm)
+	if err != nil {
+		return status, false, err
+	}
+
+	values := make(map[string]string)
+	for _, path := range []string{genericPublicIPPath, genericPrivateIPPath, genericInstanceIDPath, genericReadyPath} {
+		expression, ok := settings[path]
+		if !ok {
+			continue
+		}
+		if values[path], err = jsonPathValue(instance.Object, expression); err != nil {
+			return status, false, fmt.Errorf("error evaluating %s: %v", path, err)
+		}
+	}
+
+	if len(values[genericPublicIPPath]) > 0 {
+		status.PublicIP = values[genericPublicIPPath]
+		vm.Annotations["sshEndpoint"] = status.PublicIP
+	}
+
+	if len(values[genericPrivateIPPath]) > 0 {
+		status.PrivateIP = values[genericPrivateIPPath]
+	}
+
+	if len(values[genericInstanceIDPath]) > 0 {
+		status.Hostname = values[genericInstanceIDPath]
+	}
+
+	readyValue, ok := settings[genericReadyValue]
+	if !ok {
+		readyValue = defaultGenericReady
+	}
+	return status, values[genericReadyPath] == readyValue, nil
+}
+
+func (p *genericProvider) LivenessCheck(ctx context.Context, vm *hfv1.VirtualMachine) (bool, error) {
+	return p.RunCommand(ctx, vm, "uptime")
+}
+
+func (p *genericProvider) RunCommand(ctx context.Context, vm *hfv1.VirtualMachine, command string) (bool, error) {
+	status, _, err := p.FetchStatus(ctx, vm)
+	if err != nil {
+		return false, err
+	}
+	address := status.PrivateIP
+	if len(status.PublicIP) > 0 {
+		address = status.PublicIP
+	}
+	return p.r.sshLivenessCheck(ctx, vm, address+":22", defaultGenericUser, command)
+}
+
+func (p *genericProvider) Teardown(ctx context.Context, vm *hfv1.VirtualMachine) (bool, error) {
+	_, instance, err := p.fetchInstance(ctx, vm)
+	if errors.IsNotFound(err) {
+		return true, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	return p.r.deleteChildren(ctx, instance)
+}
+
+// fetchInstance returns the settings the generic instance of vm was created with, and its object
+func (p *genericProvider) fetchInstance(ctx context.Context, vm *hfv1.VirtualMachine) (settings genericSettings,
+	instance *unstructured.Unstructured, err error) {
+	env, err := p.r.fetchEnvironment(ctx, vm.Status.EnvironmentId, vm.Namespace)
+	if err != nil {
+		return settings, instance, err
+	}
+	settings = newGenericSettings(env, vm.Spec.VirtualMachineTemplateId)
+	instance, err = settings.object(vm)
+	if err != nil {
+		return settings, instance, err
+	}
+	err = p.r.Get(ctx, types.NamespacedName{Name: vm.Name, Namespace: vm.Namespace}, instance)
+	return settings, instance, err
+}
+
+// newGenericSettings merges the generic provider settings of the template mapping over the environment specifics
+func newGenericSettings(env *hfv1.Environment, vmTemplateName string) genericSettings {
+	settings := make(genericSettings)
+	for key, value := range env.Spec.EnvironmentSpecifics {
+		settings[key] = value
+	}
+	for key, value := range env.Spec.TemplateMapping[vmTemplateName] {
+		settings[key] = value
+	}
+	return settings
+}
+
+// object returns an empty object of the configured kind for vm
+func (s genericSettings) object(vm *hfv1.VirtualMachine) (obj *unstructured.Unstructured, err error) {
+	apiVersion, ok := s[genericAPIVersion]
+	if !ok {
+		return obj, fmt.Errorf("no %s found in env spec", genericAPIVersion)
+	}
+	kind, ok := s[genericKind]
+	if !ok {
+		return obj, fmt.Errorf("no %s found in env spec", genericKind)
+	}
+	gv, err := schema.ParseGroupVersion(apiVersion)
+	if err != nil {
+		return obj, err
+	}
+	return newUnstructured(gv.WithKind(kind), vm.Name, vm.Namespace), nil
+}
+
+// jsonPathValue evaluates a jsonpath expression against obj. Braces around the expression are optional.
+func jsonPathValue(obj map[string]interface{}, expression string) (string, error) {
+	if !strings.HasPrefix(expression, "{") {
+		expression = "{" + expression + "}"
+	}
+	jp := jsonpath.New("generic").AllowMissingKeys(true)
+	if err := jp.Parse(expression); err != nil {
+		return "", err
+	}
+	out := &bytes.Buffer{}
+	if err := jp.Execute(out, obj); err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(out.String()), nil
+}
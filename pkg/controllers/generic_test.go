@@ -0,0 +1,96 @@
+package controllers
+
+import (
+	"context"
+	"testing"
+
+	hfv1 "github.com/hobbyfarm/gargantua/pkg/apis/hobbyfarm.io/v1"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/types"
+	clientgoscheme "k8s.io/client-go/kubernetes/scheme"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+)
+
+func TestGenericProvisioning(t *testing.T) {
+	ctx := context.Background()
+	scheme := runtime.NewScheme()
+	if err := clientgoscheme.AddToScheme(scheme); err != nil {
+		t.Fatal(err)
+	}
+	if err := hfv1.AddToScheme(scheme); err != nil {
+		t.Fatal(err)
+	}
+	pubKey := "ssh-ed25519 AAAAC3NzaC1lZDI1NTE5AAAAIGenericTestKey"
+	env := &hfv1.Environment{
+		ObjectMeta: metav1.ObjectMeta{Name: "env-test", Namespace: "hobbyfarm"},
+		Spec: hfv1.EnvironmentSpec{
+			EnvironmentSpecifics: map[string]string{
+				genericAPIVersion:    "example.crossplane.io/v1alpha1",
+				genericKind:          "Instance",
+				genericTemplate:      "metadata:\n  labels:\n    team: a\nspec:\n  sshKey: {{ .PublicKey }}\n",
+				genericPublicIPPath:  ".status.address",
+				genericReadyPath:     ".status.ready",
+				genericReadyValue:    "yes",
+				genericPrivateIPPath: ".status.privateAddress",
+			},
+		},
+	}
+	vm := &hfv1.VirtualMachine{
+		ObjectMeta: metav1.ObjectMeta{Name: "vm-test", Namespace: "hobbyfarm", Annotations: map[string]string{}},
+		Spec:       hfv1.VirtualMachineSpec{VirtualMachineTemplateId: "template-test"},
+		Status:     hfv1.VirtualMachineStatus{EnvironmentId: env.Name},
+	}
+	keySecret := &v1.Secret{
+		ObjectMeta: metav1.ObjectMeta{Name: keySecretName(vm), Namespace: provisionNS},
+		Data:       map[string][]byte{"public_key": []byte(pubKey + "\n")},
+	}
+	vmTemplate := &hfv1.VirtualMachineTemplate{ObjectMeta: metav1.ObjectMeta{Name: "template-test"}}
+	r := &VirtualMachineReconciler{
+		Client: fake.NewClientBuilder().WithScheme(scheme).WithObjects(env, vm, keySecret).Build(),
+		Log:    ctrl.Log.WithName("test"),
+		Scheme: scheme,
+	}
+	p := &genericProvider{r: r}
+	if err := p.CreateInstance(ctx, vm, env, vmTemplate); err != nil {
+		t.Fatal(err)
+	}
+
+	gvk := schema.GroupVersionKind{Group: "example.crossplane.io", Version: "v1alpha1", Kind: "Instance"}
+	instance := newUnstructured(gvk, vm.Name, vm.Namespace)
+	if err := r.Get(ctx, types.NamespacedName{Name: vm.Name, Namespace: vm.Namespace}, instance); err != nil {
+		t.Fatal(err)
+	}
+	labels := instance.GetLabels()
+	if labels[vmLabel] != vm.Name || labels[vmNamespaceLabel] != vm.Namespace || labels["team"] != "a" {
+		t.Fatalf("expected the vm labels next to the template labels, got %v", labels)
+	}
+	if sshKey, _, _ := unstructured.NestedString(instance.Object, "spec", "sshKey"); sshKey != pubKey {
+		t.Fatalf("expected the vm key in the rendered template, got %q", sshKey)
+	}
+
+	// the instance is provisioned once its ready path has the ready value
+	if _, provisioned, err := p.FetchStatus(ctx, vm); provisioned || err != nil {
+		t.Fatalf("expected the vm to wait for the generic instance, got %v", err)
+	}
+	instance.Object["status"] = map[string]interface{}{
+		"ready":          "yes",
+		"address":        "203.0.113.4",
+		"privateAddress": "10.0.0.4",
+	}
+	if err := r.Update(ctx, instance); err != nil {
+		t.Fatal(err)
+	}
+	status, provisioned, err := p.FetchStatus(ctx, vm)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !provisioned || status.PublicIP != "203.0.113.4" || status.PrivateIP != "10.0.0.4" ||
+		vm.Annotations["sshEndpoint"] != "203.0.113.4" {
+		t.Fatalf("expected the addresses at the jsonpaths of the environment, got %+v", status)
+	}
+}
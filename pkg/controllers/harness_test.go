@@ -0,0 +1,242 @@
+package controllers
+
+import (
+	"context"
+	"strings"
+	"sync"
+	"testing"
+
+	ec2v1alpha1 "github.com/hobbyfarm/ec2-operator/pkg/api/v1alpha1"
+	hfv1 "github.com/hobbyfarm/gargantua/pkg/apis/hobbyfarm.io/v1"
+	shimv1alpha1 "github.com/hobbyfarm/hf-shim-operator/pkg/api/v1alpha1"
+	"github.com/hobbyfarm/hf-shim-operator/pkg/utils"
+	equinixv1alpha1 "github.com/hobbyfarm/metal-operator/pkg/api/v1alpha1"
+	dropletv1alpha1 "github.com/ibrokethecloud/droplet-operator/pkg/api/v1alpha1"
+	gossh "golang.org/x/crypto/ssh"
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	clientgoscheme "k8s.io/client-go/kubernetes/scheme"
+	"k8s.io/client-go/tools/record"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+)
+
+const (
+	testVMName       = "vm-test"
+	testEnvName      = "env-test"
+	testTemplateName = "template-test"
+)
+
+// livenessCall is a single call of the harness liveness checker
+type livenessCall struct {
+	address     string
+	userName    string
+	command     string
+	bastion     string
+	certificate string
+}
+
+// harness runs the reconciler against an in memory api server, so the provisioning flow can be
+// exercised without envtest binaries or cloud credentials.
+type harness struct {
+	t         *testing.T
+	ctx       context.Context
+	namespace string
+	r         *VirtualMachineReconciler
+	events    *record.FakeRecorder
+
+	sync.Mutex
+	live          bool
+	livenessCalls []livenessCall
+	// hostKey is presented by the instances to the liveness checks, when set
+	hostKey gossh.PublicKey
+}
+
+// newHarness creates a harness with an environment for provider, a vm template and a vm ready for provisioning
+// in the provisioning namespace
+func newHarness(t *testing.T, provider string, specifics map[string]string, mapping map[string]string) *harness {
+	return newHarnessInNamespace(t, provisionNS, provider, specifics, mapping)
+}
+
+// newHarnessInNamespace creates a harness with the environment, vm template and vm in namespace
+func newHarnessInNamespace(t *testing.T, namespace string, provider string, specifics map[string]string,
+	mapping map[string]string) *harness {
+	scheme := testScheme(t)
+	env := &hfv1.Environment{
+		ObjectMeta: metav1.ObjectMeta{Name: testEnvName, Namespace: namespace},
+		Spec: hfv1.EnvironmentSpec{
+			Provider:             provider,
+			EnvironmentSpecifics: specifics,
+			TemplateMapping:      map[string]map[string]string{testTemplateName: mapping},
+			WsEndpoint:           "ws.example.com",
+		},
+	}
+	vmTemplate := &hfv1.VirtualMachineTemplate{
+		ObjectMeta: metav1.ObjectMeta{Name: testTemplateName, Namespace: namespace},
+	}
+	vm := &hfv1.VirtualMachine{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      testVMName,
+			Namespace: namespace,
+			Labels:    map[string]string{"ready": "false"},
+		},
+		Spec: hfv1.VirtualMachineSpec{
+			Id:                       testVMName,
+			VirtualMachineTemplateId: testTemplateName,
+		},
+		Status: hfv1.VirtualMachineStatus{
+			Status:        hfv1.VmStatusRFP,
+			EnvironmentId: testEnvName,
+		},
+	}
+
+	h := &harness{t: t, ctx: context.Background(), namespace: namespace, events: record.NewFakeRecorder(1000)}
+	h.r = &VirtualMachineReconciler{
+		Client:          fake.NewClientBuilder().WithScheme(scheme).WithObjects(env, vmTemplate, vm).Build(),
+		Log:             ctrl.Log.WithName("test"),
+		Scheme:          scheme,
+		Recorder:        h.events,
+		LivenessChecker: h.livenessCheck,
+	}
+	return h
+}
+
+// testScheme returns a scheme with the types the manager registers in main.go
+func testScheme(t *testing.T) *runtime.Scheme {
+	scheme := runtime.NewScheme()
+	for _, addToScheme := range []func(*runtime.Scheme) error{
+		clientgoscheme.AddToScheme,
+		hfv1.AddToScheme,
+		ec2v1alpha1.AddToScheme,
+		dropletv1alpha1.AddToScheme,
+		equinixv1alpha1.AddToScheme,
+		shimv1alpha1.AddToScheme,
+	} {
+		if err := addToScheme(scheme); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return scheme
+}
+
+func (h *harness) livenessCheck(address string, userName string, privateKey string, certificate string,
+	command string, hostKeyCallback gossh.HostKeyCallback, bastion *utils.Bastion) (bool, error) {
+	h.Lock()
+	defer h.Unlock()
+	call := livenessCall{address: address, userName: userName, command: command, certificate: certificate}
+	if bastion != nil {
+		call.bastion = bastion.User + "@" + bastion.Address
+	}
+	h.livenessCalls = append(h.livenessCalls, call)
+	if h.hostKey != nil {
+		if err := hostKeyCallback(address, nil, h.hostKey); err != nil {
+			return false, err
+		}
+	}
+	return h.live, nil
+}
+
+// setLive decides the outcome of the following liveness checks
+func (h *harness) setLive(live bool) {
+	h.Lock()
+	defer h.Unlock()
+	h.live = live
+}
+
+func (h *harness) lastLivenessCall() livenessCall {
+	h.Lock()
+	defer h.Unlock()
+	if len(h.livenessCalls) == 0 {
+		h.t.Fatal("no liveness check was run")
+	}
+	return h.livenessCalls[len(h.livenessCalls)-1]
+}
+
+// reconcile runs a single reconcile of the test vm
+func (h *harness) reconcile() error {
+	_, err := h.r.Reconcile(h.ctx, ctrl.Request{NamespacedName: h.key(testVMName)})
+	return err
+}
+
+// step reconciles the test vm, expecting it to move to status
+func (h *harness) step(status hfv1.VmStatus) {
+	h.t.Helper()
+	if err := h.reconcile(); err != nil {
+		h.t.Fatalf("reconcile towards %s failed: %v", status, err)
+	}
+	h.expectStatus(status)
+}
+
+func (h *harness) expectStatus(status hfv1.VmStatus) {
+	h.t.Helper()
+	if got := h.vm().Status.Status; got != status {
+		h.t.Fatalf("expected vm status %s, got %s", status, got)
+	}
+}
+
+func (h *harness) vm() *hfv1.VirtualMachine {
+	h.t.Helper()
+	vm := &hfv1.VirtualMachine{}
+	if err := h.r.Get(h.ctx, h.key(testVMName), vm); err != nil {
+		h.t.Fatal(err)
+	}
+	return vm
+}
+
+// expectEvent fails unless an event with reason was recorded, and returns it. Events recorded before it are
+// discarded.
+func (h *harness) expectEvent(reason string) string {
+	h.t.Helper()
+	for {
+		select {
+		case event := <-h.events.Events:
+			if strings.Contains(event, " "+reason+" ") {
+				return event
+			}
+		default:
+			h.t.Fatalf("expected a %s event", reason)
+		}
+	}
+}
+
+// deleted reports if the test vm is gone from the api server
+func (h *harness) deleted() bool {
+	h.t.Helper()
+	err := h.r.Get(h.ctx, h.key(testVMName), &hfv1.VirtualMachine{})
+	if err != nil && !errors.IsNotFound(err) {
+		h.t.Fatal(err)
+	}
+	return errors.IsNotFound(err)
+}
+
+// get fetches the named object from the namespace of the test vm
+func (h *harness) get(name string, obj client.Object) {
+	h.t.Helper()
+	if err := h.r.Get(h.ctx, h.key(name), obj); err != nil {
+		h.t.Fatal(err)
+	}
+}
+
+// updateStatus writes the status of obj, as the operator backing it would
+func (h *harness) updateStatus(obj client.Object) {
+	h.t.Helper()
+	if err := h.r.Status().Update(h.ctx, obj); err != nil {
+		h.t.Fatal(err)
+	}
+}
+
+// keySecret fetches the keypair secret of the test vm from the provisioning namespace
+func (h *harness) keySecret() (*v1.Secret, error) {
+	secret := &v1.Secret{}
+	vm := &hfv1.VirtualMachine{ObjectMeta: metav1.ObjectMeta{Name: testVMName, Namespace: h.namespace}}
+	err := h.r.Get(h.ctx, types.NamespacedName{Name: keySecretName(vm), Namespace: provisionNS}, secret)
+	return secret, err
+}
+
+func (h *harness) key(name string) types.NamespacedName {
+	return types.NamespacedName{Name: name, Namespace: h.namespace}
+}
@@ -0,0 +1,323 @@
+package controllers
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"sync"
+
+	hfv1 "github.com/hobbyfarm/gargantua/pkg/apis/hobbyfarm.io/v1"
+	"github.com/hobbyfarm/hf-shim-operator/pkg/utils"
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/tools/clientcmd"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/controller/controllerutil"
+)
+
+/*
+Info needed in environment:
+cred_secret (optional, secret with a kubeconfig for a remote harvester cluster)
+namespace (optional, harvester namespace to launch vms in)
+network (optional, namespace/name of a harvester vm network, defaults to the pod network)
+Info needed in env template mapping:
+image (namespace/name of a harvester VirtualMachineImage)
+cpu, memory, rootDiskSize (optional)
+cloudInit (optional)
+*/
+
+const (
+	harvesterKubeconfigKey        = "kubeconfig"
+	harvesterImageIDAnnotation    = "harvesterhci.io/imageId"
+	harvesterVolumeClaimTemplates = "harvesterhci.io/volumeClaimTemplates"
+	harvesterNetworkName          = "nic-1"
+)
+
+var harvesterImageGVK = schema.GroupVersionKind{Group: "harvesterhci.io", Version: "v1beta1", Kind: "VirtualMachineImage"}
+
+func init() {
+	RegisterProvider("harvester", func(r *VirtualMachineReconciler) Provider {
+		return &harvesterProvider{r: r}
+	})
+}
+
+// harvesterProvider launches VMs on a harvester cluster. When the environment references a kubeconfig
+// the cluster is remote, and the launched objects are tracked by label instead of owner references.
+type harvesterProvider struct {
+	r *VirtualMachineReconciler
+}
+
+// harvesterTarget is the cluster and namespace harvester virtualmachines of an environment are launched in
+type harvesterTarget struct {
+	client.Client
+	namespace string
+	remote    bool
+}
+
+var (
+	harvesterClientsLock sync.Mutex
+	harvesterClients     = make(map[string]harvesterClient)
+)
+
+// harvesterClient caches the client built for a kubeconfig secret until the secret changes
+type harvesterClient struct {
+	resourceVersion string
+	client          client.Client
+}
+
+// ImportKeyPair has no backend object to create, the public key is injected through cloud-init
+func (p *harvesterProvider) ImportKeyPair(ctx context.Context, vm *hfv1.VirtualMachine, env *hfv1.Environment,
+	pubKey string) (status *hfv1.VirtualMachineStatus, err error) {
+	status = vm.Status.DeepCopy()
+	status.Status = importKeyPairCreated
+	return status, nil
+}
+
+func (p *harvesterProvider) CreateInstance(ctx context.Context, vm *hfv1.VirtualMachine, env *hfv1.Environment,
+	vmTemplate *hfv1.VirtualMachineTemplate) (err error) {
+	target, err := p.target(ctx, vm, env)
+	if err != nil {
+		return err
+	}
+
+	mapping := env.Spec.TemplateMapping[vmTemplate.Name]
+	imageID, ok := mapping["image"]
+	if !ok {
+		return fmt.Errorf("no image specified for vm template in env spec")
+	}
+	imageNamespace, imageName := target.namespace, imageID
+	if parts := strings.SplitN(imageID, "/", 2); len(parts) == 2 {
+		imageNamespace, imageName = parts[0], parts[1]
+	}
+
+	image := newUnstructured(harvesterImageGVK, imageName, imageNamespace)
+	if err = target.Get(ctx, types.NamespacedName{Name: imageName, Namespace: imageNamespace}, image); err != nil {
+		return err
+	}
+	storageClass, _, _ := unstructured.NestedString(image.Object, "status", "storageClassName")
+	if len(storageClass) == 0 {
+		return fmt.Errorf("harvester image %s/%s not yet imported", imageNamespace, imageName)
+	}
+
+	pubKey, err := p.r.vmPublicKey(ctx, vm)
+	if err != nil {
+		return err
+	}
+	cloudConfig, err := utils.ParseCloudConfig(mapping["cloudInit"])
+	if err != nil {
+		return err
+	}
+	cloudConfig.AddAuthorizedKeys(pubKey)
+	if err = p.r.addPhoneHome(ctx, vm, env, cloudConfig); err != nil {
+		return err
+	}
+	if err = p.r.addTrustedUserCA(ctx, vm, env, cloudConfig); err != nil {
+		return err
+	}
+	// the guest agent reports the interface addresses the vm status is built from
+	cloudConfig.AppendList("packages", "qemu-guest-agent")
+	cloudConfig.AppendList("runcmd", []interface{}{"systemctl", "enable", "--now", "qemu-guest-agent.service"})
+
+	network := podNetwork()
+	if networkName, ok := env.Spec.EnvironmentSpecifics["network"]; ok {
+		network = multusNetwork(networkName)
+	}
+
+	claimName := vm.Name + "-" + kubeVirtRootDisk
+	rootVolume := map[string]interface{}{
+		"name": kubeVirtRootDisk,
+		"persistentVolumeClaim": map[string]interface{}{
+			"claimName": claimName,
+		},
+	}
+	spec, err := kubeVirtTemplateSpec(vm, mapping, cloudConfig, rootVolume, network)
+	if err != nil {
+		return err
+	}
+
+	diskSize, err := resource.ParseQuantity(rootDiskSize(mapping))
+	if err != nil {
+		return fmt.Errorf("unable to parse rootDiskSize: %v", err)
+	}
+	volumeClaimTemplates, err := json.Marshal([]v1.PersistentVolumeClaim{
+		{
+			ObjectMeta: metav1.ObjectMeta{
+				Name: claimName,
+				Annotations: map[string]string{
+					harvesterImageIDAnnotation: imageNamespace + "/" + imageName,
+				},
+			},
+			Spec: v1.PersistentVolumeClaimSpec{
+				AccessModes:      []v1.PersistentVolumeAccessMode{v1.ReadWriteMany},
+				StorageClassName: &storageClass,
+				VolumeMode:       volumeModePtr(v1.PersistentVolumeBlock),
+				Resources: v1.ResourceRequirements{
+					Requests: v1.ResourceList{
+						v1.ResourceStorage: diskSize,
+					},
+				},
+			},
+		},
+	})
+	if err != nil {
+		return err
+	}
+
+	instance := newUnstructured(kubeVirtVMGVK, vm.Name, target.namespace)
+	if _, err = controllerutil.CreateOrUpdate(ctx, target, instance, func() error {
+		instance.SetLabels(map[string]string{
+			vmLabel:          vm.Name,
+			vmNamespaceLabel: vm.Namespace,
+		})
+		instance.SetAnnotations(map[string]string{harvesterVolumeClaimTemplates: string(volumeClaimTemplates)})
+		instance.Object["spec"] = spec
+		if target.remote || target.namespace != vm.Namespace {
+			return nil
+		}
+		if err := controllerutil.SetControllerReference(vm, instance, p.r.Scheme); err != nil {
+			p.r.Log.Error(err, "unable to set ownerReference for harvester virtualmachine")
+			return err
+		}
+		return nil
+	}); err != nil {
+		p.r.Log.Error(fmt.Errorf("error creating harvester virtualmachine "), vm.Name)
+		return err
+	}
+	return nil
+}
+
+// FetchStatus reports the guest agent addresses of the virtualmachineinstance. The first address is used as
+// the public ip, and the last one as the private ip.
+func (p *harvesterProvider) FetchStatus(ctx context.Context, vm *hfv1.VirtualMachine) (status *hfv1.VirtualMachineStatus,
+	provisioned bool, err error) {
+	status = vm.Status.DeepCopy()
+	env, err := p.r.fetchEnvironment(ctx, status.EnvironmentId, vm.Namespace)
+	if err != nil {
+		return status, false, err
+	}
+	target, err := p.target(ctx, vm, env)
+	if err != nil {
+		return status, false, err
+	}
+
+	instance := newUnstructured(kubeVirtVMGVK, vm.Name, target.namespace)
+	if err = target.Get(ctx, types.NamespacedName{Name: vm.Name, Namespace: target.namespace}, instance); err != nil {
+		p.r.Log.Error(fmt.Errorf("error fetching harvester virtualmachine: "), vm.Name)
+		return status, false, err
+	}
+	ready, _, _ := unstructured.NestedBool(instance.Object, "status", "ready")
+	if !ready {
+		return status, false, nil
+	}
+
+	vmi := newUnstructured(kubeVirtVMIGVK, vm.Name, target.namespace)
+	if err = target.Get(ctx, types.NamespacedName{Name: vm.Name, Namespace: target.namespace}, vmi); err != nil {
+		return status, false, err
+	}
+	ips := kubeVirtInterfaceIPs(vmi, true)
+	if len(ips) == 0 {
+		return status, false, nil
+	}
+	status.PublicIP = ips[0]
+	status.PrivateIP = ips[len(ips)-1]
+	status.Hostname = vm.Name
+	vm.Annotations["sshEndpoint"] = status.PublicIP
+	return status, true, nil
+}
+
+func (p *harvesterProvider) LivenessCheck(ctx context.Context, vm *hfv1.VirtualMachine) (bool, error) {
+	return p.RunCommand(ctx, vm, "uptime")
+}
+
+func (p *harvesterProvider) RunCommand(ctx context.Context, vm *hfv1.VirtualMachine, command string) (bool, error) {
+	status, provisioned, err := p.FetchStatus(ctx, vm)
+	if err != nil || !provisioned {
+		return false, err
+	}
+	return p.r.sshLivenessCheck(ctx, vm, status.PublicIP+":22", defaultKubeVirtUsername, command)
+}
+
+func (p *harvesterProvider) Teardown(ctx context.Context, vm *hfv1.VirtualMachine) (bool, error) {
+	env, err := p.r.fetchEnvironment(ctx, vm.Status.EnvironmentId, vm.Namespace)
+	if err != nil {
+		return false, err
+	}
+	target, err := p.target(ctx, vm, env)
+	if err != nil {
+		return false, err
+	}
+	return deleteObjects(ctx, target,
+		newUnstructured(kubeVirtVMGVK, vm.Name, target.namespace),
+		&v1.PersistentVolumeClaim{ObjectMeta: metav1.ObjectMeta{Name: vm.Name + "-" + kubeVirtRootDisk,
+			Namespace: target.namespace}})
+}
+
+// target returns the cluster and namespace to launch the harvester virtualmachine of vm in
+func (p *harvesterProvider) target(ctx context.Context, vm *hfv1.VirtualMachine, env *hfv1.Environment) (target harvesterTarget,
+	err error) {
+	target.Client = p.r.Client
+	target.namespace = vm.Namespace
+	if ns, ok := env.Spec.EnvironmentSpecifics["namespace"]; ok {
+		target.namespace = ns
+	}
+
+	credSecret, ok := env.Spec.EnvironmentSpecifics["cred_secret"]
+	if !ok {
+		return target, nil
+	}
+
+	secret := &v1.Secret{}
+	if err = p.r.Get(ctx, types.NamespacedName{Name: credSecret, Namespace: vm.Namespace}, secret); err != nil {
+		return target, err
+	}
+	kubeconfig, ok := secret.Data[harvesterKubeconfigKey]
+	if !ok {
+		return target, fmt.Errorf("%s not found in secret %s", harvesterKubeconfigKey, credSecret)
+	}
+
+	harvesterClientsLock.Lock()
+	defer harvesterClientsLock.Unlock()
+	key := secret.Namespace + "/" + secret.Name
+	cached, ok := harvesterClients[key]
+	if !ok || cached.resourceVersion != secret.ResourceVersion {
+		restConfig, err := clientcmd.RESTConfigFromKubeConfig(kubeconfig)
+		if err != nil {
+			return target, err
+		}
+		c, err := client.New(restConfig, client.Options{Scheme: p.r.Scheme})
+		if err != nil {
+			return target, err
+		}
+		cached = harvesterClient{resourceVersion: secret.ResourceVersion, client: c}
+		harvesterClients[key] = cached
+	}
+	target.Client = cached.client
+	target.remote = true
+	return target, nil
+}
+
+// multusNetwork attaches the virtualmachine to a harvester vm network through a bridge
+func multusNetwork(networkName string) kubeVirtNetwork {
+	return kubeVirtNetwork{
+		iface: map[string]interface{}{
+			"name":   harvesterNetworkName,
+			"model":  "virtio",
+			"bridge": map[string]interface{}{},
+		},
+		network: map[string]interface{}{
+			"name": harvesterNetworkName,
+			"multus": map[string]interface{}{
+				"networkName": networkName,
+			},
+		},
+	}
+}
+
+func volumeModePtr(mode v1.PersistentVolumeMode) *v1.PersistentVolumeMode {
+	return &mode
+}
@@ -0,0 +1,203 @@
+package controllers
+
+import (
+	"context"
+	"fmt"
+
+	hfv1 "github.com/hobbyfarm/gargantua/pkg/apis/hobbyfarm.io/v1"
+	shimv1alpha1 "github.com/hobbyfarm/hf-shim-operator/pkg/api/v1alpha1"
+	"github.com/hobbyfarm/hf-shim-operator/pkg/statemachine"
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/equality"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	ctrl "sigs.k8s.io/controller-runtime"
+)
+
+/*
+Info used from the vm:
+shim.hobbyfarm.io/paused label or annotation ("true" while the session of the vm is paused, which stops its
+instance. only providers implementing hibernator support it)
+*/
+
+const (
+	statusStopping = statemachine.StatusStopping
+	statusStopped  = statemachine.StatusStopped
+	statusResuming = statemachine.StatusResuming
+
+	pausedKey = "shim.hobbyfarm.io/paused"
+)
+
+// hibernator is implemented by providers which can power the instance of a vm off and on again, keeping its disks.
+// Stop and Start return true once the instance reached the power state. Start returns the addresses of the started
+// instance when the operator backing it does not refresh them, which are recorded as the startedAddresses of the
+// VirtualMachineProvisioning until the instance is stopped again.
+type hibernator interface {
+	Stop(ctx context.Context, vm *hfv1.VirtualMachine) (stopped bool, err error)
+	Start(ctx context.Context, vm *hfv1.VirtualMachine) (started bool, addresses *shimv1alpha1.InstanceAddresses,
+		err error)
+}
+
+// isPaused reports if the session of vm is paused, signalled by a label or an annotation
+func isPaused(vm *hfv1.VirtualMachine) bool {
+	return vm.Labels[pausedKey] == "true" || vm.Annotations[pausedKey] == "true"
+}
+
+// hibernateVM stops the instance of a running vm while it is paused, and starts it again once it is resumed. The
+// vm is running again after passing its liveness check with the addresses of the started instance. It returns
+// false for vms which are neither stopped nor resumed.
+func (r *VirtualMachineReconciler) hibernateVM(ctx context.Context, vm *hfv1.VirtualMachine,
+	vmp *shimv1alpha1.VirtualMachineProvisioning) (handled bool, result ctrl.Result, err error) {
+	state := vm.Status.Status
+	paused := isPaused(vm)
+	switch state {
+	case hfv1.VmStatusRunning:
+		if !paused {
+			return false, result, nil
+		}
+	case statusStopping, statusStopped, statusResuming:
+	default:
+		return false, result, nil
+	}
+
+	providerName := vmp.Status.Provider
+	p, err := r.provider(providerName)
+	if err != nil {
+		return true, result, r.provisioningError(ctx, vm, vmp, err)
+	}
+	h, ok := p.(hibernator)
+	if !ok {
+		if state == hfv1.VmStatusRunning {
+			r.providerEvent(ctx, vm, providerName, v1.EventTypeWarning, "HibernateUnsupported",
+				"%s instance can not be stopped, it keeps running while the session is paused", providerName)
+			return false, result, nil
+		}
+		return true, result, r.provisioningError(ctx, vm, vmp,
+			fmt.Errorf("%s instances can not be stopped or started", providerName))
+	}
+
+	instance := instanceVM(vm, vmp)
+	status := vm.Status.DeepCopy()
+	switch {
+	case paused && state == statusStopped:
+		return true, result, r.recordProvisioning(ctx, vm, vmp, nil, state)
+	case paused:
+		if state != statusStopping {
+			r.providerEvent(ctx, vm, providerName, v1.EventTypeNormal, "Stopping",
+				"session is paused, stopping its %s instance", providerName)
+		}
+		// stopped instances give up their addresses
+		vmp.Status.StartedAddresses = nil
+		stopped, err := h.Stop(ctx, instance)
+		if err != nil {
+			r.providerEvent(ctx, vm, providerName, v1.EventTypeWarning, "StopFailed",
+				"error stopping %s instance: %v", providerName, err)
+			return true, result, r.provisioningError(ctx, vm, vmp, err)
+		}
+		status.Status = statusStopping
+		if stopped {
+			status.Status = statusStopped
+			r.providerEvent(ctx, vm, providerName, v1.EventTypeNormal, "Stopped", "%s instance stopped",
+				providerName)
+		}
+	default:
+		if state != statusResuming {
+			r.providerEvent(ctx, vm, providerName, v1.EventTypeNormal, "Resuming",
+				"session is resumed, starting its %s instance", providerName)
+		}
+		started, addresses, err := h.Start(ctx, instance)
+		if err != nil {
+			r.providerEvent(ctx, vm, providerName, v1.EventTypeWarning, "StartFailed",
+				"error starting %s instance: %v", providerName, err)
+			return true, result, r.provisioningError(ctx, vm, vmp, err)
+		}
+		status.Status = statusResuming
+		if started && addresses != nil && !equality.Semantic.DeepEqual(addresses, vmp.Status.StartedAddresses) {
+			// providers read the addresses of the started instance from the provisioning, so they are saved first
+			vmp.Status.StartedAddresses = addresses
+			if err = r.recordProvisioning(ctx, vm, vmp, nil); err != nil {
+				return true, result, err
+			}
+		}
+		if started {
+			if status, err = r.resumeInstance(ctx, vm, vmp, p); err != nil {
+				return true, result, r.provisioningError(ctx, vm, vmp, err)
+			}
+		}
+	}
+	if status.Status != statusStopped && status.Status != hfv1.VmStatusRunning {
+		result.RequeueAfter = teardownRequeue
+	}
+
+	vm.Status = *status
+	status = vm.Status.DeepCopy()
+	if err = r.Update(ctx, vm); err != nil {
+		return true, result, err
+	}
+	vm.Status = *status
+	if err = r.Status().Update(ctx, vm); err != nil {
+		return true, result, err
+	}
+	return true, result, r.recordProvisioning(ctx, vm, vmp, nil, state, vm.Status.Status)
+}
+
+// resumeInstance refreshes the addresses of the started instance of vm, and marks vm running once it passes its
+// liveness check and readiness probes
+func (r *VirtualMachineReconciler) resumeInstance(ctx context.Context, vm *hfv1.VirtualMachine,
+	vmp *shimv1alpha1.VirtualMachineProvisioning, p Provider) (status *hfv1.VirtualMachineStatus, err error) {
+	instance := instanceVM(vm, vmp)
+	status, provisioned, err := p.FetchStatus(ctx, instance)
+	if err != nil && err != errVMNotRunning {
+		return status, err
+	}
+	status.Status = statusResuming
+	if !provisioned {
+		return status, nil
+	}
+
+	ready, err := p.LivenessCheck(ctx, instance)
+	livenessChecks.WithLabelValues(vmp.Status.Provider).Inc()
+	// providers publish the ssh endpoint of the instance on the vm they are given
+	if endpoint, ok := instance.Annotations["sshEndpoint"]; ok {
+		vm.Annotations["sshEndpoint"] = endpoint
+	}
+	if err != nil || !ready {
+		livenessCheckFailures.WithLabelValues(vmp.Status.Provider).Inc()
+		return status, nil
+	}
+	if err = r.probeReadiness(ctx, vm, vmp, p, status); err != nil {
+		r.providerEvent(ctx, vm, vmp.Status.Provider, v1.EventTypeWarning, "ReadinessProbeFailed",
+			"%s instance is not ready: %v", vmp.Status.Provider, err)
+		return status, nil
+	}
+	status.Status = hfv1.VmStatusRunning
+	r.providerEvent(ctx, vm, vmp.Status.Provider, v1.EventTypeNormal, "Resumed",
+		"%s instance started and passed its liveness check", vmp.Status.Provider)
+	return status, nil
+}
+
+// instanceAddresses returns the public and private ip the operator reports for its Instance obj, replaced by the
+// startedAddresses recorded once the shim started the instance again. The provisioning of obj is found through its
+// vm labels, as instances claimed from a warm pool keep the name of the pool member.
+func (r *VirtualMachineReconciler) instanceAddresses(ctx context.Context, obj metav1.Object, publicIP string,
+	privateIP string) (string, string, error) {
+	key := types.NamespacedName{Name: obj.GetName(), Namespace: obj.GetNamespace()}
+	if name, ok := obj.GetLabels()[vmLabel]; ok {
+		key.Name = name
+	}
+	if namespace, ok := obj.GetLabels()[vmNamespaceLabel]; ok {
+		key.Namespace = namespace
+	}
+	vmp := &shimv1alpha1.VirtualMachineProvisioning{}
+	if err := r.Get(ctx, key, vmp); err != nil {
+		if errors.IsNotFound(err) {
+			err = nil
+		}
+		return publicIP, privateIP, err
+	}
+	if started := vmp.Status.StartedAddresses; started != nil {
+		return started.PublicIP, started.PrivateIP, nil
+	}
+	return publicIP, privateIP, nil
+}
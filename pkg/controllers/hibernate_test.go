@@ -0,0 +1,175 @@
+package controllers
+
+import (
+	"context"
+	"fmt"
+	"testing"
+
+	hfv1 "github.com/hobbyfarm/gargantua/pkg/apis/hobbyfarm.io/v1"
+	shimv1alpha1 "github.com/hobbyfarm/hf-shim-operator/pkg/api/v1alpha1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+const fakeInstanceStopped = "stopped"
+
+// hibernatingFakeProvider is the fake provider powering instances off and on, which takes a reconcile each
+type hibernatingFakeProvider struct {
+	*fakeProvider
+}
+
+func (p hibernatingFakeProvider) Stop(ctx context.Context, vm *hfv1.VirtualMachine) (bool, error) {
+	p.Lock()
+	defer p.Unlock()
+	instance, ok := p.instances[vm.Name]
+	if !ok {
+		return false, fmt.Errorf("no instance found for vm %s", vm.Name)
+	}
+	if instance.status == fakeInstanceStopped {
+		return true, nil
+	}
+	instance.status = fakeInstanceStopped
+	return false, nil
+}
+
+func (p hibernatingFakeProvider) Start(ctx context.Context, vm *hfv1.VirtualMachine) (bool,
+	*shimv1alpha1.InstanceAddresses, error) {
+	p.Lock()
+	defer p.Unlock()
+	instance, ok := p.instances[vm.Name]
+	if !ok {
+		return false, nil, fmt.Errorf("no instance found for vm %s", vm.Name)
+	}
+	if instance.status == fakeInstanceStopped {
+		instance.status = fakeInstancePending
+	}
+	if instance.status != fakeInstanceProvisioned || len(instance.startedIP) == 0 {
+		return instance.status == fakeInstanceProvisioned, nil, nil
+	}
+	return true, &shimv1alpha1.InstanceAddresses{PublicIP: instance.startedIP, PrivateIP: instance.privateIP}, nil
+}
+
+// registerHibernating makes the provider available as the fake provider, with support for stopping instances
+func (p *fakeProvider) registerHibernating() {
+	RegisterProvider(fakeProviderName, func(r *VirtualMachineReconciler) Provider {
+		p.Lock()
+		defer p.Unlock()
+		p.r = r
+		return hibernatingFakeProvider{p}
+	})
+}
+
+// pause marks the session of the test vm paused, or resumed, with the annotation
+func (h *harness) pause(paused bool) {
+	h.t.Helper()
+	vm := h.vm()
+	if paused {
+		metav1.SetMetaDataAnnotation(&vm.ObjectMeta, pausedKey, "true")
+	} else {
+		delete(vm.Annotations, pausedKey)
+	}
+	if err := h.r.Update(h.ctx, vm); err != nil {
+		h.t.Fatal(err)
+	}
+}
+
+func TestHibernate(t *testing.T) {
+	p := newFakeProvider()
+	p.registerHibernating()
+	h := newHarness(t, fakeProviderName, nil, nil)
+	h.setLive(true)
+	h.step(secretCreated)
+	h.step(importKeyPairCreated)
+	h.step(hfv1.VmStatusProvisioned)
+	p.transition(testVMName, fakeInstanceProvisioned, "192.0.2.10")
+	h.step(hfv1.VmStatusRunning)
+	h.claim()
+
+	h.pause(true)
+	h.step(statusStopping)
+	h.expectEvent("Stopping")
+	h.step(statusStopped)
+	h.expectEvent("Stopped")
+	h.step(statusStopped)
+	if phase := h.provisioning().Status.Phase; phase != shimv1alpha1.PhaseStopped {
+		t.Fatalf("expected the stopped phase, got %s", phase)
+	}
+
+	h.pause(false)
+	h.step(statusResuming)
+	h.expectEvent("Resuming")
+	h.step(statusResuming)
+
+	// the started instance comes up with a new address
+	p.transition(testVMName, fakeInstanceProvisioned, "192.0.2.11")
+	h.step(hfv1.VmStatusRunning)
+	h.expectEvent("Resumed")
+	vm := h.vm()
+	if vm.Status.PublicIP != "192.0.2.11" || !vm.Status.Allocated {
+		t.Fatalf("expected the resumed vm to keep its session at the new address, got %+v", vm.Status)
+	}
+	if call := h.lastLivenessCall(); call.address != "192.0.2.11:22" {
+		t.Fatalf("expected the liveness check to run on the new address, got %+v", call)
+	}
+	resumed := false
+	for _, transition := range h.provisioning().Status.History {
+		if transition.From == shimv1alpha1.PhaseResuming && transition.To == shimv1alpha1.PhaseRunning {
+			resumed = true
+		}
+	}
+	if !resumed {
+		t.Fatal("expected the resume in the history")
+	}
+}
+
+func TestHibernateStartedAddresses(t *testing.T) {
+	p := newFakeProvider()
+	p.registerHibernating()
+	h := newHarness(t, fakeProviderName, nil, nil)
+	h.setLive(true)
+	h.step(secretCreated)
+	h.step(importKeyPairCreated)
+	h.step(hfv1.VmStatusProvisioned)
+	p.transition(testVMName, fakeInstanceProvisioned, "192.0.2.10")
+	h.step(hfv1.VmStatusRunning)
+
+	h.pause(true)
+	h.step(statusStopping)
+	h.step(statusStopped)
+	h.pause(false)
+	h.step(statusResuming)
+
+	// the started instance comes up with a new address, which its operator keeps reporting as the old one
+	instance, _ := p.instance(testVMName)
+	p.Lock()
+	instance.startedIP = "192.0.2.12"
+	p.Unlock()
+	p.transition(testVMName, fakeInstanceProvisioned, "192.0.2.10")
+	h.step(hfv1.VmStatusRunning)
+	if vm := h.vm(); vm.Status.PublicIP != "192.0.2.12" {
+		t.Fatalf("expected the resumed vm at the started address, got %+v", vm.Status)
+	}
+	if call := h.lastLivenessCall(); call.address != "192.0.2.12:22" {
+		t.Fatalf("expected the liveness check to run on the started address, got %+v", call)
+	}
+	if started := h.provisioning().Status.StartedAddresses; started == nil || started.PublicIP != "192.0.2.12" {
+		t.Fatalf("expected the started address on the provisioning, got %+v", started)
+	}
+
+	h.pause(true)
+	h.step(statusStopping)
+	if started := h.provisioning().Status.StartedAddresses; started != nil {
+		t.Fatalf("expected the started addresses to be released, got %+v", started)
+	}
+}
+
+func TestHibernateUnsupported(t *testing.T) {
+	h, _ := runningVM(t)
+	vm := h.vm()
+	vm.Labels[pausedKey] = "true"
+	if err := h.r.Update(h.ctx, vm); err != nil {
+		t.Fatal(err)
+	}
+
+	h.step(hfv1.VmStatusRunning)
+	h.expectEvent("HibernateUnsupported")
+}
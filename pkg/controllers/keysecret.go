@@ -0,0 +1,180 @@
+package controllers
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	hfv1 "github.com/hobbyfarm/gargantua/pkg/apis/hobbyfarm.io/v1"
+	"github.com/hobbyfarm/hf-shim-operator/pkg/utils"
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/controller/controllerutil"
+)
+
+/*
+Info used from environment:
+ssh_key_type (optional, type of the ssh keys generated for vms: ed25519, ecdsa-256, ecdsa-384, ecdsa-521 or
+rsa-<bits> with 2048 to 8192 bits. ecdsa and rsa default to 256 and 3072 bits, the type to rsa-2048)
+
+Info used from env template mapping:
+sshKeyType (optional, replaces the ssh_key_type of the environment for vms of the template)
+*/
+
+// keySecretFinalizer keeps keypair secrets around until the vm using them is finalized. The garbage collector
+// does not honour owner references across namespaces, so secrets of vms outside the provisioning namespace
+// would otherwise be deleted, or never cleaned up.
+const keySecretFinalizer = "shim.hobbyfarm.io/keypair"
+
+// knownHostsKey holds the known_hosts entries of the instance of a vm in its keypair secret, captured by the first
+// liveness check
+const knownHostsKey = "known_hosts"
+
+const (
+	sshKeyTypeKey         = "ssh_key_type"
+	templateSSHKeyTypeKey = "sshKeyType"
+	// keyTypeSecretKey records the type of the generated keys in the keypair secret
+	keyTypeSecretKey = "key_type"
+	// defaultSSHKeyType is the type of the keys generated for vms which do not choose one, the 2048 bit rsa keys
+	// gargantua generated and every provider imports
+	defaultSSHKeyType = "rsa-2048"
+)
+
+// providerKeyTypes are the key types accepted by the apis of providers importing the public key of vms. Providers
+// passing it on through cloud-init or ssh accept any key type.
+var providerKeyTypes = map[string][]string{
+	// ec2 imports rsa keys of 1024, 2048 and 4096 bits only
+	"aws":          {"ed25519", "rsa-2048", "rsa-4096"},
+	"digitalocean": {"ed25519", "ecdsa-256", "ecdsa-384", "ecdsa-521", "rsa-2048", "rsa-3072", "rsa-4096"},
+	"equinix":      {"ed25519", "rsa-2048", "rsa-3072", "rsa-4096"},
+}
+
+// vmKeyType returns the type of the keys generated for vms of templateName in env
+func vmKeyType(env *hfv1.Environment, templateName string) (utils.KeyType, error) {
+	value, ok := env.Spec.TemplateMapping[templateName][templateSSHKeyTypeKey]
+	if !ok {
+		value, ok = env.Spec.EnvironmentSpecifics[sshKeyTypeKey]
+	}
+	if !ok {
+		value = defaultSSHKeyType
+	}
+	return utils.ParseKeyType(value)
+}
+
+// checkKeyType fails unless providerName accepts the type of pubKey
+func checkKeyType(providerName string, pubKey string) error {
+	keyType, err := utils.PublicKeyType(pubKey)
+	if err != nil {
+		return err
+	}
+	for _, accepted := range providerKeyTypes[providerName] {
+		if keyType.String() == accepted {
+			return nil
+		}
+	}
+	return fmt.Errorf("%s does not accept %s keys, choose one of %s with %s", providerName, keyType,
+		strings.Join(providerKeyTypes[providerName], ", "), sshKeyTypeKey)
+}
+
+// keySecretName returns the name of the keypair secret of vm in the provisioning namespace. vms of other
+// namespaces get the namespace as prefix, so equally named vms do not share their keys.
+func keySecretName(vm *hfv1.VirtualMachine) string {
+	if vm.Namespace == provisionNS {
+		return vm.Name + "-secret"
+	}
+	return vm.Namespace + "-" + vm.Name + "-secret"
+}
+
+// trackKeySecret labels secret with the vm it belongs to and protects it with the keypair finalizer. The vm
+// only owns the secret when they share a namespace.
+func (r *VirtualMachineReconciler) trackKeySecret(vm *hfv1.VirtualMachine, secret *v1.Secret) error {
+	if secret.Labels == nil {
+		secret.Labels = make(map[string]string)
+	}
+	secret.Labels[vmLabel] = vm.Name
+	secret.Labels[vmNamespaceLabel] = vm.Namespace
+	controllerutil.AddFinalizer(secret, keySecretFinalizer)
+
+	if secret.Namespace == vm.Namespace {
+		return controllerutil.SetControllerReference(vm, secret, r.Scheme)
+	}
+
+	// earlier versions set a controller reference regardless of the namespace
+	var ownerRefs []metav1.OwnerReference
+	for _, ref := range secret.OwnerReferences {
+		if ref.UID != vm.UID {
+			ownerRefs = append(ownerRefs, ref)
+		}
+	}
+	secret.OwnerReferences = ownerRefs
+	return nil
+}
+
+// fetchKeySecret returns the keypair secret of vm from the provisioning namespace
+func (r *VirtualMachineReconciler) fetchKeySecret(ctx context.Context, vm *hfv1.VirtualMachine) (*v1.Secret, error) {
+	name := vm.Spec.KeyPair
+	if len(name) == 0 {
+		name = keySecretName(vm)
+	}
+	secret := &v1.Secret{}
+	err := r.Get(ctx, types.NamespacedName{Name: name, Namespace: provisionNS}, secret)
+	return secret, err
+}
+
+// forgetHostKeys removes the host keys of the instance of vm from its keypair secret, before it gets a new instance
+func (r *VirtualMachineReconciler) forgetHostKeys(ctx context.Context, vm *hfv1.VirtualMachine) error {
+	secret, err := r.fetchKeySecret(ctx, vm)
+	if err != nil {
+		return client.IgnoreNotFound(err)
+	}
+	if _, ok := secret.Data[knownHostsKey]; !ok {
+		if _, ok := secret.Data[hostKeysKey]; !ok {
+			return nil
+		}
+	}
+	delete(secret.Data, knownHostsKey)
+	delete(secret.Data, hostKeysKey)
+	return r.Update(ctx, secret)
+}
+
+// releaseKeySecrets removes the keypair finalizer from the secrets of vm, and deletes them
+func (r *VirtualMachineReconciler) releaseKeySecrets(ctx context.Context, vm *hfv1.VirtualMachine) error {
+	secrets := &v1.SecretList{}
+	if err := r.List(ctx, secrets, client.InNamespace(provisionNS), client.MatchingLabels{
+		vmLabel:          vm.Name,
+		vmNamespaceLabel: vm.Namespace,
+	}); err != nil {
+		return err
+	}
+
+	// secrets of vms provisioned by earlier versions carry no labels yet
+	if len(secrets.Items) == 0 {
+		secret, err := r.fetchKeySecret(ctx, vm)
+		if err != nil {
+			return client.IgnoreNotFound(err)
+		}
+		for _, ref := range secret.OwnerReferences {
+			if ref.UID == vm.UID {
+				secrets.Items = append(secrets.Items, *secret)
+				break
+			}
+		}
+	}
+
+	for i := range secrets.Items {
+		secret := &secrets.Items[i]
+		if controllerutil.ContainsFinalizer(secret, keySecretFinalizer) {
+			controllerutil.RemoveFinalizer(secret, keySecretFinalizer)
+			if err := r.Update(ctx, secret); err != nil {
+				return err
+			}
+		}
+		if err := r.Delete(ctx, secret); err != nil && !errors.IsNotFound(err) {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,472 @@
+package controllers
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+
+	hfv1 "github.com/hobbyfarm/gargantua/pkg/apis/hobbyfarm.io/v1"
+	shimv1alpha1 "github.com/hobbyfarm/hf-shim-operator/pkg/api/v1alpha1"
+	"github.com/hobbyfarm/hf-shim-operator/pkg/utils"
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/intstr"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/controller/controllerutil"
+)
+
+/*
+Info needed in environment:
+service_type (optional, defaults to ClusterIP)
+Info needed in env template mapping:
+image
+imageType (optional, containerDisk or dataVolume)
+cpu, memory, rootDiskSize (optional)
+cloudInit (optional)
+*/
+
+const (
+	defaultKubeVirtCPU        = "2"
+	defaultKubeVirtMemory     = "4Gi"
+	defaultKubeVirtDiskSize   = "20"
+	defaultKubeVirtUsername   = "ubuntu"
+	kubeVirtImageTypeDV       = "dataVolume"
+	kubeVirtRootDisk          = "rootdisk"
+	kubeVirtCloudInitDisk     = "cloudinitdisk"
+	kubeVirtDefaultNetwork    = "default"
+	kubeVirtDataVolumeVersion = "cdi.kubevirt.io/v1beta1"
+)
+
+var (
+	kubeVirtVMGVK  = schema.GroupVersionKind{Group: "kubevirt.io", Version: "v1", Kind: "VirtualMachine"}
+	kubeVirtVMIGVK = schema.GroupVersionKind{Group: "kubevirt.io", Version: "v1", Kind: "VirtualMachineInstance"}
+)
+
+func init() {
+	RegisterProvider("kubevirt", func(r *VirtualMachineReconciler) Provider {
+		return &kubeVirtProvider{r: r}
+	})
+}
+
+// kubeVirtProvider launches VMs as KubeVirt VirtualMachines in the namespace of the HobbyFarm VM,
+// with ssh exposed through a Service
+type kubeVirtProvider struct {
+	r *VirtualMachineReconciler
+}
+
+// ImportKeyPair has no backend object to create, the public key is injected through cloud-init
+func (p *kubeVirtProvider) ImportKeyPair(ctx context.Context, vm *hfv1.VirtualMachine, env *hfv1.Environment,
+	pubKey string) (status *hfv1.VirtualMachineStatus, err error) {
+	status = vm.Status.DeepCopy()
+	status.Status = importKeyPairCreated
+	return status, nil
+}
+
+func (p *kubeVirtProvider) CreateInstance(ctx context.Context, vm *hfv1.VirtualMachine, env *hfv1.Environment,
+	vmTemplate *hfv1.VirtualMachineTemplate) (err error) {
+	pubKey, err := p.r.vmPublicKey(ctx, vm)
+	if err != nil {
+		return err
+	}
+
+	mapping := env.Spec.TemplateMapping[vmTemplate.Name]
+	cloudConfig, err := utils.ParseCloudConfig(mapping["cloudInit"])
+	if err != nil {
+		return err
+	}
+	cloudConfig.AddAuthorizedKeys(pubKey)
+	if err = p.r.addPhoneHome(ctx, vm, env, cloudConfig); err != nil {
+		return err
+	}
+	if err = p.r.addTrustedUserCA(ctx, vm, env, cloudConfig); err != nil {
+		return err
+	}
+
+	spec, err := kubeVirtVMSpec(vm, mapping, cloudConfig)
+	if err != nil {
+		return err
+	}
+
+	instance := newUnstructured(kubeVirtVMGVK, vm.Name, vm.Namespace)
+	if _, err = controllerutil.CreateOrUpdate(ctx, p.r.Client, instance, func() error {
+		setVMLabels(instance, vm)
+		instance.Object["spec"] = spec
+		if err := controllerutil.SetControllerReference(vm, instance, p.r.Scheme); err != nil {
+			p.r.Log.Error(err, "unable to set ownerReference for kubevirt virtualmachine")
+			return err
+		}
+		return nil
+	}); err != nil {
+		p.r.Log.Error(fmt.Errorf("error creating kubevirt virtualmachine "), vm.Name)
+		return err
+	}
+
+	return p.r.createSSHService(ctx, vm, env)
+}
+
+func (p *kubeVirtProvider) FetchStatus(ctx context.Context, vm *hfv1.VirtualMachine) (status *hfv1.VirtualMachineStatus,
+	provisioned bool, err error) {
+	status = vm.Status.DeepCopy()
+	instance := newUnstructured(kubeVirtVMGVK, vm.Name, vm.Namespace)
+	if err = p.r.Get(ctx, types.NamespacedName{Name: vm.Name, Namespace: vm.Namespace}, instance); err != nil {
+		p.r.Log.Error(fmt.Errorf("error fetching kubevirt virtualmachine: "), vm.Name)
+		return status, false, err
+	}
+
+	ready, _, _ := unstructured.NestedBool(instance.Object, "status", "ready")
+	if !ready {
+		return status, false, nil
+	}
+
+	vmi := newUnstructured(kubeVirtVMIGVK, vm.Name, vm.Namespace)
+	if err = p.r.Get(ctx, types.NamespacedName{Name: vm.Name, Namespace: vm.Namespace}, vmi); err != nil {
+		return status, false, err
+	}
+	if ips := kubeVirtInterfaceIPs(vmi, false); len(ips) > 0 {
+		status.PrivateIP = ips[0]
+	}
+	status.Hostname = vm.Name
+
+	svc := &v1.Service{}
+	if err = p.r.Get(ctx, types.NamespacedName{Name: vm.Name, Namespace: vm.Namespace}, svc); err != nil {
+		return status, false, err
+	}
+	if endpoint := serviceEndpoint(svc); len(endpoint) > 0 {
+		status.PublicIP = endpoint
+		vm.Annotations["sshEndpoint"] = endpoint
+	}
+
+	return status, len(status.PrivateIP) > 0 && len(status.PublicIP) > 0, nil
+}
+
+func (p *kubeVirtProvider) LivenessCheck(ctx context.Context, vm *hfv1.VirtualMachine) (bool, error) {
+	return p.RunCommand(ctx, vm, "uptime")
+}
+
+func (p *kubeVirtProvider) RunCommand(ctx context.Context, vm *hfv1.VirtualMachine, command string) (bool, error) {
+	vmi := newUnstructured(kubeVirtVMIGVK, vm.Name, vm.Namespace)
+	if err := p.r.Get(ctx, types.NamespacedName{Name: vm.Name, Namespace: vm.Namespace}, vmi); err != nil {
+		return false, err
+	}
+	ips := kubeVirtInterfaceIPs(vmi, false)
+	if len(ips) == 0 {
+		return false, fmt.Errorf("kubevirt virtualmachineinstance %s has no ip address yet", vm.Name)
+	}
+	return p.r.sshLivenessCheck(ctx, vm, ips[0]+":22", defaultKubeVirtUsername, command)
+}
+
+func (p *kubeVirtProvider) Teardown(ctx context.Context, vm *hfv1.VirtualMachine) (bool, error) {
+	return p.r.deleteChildren(ctx, p.children(vm)...)
+}
+
+// Recycle deletes the kubevirt virtualmachine along with its data volumes, keeping the ssh service. CreateInstance
+// launches it again from the image, with the rotated keys injected through cloud-init.
+func (p *kubeVirtProvider) Recycle(ctx context.Context, vm *hfv1.VirtualMachine,
+	vmp *shimv1alpha1.VirtualMachineProvisioning) (bool, error) {
+	return p.r.deleteChildren(ctx, newUnstructured(kubeVirtVMGVK, vm.Name, vm.Namespace))
+}
+
+// Stop halts the kubevirt virtualmachine, which is stopped once its virtualmachineinstance is gone
+func (p *kubeVirtProvider) Stop(ctx context.Context, vm *hfv1.VirtualMachine) (bool, error) {
+	if err := p.setRunning(ctx, vm, false); err != nil {
+		return false, err
+	}
+	vmi := newUnstructured(kubeVirtVMIGVK, vm.Name, vm.Namespace)
+	err := p.r.Get(ctx, types.NamespacedName{Name: vm.Name, Namespace: vm.Namespace}, vmi)
+	if errors.IsNotFound(err) {
+		return true, nil
+	}
+	return false, err
+}
+
+// Start runs the kubevirt virtualmachine again, which is started once it is ready. Its addresses are refreshed by
+// kubevirt.
+func (p *kubeVirtProvider) Start(ctx context.Context, vm *hfv1.VirtualMachine) (bool,
+	*shimv1alpha1.InstanceAddresses, error) {
+	if err := p.setRunning(ctx, vm, true); err != nil {
+		return false, nil, err
+	}
+	instance := newUnstructured(kubeVirtVMGVK, vm.Name, vm.Namespace)
+	if err := p.r.Get(ctx, types.NamespacedName{Name: vm.Name, Namespace: vm.Namespace}, instance); err != nil {
+		return false, nil, err
+	}
+	ready, _, _ := unstructured.NestedBool(instance.Object, "status", "ready")
+	return ready, nil, nil
+}
+
+// setRunning sets the run state of the kubevirt virtualmachine of vm
+func (p *kubeVirtProvider) setRunning(ctx context.Context, vm *hfv1.VirtualMachine, running bool) error {
+	instance := newUnstructured(kubeVirtVMGVK, vm.Name, vm.Namespace)
+	if err := p.r.Get(ctx, types.NamespacedName{Name: vm.Name, Namespace: vm.Namespace}, instance); err != nil {
+		return err
+	}
+	if current, _, _ := unstructured.NestedBool(instance.Object, "spec", "running"); current == running {
+		return nil
+	}
+	if err := unstructured.SetNestedField(instance.Object, running, "spec", "running"); err != nil {
+		return err
+	}
+	return p.r.Update(ctx, instance)
+}
+
+func (p *kubeVirtProvider) children(vm *hfv1.VirtualMachine) []client.Object {
+	return []client.Object{
+		newUnstructured(kubeVirtVMGVK, vm.Name, vm.Namespace),
+		&v1.Service{ObjectMeta: metav1.ObjectMeta{Name: vm.Name, Namespace: vm.Namespace}},
+	}
+}
+
+// createSSHService exposes port 22 of the kubevirt virtualmachine
+func (r *VirtualMachineReconciler) createSSHService(ctx context.Context, vm *hfv1.VirtualMachine,
+	env *hfv1.Environment) (err error) {
+	serviceType, ok := env.Spec.EnvironmentSpecifics["service_type"]
+	if !ok {
+		serviceType = string(v1.ServiceTypeClusterIP)
+	}
+
+	svc := &v1.Service{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      vm.Name,
+			Namespace: vm.Namespace,
+		},
+	}
+	if _, err = controllerutil.CreateOrUpdate(ctx, r.Client, svc, func() error {
+		svc.Spec.Type = v1.ServiceType(serviceType)
+		svc.Spec.Selector = map[string]string{vmLabel: vm.Name}
+		svc.Spec.Ports = []v1.ServicePort{
+			{
+				Name:       "ssh",
+				Protocol:   v1.ProtocolTCP,
+				Port:       22,
+				TargetPort: intstr.FromInt(22),
+			},
+		}
+		if err := controllerutil.SetControllerReference(vm, svc, r.Scheme); err != nil {
+			r.Log.Error(err, "unable to set ownerReference for service")
+			return err
+		}
+		return nil
+	}); err != nil {
+		r.Log.Error(fmt.Errorf("error creating service "), svc.Name)
+		return err
+	}
+	return nil
+}
+
+// kubeVirtVMSpec generates the spec of a kubevirt virtualmachine from the template mapping of an environment and
+// the cloud-config of the vm
+func kubeVirtVMSpec(vm *hfv1.VirtualMachine, mapping map[string]string,
+	cloudConfig utils.CloudConfig) (spec map[string]interface{}, err error) {
+	image, ok := mapping["image"]
+	if !ok {
+		return spec, fmt.Errorf("no image specified for vm template in env spec")
+	}
+
+	rootVolume := map[string]interface{}{
+		"name": kubeVirtRootDisk,
+		"containerDisk": map[string]interface{}{
+			"image": image,
+		},
+	}
+
+	var dataVolumeTemplates []interface{}
+	if mapping["imageType"] == kubeVirtImageTypeDV {
+		rootVolume = map[string]interface{}{
+			"name": kubeVirtRootDisk,
+			"dataVolume": map[string]interface{}{
+				"name": vm.Name,
+			},
+		}
+		dataVolumeTemplates = []interface{}{
+			map[string]interface{}{
+				"apiVersion": kubeVirtDataVolumeVersion,
+				"kind":       "DataVolume",
+				"metadata": map[string]interface{}{
+					"name": vm.Name,
+				},
+				"spec": map[string]interface{}{
+					"source": dataVolumeSource(image),
+					"pvc": map[string]interface{}{
+						"accessModes": []interface{}{"ReadWriteOnce"},
+						"resources": map[string]interface{}{
+							"requests": map[string]interface{}{
+								"storage": rootDiskSize(mapping),
+							},
+						},
+					},
+				},
+			},
+		}
+	}
+
+	spec, err = kubeVirtTemplateSpec(vm, mapping, cloudConfig, rootVolume, podNetwork())
+	if err != nil {
+		return spec, err
+	}
+	if dataVolumeTemplates != nil {
+		spec["dataVolumeTemplates"] = dataVolumeTemplates
+	}
+	return spec, nil
+}
+
+// kubeVirtTemplateSpec generates a running virtualmachine spec booting from rootVolume, attached to network
+func kubeVirtTemplateSpec(vm *hfv1.VirtualMachine, mapping map[string]string, cloudConfig utils.CloudConfig,
+	rootVolume map[string]interface{}, network kubeVirtNetwork) (spec map[string]interface{}, err error) {
+	cpu, ok := mapping["cpu"]
+	if !ok {
+		cpu = defaultKubeVirtCPU
+	}
+	cores, err := strconv.ParseInt(cpu, 10, 64)
+	if err != nil {
+		return spec, fmt.Errorf("unable to convert cpu to int: %v", err)
+	}
+
+	memory, ok := mapping["memory"]
+	if !ok {
+		memory = defaultKubeVirtMemory
+	}
+
+	userData, err := cloudConfig.String()
+	if err != nil {
+		return spec, err
+	}
+
+	spec = map[string]interface{}{
+		"running": true,
+		"template": map[string]interface{}{
+			"metadata": map[string]interface{}{
+				"labels": map[string]interface{}{
+					vmLabel: vm.Name,
+				},
+			},
+			"spec": map[string]interface{}{
+				"domain": map[string]interface{}{
+					"cpu": map[string]interface{}{
+						"cores": cores,
+					},
+					"resources": map[string]interface{}{
+						"requests": map[string]interface{}{
+							"memory": memory,
+						},
+					},
+					"devices": map[string]interface{}{
+						"disks": []interface{}{
+							kubeVirtDisk(kubeVirtRootDisk),
+							kubeVirtDisk(kubeVirtCloudInitDisk),
+						},
+						"interfaces": []interface{}{network.iface},
+					},
+				},
+				"networks": []interface{}{network.network},
+				"volumes": []interface{}{
+					rootVolume,
+					map[string]interface{}{
+						"name": kubeVirtCloudInitDisk,
+						"cloudInitNoCloud": map[string]interface{}{
+							"userData": userData,
+						},
+					},
+				},
+			},
+		},
+	}
+
+	return spec, nil
+}
+
+// kubeVirtNetwork is the interface and network pair a virtualmachine is attached with
+type kubeVirtNetwork struct {
+	iface   map[string]interface{}
+	network map[string]interface{}
+}
+
+// podNetwork attaches the virtualmachine to the pod network
+func podNetwork() kubeVirtNetwork {
+	return kubeVirtNetwork{
+		iface: map[string]interface{}{
+			"name":       kubeVirtDefaultNetwork,
+			"masquerade": map[string]interface{}{},
+		},
+		network: map[string]interface{}{
+			"name": kubeVirtDefaultNetwork,
+			"pod":  map[string]interface{}{},
+		},
+	}
+}
+
+// rootDiskSize returns the root disk size from the template mapping as a quantity
+func rootDiskSize(mapping map[string]string) string {
+	diskSize, ok := mapping["rootDiskSize"]
+	if !ok {
+		diskSize = defaultKubeVirtDiskSize
+	}
+	return diskSize + "Gi"
+}
+
+func kubeVirtDisk(name string) map[string]interface{} {
+	return map[string]interface{}{
+		"name": name,
+		"disk": map[string]interface{}{
+			"bus": "virtio",
+		},
+	}
+}
+
+// dataVolumeSource imports docker:// images from a registry, everything else over http
+func dataVolumeSource(image string) map[string]interface{} {
+	if strings.HasPrefix(image, "docker://") {
+		return map[string]interface{}{
+			"registry": map[string]interface{}{
+				"url": image,
+			},
+		}
+	}
+	return map[string]interface{}{
+		"http": map[string]interface{}{
+			"url": image,
+		},
+	}
+}
+
+// kubeVirtInterfaceIPs returns the ip addresses reported for the interfaces of a virtualmachineinstance.
+// When guestAgent is set only the addresses reported by the qemu guest agent are returned.
+func kubeVirtInterfaceIPs(vmi *unstructured.Unstructured, guestAgent bool) (ips []string) {
+	interfaces, _, _ := unstructured.NestedSlice(vmi.Object, "status", "interfaces")
+	for _, i := range interfaces {
+		iface, ok := i.(map[string]interface{})
+		if !ok {
+			continue
+		}
+		if guestAgent {
+			source, _, _ := unstructured.NestedString(iface, "infoSource")
+			if !strings.Contains(source, "guest-agent") {
+				continue
+			}
+		}
+		if ip, _, _ := unstructured.NestedString(iface, "ipAddress"); len(ip) > 0 {
+			ips = append(ips, ip)
+		}
+	}
+	return ips
+}
+
+// serviceEndpoint returns the load balancer address of a service, or its cluster ip
+func serviceEndpoint(svc *v1.Service) string {
+	for _, ingress := range svc.Status.LoadBalancer.Ingress {
+		if len(ingress.IP) > 0 {
+			return ingress.IP
+		}
+		if len(ingress.Hostname) > 0 {
+			return ingress.Hostname
+		}
+	}
+	if svc.Spec.ClusterIP != v1.ClusterIPNone {
+		return svc.Spec.ClusterIP
+	}
+	return ""
+}
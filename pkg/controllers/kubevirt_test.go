@@ -0,0 +1,114 @@
+package controllers
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	hfv1 "github.com/hobbyfarm/gargantua/pkg/apis/hobbyfarm.io/v1"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	clientgoscheme "k8s.io/client-go/kubernetes/scheme"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+)
+
+func TestKubeVirtProvisioning(t *testing.T) {
+	ctx := context.Background()
+	scheme := runtime.NewScheme()
+	if err := clientgoscheme.AddToScheme(scheme); err != nil {
+		t.Fatal(err)
+	}
+	if err := hfv1.AddToScheme(scheme); err != nil {
+		t.Fatal(err)
+	}
+	pubKey := "ssh-ed25519 AAAAC3NzaC1lZDI1NTE5AAAAIKubeVirtTestKey"
+	vm := &hfv1.VirtualMachine{
+		ObjectMeta: metav1.ObjectMeta{Name: "vm-test", Namespace: "hobbyfarm", Annotations: map[string]string{}},
+	}
+	keySecret := &v1.Secret{
+		ObjectMeta: metav1.ObjectMeta{Name: keySecretName(vm), Namespace: provisionNS},
+		Data:       map[string][]byte{"public_key": []byte(pubKey + "\n")},
+	}
+	env := &hfv1.Environment{Spec: hfv1.EnvironmentSpec{
+		TemplateMapping: map[string]map[string]string{"template-test": {
+			"image":     "quay.io/containerdisks/ubuntu:22.04",
+			"cloudInit": "#cloud-config\npackages: [git]\n",
+		}},
+	}}
+	vmTemplate := &hfv1.VirtualMachineTemplate{ObjectMeta: metav1.ObjectMeta{Name: "template-test"}}
+	key := types.NamespacedName{Name: vm.Name, Namespace: vm.Namespace}
+
+	// labels set by others on an existing virtualmachine are kept
+	existing := newUnstructured(kubeVirtVMGVK, vm.Name, vm.Namespace)
+	existing.SetLabels(map[string]string{"team": "a"})
+	r := &VirtualMachineReconciler{
+		Client: fake.NewClientBuilder().WithScheme(scheme).WithObjects(vm, existing, keySecret).Build(),
+		Log:    ctrl.Log.WithName("test"),
+		Scheme: scheme,
+	}
+	p := &kubeVirtProvider{r: r}
+	if err := p.CreateInstance(ctx, vm, env, vmTemplate); err != nil {
+		t.Fatal(err)
+	}
+
+	instance := newUnstructured(kubeVirtVMGVK, vm.Name, vm.Namespace)
+	if err := r.Get(ctx, key, instance); err != nil {
+		t.Fatal(err)
+	}
+	labels := instance.GetLabels()
+	if labels[vmLabel] != vm.Name || labels[vmNamespaceLabel] != vm.Namespace || labels["team"] != "a" {
+		t.Fatalf("expected the vm labels next to the existing ones, got %v", labels)
+	}
+	volumes, _, _ := unstructured.NestedSlice(instance.Object, "spec", "template", "spec", "volumes")
+	var userData string
+	for _, volume := range volumes {
+		userData, _, _ = unstructured.NestedString(volume.(map[string]interface{}), "cloudInitNoCloud", "userData")
+		if len(userData) > 0 {
+			break
+		}
+	}
+	if !strings.Contains(userData, pubKey) || !strings.Contains(userData, "- git") {
+		t.Fatalf("expected the vm key next to the template cloud-init, got %s", userData)
+	}
+
+	// the vm waits for the virtualmachine to be ready and its service to get an address
+	if _, provisioned, err := p.FetchStatus(ctx, vm); provisioned || err != nil {
+		t.Fatalf("expected the vm to wait for the kubevirt virtualmachine, got %v", err)
+	}
+	if err := unstructured.SetNestedField(instance.Object, true, "status", "ready"); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.Update(ctx, instance); err != nil {
+		t.Fatal(err)
+	}
+	vmi := newUnstructured(kubeVirtVMIGVK, vm.Name, vm.Namespace)
+	if err := unstructured.SetNestedSlice(vmi.Object, []interface{}{
+		map[string]interface{}{"name": kubeVirtDefaultNetwork, "ipAddress": "10.42.0.7"},
+	}, "status", "interfaces"); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.Create(ctx, vmi); err != nil {
+		t.Fatal(err)
+	}
+	svc := &v1.Service{}
+	if err := r.Get(ctx, key, svc); err != nil {
+		t.Fatal(err)
+	}
+	svc.Spec.ClusterIP = "10.43.0.9"
+	if err := r.Update(ctx, svc); err != nil {
+		t.Fatal(err)
+	}
+
+	status, provisioned, err := p.FetchStatus(ctx, vm)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !provisioned || status.PrivateIP != "10.42.0.7" || status.PublicIP != "10.43.0.9" ||
+		vm.Annotations["sshEndpoint"] != "10.43.0.9" {
+		t.Fatalf("expected the addresses of the virtualmachineinstance and service, got %+v", status)
+	}
+}
@@ -0,0 +1,200 @@
+package controllers
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	hfv1 "github.com/hobbyfarm/gargantua/pkg/apis/hobbyfarm.io/v1"
+	shimv1alpha1 "github.com/hobbyfarm/hf-shim-operator/pkg/api/v1alpha1"
+	"github.com/hobbyfarm/hf-shim-operator/pkg/statemachine"
+	"github.com/hobbyfarm/hf-shim-operator/pkg/utils"
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	ctrl "sigs.k8s.io/controller-runtime"
+)
+
+/*
+Info used from environment, running vms are never expired without one of the limits:
+max_lifetime (optional, go duration a vm may run for, e.g. 8h)
+idle_timeout (optional, go duration a vm claimed by a session may stay idle for, e.g. 1h)
+idle_check_command (optional, command run over ssh to detect if the vm is in use. it exits with 0 while somebody
+uses the vm, defaults to checking for logged in users)
+expiry_warning (optional, go duration before reaching a limit a warning is recorded, defaults to 15m)
+*/
+
+const (
+	maxLifetimeKey      = "max_lifetime"
+	idleTimeoutKey      = "idle_timeout"
+	idleCheckCommandKey = "idle_check_command"
+	expiryWarningKey    = "expiry_warning"
+
+	defaultIdleCheckCommand = "who | grep -q ."
+	defaultExpiryWarning    = 15 * time.Minute
+	// idleCheckInterval is how often vms with an idle_timeout are checked
+	idleCheckInterval = 5 * time.Minute
+)
+
+// enforceLifetime taints running vms which exceeded the max_lifetime or idle_timeout of their environment, so they
+// are deleted or recycled. vms about to exceed them are marked expiring, with a warning event. The ssh certificates
+// of running vms are renewed here as well.
+func (r *VirtualMachineReconciler) enforceLifetime(ctx context.Context, vm *hfv1.VirtualMachine,
+	vmp *shimv1alpha1.VirtualMachineProvisioning) (ctrl.Result, error) {
+	env, err := r.fetchEnvironment(ctx, vm.Status.EnvironmentId, vm.Namespace)
+	if err != nil {
+		return ctrl.Result{}, r.recordProvisioning(ctx, vm, vmp, nil, vm.Status.Status)
+	}
+	p, _ := r.provider(vmp.Status.Provider)
+	maxLifetime := r.lifetimeSetting(env, maxLifetimeKey, 0)
+	idleTimeout := r.lifetimeSetting(env, idleTimeoutKey, 0)
+	warning := r.lifetimeSetting(env, expiryWarningKey, defaultExpiryWarning)
+
+	now := metav1.Now()
+	var deadline time.Time
+	var reason, message string
+	var requeue time.Duration
+
+	timings := &vmp.Status.Timings
+	timings.ExpiresAt = nil
+	if maxLifetime > 0 {
+		// vms which were running before the timings existed are measured from their creation
+		started := vm.CreationTimestamp
+		if timings.RunningAt != nil {
+			started = *timings.RunningAt
+		}
+		expires := metav1.NewTime(started.Add(maxLifetime))
+		timings.ExpiresAt = &expires
+		deadline, reason, message = expires.Time, "MaxLifetimeExceeded", "vm exceeds its maximum lifetime of "+
+			maxLifetime.String()
+	}
+
+	// providers which can not run commands on their instances are marked invalid by checkFeatures instead
+	if idleTimeout > 0 && vm.Status.Allocated && runsCommands(p) {
+		requeue = idleCheckInterval
+		idle, err := r.idleCheck(ctx, vm, vmp, p, env.Spec.EnvironmentSpecifics[idleCheckCommandKey])
+		switch {
+		case err != nil:
+			r.providerEvent(ctx, vm, vmp.Status.Provider, v1.EventTypeWarning, "IdleCheckFailed",
+				"error checking if the %s instance is idle: %v", vmp.Status.Provider, err)
+		case !idle:
+			timings.IdleSince = nil
+		case timings.IdleSince == nil:
+			timings.IdleSince = &now
+		}
+		if timings.IdleSince != nil {
+			idleDeadline := timings.IdleSince.Add(idleTimeout)
+			if deadline.IsZero() || idleDeadline.Before(deadline) {
+				deadline, reason, message = idleDeadline, "IdleTimeout", "vm is idle for longer than "+
+					idleTimeout.String()
+			}
+		}
+	} else {
+		timings.IdleSince = nil
+	}
+
+	// certificates of vms are renewed while they run
+	renewIn, err := r.renewCertificate(ctx, vm, env)
+	if err != nil {
+		r.providerEvent(ctx, vm, vmp.Status.Provider, v1.EventTypeWarning, "CertificateRenewalFailed",
+			"error renewing the ssh certificate: %v", err)
+		renewIn = idleCheckInterval
+	}
+	if renewIn > 0 {
+		requeue = shorterRequeue(requeue, renewIn)
+	}
+
+	if deadline.IsZero() {
+		statemachine.ClearExpiring(&vmp.Status, now)
+		return ctrl.Result{RequeueAfter: requeue}, r.recordProvisioning(ctx, vm, vmp, nil, vm.Status.Status)
+	}
+	if !now.Time.Before(deadline) {
+		return ctrl.Result{}, r.expireVM(ctx, vm, vmp, reason, message)
+	}
+
+	warnAt := deadline.Add(-warning)
+	if now.Time.Before(warnAt) {
+		statemachine.ClearExpiring(&vmp.Status, now)
+		requeue = shorterRequeue(requeue, warnAt.Sub(now.Time))
+	} else {
+		if !meta.IsStatusConditionTrue(vmp.Status.Conditions, shimv1alpha1.ConditionExpiring) {
+			r.providerEvent(ctx, vm, vmp.Status.Provider, v1.EventTypeWarning, "Expiring",
+				"%s, it is tainted at %s", message, deadline.UTC().Format(time.RFC3339))
+		}
+		statemachine.SetExpiring(&vmp.Status, reason, message, now)
+		requeue = shorterRequeue(requeue, deadline.Sub(now.Time))
+	}
+	return ctrl.Result{RequeueAfter: requeue}, r.recordProvisioning(ctx, vm, vmp, nil, vm.Status.Status)
+}
+
+// idleCheck runs command on the instance of vm, reporting it idle when the command fails
+func (r *VirtualMachineReconciler) idleCheck(ctx context.Context, vm *hfv1.VirtualMachine,
+	vmp *shimv1alpha1.VirtualMachineProvisioning, p Provider, command string) (idle bool, err error) {
+	if len(command) == 0 {
+		command = defaultIdleCheckCommand
+	}
+	exitStatus, err := r.runSSHCommand(ctx, vm, vmp, p, command)
+	return exitStatus != 0, err
+}
+
+// runsCommands reports if p can run commands on its instances
+func runsCommands(p Provider) bool {
+	_, ok := p.(commandRunner)
+	return ok
+}
+
+// runSSHCommand runs command on the instance of vm through the commandRunner of its provider, and returns the exit
+// status of the command
+func (r *VirtualMachineReconciler) runSSHCommand(ctx context.Context, vm *hfv1.VirtualMachine,
+	vmp *shimv1alpha1.VirtualMachineProvisioning, p Provider, command string) (exitStatus int, err error) {
+	runner, ok := p.(commandRunner)
+	if !ok {
+		return exitStatus, fmt.Errorf("%s instances can not run commands over ssh", vmp.Status.Provider)
+	}
+	ok, err = runner.RunCommand(ctx, instanceVM(vm, vmp), command)
+	if status, failed := utils.ExitStatus(err); failed {
+		return status, nil
+	}
+	if err != nil {
+		return exitStatus, err
+	}
+	if !ok {
+		return 1, nil
+	}
+	return 0, nil
+}
+
+// expireVM taints vm, which deletes or recycles it on its next reconcile
+func (r *VirtualMachineReconciler) expireVM(ctx context.Context, vm *hfv1.VirtualMachine,
+	vmp *shimv1alpha1.VirtualMachineProvisioning, reason string, message string) error {
+	vm.Status.Tainted = true
+	if err := r.Status().Update(ctx, vm); err != nil {
+		return err
+	}
+	r.providerEvent(ctx, vm, vmp.Status.Provider, v1.EventTypeWarning, reason, "%s, tainting it", message)
+	statemachine.ClearExpiring(&vmp.Status, metav1.Now())
+	return r.recordProvisioning(ctx, vm, vmp, nil, vm.Status.Status)
+}
+
+// lifetimeSetting parses the duration key of the environment specifics, returning fallback when it is not set
+func (r *VirtualMachineReconciler) lifetimeSetting(env *hfv1.Environment, key string,
+	fallback time.Duration) time.Duration {
+	value, ok := env.Spec.EnvironmentSpecifics[key]
+	if !ok {
+		return fallback
+	}
+	d, err := time.ParseDuration(value)
+	if err != nil {
+		r.Log.Error(err, "invalid "+key+" in env spec", "environment", env.Name)
+		return fallback
+	}
+	return d
+}
+
+// shorterRequeue returns the shorter of two requeue delays, where 0 is no requeue
+func shorterRequeue(a time.Duration, b time.Duration) time.Duration {
+	if a == 0 || b < a {
+		return b
+	}
+	return a
+}
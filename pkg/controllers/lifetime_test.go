@@ -0,0 +1,170 @@
+package controllers
+
+import (
+	"testing"
+	"time"
+
+	hfv1 "github.com/hobbyfarm/gargantua/pkg/apis/hobbyfarm.io/v1"
+	shimv1alpha1 "github.com/hobbyfarm/hf-shim-operator/pkg/api/v1alpha1"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	ctrl "sigs.k8s.io/controller-runtime"
+)
+
+// runningVMWithLimits provisions the test vm in an environment with the lifetime limits in specifics
+func runningVMWithLimits(t *testing.T, specifics map[string]string) *harness {
+	p := newFakeProvider()
+	p.register()
+	h := newHarness(t, fakeProviderName, specifics, nil)
+	h.setLive(true)
+	h.step(secretCreated)
+	h.step(importKeyPairCreated)
+	h.step(hfv1.VmStatusProvisioned)
+	p.transition(testVMName, fakeInstanceProvisioned, "192.0.2.10")
+	h.step(hfv1.VmStatusRunning)
+	return h
+}
+
+// reconcileResult runs a single reconcile of the test vm and returns its result
+func (h *harness) reconcileResult() ctrl.Result {
+	h.t.Helper()
+	result, err := h.r.Reconcile(h.ctx, ctrl.Request{NamespacedName: h.key(testVMName)})
+	if err != nil {
+		h.t.Fatal(err)
+	}
+	return result
+}
+
+// setTimings replaces the provisioning timings of the test vm
+func (h *harness) setTimings(update func(timings *shimv1alpha1.Timings)) {
+	h.t.Helper()
+	vmp := h.provisioning()
+	update(&vmp.Status.Timings)
+	h.updateStatus(vmp)
+}
+
+func ago(d time.Duration) *metav1.Time {
+	t := metav1.NewTime(time.Now().Add(-d))
+	return &t
+}
+
+func TestMaxLifetime(t *testing.T) {
+	h := runningVMWithLimits(t, map[string]string{maxLifetimeKey: "1h", expiryWarningKey: "30m"})
+
+	result := h.reconcileResult()
+	if result.RequeueAfter <= 0 || result.RequeueAfter > 30*time.Minute {
+		t.Fatalf("expected a requeue at the warning, got %v", result.RequeueAfter)
+	}
+	vmp := h.provisioning()
+	if vmp.Status.Timings.ExpiresAt == nil ||
+		meta.IsStatusConditionTrue(vmp.Status.Conditions, shimv1alpha1.ConditionExpiring) {
+		t.Fatalf("expected the expiry to be recorded without warning, got %+v", vmp.Status)
+	}
+
+	h.setTimings(func(timings *shimv1alpha1.Timings) { timings.RunningAt = ago(40 * time.Minute) })
+	if result = h.reconcileResult(); result.RequeueAfter <= 0 || result.RequeueAfter > 20*time.Minute {
+		t.Fatalf("expected a requeue at the expiry, got %v", result.RequeueAfter)
+	}
+	h.expectEvent("Expiring")
+	if !meta.IsStatusConditionTrue(h.provisioning().Status.Conditions, shimv1alpha1.ConditionExpiring) {
+		t.Fatal("expected the vm to be marked expiring")
+	}
+
+	h.setTimings(func(timings *shimv1alpha1.Timings) { timings.RunningAt = ago(2 * time.Hour) })
+	h.reconcileResult()
+	h.expectEvent("MaxLifetimeExceeded")
+	if !h.vm().Status.Tainted {
+		t.Fatal("expected the expired vm to be tainted")
+	}
+	for i := 0; i < 2; i++ {
+		h.reconcileResult()
+	}
+	if !h.deleted() {
+		t.Fatal("expected the expired vm to be deleted")
+	}
+}
+
+func TestIdleTimeout(t *testing.T) {
+	h := runningVMWithLimits(t, map[string]string{idleTimeoutKey: "1h"})
+
+	// vms without a session are not checked
+	h.setLive(false)
+	h.reconcileResult()
+	if h.lastLivenessCall().command == defaultIdleCheckCommand {
+		t.Fatal("expected unclaimed vms not to be checked")
+	}
+
+	h.claim()
+	if result := h.reconcileResult(); result.RequeueAfter != idleCheckInterval {
+		t.Fatalf("expected the idle check to be repeated, got %v", result.RequeueAfter)
+	}
+	if call := h.lastLivenessCall(); call.command != defaultIdleCheckCommand || call.address != "192.0.2.10:22" {
+		t.Fatalf("expected the idle check to run on the instance, got %+v", call)
+	}
+	if h.provisioning().Status.Timings.IdleSince == nil {
+		t.Fatal("expected the vm to be found idle")
+	}
+
+	h.setLive(true)
+	h.reconcileResult()
+	if h.provisioning().Status.Timings.IdleSince != nil {
+		t.Fatal("expected the vm to be in use")
+	}
+
+	h.setLive(false)
+	h.setTimings(func(timings *shimv1alpha1.Timings) { timings.IdleSince = ago(50 * time.Minute) })
+	if result := h.reconcileResult(); result.RequeueAfter <= 0 || result.RequeueAfter > idleCheckInterval {
+		t.Fatalf("expected a requeue before the timeout, got %v", result.RequeueAfter)
+	}
+	h.expectEvent("Expiring")
+	if h.vm().Status.Tainted {
+		t.Fatal("expected the vm not to be tainted before the timeout")
+	}
+
+	h.setTimings(func(timings *shimv1alpha1.Timings) { timings.IdleSince = ago(2 * time.Hour) })
+	h.reconcileResult()
+	h.expectEvent("IdleTimeout")
+	if !h.vm().Status.Tainted {
+		t.Fatal("expected the idle vm to be tainted")
+	}
+}
+
+// commandlessFakeProvider is the fake provider without support for running commands on its instances
+type commandlessFakeProvider struct {
+	Provider
+}
+
+func TestIdleTimeoutUnsupported(t *testing.T) {
+	p := newFakeProvider()
+	RegisterProvider(fakeProviderName, func(r *VirtualMachineReconciler) Provider {
+		p.Lock()
+		defer p.Unlock()
+		p.r = r
+		return commandlessFakeProvider{p}
+	})
+	h := newHarness(t, fakeProviderName, map[string]string{idleTimeoutKey: "1h"}, nil)
+	h.setLive(true)
+	// the idle_timeout is rejected as soon as the vm is provisioned
+	h.step(secretCreated)
+	h.expectEvent("IdleCheckUnsupported")
+	condition := meta.FindStatusCondition(h.provisioning().Status.Conditions, shimv1alpha1.ConditionInvalidConfig)
+	if condition == nil || condition.Status != metav1.ConditionTrue || condition.Reason != "IdleCheckUnsupported" {
+		t.Fatalf("expected the invalid config condition, got %+v", condition)
+	}
+	h.step(importKeyPairCreated)
+	h.step(hfv1.VmStatusProvisioned)
+	p.transition(testVMName, fakeInstanceProvisioned, "192.0.2.10")
+	h.step(hfv1.VmStatusRunning)
+
+	h.claim()
+	h.setLive(false)
+	if result := h.reconcileResult(); result.RequeueAfter != 0 {
+		t.Fatalf("expected no idle checks, got a requeue after %v", result.RequeueAfter)
+	}
+	if call := h.lastLivenessCall(); call.command == defaultIdleCheckCommand {
+		t.Fatal("expected the idle check to be skipped")
+	}
+	if h.provisioning().Status.Timings.IdleSince != nil || h.vm().Status.Tainted {
+		t.Fatal("expected the vm not to be found idle")
+	}
+}
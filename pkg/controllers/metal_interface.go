@@ -2,19 +2,22 @@ package controllers
 
 import (
 	"context"
-	b64 "encoding/base64"
 	"fmt"
 	"gopkg.in/yaml.v2"
 	"strings"
+	"time"
 
-	"github.com/hobbyfarm/hf-shim-operator/pkg/utils"
 	v1 "k8s.io/api/core/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
 	"sigs.k8s.io/controller-runtime/pkg/controller/controllerutil"
 
 	hfv1 "github.com/hobbyfarm/gargantua/pkg/apis/hobbyfarm.io/v1"
+	shimv1alpha1 "github.com/hobbyfarm/hf-shim-operator/pkg/api/v1alpha1"
 	equinixv1alpha1 "github.com/hobbyfarm/metal-operator/pkg/api/v1alpha1"
+	"github.com/hobbyfarm/metal-operator/pkg/metal"
+	"github.com/packethost/packngo"
 )
 
 /*
@@ -32,8 +35,144 @@ const (
 	defaultPassword   = "welcome2harvester"
 	defaultToken      = "token4harvester"
 	addressAnnotation = "elasticIP"
+	// reinstallRequestedAnnotation records on the VirtualMachineProvisioning when the device of a recycled vm was
+	// asked to be reinstalled, before the reinstall is sent to the metal api
+	reinstallRequestedAnnotation = "shim.hobbyfarm.io/reinstall-requested"
+	// reinstallStartedAnnotation marks VirtualMachineProvisionings whose device left the active state to reinstall
+	reinstallStartedAnnotation = "shim.hobbyfarm.io/reinstall-started"
+	// deviceStateActive is the state of equinix devices which are up
+	deviceStateActive = "active"
 )
 
+func init() {
+	RegisterProvider("equinix", func(r *VirtualMachineReconciler) Provider {
+		return &equinixProvider{r: r}
+	})
+}
+
+// equinixProvider launches VMs as metal-operator Instances
+type equinixProvider struct {
+	r *VirtualMachineReconciler
+	// devices returns the device api of the equinix project of instance, defaults to the metal api client of the
+	// credentials of instance
+	devices func(ctx context.Context, instance *equinixv1alpha1.Instance) (packngo.DeviceService, error)
+}
+
+func (p *equinixProvider) ImportKeyPair(ctx context.Context, vm *hfv1.VirtualMachine, env *hfv1.Environment,
+	pubKey string) (*hfv1.VirtualMachineStatus, error) {
+	if err := checkKeyType("equinix", pubKey); err != nil {
+		return vm.Status.DeepCopy(), err
+	}
+	return p.r.createEquinixImportKeyPair(ctx, vm, env, pubKey)
+}
+
+func (p *equinixProvider) CreateInstance(ctx context.Context, vm *hfv1.VirtualMachine, env *hfv1.Environment,
+	vmTemplate *hfv1.VirtualMachineTemplate) error {
+	return p.r.createEquinixInstance(ctx, vm, env, vmTemplate)
+}
+
+func (p *equinixProvider) FetchStatus(ctx context.Context, vm *hfv1.VirtualMachine) (*hfv1.VirtualMachineStatus, bool, error) {
+	return p.r.fetchEquinixInstance(ctx, vm)
+}
+
+// LivenessCheck is a no-op for equinix, the instance is reachable over the SOS console as soon as it is active
+func (p *equinixProvider) LivenessCheck(ctx context.Context, vm *hfv1.VirtualMachine) (bool, error) {
+	return true, nil
+}
+
+func (p *equinixProvider) Teardown(ctx context.Context, vm *hfv1.VirtualMachine) (bool, error) {
+	return p.r.deleteChildren(ctx, p.children(vm)...)
+}
+
+// Recycle reinstalls the equinix device through the metal api with the credentials of the Instance, which boots it
+// again from its ipxe script and user data. The reinstall is recorded on vmp before it is sent, so it is sent again
+// only while the device was not updated since, and the device counts as reinstalled once it left the active state
+// and is active again. The ImportKeyPair is then deleted, so the rotated key is imported into the project before
+// the Instance is updated by CreateInstance.
+func (p *equinixProvider) Recycle(ctx context.Context, vm *hfv1.VirtualMachine,
+	vmp *shimv1alpha1.VirtualMachineProvisioning) (bool, error) {
+	instance := &equinixv1alpha1.Instance{}
+	if err := p.r.Get(ctx, types.NamespacedName{Name: vm.Name, Namespace: vm.Namespace}, instance); err != nil {
+		return false, err
+	}
+	if len(instance.Status.InstanceID) == 0 {
+		return false, fmt.Errorf("equinix instance %s has no device id yet", instance.Name)
+	}
+	devices := p.devices
+	if devices == nil {
+		devices = p.metalDevices
+	}
+	deviceService, err := devices(ctx, instance)
+	if err != nil {
+		return false, err
+	}
+	device, _, err := deviceService.Get(instance.Status.InstanceID, nil)
+	if err != nil {
+		return false, err
+	}
+
+	if vmp.Annotations == nil {
+		vmp.Annotations = make(map[string]string)
+	}
+	requested, ok := vmp.Annotations[reinstallRequestedAnnotation]
+	if !ok {
+		requested = time.Now().UTC().Format(time.RFC3339)
+		vmp.Annotations[reinstallRequestedAnnotation] = requested
+		if err = p.r.Update(ctx, vmp); err != nil {
+			return false, err
+		}
+	}
+	requestedAt, err := time.Parse(time.RFC3339, requested)
+	if err != nil {
+		return false, fmt.Errorf("invalid %s annotation: %v", reinstallRequestedAnnotation, err)
+	}
+
+	_, started := vmp.Annotations[reinstallStartedAnnotation]
+	switch {
+	case !started && device.State == deviceStateActive:
+		// devices updated after the request accepted the reinstall and are about to leave the active state
+		if updated, err := time.Parse(time.RFC3339, device.Updated); err == nil && updated.After(requestedAt) {
+			return false, nil
+		}
+		_, err = deviceService.Reinstall(device.ID, &packngo.DeviceReinstallFields{
+			DeprovisionFast: true,
+		})
+		return false, err
+	case !started:
+		vmp.Annotations[reinstallStartedAnnotation] = "true"
+		return false, p.r.Update(ctx, vmp)
+	case device.State != deviceStateActive || device.Locked:
+		return false, nil
+	}
+
+	gone, err := p.r.deleteChildren(ctx, &equinixv1alpha1.ImportKeyPair{
+		ObjectMeta: metav1.ObjectMeta{Name: vm.Name, Namespace: vm.Namespace},
+	})
+	if err != nil || !gone {
+		return false, err
+	}
+	delete(vmp.Annotations, reinstallRequestedAnnotation)
+	delete(vmp.Annotations, reinstallStartedAnnotation)
+	return true, p.r.Update(ctx, vmp)
+}
+
+// metalDevices returns the device api of the metal api client of the credentials of instance
+func (p *equinixProvider) metalDevices(ctx context.Context,
+	instance *equinixv1alpha1.Instance) (packngo.DeviceService, error) {
+	metalClient, err := metal.NewClient(ctx, p.r.Client, instance.Spec.Secret, instance.Namespace)
+	if err != nil {
+		return nil, err
+	}
+	return metalClient.Devices, nil
+}
+
+func (p *equinixProvider) children(vm *hfv1.VirtualMachine) []client.Object {
+	return []client.Object{
+		&equinixv1alpha1.Instance{ObjectMeta: metav1.ObjectMeta{Name: vm.Name, Namespace: vm.Namespace}},
+		&equinixv1alpha1.ImportKeyPair{ObjectMeta: metav1.ObjectMeta{Name: vm.Name, Namespace: vm.Namespace}},
+	}
+}
+
 // createEquinixImportKeyPair will create the ssh key pair in the project
 func (r *VirtualMachineReconciler) createEquinixImportKeyPair(ctx context.Context, vm *hfv1.VirtualMachine,
 	env *hfv1.Environment, pubKey string) (status *hfv1.VirtualMachineStatus, err error) {
@@ -56,6 +195,7 @@ func (r *VirtualMachineReconciler) createEquinixImportKeyPair(ctx context.Contex
 	}
 
 	if _, err = controllerutil.CreateOrUpdate(ctx, r.Client, keyPair, func() error {
+		setVMLabels(keyPair, vm)
 		keyPair.Spec.Key = pubKey
 		keyPair.Spec.Secret = credSecret
 
@@ -69,7 +209,6 @@ func (r *VirtualMachineReconciler) createEquinixImportKeyPair(ctx context.Contex
 		return status, err
 	}
 
-	vm.Annotations["importKeyPair"] = keyPair.Name
 	status.Status = importKeyPairCreated
 	return status, nil
 }
@@ -102,16 +241,12 @@ func (r *VirtualMachineReconciler) createEquinixInstance(ctx context.Context, vm
 		},
 	}
 
-	instanceType, ok := env.Spec.TemplateMapping[vmTemplate.Name]["instanceType"]
-	if !ok {
-		instanceType = defaultEquinixInstanceType
-	}
+	instanceType := templateInstanceType(env, vmTemplate.Name)
 
 	isoURL, ok := env.Spec.EnvironmentSpecifics["iso_url"]
 	if !ok {
 		return fmt.Errorf("no iso_url found in env spec")
 	}
-	vm.Annotations[instanceTypeAnnotation] = instanceType
 	vm.Annotations["isoURL"] = isoURL
 
 	if instance.Annotations == nil {
@@ -138,7 +273,7 @@ func (r *VirtualMachineReconciler) createEquinixInstance(ctx context.Context, vm
 	}
 
 	equinixKeyPair := &equinixv1alpha1.ImportKeyPair{}
-	err = r.Get(ctx, types.NamespacedName{Namespace: vm.Namespace, Name: vm.Annotations["importKeyPair"]}, equinixKeyPair)
+	err = r.Get(ctx, types.NamespacedName{Namespace: vm.Namespace, Name: vm.Name}, equinixKeyPair)
 	if err != nil {
 		return err
 	}
@@ -148,6 +283,7 @@ func (r *VirtualMachineReconciler) createEquinixInstance(ctx context.Context, vm
 	}
 
 	if _, err = controllerutil.CreateOrUpdate(ctx, r.Client, instance, func() error {
+		setVMLabels(instance, vm)
 		instance.Spec.Metro = metro
 		instance.Spec.Secret = credSecret
 		instance.Spec.OperatingSystem = "custom_ipxe"
@@ -163,6 +299,7 @@ func (r *VirtualMachineReconciler) createEquinixInstance(ctx context.Context, vm
 		}
 		return nil
 	}); err != nil {
+		childCreateErrors.WithLabelValues("equinix", "Instance").Inc()
 		r.Log.Error(fmt.Errorf("error creating instance "), instance.Name)
 		return err
 	}
@@ -170,23 +307,25 @@ func (r *VirtualMachineReconciler) createEquinixInstance(ctx context.Context, vm
 }
 
 func (r *VirtualMachineReconciler) fetchEquinixInstance(ctx context.Context,
-	vm *hfv1.VirtualMachine) (status *hfv1.VirtualMachineStatus, err error) {
+	vm *hfv1.VirtualMachine) (status *hfv1.VirtualMachineStatus, provisioned bool, err error) {
 	status = vm.Status.DeepCopy()
 	instance := &equinixv1alpha1.Instance{}
 	err = r.Get(ctx, types.NamespacedName{Name: vm.Name, Namespace: vm.Namespace}, instance)
 	if err != nil {
 		r.Log.Error(fmt.Errorf("error fetching equinix instance: "), vm.Name)
-		return status, err
+		return status, false, err
 	}
 
 	// Additional step since we need vip info before the actual userData can be generated.
 	if instance.Status.Status == "elasticipcreated" {
 		err = r.patchEquinixInstance(ctx, vm, instance)
-		if err == nil {
-			// set a custom error to trigger a reconcile and force waiting on ssh being ready
-			err = fmt.Errorf("equinix instance patched. waiting for it to be ready")
+		if err != nil {
+			r.providerEvent(ctx, vm, "equinix", v1.EventTypeWarning, "InstancePatchFailed",
+				"error patching equinix instance with its elastic ip: %v", err)
+			return status, false, err
 		}
-		return status, err
+		// requeue to wait for the patched instance to come up
+		return status, false, errVMNotRunning
 	}
 
 	if len(instance.Status.PublicIP) > 0 {
@@ -204,35 +343,11 @@ func (r *VirtualMachineReconciler) fetchEquinixInstance(ctx context.Context,
 	if instance.Status.Status == "active" {
 		// additional update for vm object to make it possible to ssh into instance
 		vm.Spec.SshUsername = instance.Status.InstanceID
-		status.Status = hfv1.VmStatusRunning
 		vm.Annotations["sshEndpoint"] = fmt.Sprintf("sos.%s.platformequinix.com", instance.Status.Facility)
-
+		provisioned = true
 	}
 
-	if status.Status != hfv1.VmStatusRunning {
-		return status, fmt.Errorf("VM still not running")
-	}
-	return status, err
-}
-
-func (r *VirtualMachineReconciler) equinixLivenessCheck(ctx context.Context, vm *hfv1.VirtualMachine,
-	instance *equinixv1alpha1.Instance) (ready bool, err error) {
-	keySecret := &v1.Secret{}
-	var username, address string
-	err = r.Get(ctx, types.NamespacedName{Name: vm.Spec.KeyPair, Namespace: vm.Namespace}, keySecret)
-	if err != nil {
-		return ready, err
-	}
-	username = instance.Status.InstanceID
-	privKey, ok := keySecret.Data["private_key"]
-	if !ok {
-		return ready, fmt.Errorf("private_key not found in secret %s", keySecret.Name)
-	}
-	encodeKey := b64.StdEncoding.EncodeToString(privKey)
-	address = fmt.Sprintf("sos.%s.platformequinix.com:22", instance.Status.Facility)
-	vm.Annotations["sshEndpoint"] = fmt.Sprintf("sos.%s.platformequinix.com", instance.Status.Facility)
-	ready, err = utils.PerformLivenessCheck(address, username, encodeKey, "help")
-	return ready, err
+	return status, provisioned, nil
 }
 
 func (r *VirtualMachineReconciler) patchEquinixInstance(ctx context.Context, vm *hfv1.VirtualMachine, instance *equinixv1alpha1.Instance) error {
@@ -254,6 +369,8 @@ func (r *VirtualMachineReconciler) patchEquinixInstance(ctx context.Context, vm
 		return err
 	}
 
+	r.providerEvent(ctx, vm, "equinix", v1.EventTypeNormal, "InstancePatched",
+		"equinix instance patched with the cloud-init of elastic ip %s", vip)
 	return nil
 }
 
@@ -0,0 +1,134 @@
+package controllers
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	equinixv1alpha1 "github.com/hobbyfarm/metal-operator/pkg/api/v1alpha1"
+	"github.com/packethost/packngo"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// fakeDevices is the equinix device api of a single device, which is reinstalled without leaving the active state
+// until the test moves it along
+type fakeDevices struct {
+	packngo.DeviceService
+	device     packngo.Device
+	reinstalls int
+}
+
+func (d *fakeDevices) Get(id string, opts *packngo.GetOptions) (*packngo.Device, *packngo.Response, error) {
+	device := d.device
+	return &device, nil, nil
+}
+
+func (d *fakeDevices) Reinstall(id string, fields *packngo.DeviceReinstallFields) (*packngo.Response, error) {
+	d.reinstalls++
+	d.device.Updated = time.Now().Add(time.Minute).UTC().Format(time.RFC3339)
+	return nil, nil
+}
+
+// newEquinixRecycle returns the equinix provider of a provisioned test vm, whose device is active
+func newEquinixRecycle(t *testing.T) (*harness, *equinixProvider, *fakeDevices) {
+	p := newFakeProvider()
+	p.register()
+	h := newHarness(t, fakeProviderName, nil, nil)
+	h.step(secretCreated)
+	instance := &equinixv1alpha1.Instance{
+		ObjectMeta: metav1.ObjectMeta{Name: testVMName, Namespace: provisionNS},
+		Status:     equinixv1alpha1.InstanceStatus{InstanceID: "device-test"},
+	}
+	if err := h.r.Create(h.ctx, instance); err != nil {
+		t.Fatal(err)
+	}
+	keyPair := &equinixv1alpha1.ImportKeyPair{ObjectMeta: metav1.ObjectMeta{Name: testVMName, Namespace: provisionNS}}
+	if err := h.r.Create(h.ctx, keyPair); err != nil {
+		t.Fatal(err)
+	}
+
+	devices := &fakeDevices{device: packngo.Device{
+		ID:      "device-test",
+		State:   deviceStateActive,
+		Updated: time.Now().Add(-time.Hour).UTC().Format(time.RFC3339),
+	}}
+	ep := &equinixProvider{r: h.r, devices: func(ctx context.Context,
+		instance *equinixv1alpha1.Instance) (packngo.DeviceService, error) {
+		return devices, nil
+	}}
+	return h, ep, devices
+}
+
+// recycle runs one recycle step of the equinix provider on the test vm
+func (h *harness) recycle(ep *equinixProvider) bool {
+	h.t.Helper()
+	done, err := ep.Recycle(h.ctx, h.vm(), h.provisioning())
+	if err != nil {
+		h.t.Fatal(err)
+	}
+	return done
+}
+
+func TestEquinixRecycle(t *testing.T) {
+	h, ep, devices := newEquinixRecycle(t)
+
+	if h.recycle(ep) || devices.reinstalls != 1 {
+		t.Fatalf("expected the device to be reinstalled once, got %d reinstalls", devices.reinstalls)
+	}
+	if _, ok := h.provisioning().Annotations[reinstallRequestedAnnotation]; !ok {
+		t.Fatal("expected the reinstall to be recorded")
+	}
+	// the device accepted the reinstall, but did not leave the active state yet
+	if h.recycle(ep) || devices.reinstalls != 1 {
+		t.Fatalf("expected the active device to wait for the reinstall, got %d reinstalls", devices.reinstalls)
+	}
+
+	devices.device.State = "reinstalling"
+	devices.device.Locked = true
+	if h.recycle(ep) {
+		t.Fatal("expected the reinstalling device to wait")
+	}
+	devices.device.State = deviceStateActive
+	if h.recycle(ep) {
+		t.Fatal("expected the locked device to wait")
+	}
+	devices.device.Locked = false
+	done := false
+	for i := 0; i < 2 && !done; i++ {
+		done = h.recycle(ep)
+	}
+	if !done || devices.reinstalls != 1 {
+		t.Fatalf("expected the device to be reinstalled once, got %d reinstalls", devices.reinstalls)
+	}
+	keyPair := &equinixv1alpha1.ImportKeyPair{}
+	if err := h.r.Get(h.ctx, h.key(testVMName), keyPair); !errors.IsNotFound(err) {
+		t.Fatalf("expected the keypair to be deleted, got %v", err)
+	}
+	vmp := h.provisioning()
+	if _, ok := vmp.Annotations[reinstallRequestedAnnotation]; ok {
+		t.Fatalf("expected the reinstall annotations to be removed, got %v", vmp.Annotations)
+	}
+	if _, ok := vmp.Annotations[reinstallStartedAnnotation]; ok {
+		t.Fatalf("expected the reinstall annotations to be removed, got %v", vmp.Annotations)
+	}
+}
+
+func TestEquinixRecycleRecordsIntentFirst(t *testing.T) {
+	h, ep, devices := newEquinixRecycle(t)
+	vmp := h.provisioning()
+	if err := h.r.Update(h.ctx, h.provisioning()); err != nil {
+		t.Fatal(err)
+	}
+
+	// vmp is outdated by the update, the device must not be reinstalled without the reinstall being recorded
+	if _, err := ep.Recycle(h.ctx, h.vm(), vmp); !errors.IsConflict(err) {
+		t.Fatalf("expected a conflict, got %v", err)
+	}
+	if devices.reinstalls != 0 {
+		t.Fatalf("expected no reinstall, got %d", devices.reinstalls)
+	}
+	if h.recycle(ep) || devices.reinstalls != 1 {
+		t.Fatalf("expected the device to be reinstalled once, got %d reinstalls", devices.reinstalls)
+	}
+}
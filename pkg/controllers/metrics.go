@@ -0,0 +1,146 @@
+package controllers
+
+import (
+	"context"
+	"time"
+
+	hfv1 "github.com/hobbyfarm/gargantua/pkg/apis/hobbyfarm.io/v1"
+	shimv1alpha1 "github.com/hobbyfarm/hf-shim-operator/pkg/api/v1alpha1"
+	"github.com/prometheus/client_golang/prometheus"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/metrics"
+)
+
+// provisioningBuckets range from 15 seconds to a little over two hours
+var provisioningBuckets = prometheus.ExponentialBuckets(15, 2, 10)
+
+// metrics are served on the controller-runtime metrics endpoint, next to the controller metrics
+var (
+	orphanedResources = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "hf_shim_orphaned_resources",
+		Help: "Provider resources without a VirtualMachine found by the last reaper sweep",
+	}, []string{"provider", "kind", "reason"})
+
+	reapedResources = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "hf_shim_reaped_resources_total",
+		Help: "Orphaned provider resources deleted by the reaper",
+	}, []string{"provider", "kind"})
+
+	reaperErrors = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "hf_shim_reaper_errors_total",
+		Help: "Errors listing, checking or deleting resources during reaper sweeps",
+	})
+
+	reaperLastSweep = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "hf_shim_reaper_last_sweep_timestamp_seconds",
+		Help: "Time the last reaper sweep finished",
+	})
+
+	timeToRunning = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "hf_shim_time_to_running_seconds",
+		Help:    "Time from the start of provisioning until a VirtualMachine passed its liveness check",
+		Buckets: provisioningBuckets,
+	}, []string{"provider", "environment", "template"})
+
+	phaseDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "hf_shim_phase_duration_seconds",
+		Help:    "Time VirtualMachines spent in a provisioning phase before moving on",
+		Buckets: provisioningBuckets,
+	}, []string{"provider", "phase"})
+
+	livenessChecks = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "hf_shim_liveness_checks_total",
+		Help: "Liveness checks run against provisioned instances",
+	}, []string{"provider"})
+
+	livenessCheckFailures = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "hf_shim_liveness_check_failures_total",
+		Help: "Liveness checks which did not find the instance ready",
+	}, []string{"provider"})
+
+	childCreateErrors = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "hf_shim_child_create_errors_total",
+		Help: "Errors creating or updating provider resources of a VirtualMachine",
+	}, []string{"provider", "kind"})
+
+	warmPoolInstances = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "hf_shim_warm_pool_instances",
+		Help: "Running warm pool instances waiting to be claimed, as of the last refill",
+	}, []string{"environment", "template"})
+
+	virtualMachinesDesc = prometheus.NewDesc("hf_shim_virtual_machines",
+		"VirtualMachines per provider and provisioning phase", []string{"provider", "phase"}, nil)
+)
+
+func init() {
+	metrics.Registry.MustRegister(orphanedResources, reapedResources, reaperErrors, reaperLastSweep,
+		timeToRunning, phaseDuration, livenessChecks, livenessCheckFailures, childCreateErrors, warmPoolInstances)
+}
+
+// observeTimeToRunning records how long vm took to become running, counting from the start of its first
+// provisioning attempt
+func observeTimeToRunning(vm *hfv1.VirtualMachine, vmp *shimv1alpha1.VirtualMachineProvisioning, now time.Time) {
+	started := vm.CreationTimestamp.Time
+	if vmp.Status.Timings.StartedAt != nil {
+		started = vmp.Status.Timings.StartedAt.Time
+	}
+	if started.IsZero() {
+		return
+	}
+	timeToRunning.WithLabelValues(vmp.Status.Provider, vm.Status.EnvironmentId,
+		vm.Spec.VirtualMachineTemplateId).Observe(now.Sub(started).Seconds())
+}
+
+// observePhaseDuration records the time status spent in its current phase, before it moves on at now
+func observePhaseDuration(status *shimv1alpha1.VirtualMachineProvisioningStatus, now time.Time) {
+	if len(status.Phase) == 0 || len(status.History) == 0 {
+		return
+	}
+	entered := status.History[len(status.History)-1]
+	if entered.To != status.Phase {
+		return
+	}
+	phaseDuration.WithLabelValues(status.Provider, string(status.Phase)).Observe(now.Sub(entered.Time.Time).Seconds())
+}
+
+// registerProvisioningCollector publishes the number of VirtualMachines per phase, as read from reader
+func registerProvisioningCollector(reader client.Reader) error {
+	err := metrics.Registry.Register(provisioningCollector{reader})
+	if _, ok := err.(prometheus.AlreadyRegisteredError); ok {
+		return nil
+	}
+	return err
+}
+
+// provisioningCollector counts the VirtualMachineProvisionings in each phase whenever metrics are scraped
+type provisioningCollector struct {
+	client.Reader
+}
+
+func (c provisioningCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- virtualMachinesDesc
+}
+
+func (c provisioningCollector) Collect(ch chan<- prometheus.Metric) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	vmps := &shimv1alpha1.VirtualMachineProvisioningList{}
+	if err := c.List(ctx, vmps); err != nil {
+		ch <- prometheus.NewInvalidMetric(virtualMachinesDesc, err)
+		return
+	}
+	type key struct{ provider, phase string }
+	counts := make(map[key]int)
+	for _, vmp := range vmps.Items {
+		phase := vmp.Status.Phase
+		if len(phase) == 0 {
+			phase = shimv1alpha1.PhasePending
+		}
+		counts[key{vmp.Status.Provider, string(phase)}]++
+	}
+	for k, count := range counts {
+		ch <- prometheus.MustNewConstMetric(virtualMachinesDesc, prometheus.GaugeValue, float64(count),
+			k.provider, k.phase)
+	}
+}
@@ -0,0 +1,89 @@
+package controllers
+
+import (
+	"strings"
+	"testing"
+
+	hfv1 "github.com/hobbyfarm/gargantua/pkg/apis/hobbyfarm.io/v1"
+	shimv1alpha1 "github.com/hobbyfarm/hf-shim-operator/pkg/api/v1alpha1"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	dto "github.com/prometheus/client_model/go"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+)
+
+// sampleCount returns the number of observations of a histogram
+func sampleCount(t *testing.T, observer prometheus.Observer) uint64 {
+	t.Helper()
+	m := &dto.Metric{}
+	if err := observer.(prometheus.Histogram).Write(m); err != nil {
+		t.Fatal(err)
+	}
+	return m.GetHistogram().GetSampleCount()
+}
+
+func TestProvisioningMetrics(t *testing.T) {
+	checks := testutil.ToFloat64(livenessChecks.WithLabelValues(fakeProviderName))
+	failures := testutil.ToFloat64(livenessCheckFailures.WithLabelValues(fakeProviderName))
+	provisioned := sampleCount(t, phaseDuration.WithLabelValues(fakeProviderName,
+		string(shimv1alpha1.PhaseProvisioned)))
+
+	p := newFakeProvider()
+	p.register()
+	h := newHarness(t, fakeProviderName, nil, nil)
+	vm := h.vm()
+	running := timeToRunning.WithLabelValues(fakeProviderName, vm.Status.EnvironmentId,
+		vm.Spec.VirtualMachineTemplateId)
+	ran := sampleCount(t, running)
+
+	h.step(secretCreated)
+	h.step(importKeyPairCreated)
+	h.step(hfv1.VmStatusProvisioned)
+	p.transition(testVMName, fakeInstanceProvisioned, "192.0.2.10")
+	if err := h.reconcile(); err == nil {
+		t.Fatal("expected the vm failing its liveness check to requeue")
+	}
+	h.setLive(true)
+	h.step(hfv1.VmStatusRunning)
+
+	if got := testutil.ToFloat64(livenessChecks.WithLabelValues(fakeProviderName)) - checks; got != 2 {
+		t.Fatalf("expected 2 liveness checks, got %v", got)
+	}
+	if got := testutil.ToFloat64(livenessCheckFailures.WithLabelValues(fakeProviderName)) - failures; got != 1 {
+		t.Fatalf("expected 1 liveness check failure, got %v", got)
+	}
+	if got := sampleCount(t, running) - ran; got != 1 {
+		t.Fatalf("expected 1 time to running observation, got %d", got)
+	}
+	if got := sampleCount(t, phaseDuration.WithLabelValues(fakeProviderName,
+		string(shimv1alpha1.PhaseProvisioned))) - provisioned; got != 1 {
+		t.Fatalf("expected 1 provisioned phase duration observation, got %d", got)
+	}
+}
+
+func TestProvisioningCollector(t *testing.T) {
+	vmp := func(name string, provider string, phase shimv1alpha1.Phase) *shimv1alpha1.VirtualMachineProvisioning {
+		return &shimv1alpha1.VirtualMachineProvisioning{
+			ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: provisionNS},
+			Status:     shimv1alpha1.VirtualMachineProvisioningStatus{Provider: provider, Phase: phase},
+		}
+	}
+	c := fake.NewClientBuilder().WithScheme(testScheme(t)).WithObjects(
+		vmp("vm-1", "aws", shimv1alpha1.PhaseRunning),
+		vmp("vm-2", "aws", shimv1alpha1.PhaseRunning),
+		vmp("vm-3", "aws", shimv1alpha1.PhaseProvisioned),
+		vmp("vm-4", "", ""),
+	).Build()
+
+	expected := `
+# HELP hf_shim_virtual_machines VirtualMachines per provider and provisioning phase
+# TYPE hf_shim_virtual_machines gauge
+hf_shim_virtual_machines{phase="Pending",provider=""} 1
+hf_shim_virtual_machines{phase="Provisioned",provider="aws"} 1
+hf_shim_virtual_machines{phase="Running",provider="aws"} 2
+`
+	if err := testutil.CollectAndCompare(provisioningCollector{c}, strings.NewReader(expected)); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,246 @@
+package controllers
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	hfv1 "github.com/hobbyfarm/gargantua/pkg/apis/hobbyfarm.io/v1"
+	shimv1alpha1 "github.com/hobbyfarm/hf-shim-operator/pkg/api/v1alpha1"
+	"github.com/hobbyfarm/hf-shim-operator/pkg/utils"
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/util/retry"
+)
+
+/*
+Info used from environment:
+phone_home (optional, "true" to wait for the instance to call the phone home endpoint of the shim once cloud-init
+finished, in addition to the liveness check. "only" replaces the liveness check, for instances the shim can not
+reach over ssh. needs --phone-home-url and is supported by the aws, digitalocean, kubevirt and harvester providers,
+which launch instances with cloud-init)
+*/
+
+const (
+	phoneHomeKey = "phone_home"
+	// phoneHomeOnly is the phone_home mode replacing the liveness check
+	phoneHomeOnly = "only"
+
+	// phoneHomePath is the path of the phone home endpoint, followed by the namespace, name and token of the vm
+	phoneHomePath = "/phone-home/"
+	// phoneHomeTokenKey holds the one-time token of the vm in its keypair secret, until the instance phoned home
+	phoneHomeTokenKey = "phone_home_token"
+	// hostKeysKey holds the ssh host keys the instance reported in its keypair secret, one per line
+	hostKeysKey = "host_keys"
+)
+
+// phoneHomeProviders are the providers injecting the phone home call into the cloud-init of their instances
+var phoneHomeProviders = map[string]bool{
+	"aws":          true,
+	"digitalocean": true,
+	"kubevirt":     true,
+	"harvester":    true,
+}
+
+// hostKeyFields are the fields cloud-init posts the ssh host keys of the instance in
+var hostKeyFields = []string{"pub_key_rsa", "pub_key_ecdsa", "pub_key_ed25519"}
+
+// phoneHomeMode returns the phone_home mode of env, which is empty when its provider does not phone home
+func (r *VirtualMachineReconciler) phoneHomeMode(env *hfv1.Environment) string {
+	mode := env.Spec.EnvironmentSpecifics[phoneHomeKey]
+	if mode != "true" && mode != phoneHomeOnly {
+		return ""
+	}
+	if !phoneHomeProviders[env.Spec.Provider] {
+		r.Log.Info("provider does not support phone_home, ignoring it", "environment", env.Name,
+			"provider", env.Spec.Provider)
+		return ""
+	}
+	return mode
+}
+
+// addPhoneHome makes cloudConfig call the phone home endpoint with the one-time token of vm, which is kept in
+// the keypair secret of vm until the instance phoned home. A token is only generated when vm has none yet.
+// cloudConfig is unchanged when env does not phone home.
+func (r *VirtualMachineReconciler) addPhoneHome(ctx context.Context, vm *hfv1.VirtualMachine, env *hfv1.Environment,
+	cloudConfig utils.CloudConfig) error {
+	if len(r.phoneHomeMode(env)) == 0 {
+		return nil
+	}
+	if len(r.PhoneHomeURL) == 0 {
+		return fmt.Errorf("environment %s uses %s, but the shim runs without --phone-home-url", env.Name,
+			phoneHomeKey)
+	}
+
+	secret, err := r.fetchKeySecret(ctx, vm)
+	if err != nil {
+		return err
+	}
+	// instances created again before phoning home, like after a failed launch, keep the token they were given
+	if _, ok := secret.Data[phoneHomeTokenKey]; !ok {
+		token := make([]byte, 32)
+		if _, err = rand.Read(token); err != nil {
+			return err
+		}
+		if secret.Data == nil {
+			secret.Data = make(map[string][]byte)
+		}
+		secret.Data[phoneHomeTokenKey] = []byte(hex.EncodeToString(token))
+		if err = r.Update(ctx, secret); err != nil {
+			return err
+		}
+	}
+
+	cloudConfig["phone_home"] = map[interface{}]interface{}{
+		"url": fmt.Sprintf("%s%s%s/%s/%s", strings.TrimSuffix(r.PhoneHomeURL, "/"), phoneHomePath, vm.Namespace,
+			vm.Name, secret.Data[phoneHomeTokenKey]),
+		"post":  []interface{}{"pub_key_rsa", "pub_key_ecdsa", "pub_key_ed25519", "instance_id", "hostname"},
+		"tries": 10,
+	}
+	return nil
+}
+
+// cloudInitUserData returns the plain text cloud-init user data of providers passing it on as is, with the phone
+// home call and the trusted certificate authority of env added next to it. The user data of environments using
+// neither is only decoded, it is kept as it is otherwise and only merged with the added cloud-config by cloud-init.
+func (r *VirtualMachineReconciler) cloudInitUserData(ctx context.Context, vm *hfv1.VirtualMachine,
+	env *hfv1.Environment, userData string) (string, error) {
+	if len(r.phoneHomeMode(env)) == 0 && !r.sshCAEnabled(env) {
+		return utils.DecodeUserData(userData), nil
+	}
+	cloudConfig := make(utils.CloudConfig)
+	if err := r.addPhoneHome(ctx, vm, env, cloudConfig); err != nil {
+		return userData, err
+	}
+	if err := r.addTrustedUserCA(ctx, vm, env, cloudConfig); err != nil {
+		return userData, err
+	}
+	return utils.MergeUserData(userData, cloudConfig)
+}
+
+// PhoneHome serves the endpoint instances call once cloud-init finished. A call with the one-time token of a vm
+// records when it phoned home and the ssh host keys it reported, which marks the vm ready in environments with
+// phone_home.
+type PhoneHome struct {
+	Reconciler *VirtualMachineReconciler
+	// Addr is the address the endpoint listens on
+	Addr string
+}
+
+// Start serves the endpoint until ctx is done
+func (p *PhoneHome) Start(ctx context.Context) error {
+	mux := http.NewServeMux()
+	mux.Handle(phoneHomePath, p)
+	server := &http.Server{Addr: p.Addr, Handler: mux, ReadHeaderTimeout: 10 * time.Second}
+
+	errs := make(chan error, 1)
+	go func() {
+		errs <- server.ListenAndServe()
+	}()
+	select {
+	case err := <-errs:
+		return err
+	case <-ctx.Done():
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		return server.Shutdown(shutdownCtx)
+	}
+}
+
+// NeedLeaderElection is false, every replica accepts the calls of instances
+func (p *PhoneHome) NeedLeaderElection() bool {
+	return false
+}
+
+// ServeHTTP handles a call of the instance of a vm, posted to phoneHomePath/<namespace>/<name>/<token>
+func (p *PhoneHome) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	parts := strings.Split(strings.TrimPrefix(req.URL.Path, phoneHomePath), "/")
+	if len(parts) != 3 || len(parts[0]) == 0 || len(parts[1]) == 0 || len(parts[2]) == 0 {
+		http.NotFound(w, req)
+		return
+	}
+	if err := req.ParseForm(); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	status, err := p.phoneHome(req.Context(), types.NamespacedName{Namespace: parts[0], Name: parts[1]}, parts[2],
+		req)
+	if err != nil {
+		p.Reconciler.Log.Error(err, "phone home failed", "vm", parts[0]+"/"+parts[1])
+		http.Error(w, http.StatusText(status), status)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// phoneHome validates token against the keypair secret of the vm and consumes it, then records the call on the
+// VirtualMachineProvisioning. It returns the http status of a failed call.
+func (p *PhoneHome) phoneHome(ctx context.Context, name types.NamespacedName, token string,
+	req *http.Request) (int, error) {
+	r := p.Reconciler
+	vm := &hfv1.VirtualMachine{}
+	if err := r.Get(ctx, name, vm); err != nil {
+		if errors.IsNotFound(err) {
+			return http.StatusForbidden, err
+		}
+		return http.StatusInternalServerError, err
+	}
+	secret, err := r.fetchKeySecret(ctx, vm)
+	if err != nil {
+		if errors.IsNotFound(err) {
+			return http.StatusForbidden, err
+		}
+		return http.StatusInternalServerError, err
+	}
+	expected := secret.Data[phoneHomeTokenKey]
+	if len(expected) == 0 || subtle.ConstantTimeCompare(expected, []byte(token)) != 1 {
+		return http.StatusForbidden, fmt.Errorf("invalid phone home token")
+	}
+
+	// the update fails on a stale secret, so a token is accepted once
+	delete(secret.Data, phoneHomeTokenKey)
+	var hostKeys []string
+	for _, field := range hostKeyFields {
+		if value := strings.TrimSpace(req.PostForm.Get(field)); len(value) > 0 {
+			hostKeys = append(hostKeys, value)
+		}
+	}
+	if len(hostKeys) > 0 {
+		secret.Data[hostKeysKey] = []byte(strings.Join(hostKeys, "\n") + "\n")
+	}
+	if err = r.Update(ctx, secret); err != nil {
+		if errors.IsConflict(err) {
+			return http.StatusForbidden, err
+		}
+		return http.StatusInternalServerError, err
+	}
+
+	vmp := &shimv1alpha1.VirtualMachineProvisioning{}
+	if err = retry.RetryOnConflict(retry.DefaultRetry, func() error {
+		if err := r.Get(ctx, name, vmp); err != nil {
+			return err
+		}
+		now := metav1.Now()
+		vmp.Status.Timings.PhonedHomeAt = &now
+		return r.Status().Update(ctx, vmp)
+	}); err != nil {
+		return http.StatusInternalServerError, err
+	}
+
+	r.providerEvent(ctx, vm, vmp.Status.Provider, v1.EventTypeNormal, "PhonedHome",
+		"instance %s phoned home from %s with %d host keys", req.PostForm.Get("hostname"), req.RemoteAddr,
+		len(hostKeys))
+	return http.StatusNoContent, nil
+}
@@ -0,0 +1,208 @@
+package controllers
+
+import (
+	"encoding/base64"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"net/mail"
+	"net/textproto"
+	"net/url"
+	"strings"
+	"testing"
+
+	ec2v1alpha1 "github.com/hobbyfarm/ec2-operator/pkg/api/v1alpha1"
+	hfv1 "github.com/hobbyfarm/gargantua/pkg/apis/hobbyfarm.io/v1"
+	"github.com/hobbyfarm/hf-shim-operator/pkg/utils"
+)
+
+// userDataPart is a part of multipart user data
+type userDataPart struct {
+	header textproto.MIMEHeader
+	body   string
+}
+
+// userDataParts returns the parts of the multipart user data
+func userDataParts(t *testing.T, userData string) []userDataPart {
+	t.Helper()
+	msg, err := mail.ReadMessage(strings.NewReader(userData))
+	if err != nil {
+		t.Fatalf("expected multipart user data: %v", err)
+	}
+	mediaType, params, err := mime.ParseMediaType(msg.Header.Get("Content-Type"))
+	if err != nil || mediaType != "multipart/mixed" {
+		t.Fatalf("expected multipart user data, got %q: %v", mediaType, err)
+	}
+	var parts []userDataPart
+	reader := multipart.NewReader(msg.Body, params["boundary"])
+	for {
+		part, err := reader.NextPart()
+		if err == io.EOF {
+			return parts
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, err := io.ReadAll(part)
+		if err != nil {
+			t.Fatal(err)
+		}
+		parts = append(parts, userDataPart{header: part.Header, body: string(body)})
+	}
+}
+
+// phoneHome posts the form of cloud-init to path of the phone home endpoint and returns the response status
+func (h *harness) phoneHome(path string, form url.Values) int {
+	req := httptest.NewRequest(http.MethodPost, path, strings.NewReader(form.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	w := httptest.NewRecorder()
+	(&PhoneHome{Reconciler: h.r}).ServeHTTP(w, req)
+	return w.Code
+}
+
+func TestPhoneHome(t *testing.T) {
+	h := newHarness(t, "aws", map[string]string{
+		"cred_secret":           "aws-creds",
+		"region":                "us-west-2",
+		"subnet":                "subnet-1",
+		"vpc_security_group_id": "sg-1",
+		phoneHomeKey:            phoneHomeOnly,
+	}, map[string]string{
+		"image":     "ami-1",
+		"cloudInit": "#cloud-config\npackages: [git]\n",
+	})
+	h.r.PhoneHomeURL = "https://shim.example.com/"
+
+	h.step(secretCreated)
+	h.step(importKeyPairCreated)
+	h.step(hfv1.VmStatusProvisioned)
+	instance := &ec2v1alpha1.Instance{}
+	h.get(testVMName, instance)
+	userData, err := base64.StdEncoding.DecodeString(instance.Spec.UserData)
+	if err != nil {
+		t.Fatalf("expected base64 encoded user data: %v", err)
+	}
+	// the template cloud-init is kept as it is, the phone home call is merged into it by cloud-init
+	parts := userDataParts(t, string(userData))
+	if len(parts) != 2 || parts[0].body != "#cloud-config\npackages: [git]\n" ||
+		parts[1].header.Get("Merge-Type") == "" {
+		t.Fatalf("expected the phone home call next to the template cloud-init, got %s", userData)
+	}
+	cloudConfig, err := utils.ParseCloudConfig(parts[1].body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// yaml decodes nested maps as the type of the document
+	phoneHome, _ := cloudConfig["phone_home"].(utils.CloudConfig)
+	callbackURL, _ := phoneHome["url"].(string)
+	prefix := "https://shim.example.com" + phoneHomePath + h.namespace + "/" + testVMName + "/"
+	if !strings.HasPrefix(callbackURL, prefix) {
+		t.Fatalf("expected the phone home call next to the template cloud-init, got %s", userData)
+	}
+	path := strings.TrimPrefix(callbackURL, "https://shim.example.com")
+
+	// creating the instance again keeps the token it was given
+	env, err := h.r.fetchEnvironment(h.ctx, testEnvName, h.namespace)
+	if err != nil {
+		t.Fatal(err)
+	}
+	again := utils.CloudConfig{}
+	if err := h.r.addPhoneHome(h.ctx, h.vm(), env, again); err != nil {
+		t.Fatal(err)
+	}
+	if kept, _ := again["phone_home"].(map[interface{}]interface{})["url"].(string); kept != callbackURL {
+		t.Fatalf("expected the phone home token to be kept, got %s instead of %s", kept, callbackURL)
+	}
+
+	instance.Status.Status = "provisioned"
+	instance.Status.InstanceID = "i-1"
+	instance.Status.PrivateIP = "10.0.0.7"
+	h.updateStatus(instance)
+	if err := h.reconcile(); err == nil {
+		t.Fatal("expected the vm to wait for the instance to phone home")
+	}
+	h.expectStatus(hfv1.VmStatusProvisioned)
+
+	form := url.Values{"pub_key_ed25519": {"ssh-ed25519 AAAAC3Nza host"}, "hostname": {"ip-10-0-0-7"}}
+	if code := h.phoneHome(prefix+"invalid", form); code != http.StatusForbidden {
+		t.Fatalf("expected an invalid token to be refused, got %d", code)
+	}
+	if code := h.phoneHome(path, form); code != http.StatusNoContent {
+		t.Fatalf("expected the phone home call to be accepted, got %d", code)
+	}
+	if code := h.phoneHome(path, form); code != http.StatusForbidden {
+		t.Fatalf("expected the token to be accepted once, got %d", code)
+	}
+	h.expectEvent("PhonedHome")
+	secret, err := h.keySecret()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := secret.Data[phoneHomeTokenKey]; ok || string(secret.Data[hostKeysKey]) != "ssh-ed25519 AAAAC3Nza host\n" {
+		t.Fatalf("expected the token to be replaced by the host keys, got %v", secret.Data)
+	}
+
+	// the private instance is running without passing an ssh liveness check
+	h.step(hfv1.VmStatusRunning)
+	h.Lock()
+	calls := len(h.livenessCalls)
+	h.Unlock()
+	if calls != 0 {
+		t.Fatalf("expected no liveness check, got %d", calls)
+	}
+	if vmp := h.provisioning(); vmp.Status.Timings.PhonedHomeAt == nil {
+		t.Fatal("expected the phone home call in the timings")
+	}
+}
+
+func TestPhoneHomeUserData(t *testing.T) {
+	script := "#!/bin/bash\necho hello\n"
+	tests := []struct {
+		name        string
+		userData    string
+		contentType string
+		err         bool
+	}{
+		{name: "cloud-config", userData: "#cloud-config\npackages: [git]\n", contentType: "text/cloud-config"},
+		{name: "shell script", userData: script, contentType: "text/x-shellscript"},
+		{name: "base64", userData: base64.StdEncoding.EncodeToString([]byte(script)), contentType: "text/x-shellscript"},
+		{name: "multipart", userData: "Content-Type: multipart/mixed; boundary=\"parts\"\nMIME-Version: 1.0\n\n" +
+			"--parts\nContent-Type: text/x-shellscript\n\n" + script + "\n--parts--\n", contentType: "multipart/mixed"},
+		{name: "unsupported", userData: "packages: [git]\n", err: true},
+	}
+	h := newHarness(t, "aws", map[string]string{phoneHomeKey: phoneHomeOnly}, nil)
+	h.r.PhoneHomeURL = "https://shim.example.com/"
+	h.step(secretCreated)
+	env := &hfv1.Environment{}
+	h.get(testEnvName, env)
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			userData, err := h.r.cloudInitUserData(h.ctx, h.vm(), env, test.userData)
+			if test.err {
+				if err == nil {
+					t.Fatalf("expected unsupported user data to fail, got %s", userData)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			// the headers of mime documents become the headers of their part
+			content := strings.SplitN(utils.DecodeUserData(test.userData), "\n\n", 2)
+			parts := userDataParts(t, userData)
+			if len(parts) != 2 || !strings.HasPrefix(parts[0].header.Get("Content-Type"), test.contentType) ||
+				parts[0].body != content[len(content)-1] {
+				t.Fatalf("expected the user data to be kept as a %s part, got %s", test.contentType, userData)
+			}
+		})
+	}
+
+	// without phone home and a certificate authority user data is only decoded
+	env.Spec.EnvironmentSpecifics = nil
+	userData, err := h.r.cloudInitUserData(h.ctx, h.vm(), env, base64.StdEncoding.EncodeToString([]byte(script)))
+	if err != nil || userData != script {
+		t.Fatalf("expected the user data to be kept as it is, got %s: %v", userData, err)
+	}
+}
@@ -0,0 +1,191 @@
+package controllers
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+
+	hfv1 "github.com/hobbyfarm/gargantua/pkg/apis/hobbyfarm.io/v1"
+	shimv1alpha1 "github.com/hobbyfarm/hf-shim-operator/pkg/api/v1alpha1"
+	"github.com/hobbyfarm/hf-shim-operator/pkg/statemachine"
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+// Provider is implemented by every backend the shim can launch HobbyFarm VirtualMachines on.
+// The reconciler looks up the Provider matching Environment.Spec.Provider and drives it through
+// the provisioning states.
+type Provider interface {
+	// ImportKeyPair makes the public key of the VM available to the backend and returns the
+	// updated VM status.
+	ImportKeyPair(ctx context.Context, vm *hfv1.VirtualMachine, env *hfv1.Environment,
+		pubKey string) (*hfv1.VirtualMachineStatus, error)
+
+	// CreateInstance creates the child object which backs the VM.
+	CreateInstance(ctx context.Context, vm *hfv1.VirtualMachine, env *hfv1.Environment,
+		vmTemplate *hfv1.VirtualMachineTemplate) error
+
+	// FetchStatus copies the child object status into the VM status. provisioned is true once the
+	// backend reports the instance as up and it can be liveness checked.
+	FetchStatus(ctx context.Context, vm *hfv1.VirtualMachine) (status *hfv1.VirtualMachineStatus,
+		provisioned bool, err error)
+
+	// LivenessCheck reports if the instance is reachable and ready to be handed to a user.
+	LivenessCheck(ctx context.Context, vm *hfv1.VirtualMachine) (ready bool, err error)
+
+	// Teardown deletes the child objects of the VM. gone is true once all of them have been removed.
+	Teardown(ctx context.Context, vm *hfv1.VirtualMachine) (gone bool, err error)
+}
+
+// commandRunner is implemented by providers whose instances are reachable over ssh. RunCommand runs command on the
+// instance of vm the way its liveness check reaches it, and reports if the command exited with 0. Idle checks and
+// command readiness probes are only supported by providers implementing it.
+type commandRunner interface {
+	RunCommand(ctx context.Context, vm *hfv1.VirtualMachine, command string) (ok bool, err error)
+}
+
+// ProviderFactory builds a Provider bound to the reconciler which is using it.
+type ProviderFactory func(r *VirtualMachineReconciler) Provider
+
+var (
+	providersLock sync.RWMutex
+	providers     = make(map[string]ProviderFactory)
+)
+
+// RegisterProvider makes a provider available to environments with a matching Spec.Provider.
+// Registering a name twice replaces the earlier factory.
+func RegisterProvider(name string, factory ProviderFactory) {
+	providersLock.Lock()
+	defer providersLock.Unlock()
+	providers[name] = factory
+}
+
+// RegisteredProviders returns the sorted names of all registered providers.
+func RegisteredProviders() []string {
+	providersLock.RLock()
+	defer providersLock.RUnlock()
+	names := make([]string, 0, len(providers))
+	for name := range providers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// provider returns the Provider registered for name
+func (r *VirtualMachineReconciler) provider(name string) (Provider, error) {
+	providersLock.RLock()
+	factory, ok := providers[name]
+	providersLock.RUnlock()
+	if !ok {
+		return nil, fmt.Errorf("unsupported environment type %q. currently supported providers are %v",
+			name, RegisteredProviders())
+	}
+	return factory(r), nil
+}
+
+// checkFeatures marks vmp with the InvalidConfig condition when env asks for features its provider does not
+// support, which are ignored for the vm. Each of them is reported with a warning event once, when the condition is
+// set.
+func (r *VirtualMachineReconciler) checkFeatures(ctx context.Context, vm *hfv1.VirtualMachine,
+	vmp *shimv1alpha1.VirtualMachineProvisioning, env *hfv1.Environment) {
+	p, err := r.provider(env.Spec.Provider)
+	if err != nil {
+		return
+	}
+	specifics := env.Spec.EnvironmentSpecifics
+	var reasons, messages []string
+	if _, ok := p.(recycler); !ok && specifics[recycleOnTaintKey] == "true" {
+		reasons = append(reasons, "RecycleUnsupported")
+		messages = append(messages, fmt.Sprintf("%s instances can not be recycled, the vm is deleted once it is "+
+			"tainted", env.Spec.Provider))
+	}
+	if _, ok := specifics[idleTimeoutKey]; ok && !runsCommands(p) {
+		reasons = append(reasons, "IdleCheckUnsupported")
+		messages = append(messages, fmt.Sprintf("%s instances can not be checked for being idle, %s is ignored",
+			env.Spec.Provider, idleTimeoutKey))
+	}
+
+	now := metav1.Now()
+	if len(reasons) == 0 {
+		statemachine.ClearInvalidConfig(&vmp.Status, now)
+		return
+	}
+	if !meta.IsStatusConditionTrue(vmp.Status.Conditions, shimv1alpha1.ConditionInvalidConfig) {
+		for i, reason := range reasons {
+			r.providerEvent(ctx, vm, env.Spec.Provider, v1.EventTypeWarning, reason, "%s", messages[i])
+		}
+	}
+	statemachine.SetInvalidConfig(&vmp.Status, reasons[0], strings.Join(messages, "; "), now)
+}
+
+// deleteChildren deletes the objects passed, ignoring the ones which do not exist.
+// gone is only true once none of them can be found anymore.
+func (r *VirtualMachineReconciler) deleteChildren(ctx context.Context, objs ...client.Object) (gone bool, err error) {
+	return deleteObjects(ctx, r.Client, objs...)
+}
+
+// deleteObjects is deleteChildren for objects which are not managed through the reconciler client
+func deleteObjects(ctx context.Context, c client.Client, objs ...client.Object) (gone bool, err error) {
+	gone = true
+	for _, obj := range objs {
+		err = c.Get(ctx, client.ObjectKeyFromObject(obj), obj)
+		if errors.IsNotFound(err) {
+			continue
+		}
+		if err != nil {
+			return false, err
+		}
+		gone = false
+		if !obj.GetDeletionTimestamp().IsZero() {
+			continue
+		}
+		if err = c.Delete(ctx, obj); err != nil && !errors.IsNotFound(err) {
+			return false, err
+		}
+	}
+	return gone, nil
+}
+
+// newUnstructured returns an empty object of kind gvk, used for the child objects of providers without typed clients
+func newUnstructured(gvk schema.GroupVersionKind, name string, namespace string) *unstructured.Unstructured {
+	obj := &unstructured.Unstructured{}
+	obj.SetGroupVersionKind(gvk)
+	obj.SetName(name)
+	obj.SetNamespace(namespace)
+	return obj
+}
+
+// setVMLabels labels obj with the vm it belongs to, so it can be traced back to the vm without an owner reference
+func setVMLabels(obj metav1.Object, vm *hfv1.VirtualMachine) {
+	labels := obj.GetLabels()
+	if labels == nil {
+		labels = make(map[string]string)
+	}
+	labels[vmLabel] = vm.Name
+	labels[vmNamespaceLabel] = vm.Namespace
+	obj.SetLabels(labels)
+}
+
+// templateInstanceType returns the instanceType of templateName in env, or the default of the env provider
+func templateInstanceType(env *hfv1.Environment, templateName string) string {
+	if instanceType, ok := env.Spec.TemplateMapping[templateName]["instanceType"]; ok {
+		return instanceType
+	}
+	switch env.Spec.Provider {
+	case "aws":
+		return defaultInstanceType
+	case "digitalocean":
+		return defaultDOInstanceType
+	case "equinix":
+		return defaultEquinixInstanceType
+	}
+	return ""
+}
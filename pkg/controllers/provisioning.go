@@ -0,0 +1,204 @@
+package controllers
+
+import (
+	"context"
+	stdErrors "errors"
+	"fmt"
+	"strconv"
+	"time"
+
+	hfv1 "github.com/hobbyfarm/gargantua/pkg/apis/hobbyfarm.io/v1"
+	shimv1alpha1 "github.com/hobbyfarm/hf-shim-operator/pkg/api/v1alpha1"
+	"github.com/hobbyfarm/hf-shim-operator/pkg/statemachine"
+	"k8s.io/apimachinery/pkg/api/equality"
+	"k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/apiutil"
+	"sigs.k8s.io/controller-runtime/pkg/controller/controllerutil"
+)
+
+// annotations earlier versions kept the provisioning data of a vm in. they are moved to its
+// VirtualMachineProvisioning on the next reconcile.
+const (
+	legacyProviderAnnotation     = "cloudProvider"
+	legacyAttemptAnnotation      = "hobbyfarm.io/provision-attempt"
+	legacyStartedAnnotation      = "hobbyfarm.io/provision-started"
+	legacyInstanceTypeAnnotation = "hobbyfarm.io/instance-type"
+)
+
+var legacyAnnotations = []string{"pubKey", "secret", "secretName", "importKeyPair", legacyProviderAnnotation,
+	legacyAttemptAnnotation, legacyStartedAnnotation, legacyInstanceTypeAnnotation}
+
+// errVMNotRunning is returned while polling a provisioned vm which did not pass its liveness check yet. It
+// requeues the vm without marking it degraded.
+var errVMNotRunning = fmt.Errorf("VM still not running")
+
+// childProvider is implemented by providers whose child objects live next to the vm. They are listed in the
+// VirtualMachineProvisioning of the vm.
+type childProvider interface {
+	children(vm *hfv1.VirtualMachine) []client.Object
+}
+
+// fetchProvisioning returns the VirtualMachineProvisioning of vm, which shares its name and namespace. It is
+// created on first use unless vm is already being deleted, in which case an unsaved one is returned.
+func (r *VirtualMachineReconciler) fetchProvisioning(ctx context.Context,
+	vm *hfv1.VirtualMachine) (vmp *shimv1alpha1.VirtualMachineProvisioning, err error) {
+	vmp = &shimv1alpha1.VirtualMachineProvisioning{}
+	err = r.Get(ctx, types.NamespacedName{Name: vm.Name, Namespace: vm.Namespace}, vmp)
+	if errors.IsNotFound(err) {
+		vmp = &shimv1alpha1.VirtualMachineProvisioning{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:      vm.Name,
+				Namespace: vm.Namespace,
+			},
+			Spec: shimv1alpha1.VirtualMachineProvisioningSpec{
+				VirtualMachine: vm.Name,
+			},
+		}
+		if !vm.DeletionTimestamp.IsZero() {
+			err = nil
+		} else if err = controllerutil.SetControllerReference(vm, vmp, r.Scheme); err == nil {
+			err = r.Create(ctx, vmp)
+		}
+	}
+	if err != nil {
+		return vmp, err
+	}
+
+	migrateAnnotations(vm, vmp)
+	return vmp, nil
+}
+
+// migrateAnnotations moves the provisioning data earlier versions kept in annotations of vm to vmp
+func migrateAnnotations(vm *hfv1.VirtualMachine, vmp *shimv1alpha1.VirtualMachineProvisioning) {
+	status := &vmp.Status
+	if value, ok := vm.Annotations[legacyProviderAnnotation]; ok && len(status.Provider) == 0 {
+		status.Provider = value
+	}
+	if value, ok := vm.Annotations[legacyAttemptAnnotation]; ok && status.Attempt == 0 {
+		if attempt, err := strconv.Atoi(value); err == nil {
+			status.Attempt = int32(attempt)
+		}
+	}
+	if value, ok := vm.Annotations[legacyStartedAnnotation]; ok && status.Timings.AttemptStartedAt == nil {
+		if started, err := time.Parse(time.RFC3339, value); err == nil {
+			status.Timings.AttemptStartedAt = &metav1.Time{Time: started}
+		}
+	}
+	if value, ok := vm.Annotations[legacyInstanceTypeAnnotation]; ok && len(status.InstanceType) == 0 {
+		status.InstanceType = value
+	}
+	for _, annotation := range legacyAnnotations {
+		delete(vm.Annotations, annotation)
+	}
+}
+
+// recordProvisioning walks vmp through statuses, copies the endpoints and child objects of vm into it, and
+// marks it degraded when reconcileErr is set. Nothing is saved for a vmp which does not exist.
+func (r *VirtualMachineReconciler) recordProvisioning(ctx context.Context, vm *hfv1.VirtualMachine,
+	vmp *shimv1alpha1.VirtualMachineProvisioning, reconcileErr error, statuses ...hfv1.VmStatus) error {
+	if len(vmp.ResourceVersion) == 0 {
+		return nil
+	}
+	stored := &shimv1alpha1.VirtualMachineProvisioning{}
+	if err := r.Get(ctx, client.ObjectKeyFromObject(vmp), stored); err != nil {
+		return client.IgnoreNotFound(err)
+	}
+
+	status := &vmp.Status
+	now := metav1.Now()
+	for _, vmStatus := range statuses {
+		phase, ok := statemachine.PhaseOf(vmStatus)
+		if !ok {
+			continue
+		}
+		if phase != status.Phase {
+			observePhaseDuration(status, now.Time)
+		}
+		err := statemachine.Transition(status, phase, "", "", now)
+		if stdErrors.Is(err, statemachine.ErrIllegalTransition) {
+			statemachine.Resync(status, phase, fmt.Sprintf("recorded phase %s did not match vm status %s",
+				status.Phase, vmStatus), now)
+		}
+	}
+	if reconcileErr != nil {
+		statemachine.SetDegraded(status, "ReconcileError", reconcileErr.Error(), now)
+	} else {
+		statemachine.ClearDegraded(status, now)
+	}
+
+	status.Environment = vm.Status.EnvironmentId
+	status.Template = vm.Spec.VirtualMachineTemplateId
+	status.Endpoints = shimv1alpha1.Endpoints{
+		SSH:         vm.Annotations["sshEndpoint"],
+		SSHUsername: vm.Spec.SshUsername,
+		SSHProxy:    vm.Annotations[sshProxyEndpointAnnotation],
+		PublicIP:    vm.Status.PublicIP,
+		PrivateIP:   vm.Status.PrivateIP,
+		Hostname:    vm.Status.Hostname,
+		WebSocket:   vm.Status.WsEndpoint,
+	}
+	children, err := r.childReferences(ctx, instanceVM(vm, vmp), status.Provider)
+	if err != nil {
+		return err
+	}
+	status.Children = children
+
+	if equality.Semantic.DeepEqual(stored.Status, *status) {
+		return nil
+	}
+	return r.Status().Update(ctx, vmp)
+}
+
+// childReferences returns references to the child objects of vm which exist
+func (r *VirtualMachineReconciler) childReferences(ctx context.Context, vm *hfv1.VirtualMachine,
+	providerName string) (refs []shimv1alpha1.ChildReference, err error) {
+	if len(providerName) == 0 {
+		return nil, nil
+	}
+	p, err := r.provider(providerName)
+	if err != nil {
+		return nil, nil
+	}
+	cp, ok := p.(childProvider)
+	if !ok {
+		return nil, nil
+	}
+
+	for _, obj := range cp.children(vm) {
+		if err = r.Get(ctx, client.ObjectKeyFromObject(obj), obj); err != nil {
+			if errors.IsNotFound(err) || meta.IsNoMatchError(err) {
+				continue
+			}
+			return nil, err
+		}
+		gvk, err := apiutil.GVKForObject(obj, r.Scheme)
+		if err != nil {
+			return nil, err
+		}
+		refs = append(refs, shimv1alpha1.ChildReference{
+			APIVersion: gvk.GroupVersion().String(),
+			Kind:       gvk.Kind,
+			Name:       obj.GetName(),
+			Namespace:  obj.GetNamespace(),
+		})
+	}
+	return refs, nil
+}
+
+// provisioningError marks vmp degraded by err, and returns err to requeue vm. vms polled until they are running
+// are not degraded.
+func (r *VirtualMachineReconciler) provisioningError(ctx context.Context, vm *hfv1.VirtualMachine,
+	vmp *shimv1alpha1.VirtualMachineProvisioning, err error) error {
+	reconcileErr := err
+	if err == errVMNotRunning {
+		reconcileErr = nil
+	}
+	if recordErr := r.recordProvisioning(ctx, vm, vmp, reconcileErr); recordErr != nil {
+		r.Log.Error(recordErr, "unable to record provisioning error", "virtualmachine", vm.Namespace+"/"+vm.Name)
+	}
+	return err
+}
@@ -0,0 +1,168 @@
+package controllers
+
+import (
+	"fmt"
+	"testing"
+
+	hfv1 "github.com/hobbyfarm/gargantua/pkg/apis/hobbyfarm.io/v1"
+	shimv1alpha1 "github.com/hobbyfarm/hf-shim-operator/pkg/api/v1alpha1"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// provisioning fetches the VirtualMachineProvisioning of the test vm
+func (h *harness) provisioning() *shimv1alpha1.VirtualMachineProvisioning {
+	h.t.Helper()
+	vmp := &shimv1alpha1.VirtualMachineProvisioning{}
+	h.get(testVMName, vmp)
+	return vmp
+}
+
+func TestProvisioningConditions(t *testing.T) {
+	h, p := runningVM(t)
+
+	vmp := h.provisioning()
+	if !metav1.IsControlledBy(vmp, h.vm()) {
+		t.Fatal("expected the provisioning status to be owned by the vm")
+	}
+	if vmp.Status.Phase != shimv1alpha1.PhaseRunning {
+		t.Fatalf("expected phase %s, got %s", shimv1alpha1.PhaseRunning, vmp.Status.Phase)
+	}
+	for _, conditionType := range []string{
+		shimv1alpha1.ConditionKeyPairReady,
+		shimv1alpha1.ConditionInstanceProvisioned,
+		shimv1alpha1.ConditionReady,
+	} {
+		if !meta.IsStatusConditionTrue(vmp.Status.Conditions, conditionType) {
+			t.Fatalf("expected condition %s, got %+v", conditionType, vmp.Status.Conditions)
+		}
+	}
+	var phases []shimv1alpha1.Phase
+	for _, transition := range vmp.Status.History {
+		phases = append(phases, transition.To)
+	}
+	if fmt.Sprint(phases) != fmt.Sprint([]shimv1alpha1.Phase{
+		shimv1alpha1.PhasePending,
+		shimv1alpha1.PhaseSecretCreated,
+		shimv1alpha1.PhaseKeyPairImported,
+		shimv1alpha1.PhaseProvisioned,
+		shimv1alpha1.PhaseRunning,
+	}) {
+		t.Fatalf("unexpected history %v", phases)
+	}
+
+	h.taint()
+	for i := 0; i < 2; i++ {
+		if err := h.reconcile(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, ok := p.instance(testVMName); ok || !h.deleted() {
+		t.Fatal("expected the tainted vm to be torn down")
+	}
+	vmp = h.provisioning()
+	if vmp.Status.Phase != shimv1alpha1.PhaseTerminating ||
+		meta.IsStatusConditionTrue(vmp.Status.Conditions, shimv1alpha1.ConditionReady) {
+		t.Fatalf("expected the terminating vm to lose its ready condition, got %+v", vmp.Status)
+	}
+}
+
+func TestProvisioningDegraded(t *testing.T) {
+	p := newFakeProvider()
+	p.register()
+	h := newHarness(t, fakeProviderName, nil, nil)
+
+	h.step(secretCreated)
+	h.step(importKeyPairCreated)
+
+	p.Lock()
+	p.createErr = fmt.Errorf("out of capacity")
+	p.Unlock()
+	if err := h.reconcile(); err == nil {
+		t.Fatal("expected instance creation error")
+	}
+	degraded := meta.FindStatusCondition(h.provisioning().Status.Conditions, shimv1alpha1.ConditionDegraded)
+	if degraded == nil || degraded.Status != metav1.ConditionTrue || degraded.Message != "out of capacity" {
+		t.Fatalf("unexpected degraded condition %+v", degraded)
+	}
+
+	p.Lock()
+	p.createErr = nil
+	p.Unlock()
+	h.step(hfv1.VmStatusProvisioned)
+	vmp := h.provisioning()
+	if !meta.IsStatusConditionFalse(vmp.Status.Conditions, shimv1alpha1.ConditionDegraded) {
+		t.Fatalf("expected the degraded condition to be cleared, got %+v", vmp.Status.Conditions)
+	}
+
+	// polling a pending instance is not an error
+	if err := h.reconcile(); err == nil {
+		t.Fatal("expected pending instance to requeue the vm")
+	}
+	if !meta.IsStatusConditionFalse(h.provisioning().Status.Conditions, shimv1alpha1.ConditionDegraded) {
+		t.Fatal("expected a pending instance to leave the vm healthy")
+	}
+}
+
+func TestReconcileUnknownStatus(t *testing.T) {
+	p := newFakeProvider()
+	p.register()
+	h := newHarness(t, fakeProviderName, nil, nil)
+
+	vm := h.vm()
+	vm.Status.Status = "Error Fetching VMTemplate"
+	h.updateStatus(vm)
+
+	h.step(hfv1.VmStatusRFP)
+	h.expectEvent("UnknownStatus")
+	h.setLive(true)
+	h.step(secretCreated)
+	h.step(importKeyPairCreated)
+	h.step(hfv1.VmStatusProvisioned)
+	p.transition(testVMName, fakeInstanceProvisioned, "192.0.2.10")
+	h.step(hfv1.VmStatusRunning)
+	if !meta.IsStatusConditionTrue(h.provisioning().Status.Conditions, shimv1alpha1.ConditionReady) {
+		t.Fatal("expected the recovered vm to be ready")
+	}
+}
+
+func TestProvisioningMigratesAnnotations(t *testing.T) {
+	p := newFakeProvider()
+	p.register()
+	h := newHarness(t, fakeProviderName, nil, nil)
+	h.setLive(true)
+
+	h.step(secretCreated)
+	h.step(importKeyPairCreated)
+	h.step(hfv1.VmStatusProvisioned)
+
+	// vms provisioned by earlier versions have no provisioning status yet
+	if err := h.r.Delete(h.ctx, h.provisioning()); err != nil {
+		t.Fatal(err)
+	}
+	vm := h.vm()
+	vm.Annotations = map[string]string{
+		"cloudProvider":                  fakeProviderName,
+		"pubKey":                         "c3NoLWVkMjU1MTkgQUFBQQ==",
+		"hobbyfarm.io/provision-attempt": "2",
+	}
+	if err := h.r.Update(h.ctx, vm); err != nil {
+		t.Fatal(err)
+	}
+
+	p.transition(testVMName, fakeInstanceProvisioned, "192.0.2.10")
+	h.step(hfv1.VmStatusRunning)
+	vmp := h.provisioning()
+	if vmp.Status.Provider != fakeProviderName || vmp.Status.Attempt != 2 {
+		t.Fatalf("expected the annotations to be migrated, got %+v", vmp.Status)
+	}
+	if vmp.Status.Phase != shimv1alpha1.PhaseRunning || len(vmp.Status.History) != 2 ||
+		vmp.Status.History[0].To != shimv1alpha1.PhaseProvisioned {
+		t.Fatalf("expected the history of the migrated vm to start provisioned, got %+v", vmp.Status.History)
+	}
+	for _, annotation := range legacyAnnotations {
+		if _, ok := h.vm().Annotations[annotation]; ok {
+			t.Fatalf("expected annotation %s to be removed", annotation)
+		}
+	}
+}
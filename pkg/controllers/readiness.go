@@ -0,0 +1,178 @@
+package controllers
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"time"
+
+	hfv1 "github.com/hobbyfarm/gargantua/pkg/apis/hobbyfarm.io/v1"
+	shimv1alpha1 "github.com/hobbyfarm/hf-shim-operator/pkg/api/v1alpha1"
+	"sigs.k8s.io/yaml"
+)
+
+/*
+Info used from env template mapping:
+readinessProbes (optional, yaml list of probes the instance has to pass after its liveness check before the vm is
+running, all of them have to pass. each probe is one of
+  - tcp: 6443 (port accepting connections)
+  - http: {port: 80, path: /healthz, scheme: http, status: 200} (GET returning status, defaults as shown)
+  - command: {command: "systemctl is-active k3s", exitCode: 0} (ssh command exiting with exitCode)
+  - cloudInit: true (cloud-init finished)
+tcp and http probes connect to the public ip, or the private ip with address: private)
+*/
+
+const (
+	readinessProbesKey = "readinessProbes"
+
+	probeTimeout = 5 * time.Second
+	// cloudInitFinishedCommand succeeds once cloud-init finished its final stage
+	cloudInitFinishedCommand = "test -f /var/lib/cloud/instance/boot-finished"
+)
+
+// readinessProbe is a check the instance of a vm has to pass before the vm is running. Exactly one of the checks
+// is set.
+type readinessProbe struct {
+	TCP       int           `json:"tcp,omitempty"`
+	HTTP      *httpProbe    `json:"http,omitempty"`
+	Command   *commandProbe `json:"command,omitempty"`
+	CloudInit bool          `json:"cloudInit,omitempty"`
+	// Address is the ip tcp and http probes connect to, public or private
+	Address string `json:"address,omitempty"`
+}
+
+// httpProbe is a GET request expected to return Status
+type httpProbe struct {
+	Port   int    `json:"port,omitempty"`
+	Path   string `json:"path,omitempty"`
+	Scheme string `json:"scheme,omitempty"`
+	Status int    `json:"status,omitempty"`
+}
+
+// commandProbe is a command run over ssh, expected to exit with ExitCode
+type commandProbe struct {
+	Command  string `json:"command"`
+	ExitCode int    `json:"exitCode,omitempty"`
+}
+
+// probeClient runs the http probes. Instances serve self signed certificates while they are set up, and the probes
+// only check if services are up, so certificates are not verified.
+var probeClient = &http.Client{
+	Timeout: probeTimeout,
+	Transport: &http.Transport{
+		TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
+	},
+}
+
+// parseReadinessProbes parses the readiness probes of a template mapping
+func parseReadinessProbes(mapping map[string]string) (probes []readinessProbe, err error) {
+	value, ok := mapping[readinessProbesKey]
+	if !ok {
+		return nil, nil
+	}
+	if err = yaml.Unmarshal([]byte(value), &probes); err != nil {
+		return nil, fmt.Errorf("invalid %s in template mapping: %w", readinessProbesKey, err)
+	}
+	for i, probe := range probes {
+		checks := 0
+		for _, set := range []bool{probe.TCP > 0, probe.HTTP != nil, probe.Command != nil, probe.CloudInit} {
+			if set {
+				checks++
+			}
+		}
+		if checks != 1 {
+			return nil, fmt.Errorf("readiness probe %d has %d checks instead of one", i+1, checks)
+		}
+		if probe.Command != nil && len(probe.Command.Command) == 0 {
+			return nil, fmt.Errorf("readiness probe %d has no command", i+1)
+		}
+	}
+	return probes, nil
+}
+
+// probeReadiness runs the readiness probes of the template of vm against its instance, which has the addresses in
+// status. It returns an error for the first probe which fails.
+func (r *VirtualMachineReconciler) probeReadiness(ctx context.Context, vm *hfv1.VirtualMachine,
+	vmp *shimv1alpha1.VirtualMachineProvisioning, p Provider, status *hfv1.VirtualMachineStatus) error {
+	env, err := r.fetchEnvironment(ctx, vm.Status.EnvironmentId, vm.Namespace)
+	if err != nil {
+		return err
+	}
+	probes, err := parseReadinessProbes(env.Spec.TemplateMapping[vm.Spec.VirtualMachineTemplateId])
+	if err != nil {
+		return err
+	}
+	for i, probe := range probes {
+		if err = r.probe(ctx, vm, vmp, p, status, probe); err != nil {
+			return fmt.Errorf("readiness probe %d failed: %w", i+1, err)
+		}
+	}
+	return nil
+}
+
+// probe runs a single readiness probe
+func (r *VirtualMachineReconciler) probe(ctx context.Context, vm *hfv1.VirtualMachine,
+	vmp *shimv1alpha1.VirtualMachineProvisioning, p Provider, status *hfv1.VirtualMachineStatus,
+	probe readinessProbe) error {
+	switch {
+	case probe.Command != nil || probe.CloudInit:
+		command, expected := cloudInitFinishedCommand, 0
+		if probe.Command != nil {
+			command, expected = probe.Command.Command, probe.Command.ExitCode
+		}
+		exitStatus, err := r.runSSHCommand(ctx, vm, vmp, p, command)
+		if err != nil {
+			return err
+		}
+		if exitStatus != expected {
+			return fmt.Errorf("%q exited with %d, expected %d", command, exitStatus, expected)
+		}
+		return nil
+	}
+
+	host := status.PublicIP
+	if probe.Address == "private" || len(host) == 0 {
+		host = status.PrivateIP
+	}
+	if len(host) == 0 {
+		return fmt.Errorf("instance has no ip address to probe")
+	}
+	if probe.TCP > 0 {
+		conn, err := net.DialTimeout("tcp", net.JoinHostPort(host, strconv.Itoa(probe.TCP)), probeTimeout)
+		if err != nil {
+			return err
+		}
+		return conn.Close()
+	}
+
+	scheme, port, path, expected := "http", 80, "/", http.StatusOK
+	if probe.HTTP.Scheme == "https" {
+		scheme, port = "https", 443
+	}
+	if probe.HTTP.Port > 0 {
+		port = probe.HTTP.Port
+	}
+	if len(probe.HTTP.Path) > 0 {
+		path = probe.HTTP.Path
+	}
+	if probe.HTTP.Status > 0 {
+		expected = probe.HTTP.Status
+	}
+	url := fmt.Sprintf("%s://%s%s", scheme, net.JoinHostPort(host, strconv.Itoa(port)), path)
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := probeClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != expected {
+		return fmt.Errorf("GET %s returned %d, expected %d", url, resp.StatusCode, expected)
+	}
+	return nil
+}
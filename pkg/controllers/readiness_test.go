@@ -0,0 +1,91 @@
+package controllers
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync/atomic"
+	"testing"
+
+	hfv1 "github.com/hobbyfarm/gargantua/pkg/apis/hobbyfarm.io/v1"
+)
+
+func TestParseReadinessProbes(t *testing.T) {
+	probes, err := parseReadinessProbes(map[string]string{readinessProbesKey: `
+- tcp: 6443
+- http: {port: 8080, path: /healthz}
+- command: {command: "systemctl is-active k3s"}
+- cloudInit: true
+`})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(probes) != 4 || probes[0].TCP != 6443 || probes[1].HTTP.Port != 8080 ||
+		probes[2].Command.Command != "systemctl is-active k3s" || !probes[3].CloudInit {
+		t.Fatalf("unexpected probes %+v", probes)
+	}
+
+	for _, invalid := range []string{
+		"- {tcp: 22, cloudInit: true}",
+		"- address: private",
+		"- command: {exitCode: 1}",
+		"tcp: 22",
+	} {
+		if _, err := parseReadinessProbes(map[string]string{readinessProbesKey: invalid}); err == nil {
+			t.Errorf("expected %q to be rejected", invalid)
+		}
+	}
+}
+
+func TestReadinessProbes(t *testing.T) {
+	var healthy int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/healthz" || atomic.LoadInt32(&healthy) == 0 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+	}))
+	defer server.Close()
+	serverURL, err := url.Parse(server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+
+	p := newFakeProvider()
+	p.register()
+	h := newHarness(t, fakeProviderName, nil, map[string]string{readinessProbesKey: fmt.Sprintf(`
+- tcp: %d
+- http: {port: %s, path: /healthz}
+- command: {command: "systemctl is-active k3s"}
+- cloudInit: true
+`, listener.Addr().(*net.TCPAddr).Port, serverURL.Port())})
+	h.setLive(true)
+	h.step(secretCreated)
+	h.step(importKeyPairCreated)
+	h.step(hfv1.VmStatusProvisioned)
+	p.transition(testVMName, fakeInstanceProvisioned, "127.0.0.1")
+
+	if err := h.reconcile(); err == nil {
+		t.Fatal("expected the failing http probe to requeue the vm")
+	}
+	h.expectEvent("ReadinessProbeFailed")
+	h.expectStatus(hfv1.VmStatusProvisioned)
+
+	atomic.StoreInt32(&healthy, 1)
+	h.step(hfv1.VmStatusRunning)
+	commands := map[string]bool{}
+	h.Lock()
+	for _, call := range h.livenessCalls {
+		commands[call.command] = true
+	}
+	h.Unlock()
+	if !commands["systemctl is-active k3s"] || !commands[cloudInitFinishedCommand] {
+		t.Fatalf("expected the ssh probes to run, got %v", commands)
+	}
+}
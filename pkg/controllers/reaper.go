@@ -0,0 +1,200 @@
+package controllers
+
+import (
+	"context"
+	"time"
+
+	"github.com/go-logr/logr"
+	ec2v1alpha1 "github.com/hobbyfarm/ec2-operator/pkg/api/v1alpha1"
+	hfv1 "github.com/hobbyfarm/gargantua/pkg/apis/hobbyfarm.io/v1"
+	equinixv1alpha1 "github.com/hobbyfarm/metal-operator/pkg/api/v1alpha1"
+	dropletv1alpha1 "github.com/ibrokethecloud/droplet-operator/pkg/api/v1alpha1"
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/client-go/tools/record"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+const (
+	// orphanOwnerMissing resources reference a VirtualMachine which no longer exists
+	orphanOwnerMissing = "OwnerMissing"
+	// orphanUnowned resources have no controller and reference no VirtualMachine
+	orphanUnowned = "Unowned"
+)
+
+// reapedKind is a provider resource kind checked by the orphan reaper
+type reapedKind struct {
+	provider string
+	kind     string
+	newList  func() client.ObjectList
+}
+
+var reapedKinds = []reapedKind{
+	{"aws", "Instance", func() client.ObjectList { return &ec2v1alpha1.InstanceList{} }},
+	{"aws", "ImportKeyPair", func() client.ObjectList { return &ec2v1alpha1.ImportKeyPairList{} }},
+	{"digitalocean", "Instance", func() client.ObjectList { return &dropletv1alpha1.InstanceList{} }},
+	{"digitalocean", "ImportKeyPair", func() client.ObjectList { return &dropletv1alpha1.ImportKeyPairList{} }},
+	{"equinix", "Instance", func() client.ObjectList { return &equinixv1alpha1.InstanceList{} }},
+	{"equinix", "ImportKeyPair", func() client.ObjectList { return &equinixv1alpha1.ImportKeyPairList{} }},
+}
+
+// OrphanReaper periodically looks for ec2, droplet and equinix resources whose VirtualMachine is gone, and
+// for resources which have been unowned for longer than the grace period. Orphans are reported through
+// metrics and events, and deleted unless DryRun is set.
+type OrphanReaper struct {
+	client.Client
+	Log         logr.Logger
+	Recorder    record.EventRecorder
+	Interval    time.Duration
+	GracePeriod time.Duration
+	DryRun      bool
+}
+
+// Start runs a sweep every interval until ctx is done
+func (o *OrphanReaper) Start(ctx context.Context) error {
+	wait.UntilWithContext(ctx, o.sweep, o.Interval)
+	return nil
+}
+
+// NeedLeaderElection makes sure only the active manager deletes orphans
+func (o *OrphanReaper) NeedLeaderElection() bool {
+	return true
+}
+
+// orphanCount is a series of the orphaned resources metric
+type orphanCount struct {
+	provider string
+	kind     string
+	reason   string
+}
+
+func (o *OrphanReaper) sweep(ctx context.Context) {
+	// orphans are counted aside, so scrapes during the sweep see the counts of the last complete one
+	orphans := make(map[orphanCount]float64)
+	for _, k := range reapedKinds {
+		list := k.newList()
+		if err := o.List(ctx, list); err != nil {
+			// the operator of this provider is not installed
+			if meta.IsNoMatchError(err) {
+				continue
+			}
+			o.Log.Error(err, "unable to list resources", "provider", k.provider, "kind", k.kind)
+			reaperErrors.Inc()
+			continue
+		}
+		items, err := meta.ExtractList(list)
+		if err != nil {
+			o.Log.Error(err, "unable to extract resources", "provider", k.provider, "kind", k.kind)
+			reaperErrors.Inc()
+			continue
+		}
+		for _, item := range items {
+			obj, ok := item.(client.Object)
+			if !ok {
+				continue
+			}
+			reason, err := o.orphanReason(ctx, obj)
+			if err != nil {
+				o.Log.Error(err, "unable to check owner", "provider", k.provider, "kind", k.kind,
+					"name", obj.GetNamespace()+"/"+obj.GetName())
+				reaperErrors.Inc()
+				continue
+			}
+			if len(reason) == 0 {
+				continue
+			}
+			orphans[orphanCount{k.provider, k.kind, reason}]++
+			o.reap(ctx, k, obj, reason)
+		}
+	}
+
+	orphanedResources.Reset()
+	for series, count := range orphans {
+		orphanedResources.WithLabelValues(series.provider, series.kind, series.reason).Set(count)
+	}
+	reaperLastSweep.SetToCurrentTime()
+}
+
+// orphanReason returns why obj is an orphan, or nothing when its VirtualMachine exists. The VirtualMachine is found
+// through the controller reference, or the vm labels when there is none. Only resources without any controller are
+// unowned, those controlled by anything but a VirtualMachine are never orphans.
+func (o *OrphanReaper) orphanReason(ctx context.Context, obj client.Object) (reason string, err error) {
+	// resources being deleted are waited for by the vm finalizer
+	if !obj.GetDeletionTimestamp().IsZero() {
+		return "", nil
+	}
+
+	var name string
+	var uid types.UID
+	namespace := obj.GetNamespace()
+	if ref := metav1.GetControllerOf(obj); ref != nil {
+		// resources controlled by something else, e.g. a k3s-operator Cluster, are left to their controller
+		if !isVMReference(ref) {
+			return "", nil
+		}
+		name, uid = ref.Name, ref.UID
+	} else if vmName, ok := obj.GetLabels()[vmLabel]; ok {
+		name = vmName
+		if vmNamespace, ok := obj.GetLabels()[vmNamespaceLabel]; ok {
+			namespace = vmNamespace
+		}
+	}
+
+	if len(name) == 0 {
+		if time.Since(obj.GetCreationTimestamp().Time) < o.GracePeriod {
+			return "", nil
+		}
+		return orphanUnowned, nil
+	}
+
+	vm := &hfv1.VirtualMachine{}
+	if err = o.Get(ctx, types.NamespacedName{Name: name, Namespace: namespace}, vm); err != nil {
+		if errors.IsNotFound(err) {
+			return orphanOwnerMissing, nil
+		}
+		return "", err
+	}
+	// a new vm with the same name does not own the resources of its predecessor
+	if len(uid) > 0 && vm.UID != uid {
+		return orphanOwnerMissing, nil
+	}
+	return "", nil
+}
+
+// reap reports obj as orphan, and deletes it unless this is a dry run
+func (o *OrphanReaper) reap(ctx context.Context, k reapedKind, obj client.Object, reason string) {
+	log := o.Log.WithValues("provider", k.provider, "kind", k.kind, "name", obj.GetNamespace()+"/"+obj.GetName(),
+		"reason", reason)
+	if o.DryRun {
+		log.Info("found orphaned resource, leaving it in place in dry run mode")
+		o.event(obj, "Orphaned", "%s %s is orphaned (%s), dry run leaves it in place", k.provider, k.kind, reason)
+		return
+	}
+
+	if err := o.Delete(ctx, obj); err != nil && !errors.IsNotFound(err) {
+		log.Error(err, "unable to delete orphaned resource")
+		reaperErrors.Inc()
+		return
+	}
+	reapedResources.WithLabelValues(k.provider, k.kind).Inc()
+	log.Info("deleted orphaned resource")
+	o.event(obj, "OrphanDeleted", "%s %s was orphaned (%s) and has been deleted", k.provider, k.kind, reason)
+}
+
+func (o *OrphanReaper) event(obj client.Object, reason string, messageFmt string, args ...interface{}) {
+	if o.Recorder == nil {
+		return
+	}
+	o.Recorder.Eventf(obj, v1.EventTypeWarning, reason, messageFmt, args...)
+}
+
+// isVMReference reports if ref points to a hobbyfarm VirtualMachine
+func isVMReference(ref *metav1.OwnerReference) bool {
+	gv, err := schema.ParseGroupVersion(ref.APIVersion)
+	return err == nil && gv.Group == hfv1.SchemeGroupVersion.Group && ref.Kind == "VirtualMachine"
+}
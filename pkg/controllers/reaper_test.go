@@ -0,0 +1,129 @@
+package controllers
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	ec2v1alpha1 "github.com/hobbyfarm/ec2-operator/pkg/api/v1alpha1"
+	hfv1 "github.com/hobbyfarm/gargantua/pkg/apis/hobbyfarm.io/v1"
+	equinixv1alpha1 "github.com/hobbyfarm/metal-operator/pkg/api/v1alpha1"
+	dropletv1alpha1 "github.com/ibrokethecloud/droplet-operator/pkg/api/v1alpha1"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/tools/record"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+)
+
+// reaperFixture holds the objects of a reaper test, and which of them are orphans
+type reaperFixture struct {
+	kept    []client.Object
+	orphans []client.Object
+}
+
+func newReaperFixture() reaperFixture {
+	vm := &hfv1.VirtualMachine{ObjectMeta: metav1.ObjectMeta{Name: "vm-live", Namespace: provisionNS, UID: "live"}}
+	labVM := &hfv1.VirtualMachine{ObjectMeta: metav1.ObjectMeta{Name: "vm-lab", Namespace: "lab", UID: "lab"}}
+	owner := func(name string, uid types.UID) []metav1.OwnerReference {
+		owner := &hfv1.VirtualMachine{ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: provisionNS, UID: uid}}
+		return []metav1.OwnerReference{*metav1.NewControllerRef(owner, hfv1.SchemeGroupVersion.WithKind("VirtualMachine"))}
+	}
+	meta := func(name string, ownerRefs []metav1.OwnerReference, age time.Duration) metav1.ObjectMeta {
+		return metav1.ObjectMeta{
+			Name:              name,
+			Namespace:         provisionNS,
+			OwnerReferences:   ownerRefs,
+			CreationTimestamp: metav1.NewTime(time.Now().Add(-age)),
+		}
+	}
+
+	labelled := &ec2v1alpha1.ImportKeyPair{ObjectMeta: meta("labelled", nil, time.Hour)}
+	setVMLabels(labelled, labVM)
+	// machines of a k3s-operator cluster are controlled by the cluster, not a vm
+	controller := true
+	cluster := []metav1.OwnerReference{{APIVersion: "k3s.cattle.io/v1alpha1", Kind: "Cluster", Name: "k3s",
+		UID: "cluster", Controller: &controller}}
+
+	return reaperFixture{
+		kept: []client.Object{
+			vm,
+			labVM,
+			&ec2v1alpha1.Instance{ObjectMeta: meta("owned", owner("vm-live", "live"), time.Hour)},
+			&equinixv1alpha1.Instance{ObjectMeta: meta("fresh", nil, time.Minute)},
+			labelled,
+			&dropletv1alpha1.Instance{ObjectMeta: meta("foreign", cluster, time.Hour)},
+		},
+		orphans: []client.Object{
+			&ec2v1alpha1.Instance{ObjectMeta: meta("stale", owner("vm-gone", "gone"), time.Hour)},
+			&dropletv1alpha1.ImportKeyPair{ObjectMeta: meta("replaced", owner("vm-live", "earlier"), time.Hour)},
+			&equinixv1alpha1.ImportKeyPair{ObjectMeta: meta("unowned", nil, time.Hour)},
+		},
+	}
+}
+
+func (f reaperFixture) reaper(t *testing.T, dryRun bool) (*OrphanReaper, *record.FakeRecorder) {
+	events := record.NewFakeRecorder(100)
+	return &OrphanReaper{
+		Client: fake.NewClientBuilder().WithScheme(testScheme(t)).
+			WithObjects(append(f.kept, f.orphans...)...).Build(),
+		Log:         ctrl.Log.WithName("reaper"),
+		Recorder:    events,
+		GracePeriod: 30 * time.Minute,
+		DryRun:      dryRun,
+	}, events
+}
+
+func TestReaperDeletesOrphans(t *testing.T) {
+	f := newReaperFixture()
+	o, events := f.reaper(t, false)
+	reaped := testutil.ToFloat64(reapedResources.WithLabelValues("aws", "Instance"))
+
+	o.sweep(context.Background())
+
+	for _, obj := range f.orphans {
+		if err := o.Get(context.Background(), client.ObjectKeyFromObject(obj), obj); !errors.IsNotFound(err) {
+			t.Errorf("expected orphan %T %s to be deleted, got %v", obj, obj.GetName(), err)
+		}
+	}
+	for _, obj := range f.kept {
+		if err := o.Get(context.Background(), client.ObjectKeyFromObject(obj), obj); err != nil {
+			t.Errorf("expected %T %s to be kept, got %v", obj, obj.GetName(), err)
+		}
+	}
+	if len(events.Events) != len(f.orphans) {
+		t.Errorf("expected an event per orphan, got %d", len(events.Events))
+	}
+	if got := testutil.ToFloat64(reapedResources.WithLabelValues("aws", "Instance")) - reaped; got != 1 {
+		t.Errorf("expected one reaped aws instance, got %v", got)
+	}
+	if got := testutil.ToFloat64(orphanedResources.WithLabelValues("equinix", "ImportKeyPair", orphanUnowned)); got != 1 {
+		t.Errorf("expected one unowned equinix keypair, got %v", got)
+	}
+}
+
+func TestReaperDryRun(t *testing.T) {
+	f := newReaperFixture()
+	o, events := f.reaper(t, true)
+
+	o.sweep(context.Background())
+
+	for _, obj := range append(f.kept, f.orphans...) {
+		if err := o.Get(context.Background(), client.ObjectKeyFromObject(obj), obj); err != nil {
+			t.Errorf("expected %T %s to be kept in dry run, got %v", obj, obj.GetName(), err)
+		}
+	}
+	if len(events.Events) != len(f.orphans) {
+		t.Errorf("expected an event per orphan, got %d", len(events.Events))
+	}
+	if got := testutil.ToFloat64(orphanedResources.WithLabelValues("aws", "Instance", orphanOwnerMissing)); got != 1 {
+		t.Errorf("expected one aws instance without owner, got %v", got)
+	}
+	if got := testutil.ToFloat64(orphanedResources.WithLabelValues("digitalocean", "ImportKeyPair",
+		orphanOwnerMissing)); got != 1 {
+		t.Errorf("expected one digitalocean keypair owned by a replaced vm, got %v", got)
+	}
+}
@@ -0,0 +1,136 @@
+package controllers
+
+import (
+	"context"
+
+	hfv1 "github.com/hobbyfarm/gargantua/pkg/apis/hobbyfarm.io/v1"
+	shimv1alpha1 "github.com/hobbyfarm/hf-shim-operator/pkg/api/v1alpha1"
+	"github.com/hobbyfarm/hf-shim-operator/pkg/statemachine"
+	v1 "k8s.io/api/core/v1"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+/*
+Info used from environment:
+recycle_on_taint (optional, "true" resets the instances of tainted vms and provisions them again with new keys,
+instead of deleting the vms. only providers implementing recycler support it)
+*/
+
+const (
+	statusRecycling = statemachine.StatusRecycling
+
+	recycleOnTaintKey = "recycle_on_taint"
+)
+
+// recycler is implemented by providers which can reset the instance of a vm in place. Recycle returns true once
+// the instance was reset, after which it is launched again by CreateInstance. Progress which has to be recorded
+// before calling the provider is kept in the annotations of vmp.
+type recycler interface {
+	Recycle(ctx context.Context, vm *hfv1.VirtualMachine, vmp *shimv1alpha1.VirtualMachineProvisioning) (done bool,
+		err error)
+}
+
+// recycleVM resets the instance of a tainted vm, rotates its keys and hands it back to gargantua to be provisioned
+// again. It returns false when the vm has to be deleted instead.
+func (r *VirtualMachineReconciler) recycleVM(ctx context.Context,
+	vm *hfv1.VirtualMachine) (recycled bool, result ctrl.Result, err error) {
+	state := vm.Status.Status
+	switch state {
+	case hfv1.VmStatusRunning:
+		env, err := r.fetchEnvironment(ctx, vm.Status.EnvironmentId, vm.Namespace)
+		if err != nil || env.Spec.EnvironmentSpecifics[recycleOnTaintKey] != "true" {
+			return false, result, nil
+		}
+	case statusRecycling:
+	default:
+		return false, result, nil
+	}
+
+	vmp, err := r.fetchProvisioning(ctx, vm)
+	if err != nil {
+		return true, result, err
+	}
+	var rec recycler
+	if p, err := r.provider(vmp.Status.Provider); err == nil {
+		rec, _ = p.(recycler)
+	}
+	// instances claimed from a warm pool keep the name of the pool member, so they can not be launched again
+	if rec == nil || len(vmp.Status.ClaimedFrom) > 0 {
+		r.providerEvent(ctx, vm, vmp.Status.Provider, v1.EventTypeWarning, "RecycleUnsupported",
+			"%s instance can not be recycled, deleting the vm", vmp.Status.Provider)
+		return false, result, nil
+	}
+
+	if state == hfv1.VmStatusRunning {
+		r.providerEvent(ctx, vm, vmp.Status.Provider, v1.EventTypeNormal, "Recycling",
+			"vm is tainted, resetting its %s instance", vmp.Status.Provider)
+	}
+	done, err := rec.Recycle(ctx, vm, vmp)
+	if err != nil {
+		r.providerEvent(ctx, vm, vmp.Status.Provider, v1.EventTypeWarning, "RecycleFailed",
+			"error resetting %s instance: %v", vmp.Status.Provider, err)
+		return true, result, r.provisioningError(ctx, vm, vmp, err)
+	}
+	if !done {
+		if state != statusRecycling {
+			vm.Status.Status = statusRecycling
+			if err = r.Status().Update(ctx, vm); err != nil {
+				return true, result, err
+			}
+		}
+		return true, ctrl.Result{RequeueAfter: teardownRequeue}, r.recordProvisioning(ctx, vm, vmp, nil,
+			statusRecycling)
+	}
+
+	// createSecret generates new keys for secrets without them
+	secret, err := r.fetchKeySecret(ctx, vm)
+	if err == nil {
+		delete(secret.Data, "public_key")
+		delete(secret.Data, "private_key")
+		err = r.Update(ctx, secret)
+	}
+	if client.IgnoreNotFound(err) != nil {
+		return true, result, err
+	}
+	vmp.Status.Attempt = 0
+	vmp.Status.InstanceType = ""
+	vmp.Status.Timings.StartedAt = nil
+	vmp.Status.Timings.ProvisionedAt = nil
+	vmp.Status.Timings.RunningAt = nil
+	vmp.Status.Timings.ExpiresAt = nil
+	vmp.Status.Timings.IdleSince = nil
+	vmp.Status.Timings.PhonedHomeAt = nil
+	status, err := r.createSecret(ctx, vm, vmp)
+	if err != nil {
+		return true, result, r.provisioningError(ctx, vm, vmp, err)
+	}
+
+	// the vm is free to be claimed by the next session while it is provisioned again
+	if vm.Labels == nil {
+		vm.Labels = make(map[string]string)
+	}
+	vm.Labels["bound"] = "false"
+	vm.Labels["ready"] = "false"
+	vm.Spec.VirtualMachineClaimId = ""
+	vm.Spec.UserId = ""
+	delete(vm.Annotations, "sshEndpoint")
+	status.Allocated = false
+	status.Tainted = false
+	status.PublicIP = ""
+	status.PrivateIP = ""
+	status.Hostname = ""
+
+	vm.Status = *status
+	status = vm.Status.DeepCopy()
+	if err = r.Update(ctx, vm); err != nil {
+		return true, result, err
+	}
+	vm.Status = *status
+	if err = r.Status().Update(ctx, vm); err != nil {
+		return true, result, err
+	}
+	r.providerEvent(ctx, vm, vmp.Status.Provider, v1.EventTypeNormal, "Recycled",
+		"%s instance reset and keys rotated, provisioning the vm again", vmp.Status.Provider)
+	return true, result, r.recordProvisioning(ctx, vm, vmp, nil, state, statusRecycling, vm.Status.Status)
+}
@@ -0,0 +1,144 @@
+package controllers
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	hfv1 "github.com/hobbyfarm/gargantua/pkg/apis/hobbyfarm.io/v1"
+	shimv1alpha1 "github.com/hobbyfarm/hf-shim-operator/pkg/api/v1alpha1"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// recyclingFakeProvider is the fake provider resetting instances by deleting them, which takes a reconcile
+type recyclingFakeProvider struct {
+	*fakeProvider
+}
+
+func (p recyclingFakeProvider) Recycle(ctx context.Context, vm *hfv1.VirtualMachine,
+	vmp *shimv1alpha1.VirtualMachineProvisioning) (bool, error) {
+	p.Lock()
+	defer p.Unlock()
+	if _, ok := p.instances[vm.Name]; !ok {
+		return true, nil
+	}
+	delete(p.instances, vm.Name)
+	return false, nil
+}
+
+// registerRecycling makes the provider available as the fake provider, with support for recycling
+func (p *fakeProvider) registerRecycling() {
+	RegisterProvider(fakeProviderName, func(r *VirtualMachineReconciler) Provider {
+		p.Lock()
+		defer p.Unlock()
+		p.r = r
+		return recyclingFakeProvider{p}
+	})
+}
+
+// claim marks the test vm as used by a session, as gargantua does
+func (h *harness) claim() {
+	h.t.Helper()
+	vm := h.vm()
+	vm.Labels["bound"] = "true"
+	vm.Spec.UserId = "user-test"
+	vm.Spec.VirtualMachineClaimId = "claim-test"
+	if err := h.r.Update(h.ctx, vm); err != nil {
+		h.t.Fatal(err)
+	}
+	vm.Status.Allocated = true
+	h.updateStatus(vm)
+}
+
+func TestRecycleOnTaint(t *testing.T) {
+	p := newFakeProvider()
+	p.registerRecycling()
+	h := newHarness(t, fakeProviderName, map[string]string{recycleOnTaintKey: "true"}, nil)
+	h.setLive(true)
+	h.step(secretCreated)
+	h.step(importKeyPairCreated)
+	h.step(hfv1.VmStatusProvisioned)
+	p.transition(testVMName, fakeInstanceProvisioned, "192.0.2.10")
+	h.step(hfv1.VmStatusRunning)
+	secret, err := h.keySecret()
+	if err != nil {
+		t.Fatal(err)
+	}
+	oldKey := string(secret.Data["public_key"])
+
+	h.claim()
+	h.taint()
+	h.step(statusRecycling)
+	h.expectEvent("Recycling")
+	if _, ok := p.instance(testVMName); ok {
+		t.Fatal("expected the instance to be reset")
+	}
+
+	h.step(secretCreated)
+	h.expectEvent("Recycled")
+	vm := h.vm()
+	if h.deleted() || vm.Status.Tainted || vm.Status.Allocated || vm.Labels["bound"] != "false" ||
+		len(vm.Spec.UserId) > 0 || len(vm.Spec.VirtualMachineClaimId) > 0 {
+		t.Fatalf("expected the vm to be handed back to gargantua, got %+v %+v", vm.Spec, vm.Status)
+	}
+	if secret, err = h.keySecret(); err != nil {
+		t.Fatal(err)
+	}
+	if newKey := string(secret.Data["public_key"]); len(newKey) == 0 || newKey == oldKey {
+		t.Fatal("expected the keys to be rotated")
+	}
+
+	h.step(importKeyPairCreated)
+	h.step(hfv1.VmStatusProvisioned)
+	p.transition(testVMName, fakeInstanceProvisioned, "192.0.2.11")
+	h.step(hfv1.VmStatusRunning)
+	p.Lock()
+	imported := p.keys[testVMName]
+	p.Unlock()
+	if imported != strings.TrimSpace(string(secret.Data["public_key"])) {
+		t.Fatal("expected the rotated key to be imported")
+	}
+	vmp := h.provisioning()
+	if vmp.Status.Phase != shimv1alpha1.PhaseRunning || vmp.Status.Endpoints.PublicIP != "192.0.2.11" {
+		t.Fatalf("expected the recycled vm to run again, got %+v", vmp.Status)
+	}
+	recycled := false
+	for _, transition := range vmp.Status.History {
+		if transition.From == shimv1alpha1.PhaseRecycling && transition.To == shimv1alpha1.PhaseSecretCreated {
+			recycled = true
+		}
+	}
+	if !recycled {
+		t.Fatalf("expected the recycling in the history, got %+v", vmp.Status.History)
+	}
+}
+
+func TestRecycleUnsupported(t *testing.T) {
+	p := newFakeProvider()
+	p.register()
+	h := newHarness(t, fakeProviderName, map[string]string{recycleOnTaintKey: "true"}, nil)
+	h.setLive(true)
+	// the environment is marked invalid as soon as the vm is provisioned
+	h.step(secretCreated)
+	h.expectEvent("RecycleUnsupported")
+	condition := meta.FindStatusCondition(h.provisioning().Status.Conditions, shimv1alpha1.ConditionInvalidConfig)
+	if condition == nil || condition.Status != metav1.ConditionTrue || condition.Reason != "RecycleUnsupported" {
+		t.Fatalf("expected the invalid config condition, got %+v", condition)
+	}
+	h.step(importKeyPairCreated)
+	h.step(hfv1.VmStatusProvisioned)
+	p.transition(testVMName, fakeInstanceProvisioned, "192.0.2.10")
+	h.step(hfv1.VmStatusRunning)
+
+	h.taint()
+	for i := 0; i < 2; i++ {
+		if err := h.reconcile(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	h.expectEvent("RecycleUnsupported")
+	if !h.deleted() {
+		t.Fatal("expected the vm to be deleted")
+	}
+}
@@ -0,0 +1,212 @@
+package controllers
+
+import (
+	"context"
+	"strconv"
+	"strings"
+	"time"
+
+	hfv1 "github.com/hobbyfarm/gargantua/pkg/apis/hobbyfarm.io/v1"
+	shimv1alpha1 "github.com/hobbyfarm/hf-shim-operator/pkg/api/v1alpha1"
+	"github.com/hobbyfarm/hf-shim-operator/pkg/statemachine"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	ctrl "sigs.k8s.io/controller-runtime"
+)
+
+/*
+Annotation set on failed or running vms by hand to provision them again from the first attempt:
+hobbyfarm.io/retry-provisioning
+
+Info used from environment, provisioning is never retried without a provision_timeout:
+provision_timeout (go duration an attempt may take until the vm is running, e.g. 15m)
+provision_max_attempts (optional, defaults to 3)
+fallback_instance_types, fallback_regions, fallback_subnets (optional comma separated lists, used in turn by the
+attempts after the first one. regions apply to the region or metro of the environment)
+*/
+
+const (
+	provisionRetrying  = statemachine.StatusProvisionRetrying
+	provisioningFailed = statemachine.StatusProvisioningFailed
+
+	provisionTimeoutKey         = "provision_timeout"
+	provisionMaxAttemptsKey     = "provision_max_attempts"
+	defaultProvisionMaxAttempts = 3
+
+	retryProvisioningAnnotation = "hobbyfarm.io/retry-provisioning"
+)
+
+// provisionFallback is a fallback list of the environment specifics, and the settings it replaces
+type provisionFallback struct {
+	key         string
+	specifics   []string
+	mappingKeys []string
+}
+
+var provisionFallbacks = []provisionFallback{
+	{key: "fallback_instance_types", mappingKeys: []string{"instanceType"}},
+	{key: "fallback_regions", specifics: []string{"region", "metro"}},
+	{key: "fallback_subnets", specifics: []string{"subnet"}},
+}
+
+// provisioningExpired reports if the current provisioning attempt of vm exceeded the provision_timeout of its
+// environment
+func (r *VirtualMachineReconciler) provisioningExpired(ctx context.Context, vm *hfv1.VirtualMachine,
+	vmp *shimv1alpha1.VirtualMachineProvisioning) bool {
+	switch vm.Status.Status {
+	case secretCreated, importKeyPairCreated, hfv1.VmStatusProvisioned:
+	default:
+		return false
+	}
+
+	env, err := r.fetchEnvironment(ctx, vm.Status.EnvironmentId, vm.Namespace)
+	if err != nil {
+		return false
+	}
+	value, ok := env.Spec.EnvironmentSpecifics[provisionTimeoutKey]
+	if !ok {
+		return false
+	}
+	timeout, err := time.ParseDuration(value)
+	if err != nil {
+		r.Log.Error(err, "invalid provision_timeout in env spec", "environment", env.Name)
+		return false
+	}
+
+	// vms provisioned before the deadline existed are measured from their creation
+	started := vm.CreationTimestamp.Time
+	if vmp.Status.Timings.AttemptStartedAt != nil {
+		started = vmp.Status.Timings.AttemptStartedAt.Time
+	}
+	return time.Since(started) > timeout
+}
+
+// retryRequested reports if the retry annotation was set on a failed or running vm. The annotation is consumed and
+// the attempts of vm start over.
+func retryRequested(vm *hfv1.VirtualMachine, vmp *shimv1alpha1.VirtualMachineProvisioning) bool {
+	if _, ok := vm.Annotations[retryProvisioningAnnotation]; !ok {
+		return false
+	}
+	switch vm.Status.Status {
+	case provisioningFailed, hfv1.VmStatusRunning:
+	default:
+		return false
+	}
+	delete(vm.Annotations, retryProvisioningAnnotation)
+	vmp.Status.Attempt = 0
+	return true
+}
+
+// retryProvisioning tears down the instance of an expired attempt. Once it is gone the vm goes back to importing
+// its key with the next attempt, or is marked failed when it ran out of attempts.
+func (r *VirtualMachineReconciler) retryProvisioning(ctx context.Context, vm *hfv1.VirtualMachine,
+	vmp *shimv1alpha1.VirtualMachineProvisioning) (status *hfv1.VirtualMachineStatus, result ctrl.Result, err error) {
+	status = vm.Status.DeepCopy()
+
+	providerName := r.vmProviderName(ctx, vm, vmp)
+	if len(providerName) > 0 {
+		p, err := r.provider(providerName)
+		if err != nil {
+			return status, result, err
+		}
+		gone, err := p.Teardown(ctx, instanceVM(vm, vmp))
+		if err != nil {
+			return status, result, err
+		}
+		if !gone {
+			return status, ctrl.Result{RequeueAfter: teardownRequeue}, nil
+		}
+	}
+
+	env, err := r.fetchEnvironment(ctx, status.EnvironmentId, vm.Namespace)
+	if err != nil {
+		return status, result, err
+	}
+	maxAttempts := defaultProvisionMaxAttempts
+	if value, ok := env.Spec.EnvironmentSpecifics[provisionMaxAttemptsKey]; ok {
+		if maxAttempts, err = strconv.Atoi(value); err != nil {
+			r.Log.Error(err, "invalid provision_max_attempts in env spec", "environment", env.Name)
+			maxAttempts = defaultProvisionMaxAttempts
+		}
+	}
+
+	// vms retried by hand start over without an attempt
+	attempt := int(vmp.Status.Attempt)
+	if attempt >= maxAttempts {
+		status.Status = provisioningFailed
+		r.providerEvent(ctx, vm, providerName, v1.EventTypeWarning, "ProvisioningFailed",
+			"%s instance did not come up after %d attempts", providerName, attempt)
+		return status, result, nil
+	}
+
+	// the instance of the next attempt comes with new host keys
+	if err = r.forgetHostKeys(ctx, vm); err != nil {
+		return status, result, err
+	}
+
+	attempt++
+	now := metav1.Now()
+	vmp.Status.Attempt = int32(attempt)
+	vmp.Status.InstanceType = ""
+	// the claimed warm instance is gone, the next attempt launches an instance of its own
+	vmp.Status.ClaimedFrom = ""
+	vmp.Status.Timings.AttemptStartedAt = &now
+	vmp.Status.Timings.ProvisionedAt = nil
+	vmp.Status.Timings.PhonedHomeAt = nil
+	delete(vm.Annotations, "sshEndpoint")
+	status.PublicIP = ""
+	status.PrivateIP = ""
+	status.Hostname = ""
+	status.Status = secretCreated
+	r.providerEvent(ctx, vm, providerName, v1.EventTypeNormal, "ProvisioningRetry",
+		"retrying %s provisioning, attempt %d of %d", providerName, attempt, maxAttempts)
+	return status, result, nil
+}
+
+// provisionAttempt returns the current provisioning attempt recorded in vmp, starting at 1
+func provisionAttempt(vmp *shimv1alpha1.VirtualMachineProvisioning) int {
+	if vmp.Status.Attempt < 1 {
+		return 1
+	}
+	return int(vmp.Status.Attempt)
+}
+
+// provisioningEnvironment returns env with the fallbacks of the current attempt of vm applied. The first
+// attempt uses env unchanged, later attempts cycle through the fallback lists.
+func provisioningEnvironment(env *hfv1.Environment, vm *hfv1.VirtualMachine,
+	vmp *shimv1alpha1.VirtualMachineProvisioning) *hfv1.Environment {
+	attempt := provisionAttempt(vmp)
+	if attempt == 1 {
+		return env
+	}
+
+	env = env.DeepCopy()
+	for _, fallback := range provisionFallbacks {
+		var values []string
+		for _, value := range strings.Split(env.Spec.EnvironmentSpecifics[fallback.key], ",") {
+			if value = strings.TrimSpace(value); len(value) > 0 {
+				values = append(values, value)
+			}
+		}
+		if len(values) == 0 {
+			continue
+		}
+		value := values[(attempt-2)%len(values)]
+
+		for _, key := range fallback.specifics {
+			if _, ok := env.Spec.EnvironmentSpecifics[key]; ok {
+				env.Spec.EnvironmentSpecifics[key] = value
+			}
+		}
+		for _, key := range fallback.mappingKeys {
+			if env.Spec.TemplateMapping == nil {
+				env.Spec.TemplateMapping = make(map[string]map[string]string)
+			}
+			if env.Spec.TemplateMapping[vm.Spec.VirtualMachineTemplateId] == nil {
+				env.Spec.TemplateMapping[vm.Spec.VirtualMachineTemplateId] = make(map[string]string)
+			}
+			env.Spec.TemplateMapping[vm.Spec.VirtualMachineTemplateId][key] = value
+		}
+	}
+	return env
+}
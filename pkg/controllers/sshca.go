@@ -0,0 +1,183 @@
+package controllers
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	hfv1 "github.com/hobbyfarm/gargantua/pkg/apis/hobbyfarm.io/v1"
+	"github.com/hobbyfarm/hf-shim-operator/pkg/utils"
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/types"
+)
+
+/*
+Info used from environment, vms get short-lived ssh certificates instead of importing their keypair with
+ssh_ca_secret:
+ssh_ca_secret (optional, secret in the namespace of the vm with the private_key of an ssh certificate authority. its
+public key is trusted through cloud-init, so it is supported by the aws, digitalocean, kubevirt and harvester
+providers only)
+ssh_ca_validity (optional, go duration certificates are valid for, e.g. 8h. defaults to 24h, certificates of
+running vms are renewed once half of it passed)
+ssh_ca_principals (optional, comma separated users certificates are valid for. defaults to the ssh username of the
+vm, or the user the provider checks the liveness of its instances with)
+*/
+
+const (
+	sshCASecretKey     = "ssh_ca_secret"
+	sshCAValidityKey   = "ssh_ca_validity"
+	sshCAPrincipalsKey = "ssh_ca_principals"
+
+	defaultCertificateValidity = 24 * time.Hour
+	// certificateKey holds the ssh user certificate of the vm in its keypair secret
+	certificateKey = "certificate"
+	// trustedUserCAKeysPath is where cloud-init writes the public key of the certificate authority for sshd
+	trustedUserCAKeysPath = "/etc/ssh/trusted_user_ca_keys.pem"
+)
+
+// sshCAProviders are the providers trusting the certificate authority through cloud-init, with the user their
+// liveness checks log in as
+var sshCAProviders = map[string]string{
+	"aws":          "ubuntu",
+	"digitalocean": "root",
+	"kubevirt":     defaultKubeVirtUsername,
+	"harvester":    defaultKubeVirtUsername,
+}
+
+// sshCAEnabled reports if vms of env are authorized with certificates of a certificate authority
+func (r *VirtualMachineReconciler) sshCAEnabled(env *hfv1.Environment) bool {
+	if _, ok := env.Spec.EnvironmentSpecifics[sshCASecretKey]; !ok {
+		return false
+	}
+	if _, ok := sshCAProviders[env.Spec.Provider]; !ok {
+		r.Log.Info("provider does not support ssh_ca_secret, ignoring it", "environment", env.Name,
+			"provider", env.Spec.Provider)
+		return false
+	}
+	return true
+}
+
+// fetchSSHCAKey returns the private key of the certificate authority of env
+func (r *VirtualMachineReconciler) fetchSSHCAKey(ctx context.Context, vm *hfv1.VirtualMachine,
+	env *hfv1.Environment) (caKey []byte, err error) {
+	secret := &v1.Secret{}
+	if err = r.Get(ctx, types.NamespacedName{Name: env.Spec.EnvironmentSpecifics[sshCASecretKey],
+		Namespace: vm.Namespace}, secret); err != nil {
+		return caKey, err
+	}
+	caKey, ok := secret.Data["private_key"]
+	if !ok {
+		return caKey, fmt.Errorf("private_key not found in secret %s", secret.Name)
+	}
+	return caKey, nil
+}
+
+// certificatePrincipals returns the users the certificates of vm are valid for
+func certificatePrincipals(vm *hfv1.VirtualMachine, env *hfv1.Environment) []string {
+	if value, ok := env.Spec.EnvironmentSpecifics[sshCAPrincipalsKey]; ok {
+		var principals []string
+		for _, principal := range strings.Split(value, ",") {
+			if principal = strings.TrimSpace(principal); len(principal) > 0 {
+				principals = append(principals, principal)
+			}
+		}
+		return principals
+	}
+	if len(vm.Spec.SshUsername) > 0 {
+		return []string{vm.Spec.SshUsername}
+	}
+	return []string{sshCAProviders[env.Spec.Provider]}
+}
+
+// ensureCertificate issues a certificate of the certificate authority of env for the public key in secret, the
+// keypair secret of vm. Certificates are kept until half of their validity passed, unless they no longer match the
+// key, principals or certificate authority. It reports if secret changed, and returns when the certificate is due
+// for renewal.
+func (r *VirtualMachineReconciler) ensureCertificate(ctx context.Context, vm *hfv1.VirtualMachine,
+	env *hfv1.Environment, secret *v1.Secret) (changed bool, renewAt time.Time, err error) {
+	caKey, err := r.fetchSSHCAKey(ctx, vm, env)
+	if err != nil {
+		return changed, renewAt, err
+	}
+	caPubKey, err := utils.CAPublicKey(caKey)
+	if err != nil {
+		return changed, renewAt, err
+	}
+	validity := r.lifetimeSetting(env, sshCAValidityKey, defaultCertificateValidity)
+	principals := certificatePrincipals(vm, env)
+	pubKey := string(secret.Data["public_key"])
+
+	if certificate, ok := secret.Data[certificateKey]; ok {
+		validBefore, err := utils.CheckUserCertificate(string(certificate), caPubKey, pubKey, principals)
+		renewAt = validBefore.Add(-validity / 2)
+		if err == nil && time.Now().Before(renewAt) {
+			return false, renewAt, nil
+		}
+	}
+
+	certificate, err := utils.SignUserCertificate(caKey, pubKey, vm.Namespace+"/"+vm.Name, principals, validity)
+	if err != nil {
+		return changed, renewAt, err
+	}
+	secret.Data[certificateKey] = []byte(certificate)
+	return true, time.Now().Add(validity / 2), nil
+}
+
+// renewCertificate renews the certificate of vm once it is due, and returns how long until it is due again. It
+// returns 0 when env has no certificate authority.
+func (r *VirtualMachineReconciler) renewCertificate(ctx context.Context, vm *hfv1.VirtualMachine,
+	env *hfv1.Environment) (renewIn time.Duration, err error) {
+	if !r.sshCAEnabled(env) {
+		return renewIn, nil
+	}
+	secret, err := r.fetchKeySecret(ctx, vm)
+	if err != nil {
+		return renewIn, err
+	}
+	changed, renewAt, err := r.ensureCertificate(ctx, vm, env, secret)
+	if err != nil {
+		return renewIn, err
+	}
+	if changed {
+		if err = r.Update(ctx, secret); err != nil {
+			return renewIn, err
+		}
+		r.event(vm, v1.EventTypeNormal, "CertificateRenewed", "renewed the ssh certificate of the vm")
+	}
+	return time.Until(renewAt), nil
+}
+
+// addTrustedUserCA makes sshd of the instance trust the certificate authority of env with cloudConfig. The public
+// key of vm is authorized as well, as no keypair is imported for it. cloudConfig is unchanged when env has no
+// certificate authority.
+func (r *VirtualMachineReconciler) addTrustedUserCA(ctx context.Context, vm *hfv1.VirtualMachine,
+	env *hfv1.Environment, cloudConfig utils.CloudConfig) error {
+	if !r.sshCAEnabled(env) {
+		return nil
+	}
+	caKey, err := r.fetchSSHCAKey(ctx, vm, env)
+	if err != nil {
+		return err
+	}
+	caPubKey, err := utils.CAPublicKey(caKey)
+	if err != nil {
+		return err
+	}
+	pubKey, err := r.vmPublicKey(ctx, vm)
+	if err != nil {
+		return err
+	}
+
+	cloudConfig.AddAuthorizedKeys(pubKey)
+	cloudConfig.AppendList("write_files", map[interface{}]interface{}{
+		"path":        trustedUserCAKeysPath,
+		"content":     caPubKey,
+		"permissions": "0644",
+	})
+	cloudConfig.AppendList("runcmd",
+		fmt.Sprintf("grep -q '^TrustedUserCAKeys' /etc/ssh/sshd_config || echo 'TrustedUserCAKeys %s' >> "+
+			"/etc/ssh/sshd_config", trustedUserCAKeysPath),
+		"systemctl restart ssh || systemctl restart sshd")
+	return nil
+}
@@ -0,0 +1,124 @@
+package controllers
+
+import (
+	"encoding/base64"
+	"strings"
+	"testing"
+	"time"
+
+	ec2v1alpha1 "github.com/hobbyfarm/ec2-operator/pkg/api/v1alpha1"
+	hfv1 "github.com/hobbyfarm/gargantua/pkg/apis/hobbyfarm.io/v1"
+	"github.com/hobbyfarm/hf-shim-operator/pkg/utils"
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	ctrl "sigs.k8s.io/controller-runtime"
+)
+
+func TestSSHCA(t *testing.T) {
+	h := newHarness(t, "aws", map[string]string{
+		"cred_secret":           "aws-creds",
+		"region":                "us-west-2",
+		"subnet":                "subnet-1",
+		"vpc_security_group_id": "sg-1",
+		sshCASecretKey:          "ssh-ca",
+		sshCAValidityKey:        "8h",
+	}, map[string]string{
+		"image":     "ami-1",
+		"cloudInit": "#cloud-config\npackages: [git]\n",
+	})
+	h.setLive(true)
+	_, caKey, err := utils.GenerateKeyPair(utils.KeyType{Algorithm: utils.KeyAlgorithmED25519})
+	if err != nil {
+		t.Fatal(err)
+	}
+	caPubKey, err := utils.CAPublicKey([]byte(caKey))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the certificate can not be issued without the key of the certificate authority
+	if err := h.reconcile(); err == nil {
+		t.Fatal("expected the missing certificate authority secret to fail the keypair secret")
+	}
+	if err := h.r.Create(h.ctx, &v1.Secret{
+		ObjectMeta: metav1.ObjectMeta{Name: "ssh-ca", Namespace: h.namespace},
+		Data:       map[string][]byte{"private_key": []byte(caKey)},
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	h.step(secretCreated)
+	h.expectEvent("CertificateIssued")
+	secret, err := h.keySecret()
+	if err != nil {
+		t.Fatal(err)
+	}
+	certificate := string(secret.Data[certificateKey])
+	validBefore, err := utils.CheckUserCertificate(certificate, caPubKey, string(secret.Data["public_key"]),
+		[]string{"ubuntu"})
+	if err != nil {
+		t.Fatalf("expected a certificate of the authority for ubuntu: %v", err)
+	}
+	if validity := time.Until(validBefore); validity > 8*time.Hour || validity < 7*time.Hour {
+		t.Fatalf("expected the certificate to be valid for 8h, got %s", validity)
+	}
+
+	// the keypair import is skipped, the instance trusts the certificate authority instead
+	h.step(hfv1.VmStatusProvisioned)
+	h.expectEvent("KeyPairImportSkipped")
+	if err := h.r.Get(h.ctx, h.key(testVMName), &ec2v1alpha1.ImportKeyPair{}); !errors.IsNotFound(err) {
+		t.Fatalf("expected no keypair to be imported, got %v", err)
+	}
+	instance := &ec2v1alpha1.Instance{}
+	h.get(testVMName, instance)
+	userData, err := base64.StdEncoding.DecodeString(instance.Spec.UserData)
+	if err != nil {
+		t.Fatalf("expected base64 encoded user data: %v", err)
+	}
+	if len(instance.Spec.KeyName) != 0 || !strings.Contains(string(userData), strings.TrimSpace(caPubKey)) ||
+		!strings.Contains(string(userData), "TrustedUserCAKeys "+trustedUserCAKeysPath) ||
+		!strings.Contains(string(userData), "#cloud-config\npackages: [git]\n") {
+		t.Fatalf("expected the trusted certificate authority next to the template cloud-init, got %s", userData)
+	}
+	// without an imported keypair the public key of the vm is authorized through cloud-init
+	if !strings.Contains(string(userData), strings.TrimSpace(string(secret.Data["public_key"]))) {
+		t.Fatalf("expected the public key of the vm to be authorized, got %s", userData)
+	}
+
+	instance.Status.Status = "provisioned"
+	instance.Status.InstanceID = "i-1"
+	instance.Status.PublicIP = "198.51.100.7"
+	h.updateStatus(instance)
+	h.step(hfv1.VmStatusRunning)
+	if call := h.lastLivenessCall(); call.certificate != certificate {
+		t.Fatalf("expected the liveness check to present the certificate, got %+v", call)
+	}
+
+	// running vms renew their certificate once it is due
+	result, err := h.r.Reconcile(h.ctx, ctrl.Request{NamespacedName: h.key(testVMName)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.RequeueAfter <= 0 || result.RequeueAfter > 4*time.Hour {
+		t.Fatalf("expected the vm to be requeued to renew its certificate, got %s", result.RequeueAfter)
+	}
+	if secret, err = h.keySecret(); err != nil {
+		t.Fatal(err)
+	}
+	secret.Data[certificateKey] = []byte(caPubKey)
+	if err := h.r.Update(h.ctx, secret); err != nil {
+		t.Fatal(err)
+	}
+	if err := h.reconcile(); err != nil {
+		t.Fatal(err)
+	}
+	h.expectEvent("CertificateRenewed")
+	if secret, err = h.keySecret(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := utils.CheckUserCertificate(string(secret.Data[certificateKey]), caPubKey,
+		string(secret.Data["public_key"]), []string{"ubuntu"}); err != nil {
+		t.Fatalf("expected a renewed certificate: %v", err)
+	}
+}
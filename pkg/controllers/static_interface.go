@@ -0,0 +1,394 @@
+package controllers
+
+import (
+	"context"
+	b64 "encoding/base64"
+	"fmt"
+	"strconv"
+	"strings"
+
+	hfv1 "github.com/hobbyfarm/gargantua/pkg/apis/hobbyfarm.io/v1"
+	"github.com/hobbyfarm/hf-shim-operator/pkg/utils"
+	gossh "golang.org/x/crypto/ssh"
+	"gopkg.in/yaml.v2"
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+/*
+Info needed in environment:
+host_pool (configmap listing the hosts of the pool under the hosts key)
+admin_key_secret (secret with the private_key used to install keys on the hosts)
+scrub_command (optional, run as the admin user when a host is released)
+
+Hosts in the pool configmap, which is read from the namespace of the vms:
+hosts: |
+  - address: 10.0.0.10
+    user: ubuntu
+    adminUser: root
+    port: 22
+    capacity: 2
+    hostKey: ssh-ed25519 AAAA... (authorized_keys line of the host key the admin key is only offered to)
+*/
+
+const (
+	staticHostsKey        = "hosts"
+	staticLeasesKey       = "leases"
+	staticHostAnnotation  = "staticHost"
+	defaultStaticCapacity = 1
+	defaultStaticPort     = 22
+)
+
+func init() {
+	RegisterProvider("static", func(r *VirtualMachineReconciler) Provider {
+		return &staticProvider{r: r}
+	})
+}
+
+// staticProvider leases long lived hosts from a pool described in a configmap. The VM public key is
+// installed on the host when it is leased, and removed again when the host is released.
+type staticProvider struct {
+	r *VirtualMachineReconciler
+}
+
+// staticHost is a single host of a static pool
+type staticHost struct {
+	Address   string `yaml:"address"`
+	User      string `yaml:"user"`
+	AdminUser string `yaml:"adminUser,omitempty"`
+	Port      int    `yaml:"port,omitempty"`
+	Capacity  int    `yaml:"capacity,omitempty"`
+	HostKey   string `yaml:"hostKey,omitempty"`
+}
+
+// staticAdmin is the admin login of a static host
+type staticAdmin struct {
+	user       string
+	privateKey string
+	hostKey    gossh.HostKeyCallback
+	bastion    *utils.Bastion
+}
+
+// staticPool is the parsed state of a pool configmap. leases maps the host addresses to the vms leasing them.
+type staticPool struct {
+	configMap *v1.ConfigMap
+	hosts     []staticHost
+	leases    map[string][]string
+}
+
+// ImportKeyPair leases a host for the VM and installs its public key there
+func (p *staticProvider) ImportKeyPair(ctx context.Context, vm *hfv1.VirtualMachine, env *hfv1.Environment,
+	pubKey string) (status *hfv1.VirtualMachineStatus, err error) {
+	status = vm.Status.DeepCopy()
+
+	pool, err := p.fetchPool(ctx, vm, env)
+	if err != nil {
+		return status, err
+	}
+
+	host, leased := pool.leased(vm)
+	if !leased {
+		var ok bool
+		if host, ok = pool.lease(vm); !ok {
+			return status, fmt.Errorf("no free host left in pool %s", pool.configMap.Name)
+		}
+		if err = pool.save(ctx, p.r); err != nil {
+			return status, err
+		}
+	}
+
+	keyFields := strings.Fields(pubKey)
+	if len(keyFields) < 2 {
+		return status, fmt.Errorf("invalid public key for vm %s", vm.Name)
+	}
+	keyLine := fmt.Sprintf("%s %s %s", keyFields[0], keyFields[1], staticKeyComment(vm))
+	command := fmt.Sprintf("grep -qsF '%[2]s' ~%[1]s/.ssh/authorized_keys || "+
+		"{ mkdir -p ~%[1]s/.ssh && echo '%[2]s' >> ~%[1]s/.ssh/authorized_keys && "+
+		"chown -R %[1]s ~%[1]s/.ssh && chmod 600 ~%[1]s/.ssh/authorized_keys; }", host.User, keyLine)
+	if err = p.adminCommand(ctx, vm, env, host, command); err != nil {
+		// a host leased by this attempt is released again, the next attempt may lease another one
+		if !leased {
+			pool.release(vm)
+			if saveErr := pool.save(ctx, p.r); saveErr != nil {
+				p.r.Log.Error(saveErr, "unable to release static host lease", "host", host.Address)
+			}
+		}
+		return status, fmt.Errorf("error installing key on static host %s: %v", host.Address, err)
+	}
+
+	vm.Annotations[staticHostAnnotation] = host.Address
+	status.Status = importKeyPairCreated
+	return status, nil
+}
+
+// CreateInstance has nothing to launch, the host was leased when importing the key
+func (p *staticProvider) CreateInstance(ctx context.Context, vm *hfv1.VirtualMachine, env *hfv1.Environment,
+	vmTemplate *hfv1.VirtualMachineTemplate) error {
+	if _, ok := vm.Annotations[staticHostAnnotation]; !ok {
+		return fmt.Errorf("no static host leased for vm %s", vm.Name)
+	}
+	return nil
+}
+
+func (p *staticProvider) FetchStatus(ctx context.Context, vm *hfv1.VirtualMachine) (status *hfv1.VirtualMachineStatus,
+	provisioned bool, err error) {
+	status = vm.Status.DeepCopy()
+	host, err := p.leasedHost(ctx, vm)
+	if err != nil {
+		return status, false, err
+	}
+
+	status.PublicIP = host.Address
+	status.PrivateIP = host.Address
+	status.Hostname = host.Address
+	vm.Spec.SshUsername = host.User
+	vm.Annotations["sshEndpoint"] = host.Address
+	return status, true, nil
+}
+
+func (p *staticProvider) LivenessCheck(ctx context.Context, vm *hfv1.VirtualMachine) (bool, error) {
+	return p.RunCommand(ctx, vm, "uptime")
+}
+
+func (p *staticProvider) RunCommand(ctx context.Context, vm *hfv1.VirtualMachine, command string) (bool, error) {
+	host, err := p.leasedHost(ctx, vm)
+	if err != nil {
+		return false, err
+	}
+	return p.r.sshLivenessCheck(ctx, vm, host.address(), host.User, command)
+}
+
+// Teardown removes the VM key from its host, scrubs the host and releases the lease. The lease is looked up in the
+// pool, as it is taken before the host is recorded on the VM.
+func (p *staticProvider) Teardown(ctx context.Context, vm *hfv1.VirtualMachine) (bool, error) {
+	env, err := p.r.fetchEnvironment(ctx, vm.Status.EnvironmentId, vm.Namespace)
+	if err != nil {
+		return errors.IsNotFound(err), client.IgnoreNotFound(err)
+	}
+	pool, err := p.fetchPool(ctx, vm, env)
+	if pool == nil || pool.leases == nil {
+		return errors.IsNotFound(err), client.IgnoreNotFound(err)
+	}
+	if err != nil {
+		return p.releaseUnscrubbed(ctx, vm, pool, err)
+	}
+	host, ok := pool.leased(vm)
+	if !ok {
+		return true, nil
+	}
+
+	admin, err := p.fetchAdmin(ctx, vm, env, host)
+	if err != nil {
+		return p.releaseUnscrubbed(ctx, vm, pool, err)
+	}
+	command := fmt.Sprintf("sed -i '/ %[2]s$/d' ~%[1]s/.ssh/authorized_keys", host.User, staticKeyComment(vm))
+	if scrub, ok := env.Spec.EnvironmentSpecifics["scrub_command"]; ok {
+		command = command + " && " + scrub
+	}
+	if err = admin.run(host, command); err != nil {
+		return false, fmt.Errorf("error scrubbing static host %s: %v", host.Address, err)
+	}
+
+	pool.release(vm)
+	if err = pool.save(ctx, p.r); err != nil {
+		return false, err
+	}
+	delete(vm.Annotations, staticHostAnnotation)
+	return true, nil
+}
+
+// releaseUnscrubbed releases the lease of vm when its host can not be scrubbed because of the configuration of the
+// pool, which would otherwise keep the host leased forever
+func (p *staticProvider) releaseUnscrubbed(ctx context.Context, vm *hfv1.VirtualMachine, pool *staticPool,
+	cause error) (bool, error) {
+	p.r.providerEvent(ctx, vm, "static", v1.EventTypeWarning, "StaticScrubSkipped",
+		"releasing the static host of the vm without scrubbing it: %v", cause)
+	pool.release(vm)
+	if err := pool.save(ctx, p.r); err != nil {
+		return false, err
+	}
+	delete(vm.Annotations, staticHostAnnotation)
+	return true, nil
+}
+
+// leasedHost returns the host leased by vm
+func (p *staticProvider) leasedHost(ctx context.Context, vm *hfv1.VirtualMachine) (host staticHost, err error) {
+	env, err := p.r.fetchEnvironment(ctx, vm.Status.EnvironmentId, vm.Namespace)
+	if err != nil {
+		return host, err
+	}
+	pool, err := p.fetchPool(ctx, vm, env)
+	if err != nil {
+		return host, err
+	}
+	host, ok := pool.leased(vm)
+	if !ok {
+		return host, fmt.Errorf("no static host leased for vm %s", vm.Name)
+	}
+	return host, nil
+}
+
+// adminCommand runs command on host as its admin user
+func (p *staticProvider) adminCommand(ctx context.Context, vm *hfv1.VirtualMachine, env *hfv1.Environment,
+	host staticHost, command string) error {
+	admin, err := p.fetchAdmin(ctx, vm, env, host)
+	if err != nil {
+		return err
+	}
+	return admin.run(host, command)
+}
+
+// fetchAdmin returns the admin login of host. The admin key is only offered to hosts presenting their pinned host
+// key, as it has root on hosts shared by the vms of the pool.
+func (p *staticProvider) fetchAdmin(ctx context.Context, vm *hfv1.VirtualMachine, env *hfv1.Environment,
+	host staticHost) (admin *staticAdmin, err error) {
+	if len(host.HostKey) == 0 {
+		return admin, fmt.Errorf("no hostKey found for static host %s", host.Address)
+	}
+	hostKey, _, _, _, err := gossh.ParseAuthorizedKey([]byte(host.HostKey))
+	if err != nil {
+		return admin, fmt.Errorf("invalid hostKey of static host %s: %v", host.Address, err)
+	}
+	adminSecret, ok := env.Spec.EnvironmentSpecifics["admin_key_secret"]
+	if !ok {
+		return admin, fmt.Errorf("no admin_key_secret found in env spec")
+	}
+	secret := &v1.Secret{}
+	if err = p.r.Get(ctx, types.NamespacedName{Name: adminSecret, Namespace: vm.Namespace}, secret); err != nil {
+		return admin, err
+	}
+	privKey, ok := secret.Data["private_key"]
+	if !ok {
+		return admin, fmt.Errorf("private_key not found in secret %s", secret.Name)
+	}
+	bastion, err := p.r.fetchBastion(ctx, vm, env)
+	if err != nil {
+		return admin, err
+	}
+
+	admin = &staticAdmin{
+		user:       host.User,
+		privateKey: b64.StdEncoding.EncodeToString(privKey),
+		hostKey:    gossh.FixedHostKey(hostKey),
+		bastion:    bastion,
+	}
+	if len(host.AdminUser) > 0 {
+		admin.user = host.AdminUser
+	}
+	return admin, nil
+}
+
+// run runs command on host as the admin user. sudo is used when the admin user is not the lab user.
+func (a *staticAdmin) run(host staticHost, command string) error {
+	if a.user != host.User {
+		command = fmt.Sprintf("sudo -n sh -c %s", strconv.Quote(command))
+	}
+	_, err := utils.RunCommand(host.address(), a.user, a.privateKey, "", command, a.hostKey, a.bastion)
+	return err
+}
+
+// fetchPool fetches and parses the pool configmap of the environment from the namespace of vm. The leases are
+// parsed first, so they are set on pools whose hosts can not be parsed.
+func (p *staticProvider) fetchPool(ctx context.Context, vm *hfv1.VirtualMachine, env *hfv1.Environment) (pool *staticPool,
+	err error) {
+	poolName, ok := env.Spec.EnvironmentSpecifics["host_pool"]
+	if !ok {
+		return pool, fmt.Errorf("no host_pool found in env spec")
+	}
+
+	pool = &staticPool{configMap: &v1.ConfigMap{}}
+	if err = p.r.Get(ctx, types.NamespacedName{Name: poolName, Namespace: vm.Namespace}, pool.configMap); err != nil {
+		return pool, err
+	}
+	leases := make(map[string][]string)
+	if err = yaml.Unmarshal([]byte(pool.configMap.Data[staticLeasesKey]), &leases); err != nil {
+		return pool, fmt.Errorf("error parsing leases of pool %s: %v", poolName, err)
+	}
+	pool.leases = leases
+	if pool.leases == nil {
+		pool.leases = make(map[string][]string)
+	}
+	if err = yaml.Unmarshal([]byte(pool.configMap.Data[staticHostsKey]), &pool.hosts); err != nil {
+		return pool, fmt.Errorf("error parsing hosts of pool %s: %v", poolName, err)
+	}
+	return pool, nil
+}
+
+// leased returns the host leased by vm
+func (s *staticPool) leased(vm *hfv1.VirtualMachine) (host staticHost, ok bool) {
+	for _, host = range s.hosts {
+		for _, holder := range s.leases[host.Address] {
+			if holder == staticLeaseHolder(vm) {
+				return host, true
+			}
+		}
+	}
+	return host, false
+}
+
+// lease records a lease for vm on the least used host with capacity left
+func (s *staticPool) lease(vm *hfv1.VirtualMachine) (host staticHost, ok bool) {
+	free := 0
+	for _, h := range s.hosts {
+		capacity := h.Capacity
+		if capacity == 0 {
+			capacity = defaultStaticCapacity
+		}
+		if left := capacity - len(s.leases[h.Address]); left > free {
+			host, free, ok = h, left, true
+		}
+	}
+	if ok {
+		s.leases[host.Address] = append(s.leases[host.Address], staticLeaseHolder(vm))
+	}
+	return host, ok
+}
+
+// release removes the lease of vm
+func (s *staticPool) release(vm *hfv1.VirtualMachine) {
+	for address, holders := range s.leases {
+		var kept []string
+		for _, holder := range holders {
+			if holder != staticLeaseHolder(vm) {
+				kept = append(kept, holder)
+			}
+		}
+		if len(kept) == 0 {
+			delete(s.leases, address)
+			continue
+		}
+		s.leases[address] = kept
+	}
+}
+
+// save writes the leases back to the pool configmap. Concurrent leases fail with a conflict and are retried.
+func (s *staticPool) save(ctx context.Context, r *VirtualMachineReconciler) error {
+	leases, err := yaml.Marshal(s.leases)
+	if err != nil {
+		return err
+	}
+	if s.configMap.Data == nil {
+		s.configMap.Data = make(map[string]string)
+	}
+	s.configMap.Data[staticLeasesKey] = string(leases)
+	return r.Update(ctx, s.configMap)
+}
+
+func (h staticHost) address() string {
+	port := h.Port
+	if port == 0 {
+		port = defaultStaticPort
+	}
+	return fmt.Sprintf("%s:%d", h.Address, port)
+}
+
+func staticLeaseHolder(vm *hfv1.VirtualMachine) string {
+	return vm.Namespace + "/" + vm.Name
+}
+
+// staticKeyComment marks the keys installed for vm, so they can be removed again on release
+func staticKeyComment(vm *hfv1.VirtualMachine) string {
+	return fmt.Sprintf("hobbyfarm-%s-%s", vm.Namespace, vm.Name)
+}
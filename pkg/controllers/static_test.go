@@ -0,0 +1,165 @@
+package controllers
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	hfv1 "github.com/hobbyfarm/gargantua/pkg/apis/hobbyfarm.io/v1"
+	gossh "golang.org/x/crypto/ssh"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	clientgoscheme "k8s.io/client-go/kubernetes/scheme"
+	"k8s.io/client-go/tools/record"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+)
+
+// testStaticHosts returns the hosts of a pool with a single host, whose host key is pinned
+func testStaticHosts(t *testing.T) string {
+	t.Helper()
+	return "- address: 192.0.2.10\n  user: ubuntu\n  hostKey: " +
+		strings.TrimSpace(string(gossh.MarshalAuthorizedKey(testHostKey(t)))) + "\n"
+}
+
+// staticTest is a static provider with an environment using the classroom-hosts pool, and a vm of it
+type staticTest struct {
+	t      *testing.T
+	ctx    context.Context
+	p      *staticProvider
+	vm     *hfv1.VirtualMachine
+	env    *hfv1.Environment
+	events *record.FakeRecorder
+}
+
+// newStaticTest creates the pool configmap with poolData and objs next to the environment of specifics
+func newStaticTest(t *testing.T, specifics map[string]string, poolData map[string]string,
+	objs ...client.Object) *staticTest {
+	scheme := runtime.NewScheme()
+	if err := clientgoscheme.AddToScheme(scheme); err != nil {
+		t.Fatal(err)
+	}
+	if err := hfv1.AddToScheme(scheme); err != nil {
+		t.Fatal(err)
+	}
+	specifics["host_pool"] = "classroom-hosts"
+	env := &hfv1.Environment{
+		ObjectMeta: metav1.ObjectMeta{Name: "env-test", Namespace: "hobbyfarm"},
+		Spec:       hfv1.EnvironmentSpec{EnvironmentSpecifics: specifics},
+	}
+	vm := &hfv1.VirtualMachine{
+		ObjectMeta: metav1.ObjectMeta{Name: "vm-test", Namespace: "hobbyfarm", Annotations: map[string]string{}},
+		Status:     hfv1.VirtualMachineStatus{EnvironmentId: env.Name},
+	}
+	pool := &v1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{Name: "classroom-hosts", Namespace: "hobbyfarm"},
+		Data:       poolData,
+	}
+	events := record.NewFakeRecorder(100)
+	r := &VirtualMachineReconciler{
+		Client:   fake.NewClientBuilder().WithScheme(scheme).WithObjects(append(objs, env, vm, pool)...).Build(),
+		Log:      ctrl.Log.WithName("test"),
+		Scheme:   scheme,
+		Recorder: events,
+	}
+	return &staticTest{t: t, ctx: context.Background(), p: &staticProvider{r: r}, vm: vm, env: env, events: events}
+}
+
+// leases returns the leases of the pool configmap
+func (s *staticTest) leases() string {
+	s.t.Helper()
+	cm := &v1.ConfigMap{}
+	if err := s.p.r.Get(s.ctx, types.NamespacedName{Name: "classroom-hosts", Namespace: "hobbyfarm"}, cm); err != nil {
+		s.t.Fatal(err)
+	}
+	return cm.Data[staticLeasesKey]
+}
+
+func TestStaticLeases(t *testing.T) {
+	// the admin key can not be parsed, so installing the vm key fails
+	s := newStaticTest(t, map[string]string{"admin_key_secret": "admin-key"},
+		map[string]string{staticHostsKey: testStaticHosts(t)}, &v1.Secret{
+			ObjectMeta: metav1.ObjectMeta{Name: "admin-key", Namespace: "hobbyfarm"},
+			Data:       map[string][]byte{"private_key": []byte("invalid")},
+		})
+
+	_, err := s.p.ImportKeyPair(s.ctx, s.vm, s.env, "ssh-ed25519 AAAAC3NzaC1lZDI1NTE5AAAAIStaticTestKey")
+	if err == nil || !strings.Contains(err.Error(), "error installing key") {
+		t.Fatalf("expected the key install to fail, got %v", err)
+	}
+	if leases := s.leases(); strings.Contains(leases, s.vm.Name) {
+		t.Fatalf("expected the lease to be released after the failed key install, got %q", leases)
+	}
+
+	// leases are released on teardown even when the vm never recorded its host
+	pool, err := s.p.fetchPool(s.ctx, s.vm, s.env)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := pool.lease(s.vm); !ok {
+		t.Fatal("expected a free host")
+	}
+	if err = pool.save(s.ctx, s.p.r); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := s.vm.Annotations[staticHostAnnotation]; ok {
+		t.Fatal("expected no host recorded on the vm")
+	}
+	if done, err := s.p.Teardown(s.ctx, s.vm); done || err == nil {
+		t.Fatalf("expected the teardown to scrub the leased host, got done %v and %v", done, err)
+	}
+	if leases := s.leases(); !strings.Contains(leases, s.vm.Name) {
+		t.Fatalf("expected the lease to be kept until the host was scrubbed, got %q", leases)
+	}
+}
+
+func TestStaticHostKeyRequired(t *testing.T) {
+	s := newStaticTest(t, map[string]string{"admin_key_secret": "admin-key"},
+		map[string]string{staticHostsKey: "- address: 192.0.2.10\n  user: ubuntu\n"})
+
+	// the admin key is never offered to hosts without a pinned host key
+	_, err := s.p.ImportKeyPair(s.ctx, s.vm, s.env, "ssh-ed25519 AAAAC3NzaC1lZDI1NTE5AAAAIStaticTestKey")
+	if err == nil || !strings.Contains(err.Error(), "no hostKey found") {
+		t.Fatalf("expected the host without a host key to be refused, got %v", err)
+	}
+}
+
+func TestStaticTeardownUnscrubbed(t *testing.T) {
+	for name, hosts := range map[string]string{
+		"missing admin key": testStaticHosts(t),
+		"malformed hosts":   "address: [",
+	} {
+		t.Run(name, func(t *testing.T) {
+			s := newStaticTest(t, map[string]string{}, map[string]string{
+				staticHostsKey:  hosts,
+				staticLeasesKey: "192.0.2.10:\n- hobbyfarm/vm-test\n",
+			})
+
+			// hosts which can not be scrubbed are released anyway, instead of being leased forever
+			if done, err := s.p.Teardown(s.ctx, s.vm); !done || err != nil {
+				t.Fatalf("expected the unscrubbed host to be released, got done %v and %v", done, err)
+			}
+			select {
+			case event := <-s.events.Events:
+				if !strings.Contains(event, " StaticScrubSkipped ") {
+					t.Fatalf("expected a StaticScrubSkipped event, got %q", event)
+				}
+			default:
+				t.Fatal("expected a StaticScrubSkipped event")
+			}
+			if leases := s.leases(); strings.Contains(leases, s.vm.Name) {
+				t.Fatalf("expected the lease to be released, got %q", leases)
+			}
+		})
+	}
+}
+
+func TestStaticTeardownWithoutLease(t *testing.T) {
+	s := newStaticTest(t, map[string]string{}, map[string]string{staticHostsKey: testStaticHosts(t)})
+	if done, err := s.p.Teardown(s.ctx, s.vm); !done || err != nil {
+		t.Fatalf("expected vms without a lease to be torn down, got done %v and %v", done, err)
+	}
+}
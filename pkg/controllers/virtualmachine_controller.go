@@ -17,9 +17,11 @@ limitations under the License.
 package controllers
 
 import (
+	"bytes"
 	"context"
 	b64 "encoding/base64"
 	"fmt"
+	"net"
 	"os"
 	"strings"
 	"time"
@@ -28,6 +30,7 @@ import (
 
 	dropletv1alpha1 "github.com/ibrokethecloud/droplet-operator/pkg/api/v1alpha1"
 	"github.com/sirupsen/logrus"
+	gossh "golang.org/x/crypto/ssh"
 
 	"k8s.io/apimachinery/pkg/types"
 
@@ -35,11 +38,14 @@ import (
 
 	"github.com/go-logr/logr"
 	hfv1 "github.com/hobbyfarm/gargantua/pkg/apis/hobbyfarm.io/v1"
-	"github.com/hobbyfarm/gargantua/pkg/util"
+	shimv1alpha1 "github.com/hobbyfarm/hf-shim-operator/pkg/api/v1alpha1"
+	"github.com/hobbyfarm/hf-shim-operator/pkg/statemachine"
+	"github.com/hobbyfarm/hf-shim-operator/pkg/utils"
 	v1 "k8s.io/api/core/v1"
 	"k8s.io/apimachinery/pkg/api/errors"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/tools/record"
 	ctrl "sigs.k8s.io/controller-runtime"
 	"sigs.k8s.io/controller-runtime/pkg/client"
 	ctrlCtrl "sigs.k8s.io/controller-runtime/pkg/controller"
@@ -52,20 +58,42 @@ type VirtualMachineReconciler struct {
 	Log     logr.Logger
 	Scheme  *runtime.Scheme
 	Threads int
+	// Recorder publishes the provisioning events of VMs
+	Recorder record.EventRecorder
+	// TeardownTimeout bounds how long a deleted VM waits for its provider resources to be gone
+	TeardownTimeout time.Duration
+	// LivenessChecker runs the ssh liveness checks, defaults to utils.PerformLivenessCheck
+	LivenessChecker LivenessChecker
+	// PhoneHomeURL is the external url of the phone home endpoint, which instances of environments with
+	// phone_home call once they are up
+	PhoneHomeURL string
 }
 
+// LivenessChecker runs command on address over ssh and reports if the instance is ready. The host key of the
+// instance is verified with hostKeyCallback, and the connection is tunnelled through bastion when it is set.
+// certificate is the ssh user certificate of privateKey, which is empty for vms without a certificate authority.
+type LivenessChecker func(address string, userName string, privateKey string, certificate string, command string,
+	hostKeyCallback gossh.HostKeyCallback, bastion *utils.Bastion) (ready bool, err error)
+
 var provisionNS = "hobbyfarm"
 var defaultInstanceType = "t2.medium"
 
 const (
-	secretCreated              = "SecretCreated"
-	importKeyPairCreated       = "ImportKeyPairCreated"
+	secretCreated              = statemachine.StatusSecretCreated
+	importKeyPairCreated       = statemachine.StatusImportKeyPairCreated
 	defaultDOInstanceType      = "s-4vcpu-8gb"
 	defaultEquinixInstanceType = "c3.small.x86"
 	defaultEquinixBillingCycle = "hourly"
 	defaultIPXEScriptURL       = "https://raw.githubusercontent.com/ibrokethecloud/custom_pxe/master/shell.ipxe"
 
-	instanceTypeAnnotation = "hobbyfarm.io/instance-type"
+	// labels tracking the vm of objects which can not be owned by it
+	vmLabel          = "hobbyfarm.io/vm"
+	vmNamespaceLabel = "hobbyfarm.io/vm-namespace"
+
+	// teardownFinalizer holds deleted VMs until the provider resources backing them are gone
+	teardownFinalizer      = "shim.hobbyfarm.io/teardown"
+	defaultTeardownTimeout = 10 * time.Minute
+	teardownRequeue        = 10 * time.Second
 )
 
 func init() {
@@ -91,9 +119,26 @@ func (r *VirtualMachineReconciler) Reconcile(ctx context.Context, req ctrl.Reque
 		log.Error(err, "unable to fetch virtualmachine")
 		return ctrl.Result{}, client.IgnoreNotFound(err)
 	}
+	// warm pool members handed over to another vm are deleted by the claiming vm, once their resources moved
+	if _, claimed := vm.Labels[warmPoolClaimLabel]; claimed {
+		return ctrl.Result{}, nil
+	}
+
 	// initialize status //
 	status := vm.Status.DeepCopy()
 
+	// providers publish the ssh endpoint for gargantua in the annotations
+	if vm.GetAnnotations() == nil {
+		vm.Annotations = make(map[string]string)
+	}
+
+	// tainted vms of environments recycling them are reset and provisioned again instead of being deleted
+	if (vm.Status.Tainted || vm.Status.Status == statusRecycling) && vm.ObjectMeta.DeletionTimestamp.IsZero() {
+		if recycled, result, err := r.recycleVM(ctx, vm); recycled {
+			return result, err
+		}
+	}
+
 	// we only delete VMs that are tainted (and that also haven't already been deleted)
 	// tainting occurs when a session ends, and gargantua marks the vm as tainted, indicating recycling can occur
 	if vm.Status.Tainted && vm.ObjectMeta.DeletionTimestamp.IsZero() {
@@ -107,55 +152,129 @@ func (r *VirtualMachineReconciler) Reconcile(ctx context.Context, req ctrl.Reque
 			}
 		}
 
-		// now that the vm is not ready, we can proceed with deleting it
+		// now that the vm is not ready, we can proceed with deleting it. the teardown finalizer
+		// keeps it around until the provider resources are gone.
 		if err := r.Delete(ctx, vm); err != nil {
 			log.Error(fmt.Errorf("ErrDelete"), "Error deleting VM")
 			return ctrl.Result{}, nil
 		}
+		r.providerEvent(ctx, vm, r.environmentProvider(ctx, vm), v1.EventTypeNormal, "Deleting",
+			"vm is tainted, deleting it")
 		log.Info("VM deleted")
+		return ctrl.Result{}, nil
 	}
 
-	if vm.ObjectMeta.DeletionTimestamp.IsZero() {
-		// provisioning logic
-		switch state := vm.Status.Status; state {
-		case hfv1.VmStatusRFP:
-			status, err = r.createSecret(ctx, vm)
-			if err != nil {
-				return ctrl.Result{}, err
-			}
-		case secretCreated:
-			status, err = r.createImportKeyPair(ctx, vm)
-			if err != nil {
-				return ctrl.Result{}, err
-			}
-		case importKeyPairCreated:
-			status, err = r.launchInstance(ctx, vm)
-			if err != nil {
-				return ctrl.Result{}, err
-			}
-		case hfv1.VmStatusProvisioned:
-			status, err = r.fetchVMDetails(ctx, vm)
-			if err != nil {
-				return ctrl.Result{}, err
+	if !vm.ObjectMeta.DeletionTimestamp.IsZero() {
+		vmp, err := r.fetchProvisioning(ctx, vm)
+		if err != nil {
+			return ctrl.Result{}, err
+		}
+		if err := r.recordProvisioning(ctx, vm, vmp, nil, hfv1.VmStatusTerminating); err != nil {
+			return ctrl.Result{}, err
+		}
+		return r.finalizeVM(ctx, vm, vmp)
+	}
+
+	// gargantua sets the status after creating the vm
+	if len(vm.Status.Status) == 0 {
+		return ctrl.Result{}, nil
+	}
+
+	vmp, err := r.fetchProvisioning(ctx, vm)
+	if err != nil {
+		return ctrl.Result{}, err
+	}
+
+	// vms provisioned before the finalizer existed get it on their next reconcile
+	finalizerAdded := !controllerutil.ContainsFinalizer(vm, teardownFinalizer)
+	controllerutil.AddFinalizer(vm, teardownFinalizer)
+
+	// the instances of paused vms are stopped, and started again once the vms are resumed
+	if !finalizerAdded {
+		if handled, result, err := r.hibernateVM(ctx, vm, vmp); handled {
+			return result, err
+		}
+	}
+
+	// attempts which did not come up in time are torn down and provisioned again
+	previous := vm.Status.Status
+	if r.provisioningExpired(ctx, vm, vmp) {
+		r.providerEvent(ctx, vm, vmp.Status.Provider, v1.EventTypeWarning, "ProvisioningTimeout",
+			"provisioning attempt %d did not finish in time", provisionAttempt(vmp))
+		vm.Status.Status = provisionRetrying
+	}
+	if retryRequested(vm, vmp) {
+		r.providerEvent(ctx, vm, vmp.Status.Provider, v1.EventTypeNormal, "RetryRequested",
+			"provisioning was retried by hand, starting over from the first attempt")
+		vm.Status.Status = provisionRetrying
+	}
+
+	// provisioning logic
+	var result ctrl.Result
+	switch state := vm.Status.Status; state {
+	case hfv1.VmStatusRFP:
+		var claimed bool
+		status, claimed, err = r.claimWarmInstance(ctx, vm, vmp)
+		if err == nil && !claimed {
+			status, err = r.createSecret(ctx, vm, vmp)
+		}
+	case secretCreated:
+		status, err = r.createImportKeyPair(ctx, vm, vmp)
+	case importKeyPairCreated:
+		status, err = r.launchInstance(ctx, vm, vmp)
+	case hfv1.VmStatusProvisioned:
+		status, err = r.fetchVMDetails(ctx, vm, vmp)
+	case provisionRetrying:
+		status, result, err = r.retryProvisioning(ctx, vm, vmp)
+	case hfv1.VmStatusRunning, provisioningFailed, hfv1.VmStatusTerminating:
+		if !finalizerAdded {
+			if state == hfv1.VmStatusRunning {
+				return r.enforceLifetime(ctx, vm, vmp)
 			}
-		case hfv1.VmStatusRunning:
-			return ctrl.Result{}, nil
-		case "default":
-			return ctrl.Result{Requeue: false}, fmt.Errorf("VM in an undefined state. Ignoring")
+			return ctrl.Result{}, r.recordProvisioning(ctx, vm, vmp, nil, state)
 		}
-		vm.Status = *status
+	default:
+		// statuses of earlier versions, or set by hand, restart provisioning from scratch. the steps
+		// update existing keys and instances in place.
+		r.event(vm, v1.EventTypeWarning, "UnknownStatus", "vm status %q is unknown, restarting provisioning", state)
+		status.Status = hfv1.VmStatusRFP
 	}
+	if err != nil {
+		return ctrl.Result{}, r.provisioningError(ctx, vm, vmp, err)
+	}
+
+	state := vm.Status.Status
+	if _, known := statemachine.PhaseOf(state); known && !statemachine.CanTransitionStatus(state, status.Status) {
+		err = fmt.Errorf("%w from %s to %s", statemachine.ErrIllegalTransition, state, status.Status)
+		r.event(vm, v1.EventTypeWarning, "IllegalTransition", "%v", err)
+		return ctrl.Result{}, r.provisioningError(ctx, vm, vmp, err)
+	}
+
+	vm.Status = *status
 	// if ignoreVM is not true.. we need to requeue to make sure we check the
 	// ssh works
-	err = r.Status().Update(ctx, vm.DeepCopy())
+	// the update returns the stored status, so keep a copy of the new one to write afterwards
+	status = vm.Status.DeepCopy()
+	err = r.Update(ctx, vm)
 	if err != nil {
 		return ctrl.Result{}, err
 	}
 
-	return ctrl.Result{}, r.Update(ctx, vm)
+	vm.Status = *status
+	if err = r.Status().Update(ctx, vm); err != nil {
+		return ctrl.Result{}, err
+	}
+	// the lifetime limits of running vms are enforced by reconciling them again
+	if state != hfv1.VmStatusRunning && vm.Status.Status == hfv1.VmStatusRunning {
+		result.Requeue = true
+	}
+	return result, r.recordProvisioning(ctx, vm, vmp, nil, previous, state, vm.Status.Status)
 }
 
 func (r *VirtualMachineReconciler) SetupWithManager(mgr ctrl.Manager) error {
+	if err := registerProvisioningCollector(mgr.GetClient()); err != nil {
+		return err
+	}
 	return ctrl.NewControllerManagedBy(mgr).
 		WithOptions(ctrlCtrl.Options{
 			MaxConcurrentReconciles: r.Threads,
@@ -167,6 +286,8 @@ func (r *VirtualMachineReconciler) SetupWithManager(mgr ctrl.Manager) error {
 		Owns(&dropletv1alpha1.Instance{}).
 		Owns(&dropletv1alpha1.ImportKeyPair{}).
 		Owns(&v1.Secret{}).
+		Owns(&v1.Service{}).
+		Owns(&shimv1alpha1.VirtualMachineProvisioning{}).
 		Complete(r)
 }
 
@@ -194,166 +315,356 @@ func (r *VirtualMachineReconciler) fetchVMTemplate(ctx context.Context,
 }
 
 // Launch a new EC2 Instance
-func (r *VirtualMachineReconciler) launchInstance(ctx context.Context,
-	vm *hfv1.VirtualMachine) (status *hfv1.VirtualMachineStatus,
-	err error) {
+func (r *VirtualMachineReconciler) launchInstance(ctx context.Context, vm *hfv1.VirtualMachine,
+	vmp *shimv1alpha1.VirtualMachineProvisioning) (status *hfv1.VirtualMachineStatus, err error) {
 	status = vm.Status.DeepCopy()
 	vmTemplate, err := r.fetchVMTemplate(ctx, vm.Spec.VirtualMachineTemplateId, vm.Namespace)
 	if err != nil {
-		status.Status = "Error Fetching VMTemplate"
 		return status, err
 	}
 
 	environment, err := r.fetchEnvironment(ctx, status.EnvironmentId, vm.Namespace)
 	if err != nil {
-		status.Status = "Error fetching Environment"
 		return status, err
 	}
+	environment = provisioningEnvironment(environment, vm, vmp)
 
 	// create a associated cloud provider instance //
-	switch environment.Spec.Provider {
-	case "aws":
-		err = r.createEC2Instance(ctx, vm, environment, vmTemplate)
-	case "digitalocean":
-		err = r.createDropletInstance(ctx, vm, environment, vmTemplate)
-	case "equinix":
-		err = r.createEquinixInstance(ctx, vm, environment, vmTemplate)
-	default:
-		err = fmt.Errorf("unsupported environment type. currently support aws and digitalocean environments only")
+	p, err := r.provider(environment.Spec.Provider)
+	if err == nil {
+		err = p.CreateInstance(ctx, vm, environment, vmTemplate)
 	}
 
 	if err != nil {
 		r.Log.Info("Error during instance creation")
+		r.providerEvent(ctx, vm, environment.Spec.Provider, v1.EventTypeWarning, "InstanceCreateFailed",
+			"error creating %s instance: %v", environment.Spec.Provider, err)
 		return status, err
 	}
+	r.providerEvent(ctx, vm, environment.Spec.Provider, v1.EventTypeNormal, "InstanceCreated",
+		"%s instance created", environment.Spec.Provider)
+	vmp.Status.InstanceType = templateInstanceType(environment, vmTemplate.Name)
 	status.WsEndpoint = environment.Spec.WsEndpoint
 	status.Status = hfv1.VmStatusProvisioned
 	return status, nil
 }
 
-// create a managed secret which contains the ssh keys
-func (r *VirtualMachineReconciler) createSecret(ctx context.Context, vm *hfv1.VirtualMachine) (status *hfv1.VirtualMachineStatus, err error) {
+// create a managed secret which contains the ssh keys. The secret lives in the provisioning namespace, where
+// gargantua reads it from through vm.Spec.KeyPair, and is tracked by the labels and finalizer set in trackKeySecret.
+func (r *VirtualMachineReconciler) createSecret(ctx context.Context, vm *hfv1.VirtualMachine,
+	vmp *shimv1alpha1.VirtualMachineProvisioning) (status *hfv1.VirtualMachineStatus, err error) {
 	status = vm.Status.DeepCopy()
 
-	// setup annotations for the first run it doesnt exist
-	if vm.GetAnnotations() == nil {
-		vm.Annotations = make(map[string]string)
+	env, err := r.fetchEnvironment(ctx, status.EnvironmentId, vm.Namespace)
+	if err != nil {
+		return status, err
+	}
+	keyType, err := vmKeyType(env, vm.Spec.VirtualMachineTemplateId)
+	if err != nil {
+		r.providerEvent(ctx, vm, env.Spec.Provider, v1.EventTypeWarning, "KeySecretFailed",
+			"invalid ssh key type: %v", err)
+		return status, err
+	}
+	r.checkFeatures(ctx, vm, vmp, env)
+
+	secretName := keySecretName(vm)
+	keypair := &v1.Secret{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      secretName,
+			Namespace: provisionNS,
+		},
 	}
 
-	_, created := vm.Annotations["secret"]
-	secretName := strings.Join([]string{vm.Name + "-secret"}, "-")
-	existingSecret := &v1.Secret{}
-	err = r.Get(ctx, types.NamespacedName{Namespace: provisionNS, Name: secretName}, existingSecret)
-
-	if !created && errors.IsNotFound(err) {
-		logrus.Info("creating new keypair")
-		pubKey, privKey, err := util.GenKeyPair()
-
-		if err != nil {
-			status.Status = "Error generating ssh keypair"
-			return status, err
+	caEnabled := r.sshCAEnabled(env)
+	generated, issued := false, false
+	if _, err = controllerutil.CreateOrUpdate(ctx, r.Client, keypair, func() error {
+		if name, ok := keypair.Labels[vmLabel]; ok && (name != vm.Name || keypair.Labels[vmNamespaceLabel] != vm.Namespace) {
+			return fmt.Errorf("secret %s belongs to vm %s/%s", secretName, keypair.Labels[vmNamespaceLabel], name)
 		}
 
-		secretData := make(map[string][]byte)
-		secretData["public_key"] = []byte(pubKey)
-		secretData["private_key"] = []byte(privKey)
-		keypair := &v1.Secret{
-			ObjectMeta: metav1.ObjectMeta{
-				Name:      secretName,
-				Namespace: provisionNS,
-			},
+		if len(keypair.Data["public_key"]) == 0 || len(keypair.Data["private_key"]) == 0 {
+			logrus.Info("creating new keypair")
+			pubKey, privKey, err := utils.GenerateKeyPair(keyType)
+			if err != nil {
+				return err
+			}
+			keypair.Data = map[string][]byte{
+				"public_key":     []byte(pubKey),
+				"private_key":    []byte(privKey),
+				keyTypeSecretKey: []byte(keyType.String()),
+			}
+			generated = true
 		}
-
-		if _, err = controllerutil.CreateOrUpdate(ctx, r.Client, keypair, func() error {
-
-			keypair.Data = secretData
-
-			if err := controllerutil.SetControllerReference(vm, keypair, r.Scheme); err != nil {
-				r.Log.Error(err, "unable to set ownerReference for secret")
+		if caEnabled {
+			changed, _, err := r.ensureCertificate(ctx, vm, env, keypair)
+			if err != nil {
 				return err
 			}
-
-			return nil
-		}); err != nil {
-			r.Log.Error(fmt.Errorf("Error creating secret "), secretName)
-			return status, err
+			issued = changed
 		}
 
-		vm.Annotations["pubKey"] = b64.StdEncoding.EncodeToString([]byte(pubKey))
-
-	} else {
-		vm.Annotations["pubKey"] = b64.StdEncoding.EncodeToString(existingSecret.Data["public_key"])
-		vm.Spec.KeyPair = secretName
+		return r.trackKeySecret(vm, keypair)
+	}); err != nil {
+		r.Log.Error(fmt.Errorf("Error creating secret "), secretName)
+		r.providerEvent(ctx, vm, r.environmentProvider(ctx, vm), v1.EventTypeWarning, "KeySecretFailed",
+			"error creating keypair secret %s/%s: %v", provisionNS, secretName, err)
+		return status, err
 	}
+
 	vm.Spec.KeyPair = secretName
 	status.Status = secretCreated
-	vm.Annotations["secret"] = "created"
-	vm.Annotations["secretName"] = secretName
-	return status, err
+	if generated {
+		r.providerEvent(ctx, vm, r.environmentProvider(ctx, vm), v1.EventTypeNormal, "KeyPairGenerated",
+			"generated %s ssh keypair", keyType)
+	} else {
+		r.providerEvent(ctx, vm, r.environmentProvider(ctx, vm), v1.EventTypeNormal, "KeyPairReused",
+			"reusing the ssh keypair of the existing secret")
+	}
+	if issued {
+		r.providerEvent(ctx, vm, r.environmentProvider(ctx, vm), v1.EventTypeNormal, "CertificateIssued",
+			"issued an ssh certificate for %s", strings.Join(certificatePrincipals(vm, env), ", "))
+	}
+
+	now := metav1.Now()
+	vmp.Status.KeySecret = secretName
+	if vmp.Status.Attempt == 0 {
+		vmp.Status.Attempt = 1
+	}
+	if vmp.Status.Timings.StartedAt == nil {
+		vmp.Status.Timings.StartedAt = &now
+	}
+	vmp.Status.Timings.AttemptStartedAt = &now
+	return status, nil
 }
 
 // fetch ec2 instance details to update the vm status
 
-func (r *VirtualMachineReconciler) fetchVMDetails(ctx context.Context,
-	vm *hfv1.VirtualMachine) (status *hfv1.VirtualMachineStatus, err error) {
-	cloudProvider, ok := vm.Annotations["cloudProvider"]
-	if !ok {
-		return status, fmt.Errorf("no vm annotation for cloudProvider exists")
-	}
-	switch cloudProvider {
-	case "aws":
-		status, err = r.fetchEC2Instance(ctx, vm)
-	case "digitalocean":
-		status, err = r.fetchDOInstance(ctx, vm)
-	case "equinix":
-		status, err = r.fetchEquinixInstance(ctx, vm)
-	default:
-		return status, fmt.Errorf("unsupported cloud provider in fetchVMDetails")
+func (r *VirtualMachineReconciler) fetchVMDetails(ctx context.Context, vm *hfv1.VirtualMachine,
+	vmp *shimv1alpha1.VirtualMachineProvisioning) (status *hfv1.VirtualMachineStatus, err error) {
+	status = vm.Status.DeepCopy()
+	if len(vmp.Status.Provider) == 0 {
+		return status, fmt.Errorf("no provider recorded for vm")
 	}
+	p, err := r.provider(vmp.Status.Provider)
 	if err != nil {
-		vm.Labels["ready"] = "true"
+		return status, err
+	}
+	status, provisioned, err := p.FetchStatus(ctx, vm)
+	if err != nil {
+		if err != errVMNotRunning {
+			r.providerEvent(ctx, vm, vmp.Status.Provider, v1.EventTypeWarning, "InstanceStatusFailed",
+				"error fetching %s instance status: %v", vmp.Status.Provider, err)
+		}
+		return status, err
+	}
+	if provisioned {
+		now := metav1.Now()
+		if vmp.Status.Timings.ProvisionedAt == nil {
+			vmp.Status.Timings.ProvisionedAt = &now
+		}
+		env, err := r.fetchEnvironment(ctx, vm.Status.EnvironmentId, vm.Namespace)
+		if err != nil {
+			return status, err
+		}
+		// instances of environments with phone_home are ready once they called the phone home endpoint
+		phoneHome := r.phoneHomeMode(env)
+		if len(phoneHome) > 0 && vmp.Status.Timings.PhonedHomeAt == nil {
+			return status, errVMNotRunning
+		}
+		if phoneHome != phoneHomeOnly {
+			ready, err := p.LivenessCheck(ctx, vm)
+			livenessChecks.WithLabelValues(vmp.Status.Provider).Inc()
+			if err != nil || !ready {
+				livenessCheckFailures.WithLabelValues(vmp.Status.Provider).Inc()
+				// instances fail their liveness checks until ssh is up, which is not an error of the vm
+				cause := "instance is not ready"
+				if err != nil {
+					cause = err.Error()
+				}
+				r.providerEvent(ctx, vm, vmp.Status.Provider, v1.EventTypeWarning, "LivenessCheckFailed",
+					"%s instance failed its liveness check: %s", vmp.Status.Provider, cause)
+				return status, errVMNotRunning
+			}
+		}
+		if err = r.probeReadiness(ctx, vm, vmp, p, status); err != nil {
+			r.providerEvent(ctx, vm, vmp.Status.Provider, v1.EventTypeWarning, "ReadinessProbeFailed",
+				"%s instance is not ready: %v", vmp.Status.Provider, err)
+			return status, errVMNotRunning
+		}
+		status.Status = hfv1.VmStatusRunning
+		vmp.Status.Timings.RunningAt = &now
+		observeTimeToRunning(vm, vmp, now.Time)
+		check := "passed its liveness check"
+		if phoneHome == phoneHomeOnly {
+			check = "phoned home"
+		}
+		r.providerEvent(ctx, vm, vmp.Status.Provider, v1.EventTypeNormal, "LivenessCheckPassed",
+			"%s instance %s and is running", vmp.Status.Provider, check)
+	}
+	if status.Status != hfv1.VmStatusRunning {
+		return status, errVMNotRunning
 	}
 	// VM is provisioned and we have all the endpoint info we needed //
 	return status, err
 }
 
-func (r *VirtualMachineReconciler) createImportKeyPair(ctx context.Context, vm *hfv1.VirtualMachine) (status *hfv1.VirtualMachineStatus, err error) {
+func (r *VirtualMachineReconciler) createImportKeyPair(ctx context.Context, vm *hfv1.VirtualMachine,
+	vmp *shimv1alpha1.VirtualMachineProvisioning) (status *hfv1.VirtualMachineStatus, err error) {
 
 	status = vm.Status.DeepCopy()
 
-	b64PubKey, ok := vm.Annotations["pubKey"]
-	if !ok {
-		return status, fmt.Errorf("unable to find label pubKey on VM")
+	pubKey, err := r.vmPublicKey(ctx, vm)
+	if err != nil {
+		return status, err
 	}
 
-	pubKeyByte, err := b64.StdEncoding.DecodeString(b64PubKey)
+	env, err := r.fetchEnvironment(ctx, status.EnvironmentId, vm.Namespace)
 	if err != nil {
 		return status, err
 	}
+	env = provisioningEnvironment(env, vm, vmp)
 
-	pubKey := strings.TrimSpace(string(pubKeyByte))
-
-	env, err := r.fetchEnvironment(ctx, status.EnvironmentId, vm.Namespace)
+	p, err := r.provider(env.Spec.Provider)
 	if err != nil {
 		return status, err
 	}
+	vmp.Status.Provider = env.Spec.Provider
+	// instances trusting a certificate authority get no keypair, they are launched right away
+	if r.sshCAEnabled(env) {
+		r.providerEvent(ctx, vm, env.Spec.Provider, v1.EventTypeNormal, "KeyPairImportSkipped",
+			"%s instances trust the ssh certificate authority, skipping the keypair import", env.Spec.Provider)
+		return r.launchInstance(ctx, vm, vmp)
+	}
+	status, err = p.ImportKeyPair(ctx, vm, env, pubKey)
+	if err != nil {
+		r.providerEvent(ctx, vm, env.Spec.Provider, v1.EventTypeWarning, "KeyPairImportFailed",
+			"error importing keypair to %s: %v", env.Spec.Provider, err)
+		return status, err
+	}
+	r.providerEvent(ctx, vm, env.Spec.Provider, v1.EventTypeNormal, "KeyPairImported", "keypair imported to %s",
+		env.Spec.Provider)
+	return status, nil
+}
 
-	switch env.Spec.Provider {
-	case "aws":
-		status, err = r.createEC2ImportKeyPair(ctx, vm, env, pubKey)
-	case "digitalocean":
-		status, err = r.createDOImportKeyPair(ctx, vm, env, pubKey)
-	case "equinix":
-		status, err = r.createEquinixImportKeyPair(ctx, vm, env, pubKey)
-	default:
-		err = fmt.Errorf("unsupported environment type. currently support aws and digitalocean environments only")
+// sshLivenessCheck runs command on address over ssh, authenticating with the private key from the VM keypair secret.
+// username is used when the VM has no ssh username of its own. The host key of the instance is recorded in the
+// known_hosts of the secret on first use, and connections presenting another host key are refused. Environments
+// with a bastion are reached through it, and vms of environments with a certificate authority present their ssh
+// certificate.
+func (r *VirtualMachineReconciler) sshLivenessCheck(ctx context.Context, vm *hfv1.VirtualMachine,
+	address string, username string, command string) (ready bool, err error) {
+	keySecret, err := r.fetchKeySecret(ctx, vm)
+	if err != nil {
+		return ready, err
+	}
+	if len(vm.Spec.SshUsername) != 0 {
+		username = vm.Spec.SshUsername
 	}
 
-	vm.Annotations["cloudProvider"] = env.Spec.Provider
-	return status, err
+	privKey, ok := keySecret.Data["private_key"]
+	if !ok {
+		return ready, fmt.Errorf("private_key not found in secret %s", keySecret.Name)
+	}
+	encodeKey := b64.StdEncoding.EncodeToString(privKey)
+
+	env, err := r.fetchEnvironment(ctx, vm.Status.EnvironmentId, vm.Namespace)
+	if err != nil {
+		return ready, err
+	}
+	bastion, err := r.fetchBastion(ctx, vm, env)
+	if err != nil {
+		return ready, err
+	}
+	publishBastion(vm, env, bastion, address)
+	// vms of environments with a certificate authority present their certificate, renewed when it is due
+	var certificate string
+	if r.sshCAEnabled(env) {
+		changed, _, err := r.ensureCertificate(ctx, vm, env, keySecret)
+		if err != nil {
+			return ready, err
+		}
+		if changed {
+			if err = r.Update(ctx, keySecret); err != nil {
+				return ready, err
+			}
+		}
+		certificate = string(keySecret.Data[certificateKey])
+	}
+
+	livenessCheck := r.LivenessChecker
+	if livenessCheck == nil {
+		livenessCheck = utils.PerformLivenessCheck
+	}
+	// the ssh client does not wrap the errors of the callback, so a mismatch is kept aside
+	var knownHosts []byte
+	var mismatch error
+	ready, err = livenessCheck(address, username, encodeKey, certificate, command,
+		func(hostname string, remote net.Addr, key gossh.PublicKey) error {
+			knownHosts, mismatch = utils.VerifyHostKey(keySecret.Data[knownHostsKey], keySecret.Data[hostKeysKey],
+				hostname, key)
+			return mismatch
+		}, bastion)
+	if mismatch != nil {
+		r.event(vm, v1.EventTypeWarning, "HostKeyMismatch", "refusing to connect: %v", mismatch)
+		return false, mismatch
+	}
+	if len(knownHosts) > 0 && !bytes.Equal(knownHosts, keySecret.Data[knownHostsKey]) {
+		keySecret.Data[knownHostsKey] = knownHosts
+		if updateErr := r.Update(ctx, keySecret); updateErr != nil {
+			return ready, updateErr
+		}
+	}
+	return ready, err
+}
+
+// event records an event on vm when the reconciler has a recorder
+func (r *VirtualMachineReconciler) event(vm *hfv1.VirtualMachine, eventType string, reason string,
+	messageFmt string, args ...interface{}) {
+	if r.Recorder == nil {
+		return
+	}
+	r.Recorder.Eventf(vm, eventType, reason, messageFmt, args...)
 }
 
-func keyCreationDone(vm *hfv1.VirtualMachine, key string) (ok bool) {
-	_, ok = vm.Labels[key]
-	return ok
+// providerEvent records an event on vm like event, naming the provider and the objects backing vm
+func (r *VirtualMachineReconciler) providerEvent(ctx context.Context, vm *hfv1.VirtualMachine, providerName string,
+	eventType string, reason string, messageFmt string, args ...interface{}) {
+	if r.Recorder == nil {
+		return
+	}
+	if len(providerName) == 0 {
+		providerName = "unknown"
+	}
+	details := []string{"provider " + providerName}
+	if len(vm.Spec.KeyPair) > 0 {
+		details = append(details, fmt.Sprintf("Secret %s/%s", provisionNS, vm.Spec.KeyPair))
+	}
+	instance := vm
+	vmp := &shimv1alpha1.VirtualMachineProvisioning{}
+	if err := r.Get(ctx, client.ObjectKeyFromObject(vm), vmp); err == nil {
+		instance = instanceVM(vm, vmp)
+	}
+	refs, err := r.childReferences(ctx, instance, providerName)
+	if err != nil {
+		r.Log.Error(err, "unable to look up child objects", "virtualmachine", vm.Namespace+"/"+vm.Name)
+	}
+	for _, ref := range refs {
+		details = append(details, fmt.Sprintf("%s %s/%s", ref.Kind, ref.Namespace, ref.Name))
+	}
+	r.Recorder.Eventf(vm, eventType, reason, "%s (%s)", fmt.Sprintf(messageFmt, args...),
+		strings.Join(details, ", "))
+}
+
+// vmPublicKey returns the public key generated for the VM by createSecret
+func (r *VirtualMachineReconciler) vmPublicKey(ctx context.Context, vm *hfv1.VirtualMachine) (pubKey string, err error) {
+	keySecret, err := r.fetchKeySecret(ctx, vm)
+	if err != nil {
+		return pubKey, err
+	}
+	pubKeyByte, ok := keySecret.Data["public_key"]
+	if !ok {
+		return pubKey, fmt.Errorf("public_key not found in secret %s", keySecret.Name)
+	}
+
+	return strings.TrimSpace(string(pubKeyByte)), nil
 }
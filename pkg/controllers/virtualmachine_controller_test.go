@@ -0,0 +1,738 @@
+package controllers
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	ec2v1alpha1 "github.com/hobbyfarm/ec2-operator/pkg/api/v1alpha1"
+	hfv1 "github.com/hobbyfarm/gargantua/pkg/apis/hobbyfarm.io/v1"
+	shimv1alpha1 "github.com/hobbyfarm/hf-shim-operator/pkg/api/v1alpha1"
+	"github.com/hobbyfarm/hf-shim-operator/pkg/utils"
+	equinixv1alpha1 "github.com/hobbyfarm/metal-operator/pkg/api/v1alpha1"
+	dropletv1alpha1 "github.com/ibrokethecloud/droplet-operator/pkg/api/v1alpha1"
+	gossh "golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/controller/controllerutil"
+)
+
+func TestReconcileFakeProvider(t *testing.T) {
+	p := newFakeProvider()
+	p.register()
+	h := newHarness(t, fakeProviderName, nil, nil)
+
+	h.step(secretCreated)
+	secret, err := h.keySecret()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(secret.Data["private_key"]) == 0 || len(secret.Data["public_key"]) == 0 {
+		t.Fatalf("keypair secret %s is missing keys", secret.Name)
+	}
+	vm := h.vm()
+	if vm.Spec.KeyPair != secret.Name || !metav1.IsControlledBy(secret, vm) {
+		t.Fatalf("expected keypair secret %s to be used and owned by the vm", secret.Name)
+	}
+
+	h.step(importKeyPairCreated)
+	if provider := h.provisioning().Status.Provider; provider != fakeProviderName {
+		t.Fatalf("expected provider %s, got %s", fakeProviderName, provider)
+	}
+
+	h.step(hfv1.VmStatusProvisioned)
+	if vm = h.vm(); vm.Status.WsEndpoint != "ws.example.com" {
+		t.Fatalf("expected ws endpoint from the environment, got %s", vm.Status.WsEndpoint)
+	}
+
+	// the instance is still pending
+	if err := h.reconcile(); err == nil {
+		t.Fatal("expected pending instance to requeue the vm")
+	}
+	h.expectStatus(hfv1.VmStatusProvisioned)
+
+	// the instance is up, but ssh is not reachable yet
+	p.transition(testVMName, fakeInstanceProvisioned, "192.0.2.10")
+	if err := h.reconcile(); err == nil {
+		t.Fatal("expected failing liveness check to requeue the vm")
+	}
+	h.expectStatus(hfv1.VmStatusProvisioned)
+
+	h.setLive(true)
+	h.step(hfv1.VmStatusRunning)
+	vm = h.vm()
+	if vm.Status.PublicIP != "192.0.2.10" || vm.Status.Hostname != testVMName {
+		t.Fatalf("unexpected vm status %+v", vm.Status)
+	}
+	if call := h.lastLivenessCall(); call.address != "192.0.2.10:22" || call.userName != "ubuntu" {
+		t.Fatalf("unexpected liveness check %+v", call)
+	}
+
+	// running vms are left alone
+	h.step(hfv1.VmStatusRunning)
+}
+
+func TestReconcileFakeProviderFailure(t *testing.T) {
+	p := newFakeProvider()
+	p.register()
+	h := newHarness(t, fakeProviderName, nil, nil)
+
+	h.step(secretCreated)
+	h.step(importKeyPairCreated)
+
+	p.Lock()
+	p.createErr = fmt.Errorf("out of capacity")
+	p.Unlock()
+	if err := h.reconcile(); err == nil {
+		t.Fatal("expected instance creation error")
+	}
+	h.expectStatus(importKeyPairCreated)
+
+	p.Lock()
+	p.createErr = nil
+	p.Unlock()
+	h.step(hfv1.VmStatusProvisioned)
+
+	p.transition(testVMName, fakeInstanceFailed, "")
+	if err := h.reconcile(); err == nil {
+		t.Fatal("expected failed instance to be reported")
+	}
+	h.expectStatus(hfv1.VmStatusProvisioned)
+}
+
+// runningVM walks the test vm through provisioning with the fake provider
+func runningVM(t *testing.T) (*harness, *fakeProvider) {
+	p := newFakeProvider()
+	p.register()
+	h := newHarness(t, fakeProviderName, nil, nil)
+	h.setLive(true)
+
+	h.step(secretCreated)
+	h.step(importKeyPairCreated)
+	h.step(hfv1.VmStatusProvisioned)
+	p.transition(testVMName, fakeInstanceProvisioned, "192.0.2.10")
+	h.step(hfv1.VmStatusRunning)
+	return h, p
+}
+
+// taint marks the test vm tainted, as gargantua does when its session ends
+func (h *harness) taint() {
+	h.t.Helper()
+	vm := h.vm()
+	vm.Status.Tainted = true
+	h.updateStatus(vm)
+}
+
+func TestReconcileTaintedVM(t *testing.T) {
+	h, p := runningVM(t)
+	if vm := h.vm(); !controllerutil.ContainsFinalizer(vm, teardownFinalizer) {
+		t.Fatalf("expected vm to carry the %s finalizer", teardownFinalizer)
+	}
+
+	h.taint()
+	if err := h.reconcile(); err != nil {
+		t.Fatal(err)
+	}
+	if h.deleted() || h.vm().DeletionTimestamp.IsZero() {
+		t.Fatal("expected tainted vm to be held by the finalizer")
+	}
+
+	if err := h.reconcile(); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := p.instance(testVMName); ok {
+		t.Fatal("expected instance of tainted vm to be torn down")
+	}
+	h.expectEvent("TeardownComplete")
+	if !h.deleted() {
+		t.Fatal("expected tainted vm to be released")
+	}
+	if _, err := h.keySecret(); !errors.IsNotFound(err) {
+		t.Fatalf("expected keypair secret to be deleted, got %v", err)
+	}
+}
+
+func TestKeySecretCrossNamespace(t *testing.T) {
+	p := newFakeProvider()
+	p.register()
+	h := newHarnessInNamespace(t, "lab", fakeProviderName, nil, nil)
+	h.setLive(true)
+
+	h.step(secretCreated)
+	secret, err := h.keySecret()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if secret.Name != "lab-"+testVMName+"-secret" || len(secret.OwnerReferences) != 0 {
+		t.Fatalf("unexpected keypair secret %s owned by %v", secret.Name, secret.OwnerReferences)
+	}
+	if secret.Labels[vmLabel] != testVMName || secret.Labels[vmNamespaceLabel] != "lab" ||
+		!controllerutil.ContainsFinalizer(secret, keySecretFinalizer) {
+		t.Fatalf("expected keypair secret to be tracked, got labels %v and finalizers %v", secret.Labels,
+			secret.Finalizers)
+	}
+
+	// the liveness check authenticates with the key from the provisioning namespace
+	h.step(importKeyPairCreated)
+	h.step(hfv1.VmStatusProvisioned)
+	p.transition(testVMName, fakeInstanceProvisioned, "192.0.2.10")
+	h.step(hfv1.VmStatusRunning)
+
+	if err := h.r.Delete(h.ctx, h.vm()); err != nil {
+		t.Fatal(err)
+	}
+	if err := h.reconcile(); err != nil {
+		t.Fatal(err)
+	}
+	if !h.deleted() {
+		t.Fatal("expected vm to be released")
+	}
+	if _, err := h.keySecret(); !errors.IsNotFound(err) {
+		t.Fatalf("expected keypair secret to be deleted, got %v", err)
+	}
+}
+
+func TestKeySecretAdoption(t *testing.T) {
+	p := newFakeProvider()
+	p.register()
+	h := newHarnessInNamespace(t, "lab", fakeProviderName, nil, nil)
+
+	// a secret left by an earlier version, owned across namespaces
+	vm := h.vm()
+	legacy := &v1.Secret{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      keySecretName(vm),
+			Namespace: provisionNS,
+			OwnerReferences: []metav1.OwnerReference{
+				*metav1.NewControllerRef(vm, hfv1.SchemeGroupVersion.WithKind("VirtualMachine")),
+			},
+		},
+		Data: map[string][]byte{
+			"public_key":  []byte("ssh-rsa AAAA legacy"),
+			"private_key": []byte("legacy"),
+		},
+	}
+	if err := h.r.Create(h.ctx, legacy); err != nil {
+		t.Fatal(err)
+	}
+
+	h.step(secretCreated)
+	secret, err := h.keySecret()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(secret.Data["private_key"]) != "legacy" || len(secret.OwnerReferences) != 0 ||
+		secret.Labels[vmLabel] != testVMName {
+		t.Fatalf("expected legacy keypair secret to be adopted, got %+v", secret.ObjectMeta)
+	}
+
+	// secrets of other vms are never reused
+	secret.Labels[vmNamespaceLabel] = "other"
+	if err := h.r.Update(h.ctx, secret); err != nil {
+		t.Fatal(err)
+	}
+	vm = h.vm()
+	vm.Status.Status = hfv1.VmStatusRFP
+	h.updateStatus(vm)
+	if err := h.reconcile(); err == nil {
+		t.Fatal("expected the keypair secret of another vm to be refused")
+	}
+}
+
+func TestKeyTypes(t *testing.T) {
+	h := newHarness(t, "aws", map[string]string{
+		"cred_secret":           "aws-creds",
+		"region":                "us-west-2",
+		"subnet":                "subnet-1",
+		"vpc_security_group_id": "sg-1",
+		sshKeyTypeKey:           "rsa-4096",
+	}, map[string]string{
+		"image":               "ami-1",
+		templateSSHKeyTypeKey: "ecdsa-384",
+	})
+
+	// the key type of the template replaces the one of the environment
+	h.step(secretCreated)
+	h.expectEvent("KeyPairGenerated")
+	secret, err := h.keySecret()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(secret.Data[keyTypeSecretKey]) != "ecdsa-384" ||
+		!strings.HasPrefix(string(secret.Data["public_key"]), "ecdsa-sha2-nistp384 ") {
+		t.Fatalf("expected an ecdsa-384 keypair, got %s", secret.Data["public_key"])
+	}
+	signer, err := gossh.ParsePrivateKey(secret.Data["private_key"])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(gossh.MarshalAuthorizedKey(signer.PublicKey())) != string(secret.Data["public_key"]) {
+		t.Fatal("expected the private key to match the public key")
+	}
+
+	// ec2 does not import ecdsa keys
+	if err := h.reconcile(); err == nil || !strings.Contains(err.Error(), "does not accept ecdsa-384 keys") {
+		t.Fatalf("expected the ecdsa key to be refused, got %v", err)
+	}
+	h.expectEvent("KeyPairImportFailed")
+	h.expectStatus(secretCreated)
+	if err := h.r.Get(h.ctx, h.key(testVMName), &ec2v1alpha1.ImportKeyPair{}); !errors.IsNotFound(err) {
+		t.Fatalf("expected no ImportKeyPair, got %v", err)
+	}
+
+	// vms without a key type get the rsa keys gargantua generated
+	if keyType, err := vmKeyType(&hfv1.Environment{}, testTemplateName); err != nil || keyType.String() != "rsa-2048" {
+		t.Fatalf("expected rsa-2048 keys by default, got %s and %v", keyType, err)
+	}
+}
+
+// testHostKey returns a new ed25519 host key
+func testHostKey(t *testing.T) gossh.PublicKey {
+	t.Helper()
+	pub, _, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	key, err := gossh.NewPublicKey(pub)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return key
+}
+
+func TestKnownHosts(t *testing.T) {
+	p := newFakeProvider()
+	p.register()
+	h := newHarness(t, fakeProviderName, nil, nil)
+	hostKey := testHostKey(t)
+	h.hostKey = hostKey
+	h.setLive(true)
+	h.step(secretCreated)
+	h.step(importKeyPairCreated)
+	h.step(hfv1.VmStatusProvisioned)
+	p.transition(testVMName, fakeInstanceProvisioned, "192.0.2.10")
+	h.step(hfv1.VmStatusRunning)
+
+	secret, err := h.keySecret()
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := knownhosts.Line([]string{"192.0.2.10"}, hostKey) + "\n"
+	if string(secret.Data[knownHostsKey]) != expected {
+		t.Fatalf("expected the host key to be captured as %q, got %q", expected, secret.Data[knownHostsKey])
+	}
+
+	// the instance keeps its host key at a new address
+	if _, err := h.r.sshLivenessCheck(h.ctx, h.vm(), "192.0.2.11:22", "ubuntu", "uptime"); err != nil {
+		t.Fatal(err)
+	}
+	if secret, _ = h.keySecret(); strings.Count(string(secret.Data[knownHostsKey]), "\n") != 2 {
+		t.Fatalf("expected the new address in known_hosts, got %q", secret.Data[knownHostsKey])
+	}
+
+	h.hostKey = testHostKey(t)
+	if ready, err := h.r.sshLivenessCheck(h.ctx, h.vm(), "192.0.2.10:22", "ubuntu", "uptime"); err == nil || ready {
+		t.Fatal("expected a connection presenting another host key to be refused")
+	}
+	h.expectEvent("HostKeyMismatch")
+
+	// a new instance is trusted on first use again
+	if err := h.r.forgetHostKeys(h.ctx, h.vm()); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := h.r.sshLivenessCheck(h.ctx, h.vm(), "192.0.2.10:22", "ubuntu", "uptime"); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestKnownHostsReported(t *testing.T) {
+	reported, other := testHostKey(t), testHostKey(t)
+	if _, err := utils.VerifyHostKey(nil, gossh.MarshalAuthorizedKey(reported), "192.0.2.10:22",
+		other); err == nil {
+		t.Fatal("expected a host key the instance did not report to be refused")
+	}
+	knownHosts, err := utils.VerifyHostKey(nil, gossh.MarshalAuthorizedKey(reported), "192.0.2.10:2222", reported)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(string(knownHosts), "[192.0.2.10]:2222 ssh-ed25519 ") {
+		t.Fatalf("unexpected known_hosts %q", knownHosts)
+	}
+}
+
+func TestReconcileTeardownTimeout(t *testing.T) {
+	h, p := runningVM(t)
+	p.Lock()
+	p.teardownPending = true
+	p.Unlock()
+
+	if err := h.r.Delete(h.ctx, h.vm()); err != nil {
+		t.Fatal(err)
+	}
+	result, err := h.r.Reconcile(h.ctx, ctrl.Request{NamespacedName: h.key(testVMName)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.RequeueAfter != teardownRequeue || h.deleted() {
+		t.Fatal("expected vm to wait for its instance to be torn down")
+	}
+	h.expectEvent("WaitingForTeardown")
+
+	h.r.TeardownTimeout = time.Nanosecond
+	if err := h.reconcile(); err != nil {
+		t.Fatal(err)
+	}
+	h.expectEvent("TeardownTimeout")
+	if !h.deleted() {
+		t.Fatal("expected vm to be released after the teardown timeout")
+	}
+	if _, ok := p.instance(testVMName); !ok {
+		t.Fatal("expected the stuck instance to be left behind")
+	}
+}
+
+func TestReconcileEC2(t *testing.T) {
+	h := newHarness(t, "aws", map[string]string{
+		"cred_secret":           "aws-creds",
+		"region":                "us-west-2",
+		"subnet":                "subnet-1",
+		"vpc_security_group_id": "sg-1",
+	}, map[string]string{
+		"image": "ami-1",
+	})
+
+	h.step(secretCreated)
+	h.step(importKeyPairCreated)
+	keyPair := &ec2v1alpha1.ImportKeyPair{}
+	h.get(testVMName, keyPair)
+	if keyPair.Spec.Region != "us-west-2" || len(keyPair.Spec.PublicKey) == 0 {
+		t.Fatalf("unexpected keypair spec %+v", keyPair.Spec)
+	}
+
+	h.step(hfv1.VmStatusProvisioned)
+	instance := &ec2v1alpha1.Instance{}
+	h.get(testVMName, instance)
+	if instance.Spec.ImageID != "ami-1" || instance.Spec.InstanceType != defaultInstanceType {
+		t.Fatalf("unexpected instance spec %+v", instance.Spec)
+	}
+
+	instance.Status.Status = "provisioned"
+	instance.Status.InstanceID = "i-1"
+	instance.Status.PublicIP = "198.51.100.7"
+	instance.Status.PrivateIP = "10.0.0.7"
+	h.updateStatus(instance)
+
+	h.setLive(true)
+	h.step(hfv1.VmStatusRunning)
+	vm := h.vm()
+	if vm.Status.PublicIP != "198.51.100.7" || vm.Status.PrivateIP != "10.0.0.7" || vm.Status.Hostname != "i-1" {
+		t.Fatalf("unexpected vm status %+v", vm.Status)
+	}
+	if vm.Annotations["sshEndpoint"] != "198.51.100.7" {
+		t.Fatalf("unexpected ssh endpoint %s", vm.Annotations["sshEndpoint"])
+	}
+	if call := h.lastLivenessCall(); call.address != "198.51.100.7:22" || call.userName != "ubuntu" ||
+		call.command != "uptime" {
+		t.Fatalf("unexpected liveness check %+v", call)
+	}
+	vmp := h.provisioning()
+	if vmp.Status.Provider != "aws" || vmp.Status.InstanceType != defaultInstanceType ||
+		vmp.Status.KeySecret != vm.Spec.KeyPair || vmp.Status.Endpoints.SSH != "198.51.100.7" ||
+		vmp.Status.Timings.RunningAt == nil {
+		t.Fatalf("unexpected provisioning status %+v", vmp.Status)
+	}
+	if len(vmp.Status.Children) != 2 || vmp.Status.Children[0].Kind != "Instance" ||
+		vmp.Status.Children[1].Kind != "ImportKeyPair" ||
+		vmp.Status.Children[0].APIVersion != ec2v1alpha1.GroupVersion.String() {
+		t.Fatalf("unexpected children %+v", vmp.Status.Children)
+	}
+
+	// the vm is only released once the instance and keypair are really gone
+	h.taint()
+	for i := 0; i < 2; i++ {
+		if err := h.reconcile(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	h.expectEvent("WaitingForTeardown")
+	if h.deleted() {
+		t.Fatal("expected vm to wait for the ec2 resources to be deleted")
+	}
+	if err := h.reconcile(); err != nil {
+		t.Fatal(err)
+	}
+	h.expectEvent("TeardownComplete")
+	if !h.deleted() {
+		t.Fatal("expected vm to be released")
+	}
+	for _, obj := range []client.Object{&ec2v1alpha1.Instance{}, &ec2v1alpha1.ImportKeyPair{}} {
+		if err := h.r.Get(h.ctx, h.key(testVMName), obj); !errors.IsNotFound(err) {
+			t.Fatalf("expected %T to be deleted, got %v", obj, err)
+		}
+	}
+}
+
+func TestReconcileEvents(t *testing.T) {
+	h := newHarness(t, "aws", map[string]string{
+		"cred_secret":           "aws-creds",
+		"region":                "us-west-2",
+		"subnet":                "subnet-1",
+		"vpc_security_group_id": "sg-1",
+	}, map[string]string{
+		"image": "ami-1",
+	})
+	secret := fmt.Sprintf("Secret %s/%s", provisionNS, keySecretName(h.vm()))
+	keyPair := "ImportKeyPair " + h.namespace + "/" + testVMName
+	instanceRef := "Instance " + h.namespace + "/" + testVMName
+
+	expect := func(reason string, eventType string, refs ...string) {
+		t.Helper()
+		event := h.expectEvent(reason)
+		if !strings.HasPrefix(event, eventType+" ") || !strings.Contains(event, "provider aws") {
+			t.Fatalf("unexpected %s event %q", reason, event)
+		}
+		for _, ref := range refs {
+			if !strings.Contains(event, ref) {
+				t.Fatalf("expected %s event %q to reference %s", reason, event, ref)
+			}
+		}
+	}
+
+	h.step(secretCreated)
+	expect("KeyPairGenerated", v1.EventTypeNormal, secret)
+	h.step(importKeyPairCreated)
+	expect("KeyPairImported", v1.EventTypeNormal, secret, keyPair)
+	h.step(hfv1.VmStatusProvisioned)
+	expect("InstanceCreated", v1.EventTypeNormal, keyPair, instanceRef)
+
+	instance := &ec2v1alpha1.Instance{}
+	h.get(testVMName, instance)
+	instance.Status.Status = "provisioned"
+	instance.Status.PublicIP = "198.51.100.7"
+	h.updateStatus(instance)
+	if err := h.reconcile(); err == nil {
+		t.Fatal("expected failing liveness check to requeue the vm")
+	}
+	expect("LivenessCheckFailed", v1.EventTypeWarning, instanceRef)
+
+	h.setLive(true)
+	h.step(hfv1.VmStatusRunning)
+	expect("LivenessCheckPassed", v1.EventTypeNormal, instanceRef)
+
+	h.taint()
+	if err := h.reconcile(); err != nil {
+		t.Fatal(err)
+	}
+	expect("Deleting", v1.EventTypeNormal, instanceRef)
+}
+
+func TestReconcileDroplet(t *testing.T) {
+	h := newHarness(t, "digitalocean", map[string]string{
+		"cred_secret": "do-creds",
+		"region":      "ams3",
+	}, map[string]string{
+		"image": "ubuntu-20-04-x64",
+	})
+
+	h.step(secretCreated)
+	h.step(importKeyPairCreated)
+
+	// the droplet needs the id of the imported key
+	if err := h.reconcile(); err == nil {
+		t.Fatal("expected unprocessed keypair to requeue the vm")
+	}
+	h.expectStatus(importKeyPairCreated)
+
+	keyPair := &dropletv1alpha1.ImportKeyPair{}
+	h.get(testVMName, keyPair)
+	keyPair.Status.ID = 42
+	keyPair.Status.FingerPrint = "aa:bb"
+	h.updateStatus(keyPair)
+
+	h.step(hfv1.VmStatusProvisioned)
+	instance := &dropletv1alpha1.Instance{}
+	h.get(testVMName, instance)
+	if len(instance.Spec.SSHKeys) != 1 || instance.Spec.SSHKeys[0].ID != 42 {
+		t.Fatalf("unexpected droplet keys %+v", instance.Spec.SSHKeys)
+	}
+
+	instance.Status.Status = "provisioned"
+	instance.Status.PublicIP = "203.0.113.5"
+	h.updateStatus(instance)
+
+	h.setLive(true)
+	h.step(hfv1.VmStatusRunning)
+	if call := h.lastLivenessCall(); call.address != "203.0.113.5:22" {
+		t.Fatalf("unexpected liveness check %+v", call)
+	}
+}
+
+func TestReconcileEquinix(t *testing.T) {
+	h := newHarness(t, "equinix", map[string]string{
+		"cred_secret": "equinix-creds",
+		"metro":       "am",
+		"iso_url":     "https://example.com/lab.iso",
+	}, nil)
+
+	h.step(secretCreated)
+	h.step(importKeyPairCreated)
+
+	keyPair := &equinixv1alpha1.ImportKeyPair{}
+	h.get(testVMName, keyPair)
+	keyPair.Status.KeyPairID = "key-1"
+	h.updateStatus(keyPair)
+
+	h.step(hfv1.VmStatusProvisioned)
+
+	// the elastic ip is needed before the user data can be generated
+	instance := &equinixv1alpha1.Instance{}
+	h.get(testVMName, instance)
+	instance.Annotations = map[string]string{addressAnnotation: "147.75.0.1"}
+	if err := h.r.Update(h.ctx, instance); err != nil {
+		t.Fatal(err)
+	}
+	instance.Status.Status = "elasticipcreated"
+	h.updateStatus(instance)
+
+	if err := h.reconcile(); err == nil {
+		t.Fatal("expected patched instance to requeue the vm")
+	}
+	h.get(testVMName, instance)
+	if instance.Status.Status != "patched" || len(instance.Spec.UserData) == 0 {
+		t.Fatalf("expected instance to be patched with user data, got %s", instance.Status.Status)
+	}
+
+	instance.Status.Status = "active"
+	instance.Status.InstanceID = "device-1"
+	instance.Status.Facility = "am6"
+	instance.Status.PublicIP = "147.75.0.2"
+	h.updateStatus(instance)
+
+	// active instances are reachable over the SOS console without a liveness check
+	h.step(hfv1.VmStatusRunning)
+	vm := h.vm()
+	if vm.Spec.SshUsername != "device-1" || vm.Annotations["sshEndpoint"] != "sos.am6.platformequinix.com" {
+		t.Fatalf("unexpected ssh settings %s@%s", vm.Spec.SshUsername, vm.Annotations["sshEndpoint"])
+	}
+	if vm.Status.PublicIP != "147.75.0.2" || vm.Status.Hostname != "device-1" {
+		t.Fatalf("unexpected vm status %+v", vm.Status)
+	}
+}
+
+// expireAttempt moves the start of the current provisioning attempt of the test vm into the past
+func (h *harness) expireAttempt() {
+	h.t.Helper()
+	vmp := h.provisioning()
+	vmp.Status.Timings.AttemptStartedAt = &metav1.Time{Time: time.Now().Add(-2 * time.Hour)}
+	h.updateStatus(vmp)
+}
+
+func TestReconcileProvisioningRetry(t *testing.T) {
+	h := newHarness(t, "aws", map[string]string{
+		"cred_secret":             "aws-creds",
+		"region":                  "us-west-2",
+		"subnet":                  "subnet-1",
+		"vpc_security_group_id":   "sg-1",
+		"provision_timeout":       "1h",
+		"provision_max_attempts":  "3",
+		"fallback_instance_types": "t3.large, t3.xlarge",
+		"fallback_subnets":        "subnet-2",
+	}, map[string]string{
+		"image": "ami-1",
+	})
+
+	h.step(secretCreated)
+	h.step(importKeyPairCreated)
+	h.step(hfv1.VmStatusProvisioned)
+
+	for attempt, expected := range []struct{ instanceType, subnet string }{
+		{"t3.large", "subnet-2"},
+		{"t3.xlarge", "subnet-2"},
+	} {
+		h.expireAttempt()
+		// the first pass deletes the ec2 resources, the second one finds them gone
+		for i := 0; i < 2; i++ {
+			if err := h.reconcile(); err != nil {
+				t.Fatal(err)
+			}
+		}
+		h.expectEvent("ProvisioningRetry")
+		h.expectStatus(secretCreated)
+		if got := provisionAttempt(h.provisioning()); got != attempt+2 {
+			t.Fatalf("expected attempt %d, got %d", attempt+2, got)
+		}
+
+		h.step(importKeyPairCreated)
+		h.step(hfv1.VmStatusProvisioned)
+		instance := &ec2v1alpha1.Instance{}
+		h.get(testVMName, instance)
+		if instance.Spec.InstanceType != expected.instanceType || instance.Spec.SubnetID != expected.subnet {
+			t.Fatalf("expected fallback %+v, got %s in %s", expected, instance.Spec.InstanceType,
+				instance.Spec.SubnetID)
+		}
+	}
+
+	// out of attempts
+	h.expireAttempt()
+	for i := 0; i < 2; i++ {
+		if err := h.reconcile(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	h.expectEvent("ProvisioningFailed")
+	h.expectStatus(provisioningFailed)
+	if err := h.r.Get(h.ctx, h.key(testVMName), &ec2v1alpha1.Instance{}); !errors.IsNotFound(err) {
+		t.Fatalf("expected the instance of the failed vm to be deleted, got %v", err)
+	}
+	h.step(provisioningFailed)
+
+	// failed vms retried by hand start over from the first attempt
+	vm := h.vm()
+	vm.Annotations = map[string]string{retryProvisioningAnnotation: "true"}
+	if err := h.r.Update(h.ctx, vm); err != nil {
+		t.Fatal(err)
+	}
+	h.step(secretCreated)
+	h.expectEvent("RetryRequested")
+	if _, ok := h.vm().Annotations[retryProvisioningAnnotation]; ok {
+		t.Fatal("expected the retry annotation to be consumed")
+	}
+	vmp := h.provisioning()
+	if got := provisionAttempt(vmp); got != 1 {
+		t.Fatalf("expected the first attempt, got %d", got)
+	}
+	recovered := false
+	for _, transition := range vmp.Status.History {
+		if transition.From == shimv1alpha1.PhaseFailed && transition.To == shimv1alpha1.PhaseRetrying {
+			recovered = true
+		}
+	}
+	if !recovered {
+		t.Fatalf("expected the recovery in the history, got %+v", vmp.Status.History)
+	}
+}
+
+func TestReconcileWithoutProvisionTimeout(t *testing.T) {
+	p := newFakeProvider()
+	p.register()
+	h := newHarness(t, fakeProviderName, nil, nil)
+
+	h.step(secretCreated)
+	h.step(importKeyPairCreated)
+	h.step(hfv1.VmStatusProvisioned)
+	h.expireAttempt()
+	if err := h.reconcile(); err == nil {
+		t.Fatal("expected pending instance to requeue the vm")
+	}
+	h.expectStatus(hfv1.VmStatusProvisioned)
+	if _, ok := p.instance(testVMName); !ok {
+		t.Fatal("expected the instance to be kept without a provision_timeout")
+	}
+}
@@ -0,0 +1,355 @@
+package controllers
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strconv"
+	"time"
+
+	hfv1 "github.com/hobbyfarm/gargantua/pkg/apis/hobbyfarm.io/v1"
+	shimv1alpha1 "github.com/hobbyfarm/hf-shim-operator/pkg/api/v1alpha1"
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	utilrand "k8s.io/apimachinery/pkg/util/rand"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/controller/controllerutil"
+)
+
+/*
+Info used from the template mapping of an environment:
+warmPoolSize (optional, number of running instances kept ready for vms of the template, defaults to 0)
+*/
+
+const (
+	warmPoolSizeKey = "warmPoolSize"
+
+	// labels of the vms making up a warm pool. they carry none of the labels gargantua selects vms by, so it
+	// never assigns them to a session itself.
+	warmPoolLabel         = "shim.hobbyfarm.io/warm-pool"
+	warmPoolTemplateLabel = "shim.hobbyfarm.io/warm-pool-template"
+	// warmPoolClaimLabel marks a pool member whose instance is being handed over to the vm it names
+	warmPoolClaimLabel = "shim.hobbyfarm.io/claimed-by"
+)
+
+// warmPoolSize returns the number of warm instances env keeps for templateName
+func warmPoolSize(env *hfv1.Environment, templateName string) int {
+	value, ok := env.Spec.TemplateMapping[templateName][warmPoolSizeKey]
+	if !ok {
+		return 0
+	}
+	size, err := strconv.Atoi(value)
+	if err != nil || size < 0 {
+		return 0
+	}
+	return size
+}
+
+// isWarmPoolMember reports if vm was created by the shim to fill a warm pool
+func isWarmPoolMember(vm *hfv1.VirtualMachine) bool {
+	_, ok := vm.Labels[warmPoolLabel]
+	return ok
+}
+
+// instanceVM returns vm as its provider resources know it. vms which claimed a warm instance use the resources
+// of the pool member, which keep its name.
+func instanceVM(vm *hfv1.VirtualMachine, vmp *shimv1alpha1.VirtualMachineProvisioning) *hfv1.VirtualMachine {
+	if len(vmp.Status.ClaimedFrom) == 0 {
+		return vm
+	}
+	instance := vm.DeepCopy()
+	instance.Name = vmp.Status.ClaimedFrom
+	return instance
+}
+
+// claimWarmInstance hands a running member of the warm pool for the environment and template of vm over to vm,
+// instead of launching an instance for it. It returns false when the pool has no running member.
+func (r *VirtualMachineReconciler) claimWarmInstance(ctx context.Context, vm *hfv1.VirtualMachine,
+	vmp *shimv1alpha1.VirtualMachineProvisioning) (status *hfv1.VirtualMachineStatus, claimed bool, err error) {
+	status = vm.Status.DeepCopy()
+	if isWarmPoolMember(vm) {
+		return status, false, nil
+	}
+	env, err := r.fetchEnvironment(ctx, vm.Status.EnvironmentId, vm.Namespace)
+	if err != nil {
+		return status, false, err
+	}
+	if warmPoolSize(env, vm.Spec.VirtualMachineTemplateId) == 0 {
+		return status, false, nil
+	}
+	p, err := r.provider(env.Spec.Provider)
+	if err != nil {
+		return status, false, err
+	}
+	cp, ok := p.(childProvider)
+	if !ok {
+		return status, false, nil
+	}
+
+	member, err := r.warmPoolMember(ctx, vm, env)
+	if err != nil || member == nil {
+		return status, false, err
+	}
+	memberVMP := &shimv1alpha1.VirtualMachineProvisioning{}
+	if err = r.Get(ctx, client.ObjectKeyFromObject(member), memberVMP); err != nil {
+		return status, false, err
+	}
+
+	// marking the member first keeps other vms from claiming it, and its own reconciles from tearing it down
+	if member.Labels[warmPoolClaimLabel] != vm.Name {
+		member.Labels[warmPoolClaimLabel] = vm.Name
+		controllerutil.RemoveFinalizer(member, teardownFinalizer)
+		if err = r.Update(ctx, member); err != nil {
+			return status, false, err
+		}
+	}
+
+	for _, obj := range cp.children(member) {
+		if err = r.rebindChild(ctx, obj, member, vm); err != nil {
+			return status, false, err
+		}
+	}
+	secret, err := r.fetchKeySecret(ctx, member)
+	if err != nil {
+		return status, false, err
+	}
+	if err = r.rebindChild(ctx, secret, member, vm); err != nil {
+		return status, false, err
+	}
+
+	// the children are owned by vm now, so deleting the member leaves them alone
+	if err = r.Delete(ctx, member); err != nil && !errors.IsNotFound(err) {
+		return status, false, err
+	}
+
+	// providers keep instance details like the equinix device id in the ssh username, and the bastion in
+	// annotations, next to the endpoint
+	vm.Spec.KeyPair = secret.Name
+	vm.Spec.SshUsername = member.Spec.SshUsername
+	for _, annotation := range []string{"sshEndpoint", sshProxyEndpointAnnotation, sshProxyUserAnnotation,
+		sshProxyKeySecretAnnotation} {
+		if value, ok := member.Annotations[annotation]; ok {
+			if vm.Annotations == nil {
+				vm.Annotations = make(map[string]string)
+			}
+			vm.Annotations[annotation] = value
+		}
+	}
+	status.Status = hfv1.VmStatusRunning
+	status.PublicIP = member.Status.PublicIP
+	status.PrivateIP = member.Status.PrivateIP
+	status.Hostname = member.Status.Hostname
+	status.WsEndpoint = member.Status.WsEndpoint
+
+	now := metav1.Now()
+	vmp.Status.Provider = memberVMP.Status.Provider
+	vmp.Status.InstanceType = memberVMP.Status.InstanceType
+	vmp.Status.KeySecret = secret.Name
+	vmp.Status.ClaimedFrom = member.Name
+	vmp.Status.Attempt = 1
+	vmp.Status.Timings.StartedAt = &now
+	vmp.Status.Timings.AttemptStartedAt = &now
+	vmp.Status.Timings.ProvisionedAt = memberVMP.Status.Timings.ProvisionedAt
+	vmp.Status.Timings.RunningAt = &now
+	observeTimeToRunning(vm, vmp, now.Time)
+
+	r.providerEvent(ctx, vm, vmp.Status.Provider, v1.EventTypeNormal, "WarmInstanceClaimed",
+		"claimed the running %s instance of warm pool vm %s", vmp.Status.Provider, member.Name)
+	return status, true, nil
+}
+
+// warmPoolMember returns the running pool member vm can claim, preferring one it already started claiming
+func (r *VirtualMachineReconciler) warmPoolMember(ctx context.Context, vm *hfv1.VirtualMachine,
+	env *hfv1.Environment) (*hfv1.VirtualMachine, error) {
+	members := &hfv1.VirtualMachineList{}
+	if err := r.List(ctx, members, client.InNamespace(vm.Namespace), client.MatchingLabels{
+		warmPoolLabel:         env.Name,
+		warmPoolTemplateLabel: vm.Spec.VirtualMachineTemplateId,
+	}); err != nil {
+		return nil, err
+	}
+
+	var free *hfv1.VirtualMachine
+	for i := range members.Items {
+		member := &members.Items[i]
+		if claimedBy, ok := member.Labels[warmPoolClaimLabel]; ok {
+			if claimedBy == vm.Name {
+				return member, nil
+			}
+			continue
+		}
+		if free == nil && member.DeletionTimestamp.IsZero() && !member.Status.Tainted &&
+			member.Status.Status == hfv1.VmStatusRunning {
+			free = member
+		}
+	}
+	return free, nil
+}
+
+// rebindChild moves obj from the pool member to vm. Objects which do not exist are skipped.
+func (r *VirtualMachineReconciler) rebindChild(ctx context.Context, obj client.Object, member *hfv1.VirtualMachine,
+	vm *hfv1.VirtualMachine) error {
+	if err := r.Get(ctx, client.ObjectKeyFromObject(obj), obj); err != nil {
+		return client.IgnoreNotFound(err)
+	}
+
+	var ownerRefs []metav1.OwnerReference
+	for _, ref := range obj.GetOwnerReferences() {
+		if ref.UID != member.UID {
+			ownerRefs = append(ownerRefs, ref)
+		}
+	}
+	obj.SetOwnerReferences(ownerRefs)
+
+	if secret, ok := obj.(*v1.Secret); ok {
+		if err := r.trackKeySecret(vm, secret); err != nil {
+			return err
+		}
+	} else {
+		setVMLabels(obj, vm)
+		if err := controllerutil.SetControllerReference(vm, obj, r.Scheme); err != nil {
+			return err
+		}
+	}
+	return r.Update(ctx, obj)
+}
+
+// WarmPool keeps the number of running instances requested by the warmPoolSize of each environment template
+// mapping ready to be claimed. Members are VirtualMachines created by the shim and provisioned like any other;
+// failed and surplus members are deleted.
+type WarmPool struct {
+	Reconciler *VirtualMachineReconciler
+	Interval   time.Duration
+}
+
+// Start refills the pools every interval until ctx is done
+func (w *WarmPool) Start(ctx context.Context) error {
+	wait.UntilWithContext(ctx, w.refill, w.Interval)
+	return nil
+}
+
+// NeedLeaderElection makes sure only the active manager creates pool members
+func (w *WarmPool) NeedLeaderElection() bool {
+	return true
+}
+
+func (w *WarmPool) refill(ctx context.Context) {
+	r := w.Reconciler
+	envs := &hfv1.EnvironmentList{}
+	if err := r.List(ctx, envs); err != nil {
+		r.Log.Error(err, "unable to list environments for the warm pool")
+		return
+	}
+
+	warmPoolInstances.Reset()
+	for i := range envs.Items {
+		env := &envs.Items[i]
+		members := &hfv1.VirtualMachineList{}
+		if err := r.List(ctx, members, client.InNamespace(env.Namespace),
+			client.MatchingLabels{warmPoolLabel: env.Name}); err != nil {
+			r.Log.Error(err, "unable to list warm pool", "environment", env.Name)
+			continue
+		}
+		pools := make(map[string][]*hfv1.VirtualMachine)
+		for template := range env.Spec.TemplateMapping {
+			pools[template] = nil
+		}
+		for j := range members.Items {
+			member := &members.Items[j]
+			template := member.Labels[warmPoolTemplateLabel]
+			pools[template] = append(pools[template], member)
+		}
+
+		for template, members := range pools {
+			size := warmPoolSize(env, template)
+			if size > 0 {
+				p, err := r.provider(env.Spec.Provider)
+				if err != nil {
+					continue
+				}
+				if _, ok := p.(childProvider); !ok {
+					r.Log.Info("provider does not support warm pools", "environment", env.Name,
+						"provider", env.Spec.Provider)
+					size = 0
+				}
+			}
+			if err := w.resize(ctx, env, template, members, size); err != nil {
+				r.Log.Error(err, "unable to refill warm pool", "environment", env.Name, "template", template)
+			}
+		}
+	}
+}
+
+// resize creates or deletes members of the pool of template until it holds size members. Failed members are
+// replaced, and the members furthest from running are deleted first.
+func (w *WarmPool) resize(ctx context.Context, env *hfv1.Environment, template string,
+	members []*hfv1.VirtualMachine, size int) error {
+	r := w.Reconciler
+	var active []*hfv1.VirtualMachine
+	for _, member := range members {
+		if _, claimed := member.Labels[warmPoolClaimLabel]; claimed || !member.DeletionTimestamp.IsZero() {
+			continue
+		}
+		if member.Status.Status == provisioningFailed || member.Status.Tainted {
+			if err := r.Delete(ctx, member); err != nil && !errors.IsNotFound(err) {
+				return err
+			}
+			continue
+		}
+		active = append(active, member)
+	}
+	sort.SliceStable(active, func(i, j int) bool {
+		return active[i].Status.Status == hfv1.VmStatusRunning && active[j].Status.Status != hfv1.VmStatusRunning
+	})
+
+	ready := 0
+	for _, member := range active {
+		if member.Status.Status == hfv1.VmStatusRunning {
+			ready++
+		}
+	}
+	warmPoolInstances.WithLabelValues(env.Name, template).Set(float64(ready))
+
+	for len(active) > size {
+		if err := r.Delete(ctx, active[len(active)-1]); err != nil && !errors.IsNotFound(err) {
+			return err
+		}
+		active = active[:len(active)-1]
+	}
+	for created := len(active); created < size; created++ {
+		if err := w.createMember(ctx, env, template); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// createMember creates a vm ready for provisioning in the pool of template
+func (w *WarmPool) createMember(ctx context.Context, env *hfv1.Environment, template string) error {
+	r := w.Reconciler
+	name := fmt.Sprintf("warm-%s-%s", template, utilrand.String(5))
+	member := &hfv1.VirtualMachine{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      name,
+			Namespace: env.Namespace,
+			Labels: map[string]string{
+				warmPoolLabel:         env.Name,
+				warmPoolTemplateLabel: template,
+			},
+		},
+		Spec: hfv1.VirtualMachineSpec{
+			Id:                       name,
+			VirtualMachineTemplateId: template,
+		},
+	}
+	if err := r.Create(ctx, member); err != nil {
+		return err
+	}
+	member.Status = hfv1.VirtualMachineStatus{
+		Status:        hfv1.VmStatusRFP,
+		EnvironmentId: env.Name,
+	}
+	return r.Status().Update(ctx, member)
+}
@@ -0,0 +1,186 @@
+package controllers
+
+import (
+	"testing"
+
+	hfv1 "github.com/hobbyfarm/gargantua/pkg/apis/hobbyfarm.io/v1"
+	shimv1alpha1 "github.com/hobbyfarm/hf-shim-operator/pkg/api/v1alpha1"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/controller/controllerutil"
+)
+
+// pooledFakeProvider is the fake provider with a ConfigMap standing in for each instance, as warm pools hand
+// over the child objects of their members
+type pooledFakeProvider struct {
+	*fakeProvider
+}
+
+func (p pooledFakeProvider) children(vm *hfv1.VirtualMachine) []client.Object {
+	return []client.Object{&v1.ConfigMap{ObjectMeta: metav1.ObjectMeta{Name: vm.Name, Namespace: vm.Namespace}}}
+}
+
+// registerPooled makes the provider available as the fake provider, with support for warm pools
+func (p *fakeProvider) registerPooled() {
+	RegisterProvider(fakeProviderName, func(r *VirtualMachineReconciler) Provider {
+		p.Lock()
+		defer p.Unlock()
+		p.r = r
+		return pooledFakeProvider{p}
+	})
+}
+
+// poolMembers returns the unclaimed members of the warm pool of the test environment
+func (h *harness) poolMembers() []hfv1.VirtualMachine {
+	h.t.Helper()
+	members := &hfv1.VirtualMachineList{}
+	if err := h.r.List(h.ctx, members, client.InNamespace(h.namespace),
+		client.MatchingLabels{warmPoolLabel: testEnvName}); err != nil {
+		h.t.Fatal(err)
+	}
+	var unclaimed []hfv1.VirtualMachine
+	for _, member := range members.Items {
+		if _, claimed := member.Labels[warmPoolClaimLabel]; !claimed {
+			unclaimed = append(unclaimed, member)
+		}
+	}
+	return unclaimed
+}
+
+// reconcileNamed runs a single reconcile of the vm called name
+func (h *harness) reconcileNamed(name string) {
+	h.t.Helper()
+	if _, err := h.r.Reconcile(h.ctx, ctrl.Request{NamespacedName: h.key(name)}); err != nil {
+		h.t.Fatalf("reconcile of %s failed: %v", name, err)
+	}
+}
+
+func TestWarmPoolClaim(t *testing.T) {
+	p := newFakeProvider()
+	p.registerPooled()
+	h := newHarness(t, fakeProviderName, nil, map[string]string{warmPoolSizeKey: "1"})
+	h.setLive(true)
+	pool := &WarmPool{Reconciler: h.r}
+
+	pool.refill(h.ctx)
+	members := h.poolMembers()
+	if len(members) != 1 {
+		t.Fatalf("expected 1 warm pool member, got %d", len(members))
+	}
+	member := members[0].Name
+	if _, ok := members[0].Labels["bound"]; ok {
+		t.Fatal("expected pool members to be hidden from gargantua")
+	}
+
+	// the member is provisioned like any other vm
+	for i := 0; i < 3; i++ {
+		h.reconcileNamed(member)
+	}
+	p.transition(member, fakeInstanceProvisioned, "192.0.2.20")
+	h.reconcileNamed(member)
+	memberVM := &hfv1.VirtualMachine{}
+	h.get(member, memberVM)
+	if memberVM.Status.Status != hfv1.VmStatusRunning {
+		t.Fatalf("expected the pool member to be running, got %s", memberVM.Status.Status)
+	}
+	instance := &v1.ConfigMap{ObjectMeta: metav1.ObjectMeta{Name: member, Namespace: h.namespace}}
+	if err := controllerutil.SetControllerReference(memberVM, instance, h.r.Scheme); err != nil {
+		t.Fatal(err)
+	}
+	if err := h.r.Create(h.ctx, instance); err != nil {
+		t.Fatal(err)
+	}
+	// providers record instance details on the member, as equinix does with the device id
+	memberVM.Spec.SshUsername = "device-1"
+	memberVM.Annotations = map[string]string{
+		"sshEndpoint":               "192.0.2.20",
+		sshProxyEndpointAnnotation:  "203.0.113.5:22",
+		sshProxyUserAnnotation:      "jump",
+		sshProxyKeySecretAnnotation: "bastion-key",
+	}
+	if err := h.r.Update(h.ctx, memberVM); err != nil {
+		t.Fatal(err)
+	}
+
+	h.step(hfv1.VmStatusRunning)
+	h.expectEvent("WarmInstanceClaimed")
+	vm := h.vm()
+	if vm.Status.PublicIP != "192.0.2.20" || vm.Spec.KeyPair != keySecretName(memberVM) {
+		t.Fatalf("expected the vm to take over the member instance and keys, got %+v %+v", vm.Spec, vm.Status)
+	}
+	if vm.Spec.SshUsername != "device-1" || vm.Annotations["sshEndpoint"] != "192.0.2.20" ||
+		vm.Annotations[sshProxyEndpointAnnotation] != "203.0.113.5:22" ||
+		vm.Annotations[sshProxyUserAnnotation] != "jump" || vm.Annotations[sshProxyKeySecretAnnotation] != "bastion-key" {
+		t.Fatalf("expected the vm to take over the ssh username and proxy of the member, got %+v %v",
+			vm.Spec, vm.Annotations)
+	}
+	if err := h.r.Get(h.ctx, h.key(member), &hfv1.VirtualMachine{}); err == nil {
+		t.Fatal("expected the claimed pool member to be deleted")
+	}
+	h.get(member, instance)
+	if !metav1.IsControlledBy(instance, vm) || instance.Labels[vmLabel] != testVMName {
+		t.Fatalf("expected the instance to be handed over, got %+v", instance.ObjectMeta)
+	}
+	secret, err := h.r.fetchKeySecret(h.ctx, vm)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !metav1.IsControlledBy(secret, vm) || secret.Labels[vmLabel] != testVMName {
+		t.Fatalf("expected the keypair secret to be handed over, got %+v", secret.ObjectMeta)
+	}
+	vmp := h.provisioning()
+	if vmp.Status.ClaimedFrom != member || vmp.Status.Phase != shimv1alpha1.PhaseRunning ||
+		vmp.Status.Provider != fakeProviderName {
+		t.Fatalf("unexpected provisioning status %+v", vmp.Status)
+	}
+	if len(vmp.Status.Children) != 1 || vmp.Status.Children[0].Name != member {
+		t.Fatalf("expected the member instance as child, got %+v", vmp.Status.Children)
+	}
+
+	pool.refill(h.ctx)
+	if members := h.poolMembers(); len(members) != 1 || members[0].Name == member {
+		t.Fatalf("expected the pool to be refilled, got %d members", len(members))
+	}
+
+	// the claimed instance is torn down with the vm
+	h.taint()
+	for i := 0; i < 2; i++ {
+		if err := h.reconcile(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, ok := p.instance(member); ok || !h.deleted() {
+		t.Fatal("expected the claimed instance to be torn down with the vm")
+	}
+}
+
+func TestWarmPoolEmpty(t *testing.T) {
+	p := newFakeProvider()
+	p.registerPooled()
+	h := newHarness(t, fakeProviderName, nil, map[string]string{warmPoolSizeKey: "2"})
+	pool := &WarmPool{Reconciler: h.r}
+
+	pool.refill(h.ctx)
+	if members := h.poolMembers(); len(members) != 2 {
+		t.Fatalf("expected 2 warm pool members, got %d", len(members))
+	}
+
+	// members which are not running yet are not claimed
+	h.step(secretCreated)
+	if len(h.provisioning().Status.ClaimedFrom) > 0 {
+		t.Fatal("expected the vm to be provisioned itself")
+	}
+
+	env := &hfv1.Environment{}
+	h.get(testEnvName, env)
+	env.Spec.TemplateMapping[testTemplateName][warmPoolSizeKey] = "0"
+	if err := h.r.Update(h.ctx, env); err != nil {
+		t.Fatal(err)
+	}
+	pool.refill(h.ctx)
+	if members := h.poolMembers(); len(members) != 0 {
+		t.Fatalf("expected the pool to be drained, got %d members", len(members))
+	}
+}
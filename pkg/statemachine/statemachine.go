@@ -0,0 +1,201 @@
+// Package statemachine defines the phases a hobbyfarm VirtualMachine goes through while the shim provisions it,
+// the legal transitions between them, and the conditions published for each phase.
+package statemachine
+
+import (
+	"errors"
+	"fmt"
+
+	hfv1 "github.com/hobbyfarm/gargantua/pkg/apis/hobbyfarm.io/v1"
+	shimv1alpha1 "github.com/hobbyfarm/hf-shim-operator/pkg/api/v1alpha1"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// VirtualMachine statuses set by the shim, next to the ones defined by gargantua
+const (
+	StatusSecretCreated        hfv1.VmStatus = "SecretCreated"
+	StatusImportKeyPairCreated hfv1.VmStatus = "ImportKeyPairCreated"
+	StatusProvisionRetrying    hfv1.VmStatus = "ProvisionRetrying"
+	StatusProvisioningFailed   hfv1.VmStatus = "ProvisioningFailed"
+	StatusRecycling            hfv1.VmStatus = "Recycling"
+	StatusStopping             hfv1.VmStatus = "Stopping"
+	StatusStopped              hfv1.VmStatus = "Stopped"
+	StatusResuming             hfv1.VmStatus = "Resuming"
+)
+
+// MaxHistory is the number of transitions kept in the status history
+const MaxHistory = 20
+
+// ErrIllegalTransition is returned for transitions the state machine does not allow
+var ErrIllegalTransition = errors.New("illegal phase transition")
+
+var phases = map[hfv1.VmStatus]shimv1alpha1.Phase{
+	hfv1.VmStatusRFP:           shimv1alpha1.PhasePending,
+	StatusSecretCreated:        shimv1alpha1.PhaseSecretCreated,
+	StatusImportKeyPairCreated: shimv1alpha1.PhaseKeyPairImported,
+	hfv1.VmStatusProvisioned:   shimv1alpha1.PhaseProvisioned,
+	hfv1.VmStatusRunning:       shimv1alpha1.PhaseRunning,
+	StatusProvisionRetrying:    shimv1alpha1.PhaseRetrying,
+	StatusProvisioningFailed:   shimv1alpha1.PhaseFailed,
+	StatusRecycling:            shimv1alpha1.PhaseRecycling,
+	StatusStopping:             shimv1alpha1.PhaseStopping,
+	StatusStopped:              shimv1alpha1.PhaseStopped,
+	StatusResuming:             shimv1alpha1.PhaseResuming,
+	hfv1.VmStatusTerminating:   shimv1alpha1.PhaseTerminating,
+}
+
+// transitions lists the phases each phase may move on to. Every phase may move to Terminating. Pending VMs
+// claiming a running instance of a warm pool move straight to Running, and tainted Running VMs of environments
+// which recycle them are provisioned again once their instance was reset. Running VMs of paused sessions are
+// stopped, and resumed until they run again. VMs of environments with an ssh certificate authority import no
+// keypair and are provisioned right after their secret was created. Failed VMs, and Running VMs with a broken
+// instance, recover by being retried by hand, which tears their instance down and provisions them again.
+var transitions = map[shimv1alpha1.Phase][]shimv1alpha1.Phase{
+	shimv1alpha1.PhasePending:         {shimv1alpha1.PhaseSecretCreated, shimv1alpha1.PhaseRunning},
+	shimv1alpha1.PhaseSecretCreated:   {shimv1alpha1.PhaseKeyPairImported, shimv1alpha1.PhaseProvisioned, shimv1alpha1.PhaseRetrying},
+	shimv1alpha1.PhaseKeyPairImported: {shimv1alpha1.PhaseProvisioned, shimv1alpha1.PhaseRetrying},
+	shimv1alpha1.PhaseProvisioned:     {shimv1alpha1.PhaseRunning, shimv1alpha1.PhaseRetrying},
+	shimv1alpha1.PhaseRunning:         {shimv1alpha1.PhaseRecycling, shimv1alpha1.PhaseStopping, shimv1alpha1.PhaseRetrying},
+	shimv1alpha1.PhaseRetrying:        {shimv1alpha1.PhaseSecretCreated, shimv1alpha1.PhaseFailed},
+	shimv1alpha1.PhaseFailed:          {shimv1alpha1.PhaseRetrying},
+	shimv1alpha1.PhaseRecycling:       {shimv1alpha1.PhaseSecretCreated},
+	shimv1alpha1.PhaseStopping:        {shimv1alpha1.PhaseStopped, shimv1alpha1.PhaseResuming},
+	shimv1alpha1.PhaseStopped:         {shimv1alpha1.PhaseResuming},
+	shimv1alpha1.PhaseResuming:        {shimv1alpha1.PhaseRunning, shimv1alpha1.PhaseStopping},
+}
+
+// PhaseOf returns the phase of a VirtualMachine status, and false for statuses the shim does not know
+func PhaseOf(status hfv1.VmStatus) (shimv1alpha1.Phase, bool) {
+	phase, ok := phases[status]
+	return phase, ok
+}
+
+// CanTransition reports if the state machine allows moving from one phase to another. Staying in a phase is
+// always allowed, as is entering the first phase.
+func CanTransition(from, to shimv1alpha1.Phase) bool {
+	if from == to || len(from) == 0 || to == shimv1alpha1.PhaseTerminating {
+		return true
+	}
+	for _, next := range transitions[from] {
+		if next == to {
+			return true
+		}
+	}
+	return false
+}
+
+// CanTransitionStatus reports if a VirtualMachine may move from one status to another. Statuses the shim does
+// not know never take part in a legal transition.
+func CanTransitionStatus(from, to hfv1.VmStatus) bool {
+	fromPhase, ok := PhaseOf(from)
+	if !ok {
+		return false
+	}
+	toPhase, ok := PhaseOf(to)
+	if !ok {
+		return false
+	}
+	return CanTransition(fromPhase, toPhase)
+}
+
+// Transition moves status to phase to, recording the transition in the history and updating the phase
+// conditions. Transitions which are not allowed leave status untouched and return ErrIllegalTransition.
+func Transition(status *shimv1alpha1.VirtualMachineProvisioningStatus, to shimv1alpha1.Phase, reason string,
+	message string, now metav1.Time) error {
+	if !CanTransition(status.Phase, to) {
+		return fmt.Errorf("%w from %s to %s", ErrIllegalTransition, status.Phase, to)
+	}
+	setPhase(status, to, reason, message, now)
+	return nil
+}
+
+// Resync moves status to phase to regardless of the legal transitions. It is used when the recorded phase
+// no longer matches the VirtualMachine, e.g. for VMs provisioned before the state machine existed.
+func Resync(status *shimv1alpha1.VirtualMachineProvisioningStatus, to shimv1alpha1.Phase, message string,
+	now metav1.Time) {
+	setPhase(status, to, "Resync", message, now)
+}
+
+// SetDegraded marks status as degraded, e.g. when reconciling the current phase fails
+func SetDegraded(status *shimv1alpha1.VirtualMachineProvisioningStatus, reason string, message string,
+	now metav1.Time) {
+	setCondition(status, shimv1alpha1.ConditionDegraded, true, reason, message, now)
+}
+
+// ClearDegraded marks a degraded status as recovered
+func ClearDegraded(status *shimv1alpha1.VirtualMachineProvisioningStatus, now metav1.Time) {
+	if meta.IsStatusConditionTrue(status.Conditions, shimv1alpha1.ConditionDegraded) {
+		setCondition(status, shimv1alpha1.ConditionDegraded, false, "Reconciled", "", now)
+	}
+}
+
+// SetExpiring marks status as about to exceed the lifetime limits of the VM
+func SetExpiring(status *shimv1alpha1.VirtualMachineProvisioningStatus, reason string, message string,
+	now metav1.Time) {
+	setCondition(status, shimv1alpha1.ConditionExpiring, true, reason, message, now)
+}
+
+// ClearExpiring marks an expiring status as within its lifetime limits again
+func ClearExpiring(status *shimv1alpha1.VirtualMachineProvisioningStatus, now metav1.Time) {
+	if meta.IsStatusConditionTrue(status.Conditions, shimv1alpha1.ConditionExpiring) {
+		setCondition(status, shimv1alpha1.ConditionExpiring, false, "WithinLimits", "", now)
+	}
+}
+
+// SetInvalidConfig marks status as asking for a feature its provider does not support
+func SetInvalidConfig(status *shimv1alpha1.VirtualMachineProvisioningStatus, reason string, message string,
+	now metav1.Time) {
+	setCondition(status, shimv1alpha1.ConditionInvalidConfig, true, reason, message, now)
+}
+
+// ClearInvalidConfig marks an invalid config of status as fixed
+func ClearInvalidConfig(status *shimv1alpha1.VirtualMachineProvisioningStatus, now metav1.Time) {
+	if meta.IsStatusConditionTrue(status.Conditions, shimv1alpha1.ConditionInvalidConfig) {
+		setCondition(status, shimv1alpha1.ConditionInvalidConfig, false, "Supported", "", now)
+	}
+}
+
+func setPhase(status *shimv1alpha1.VirtualMachineProvisioningStatus, to shimv1alpha1.Phase, reason string,
+	message string, now metav1.Time) {
+	if status.Phase == to {
+		return
+	}
+	if len(reason) == 0 {
+		reason = string(to)
+	}
+
+	status.History = append(status.History, shimv1alpha1.PhaseTransition{
+		From:    status.Phase,
+		To:      to,
+		Reason:  reason,
+		Message: message,
+		Time:    now,
+	})
+	if len(status.History) > MaxHistory {
+		status.History = status.History[len(status.History)-MaxHistory:]
+	}
+	status.Phase = to
+
+	setCondition(status, shimv1alpha1.ConditionKeyPairReady, to == shimv1alpha1.PhaseKeyPairImported ||
+		to == shimv1alpha1.PhaseProvisioned || to == shimv1alpha1.PhaseRunning, reason, message, now)
+	setCondition(status, shimv1alpha1.ConditionInstanceProvisioned, to == shimv1alpha1.PhaseProvisioned ||
+		to == shimv1alpha1.PhaseRunning, reason, message, now)
+	setCondition(status, shimv1alpha1.ConditionReady, to == shimv1alpha1.PhaseRunning, reason, message, now)
+	setCondition(status, shimv1alpha1.ConditionFailed, to == shimv1alpha1.PhaseFailed, reason, message, now)
+}
+
+func setCondition(status *shimv1alpha1.VirtualMachineProvisioningStatus, conditionType string, value bool,
+	reason string, message string, now metav1.Time) {
+	conditionStatus := metav1.ConditionFalse
+	if value {
+		conditionStatus = metav1.ConditionTrue
+	}
+	meta.SetStatusCondition(&status.Conditions, metav1.Condition{
+		Type:               conditionType,
+		Status:             conditionStatus,
+		Reason:             reason,
+		Message:            message,
+		LastTransitionTime: now,
+	})
+}
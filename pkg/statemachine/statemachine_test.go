@@ -0,0 +1,161 @@
+package statemachine
+
+import (
+	"errors"
+	"testing"
+
+	hfv1 "github.com/hobbyfarm/gargantua/pkg/apis/hobbyfarm.io/v1"
+	shimv1alpha1 "github.com/hobbyfarm/hf-shim-operator/pkg/api/v1alpha1"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func TestCanTransitionStatus(t *testing.T) {
+	cases := []struct {
+		from, to hfv1.VmStatus
+		legal    bool
+	}{
+		{hfv1.VmStatusRFP, StatusSecretCreated, true},
+		{StatusSecretCreated, StatusImportKeyPairCreated, true},
+		{StatusSecretCreated, hfv1.VmStatusProvisioned, true},
+		{StatusImportKeyPairCreated, hfv1.VmStatusProvisioned, true},
+		{hfv1.VmStatusProvisioned, hfv1.VmStatusRunning, true},
+		{hfv1.VmStatusProvisioned, hfv1.VmStatusProvisioned, true},
+		{hfv1.VmStatusProvisioned, StatusProvisionRetrying, true},
+		{StatusProvisionRetrying, StatusSecretCreated, true},
+		{StatusProvisionRetrying, StatusProvisioningFailed, true},
+		{hfv1.VmStatusRunning, hfv1.VmStatusTerminating, true},
+		{hfv1.VmStatusRunning, StatusRecycling, true},
+		{StatusRecycling, StatusSecretCreated, true},
+		{hfv1.VmStatusProvisioned, StatusRecycling, false},
+		{hfv1.VmStatusRunning, StatusStopping, true},
+		{StatusStopping, StatusStopped, true},
+		{StatusStopped, StatusResuming, true},
+		{StatusResuming, hfv1.VmStatusRunning, true},
+		{StatusStopped, hfv1.VmStatusRunning, false},
+		{hfv1.VmStatusProvisioned, StatusStopping, false},
+		{hfv1.VmStatusRFP, hfv1.VmStatusRunning, true},
+		{hfv1.VmStatusRFP, hfv1.VmStatusProvisioned, false},
+		{hfv1.VmStatusRunning, StatusSecretCreated, false},
+		{StatusProvisioningFailed, hfv1.VmStatusRunning, false},
+		{StatusProvisioningFailed, StatusProvisionRetrying, true},
+		{hfv1.VmStatusRunning, StatusProvisionRetrying, true},
+		{StatusProvisioningFailed, StatusSecretCreated, false},
+		{"Error Fetching VMTemplate", hfv1.VmStatusRFP, false},
+	}
+	for _, c := range cases {
+		if legal := CanTransitionStatus(c.from, c.to); legal != c.legal {
+			t.Errorf("transition from %q to %q: expected legal %v, got %v", c.from, c.to, c.legal, legal)
+		}
+	}
+}
+
+func TestTransition(t *testing.T) {
+	status := &shimv1alpha1.VirtualMachineProvisioningStatus{}
+	now := metav1.Now()
+	for _, phase := range []shimv1alpha1.Phase{
+		shimv1alpha1.PhasePending,
+		shimv1alpha1.PhaseSecretCreated,
+		shimv1alpha1.PhaseKeyPairImported,
+		shimv1alpha1.PhaseProvisioned,
+	} {
+		if err := Transition(status, phase, "", "", now); err != nil {
+			t.Fatalf("transition to %s: %v", phase, err)
+		}
+	}
+	if !meta.IsStatusConditionTrue(status.Conditions, shimv1alpha1.ConditionInstanceProvisioned) {
+		t.Fatalf("expected condition %s after provisioning", shimv1alpha1.ConditionInstanceProvisioned)
+	}
+	if meta.IsStatusConditionTrue(status.Conditions, shimv1alpha1.ConditionReady) {
+		t.Fatalf("expected condition %s to be false before running", shimv1alpha1.ConditionReady)
+	}
+
+	err := Transition(status, shimv1alpha1.PhasePending, "", "", now)
+	if !errors.Is(err, ErrIllegalTransition) {
+		t.Fatalf("expected illegal transition back to pending, got %v", err)
+	}
+	if status.Phase != shimv1alpha1.PhaseProvisioned {
+		t.Fatalf("illegal transition changed the phase to %s", status.Phase)
+	}
+
+	if err := Transition(status, shimv1alpha1.PhaseRunning, "LivenessCheckPassed", "ssh is up", now); err != nil {
+		t.Fatal(err)
+	}
+	ready := meta.FindStatusCondition(status.Conditions, shimv1alpha1.ConditionReady)
+	if ready == nil || ready.Status != metav1.ConditionTrue || ready.Reason != "LivenessCheckPassed" {
+		t.Fatalf("unexpected ready condition %+v", ready)
+	}
+	if len(status.History) != 5 {
+		t.Fatalf("expected 5 transitions in the history, got %d", len(status.History))
+	}
+	last := status.History[len(status.History)-1]
+	if last.From != shimv1alpha1.PhaseProvisioned || last.To != shimv1alpha1.PhaseRunning {
+		t.Fatalf("unexpected last transition %+v", last)
+	}
+}
+
+func TestHistoryIsCapped(t *testing.T) {
+	status := &shimv1alpha1.VirtualMachineProvisioningStatus{}
+	now := metav1.Now()
+	for i := 0; i < MaxHistory; i++ {
+		Resync(status, shimv1alpha1.PhaseSecretCreated, "", now)
+		Resync(status, shimv1alpha1.PhaseRetrying, "", now)
+	}
+	if len(status.History) != MaxHistory {
+		t.Fatalf("expected %d transitions in the history, got %d", MaxHistory, len(status.History))
+	}
+	if status.History[len(status.History)-1].To != shimv1alpha1.PhaseRetrying {
+		t.Fatalf("history lost the latest transition")
+	}
+}
+
+func TestDegraded(t *testing.T) {
+	status := &shimv1alpha1.VirtualMachineProvisioningStatus{}
+	now := metav1.Now()
+	ClearDegraded(status, now)
+	if meta.FindStatusCondition(status.Conditions, shimv1alpha1.ConditionDegraded) != nil {
+		t.Fatalf("clearing a healthy status added a condition")
+	}
+	SetDegraded(status, "ReconcileError", "boom", now)
+	if !meta.IsStatusConditionTrue(status.Conditions, shimv1alpha1.ConditionDegraded) {
+		t.Fatalf("expected degraded condition")
+	}
+	ClearDegraded(status, now)
+	if !meta.IsStatusConditionFalse(status.Conditions, shimv1alpha1.ConditionDegraded) {
+		t.Fatalf("expected degraded condition to be cleared")
+	}
+}
+
+func TestExpiring(t *testing.T) {
+	status := &shimv1alpha1.VirtualMachineProvisioningStatus{}
+	now := metav1.Now()
+	ClearExpiring(status, now)
+	if meta.FindStatusCondition(status.Conditions, shimv1alpha1.ConditionExpiring) != nil {
+		t.Fatalf("clearing a status within its limits added a condition")
+	}
+	SetExpiring(status, "IdleTimeout", "idle", now)
+	if !meta.IsStatusConditionTrue(status.Conditions, shimv1alpha1.ConditionExpiring) {
+		t.Fatalf("expected expiring condition")
+	}
+	ClearExpiring(status, now)
+	if !meta.IsStatusConditionFalse(status.Conditions, shimv1alpha1.ConditionExpiring) {
+		t.Fatalf("expected expiring condition to be cleared")
+	}
+}
+
+func TestInvalidConfig(t *testing.T) {
+	status := &shimv1alpha1.VirtualMachineProvisioningStatus{}
+	now := metav1.Now()
+	ClearInvalidConfig(status, now)
+	if meta.FindStatusCondition(status.Conditions, shimv1alpha1.ConditionInvalidConfig) != nil {
+		t.Fatalf("clearing a valid status added a condition")
+	}
+	SetInvalidConfig(status, "RecycleUnsupported", "unsupported", now)
+	if !meta.IsStatusConditionTrue(status.Conditions, shimv1alpha1.ConditionInvalidConfig) {
+		t.Fatalf("expected invalid config condition")
+	}
+	ClearInvalidConfig(status, now)
+	if !meta.IsStatusConditionFalse(status.Conditions, shimv1alpha1.ConditionInvalidConfig) {
+		t.Fatalf("expected invalid config condition to be cleared")
+	}
+}
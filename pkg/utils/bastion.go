@@ -0,0 +1,49 @@
+package utils
+
+import (
+	"fmt"
+
+	"github.com/ibrokethecloud/k3s-operator/pkg/ssh"
+	gossh "golang.org/x/crypto/ssh"
+)
+
+// Bastion is a jump host SSH connections to instances without a reachable address are tunnelled through
+type Bastion struct {
+	// Address is the host:port of the bastion
+	Address string
+	User    string
+	// PrivateKey is the base64 encoded private key of User
+	PrivateKey string
+	// HostKeyCallback verifies the host key of the bastion, any host key is accepted without one
+	HostKeyCallback gossh.HostKeyCallback
+}
+
+// dial connects to address through the bastion. Both the returned client and the jump client connected to the
+// bastion have to be closed.
+func (b *Bastion) dial(address string, config *gossh.ClientConfig) (client *gossh.Client, jump *gossh.Client,
+	err error) {
+	rc, err := ssh.NewRemoteConnection(b.Address, b.User, b.PrivateKey)
+	if err != nil {
+		return client, jump, err
+	}
+	if b.HostKeyCallback != nil {
+		rc.Config.HostKeyCallback = b.HostKeyCallback
+	}
+	jump, err = rc.CheckConnection()
+	if err != nil {
+		return client, jump, fmt.Errorf("error connecting to bastion %s: %w", b.Address, err)
+	}
+
+	conn, err := jump.Dial("tcp", address)
+	if err != nil {
+		jump.Close()
+		return client, jump, fmt.Errorf("error connecting to %s through bastion %s: %w", address, b.Address, err)
+	}
+	clientConn, chans, reqs, err := gossh.NewClientConn(conn, address, config)
+	if err != nil {
+		conn.Close()
+		jump.Close()
+		return client, jump, err
+	}
+	return gossh.NewClient(clientConn, chans, reqs), jump, nil
+}
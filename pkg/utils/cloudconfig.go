@@ -0,0 +1,139 @@
+package utils
+
+import (
+	"encoding/base64"
+	"fmt"
+	"strings"
+
+	"gopkg.in/yaml.v2"
+)
+
+const (
+	cloudConfigHeader = "#cloud-config"
+	// userDataBoundary separates the parts of the multipart user data rendered by MergeUserData
+	userDataBoundary = "==hf-shim-operator-user-data=="
+	// userDataMergeType merges the generated cloud-config into the one of the template user data, appending to
+	// its lists and keeping its settings
+	userDataMergeType = "list(append)+dict(no_replace,recurse_list)+str()"
+)
+
+// userDataTypes are the content types of the user data formats cloud-init detects by their first line. Longer
+// prefixes come first.
+var userDataTypes = []struct {
+	prefix      string
+	contentType string
+}{
+	{"#cloud-config-archive", "text/cloud-config-archive"},
+	{"#cloud-config", "text/cloud-config"},
+	{"#cloud-boothook", "text/cloud-boothook"},
+	{"#include", "text/x-include-url"},
+	{"#part-handler", "text/part-handler"},
+	{"#upstart-job", "text/upstart-job"},
+	{"#!", "text/x-shellscript"},
+}
+
+// CloudConfig is a parsed #cloud-config user data document
+type CloudConfig map[interface{}]interface{}
+
+// ParseCloudConfig parses user data from an environment template mapping. The user data may
+// be plain text or base64 encoded, and may be empty.
+func ParseCloudConfig(userData string) (cloudConfig CloudConfig, err error) {
+	cloudConfig = make(CloudConfig)
+	userData = DecodeUserData(userData)
+	if len(strings.TrimSpace(userData)) == 0 {
+		return cloudConfig, nil
+	}
+	if err = yaml.Unmarshal([]byte(userData), &cloudConfig); err != nil {
+		return cloudConfig, fmt.Errorf("error parsing cloud-config: %v", err)
+	}
+	return cloudConfig, nil
+}
+
+// DecodeUserData returns user data from an environment template mapping as plain text. The user data may be plain
+// text or base64 encoded.
+func DecodeUserData(userData string) string {
+	if decoded, err := base64.StdEncoding.DecodeString(userData); err == nil {
+		return string(decoded)
+	}
+	return userData
+}
+
+// MergeUserData renders cloudConfig next to user data from an environment template mapping, as a multipart MIME
+// document running the user data unchanged before cloudConfig is merged into it. The user data may be in any of the
+// formats cloud-init detects by their first line or a MIME document, and plain text or base64 encoded. The plain
+// text document is returned, which is cloudConfig alone for empty user data.
+func MergeUserData(userData string, cloudConfig CloudConfig) (string, error) {
+	config, err := cloudConfig.String()
+	if err != nil {
+		return "", err
+	}
+	userData = DecodeUserData(userData)
+	if len(strings.TrimSpace(userData)) == 0 {
+		return config, nil
+	}
+	part, err := userDataPart(userData)
+	if err != nil {
+		return "", err
+	}
+	if strings.Contains(userData, userDataBoundary) {
+		return "", fmt.Errorf("user data contains the mime boundary %s", userDataBoundary)
+	}
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "Content-Type: multipart/mixed; boundary=\"%s\"\nMIME-Version: 1.0\n\n", userDataBoundary)
+	// the line break in front of a boundary belongs to the boundary, the parts are kept byte for byte
+	fmt.Fprintf(&b, "--%s\n%s\n", userDataBoundary, part)
+	fmt.Fprintf(&b, "--%s\nContent-Type: text/cloud-config; charset=\"us-ascii\"\nMerge-Type: %s\n\n%s\n",
+		userDataBoundary, userDataMergeType, config)
+	fmt.Fprintf(&b, "--%s--\n", userDataBoundary)
+	return b.String(), nil
+}
+
+// userDataPart returns user data as a part of a multipart MIME document. MIME documents are parts already, other
+// user data is typed by its first line the way cloud-init detects it.
+func userDataPart(userData string) (string, error) {
+	start := strings.ToLower(strings.TrimLeft(userData, " \t\r\n"))
+	if strings.HasPrefix(start, "content-type:") || strings.HasPrefix(start, "mime-version:") {
+		return userData, nil
+	}
+	for _, t := range userDataTypes {
+		if strings.HasPrefix(start, t.prefix) {
+			return fmt.Sprintf("Content-Type: %s; charset=\"us-ascii\"\n\n%s", t.contentType, userData), nil
+		}
+	}
+	return "", fmt.Errorf("unsupported user data, expected a mime document or a format cloud-init detects by its " +
+		"first line, like #cloud-config or #!")
+}
+
+// AppendList appends items to the list stored under key
+func (c CloudConfig) AppendList(key string, items ...interface{}) {
+	list, _ := c[key].([]interface{})
+	c[key] = append(list, items...)
+}
+
+// AddAuthorizedKeys appends ssh public keys to the ssh_authorized_keys list, keys already in it are skipped
+func (c CloudConfig) AddAuthorizedKeys(keys ...string) {
+	for _, key := range keys {
+		key = strings.TrimSpace(key)
+		authorized, _ := c["ssh_authorized_keys"].([]interface{})
+		found := false
+		for _, k := range authorized {
+			if k == key {
+				found = true
+				break
+			}
+		}
+		if !found {
+			c.AppendList("ssh_authorized_keys", key)
+		}
+	}
+}
+
+// String renders the plain text #cloud-config document
+func (c CloudConfig) String() (string, error) {
+	out, err := yaml.Marshal(map[interface{}]interface{}(c))
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%s\n%s", cloudConfigHeader, string(out)), nil
+}
@@ -0,0 +1,100 @@
+package utils
+
+import (
+	"encoding/base64"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParseCloudConfig(t *testing.T) {
+	cloudConfig := "#cloud-config\npackages: [git]\nusers:\n- name: ubuntu\n"
+	parsed := CloudConfig{
+		"packages": []interface{}{"git"},
+		"users":    []interface{}{CloudConfig{"name": "ubuntu"}},
+	}
+	cases := []struct {
+		name        string
+		userData    string
+		cloudConfig CloudConfig
+		err         bool
+	}{
+		{name: "empty", userData: "", cloudConfig: CloudConfig{}},
+		{name: "blank", userData: " \n", cloudConfig: CloudConfig{}},
+		{name: "plain text", userData: cloudConfig, cloudConfig: parsed},
+		{name: "base64", userData: base64.StdEncoding.EncodeToString([]byte(cloudConfig)), cloudConfig: parsed},
+		{name: "invalid", userData: "#cloud-config\npackages: [git\n", err: true},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			cloudConfig, err := ParseCloudConfig(c.userData)
+			if c.err {
+				if err == nil {
+					t.Fatalf("expected invalid cloud-config to fail, got %v", cloudConfig)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(cloudConfig, c.cloudConfig) {
+				t.Fatalf("expected %v, got %v", c.cloudConfig, cloudConfig)
+			}
+		})
+	}
+}
+
+func TestAddAuthorizedKeys(t *testing.T) {
+	cloudConfig := CloudConfig{"ssh_authorized_keys": []interface{}{"ssh-ed25519 AAAA1"}}
+	cloudConfig.AddAuthorizedKeys("ssh-ed25519 AAAA1\n", "ssh-ed25519 AAAA2\n", "ssh-ed25519 AAAA2")
+	expected := []interface{}{"ssh-ed25519 AAAA1", "ssh-ed25519 AAAA2"}
+	if !reflect.DeepEqual(cloudConfig["ssh_authorized_keys"], expected) {
+		t.Fatalf("expected the keys to be authorized once, got %v", cloudConfig["ssh_authorized_keys"])
+	}
+}
+
+func TestMergeUserData(t *testing.T) {
+	script := "#!/bin/bash\necho hello\n"
+	cases := []struct {
+		name     string
+		userData string
+		part     string
+		err      bool
+	}{
+		{name: "cloud-config", userData: "#cloud-config\npackages: [git]\n",
+			part: "Content-Type: text/cloud-config; charset=\"us-ascii\"\n\n#cloud-config\npackages: [git]\n"},
+		{name: "shell script", userData: script,
+			part: "Content-Type: text/x-shellscript; charset=\"us-ascii\"\n\n" + script},
+		{name: "base64", userData: base64.StdEncoding.EncodeToString([]byte(script)),
+			part: "Content-Type: text/x-shellscript; charset=\"us-ascii\"\n\n" + script},
+		{name: "mime", userData: "Content-Type: text/x-shellscript\n\n" + script,
+			part: "Content-Type: text/x-shellscript\n\n" + script},
+		{name: "unsupported", userData: "packages: [git]\n", err: true},
+		{name: "boundary", userData: "#cloud-config\n# --" + userDataBoundary + "\n", err: true},
+	}
+	cloudConfig := CloudConfig{"runcmd": []interface{}{"true"}}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			userData, err := MergeUserData(c.userData, cloudConfig)
+			if c.err {
+				if err == nil {
+					t.Fatalf("expected the user data to be refused, got %s", userData)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !strings.HasPrefix(userData, "Content-Type: multipart/mixed") ||
+				!strings.Contains(userData, "--"+userDataBoundary+"\n"+c.part+"\n--"+userDataBoundary+"\n") ||
+				!strings.Contains(userData, "Merge-Type: "+userDataMergeType+"\n\n#cloud-config\nruncmd:\n- \"true\"\n") {
+				t.Fatalf("expected the user data to be kept next to the cloud-config, got %s", userData)
+			}
+		})
+	}
+
+	userData, err := MergeUserData("", cloudConfig)
+	if err != nil || userData != "#cloud-config\nruncmd:\n- \"true\"\n" {
+		t.Fatalf("expected the cloud-config alone without user data, got %s: %v", userData, err)
+	}
+}
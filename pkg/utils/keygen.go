@@ -0,0 +1,154 @@
+package utils
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"strconv"
+	"strings"
+
+	gossh "golang.org/x/crypto/ssh"
+)
+
+// algorithms of the keys GenerateKeyPair generates
+const (
+	KeyAlgorithmED25519 = "ed25519"
+	KeyAlgorithmECDSA   = "ecdsa"
+	KeyAlgorithmRSA     = "rsa"
+)
+
+// KeyType is an ssh key algorithm with the size of its keys, which ed25519 keys have none of
+type KeyType struct {
+	Algorithm string
+	Bits      int
+}
+
+// defaultKeyBits are the sizes of the algorithms chosen without one
+var defaultKeyBits = map[string]int{
+	KeyAlgorithmECDSA: 256,
+	KeyAlgorithmRSA:   3072,
+}
+
+// ParseKeyType parses a key type like ed25519, ecdsa-384 or rsa-4096. ecdsa and rsa without a size are 256 and
+// 3072 bit keys.
+func ParseKeyType(value string) (keyType KeyType, err error) {
+	parts := strings.SplitN(strings.ToLower(strings.TrimSpace(value)), "-", 2)
+	keyType.Algorithm = parts[0]
+	if len(parts) == 2 {
+		if keyType.Bits, err = strconv.Atoi(parts[1]); err != nil {
+			return keyType, fmt.Errorf("invalid key size in key type %q", value)
+		}
+	}
+	switch keyType.Algorithm {
+	case KeyAlgorithmED25519:
+		if keyType.Bits != 0 {
+			return keyType, fmt.Errorf("ed25519 keys have a fixed size, got key type %q", value)
+		}
+	case KeyAlgorithmECDSA:
+		if keyType.Bits == 0 {
+			keyType.Bits = defaultKeyBits[KeyAlgorithmECDSA]
+		}
+		if keyType.Bits != 256 && keyType.Bits != 384 && keyType.Bits != 521 {
+			return keyType, fmt.Errorf("ecdsa keys are 256, 384 or 521 bits, got key type %q", value)
+		}
+	case KeyAlgorithmRSA:
+		if keyType.Bits == 0 {
+			keyType.Bits = defaultKeyBits[KeyAlgorithmRSA]
+		}
+		if keyType.Bits < 2048 || keyType.Bits > 8192 {
+			return keyType, fmt.Errorf("rsa keys are 2048 to 8192 bits, got key type %q", value)
+		}
+	default:
+		return keyType, fmt.Errorf("unknown key algorithm in key type %q, expected ed25519, ecdsa or rsa", value)
+	}
+	return keyType, nil
+}
+
+// String returns the key type as ParseKeyType parses it, e.g. rsa-4096
+func (k KeyType) String() string {
+	if k.Bits == 0 {
+		return k.Algorithm
+	}
+	return fmt.Sprintf("%s-%d", k.Algorithm, k.Bits)
+}
+
+// GenerateKeyPair generates an ssh keypair of keyType. The public key is returned in authorized_keys format and
+// the private key PEM encoded, as gargantua reads them from the keypair secret.
+func GenerateKeyPair(keyType KeyType) (pubKey string, privKey string, err error) {
+	var public interface{}
+	var block *pem.Block
+	switch keyType.Algorithm {
+	case KeyAlgorithmED25519:
+		var private ed25519.PrivateKey
+		public, private, err = ed25519.GenerateKey(rand.Reader)
+		if err != nil {
+			return pubKey, privKey, err
+		}
+		der, err := x509.MarshalPKCS8PrivateKey(private)
+		if err != nil {
+			return pubKey, privKey, err
+		}
+		block = &pem.Block{Type: "PRIVATE KEY", Bytes: der}
+	case KeyAlgorithmECDSA:
+		curves := map[int]elliptic.Curve{256: elliptic.P256(), 384: elliptic.P384(), 521: elliptic.P521()}
+		curve, ok := curves[keyType.Bits]
+		if !ok {
+			return pubKey, privKey, fmt.Errorf("unsupported key type %s", keyType)
+		}
+		private, err := ecdsa.GenerateKey(curve, rand.Reader)
+		if err != nil {
+			return pubKey, privKey, err
+		}
+		der, err := x509.MarshalECPrivateKey(private)
+		if err != nil {
+			return pubKey, privKey, err
+		}
+		public, block = &private.PublicKey, &pem.Block{Type: "EC PRIVATE KEY", Bytes: der}
+	case KeyAlgorithmRSA:
+		private, err := rsa.GenerateKey(rand.Reader, keyType.Bits)
+		if err != nil {
+			return pubKey, privKey, err
+		}
+		public = &private.PublicKey
+		block = &pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(private)}
+	default:
+		return pubKey, privKey, fmt.Errorf("unsupported key type %s", keyType)
+	}
+
+	sshPublic, err := gossh.NewPublicKey(public)
+	if err != nil {
+		return pubKey, privKey, err
+	}
+	var private bytes.Buffer
+	if err = pem.Encode(&private, block); err != nil {
+		return pubKey, privKey, err
+	}
+	return string(gossh.MarshalAuthorizedKey(sshPublic)), private.String(), nil
+}
+
+// PublicKeyType returns the key type of pubKey, an authorized_keys line
+func PublicKeyType(pubKey string) (keyType KeyType, err error) {
+	key, _, _, _, err := gossh.ParseAuthorizedKey([]byte(pubKey))
+	if err != nil {
+		return keyType, err
+	}
+	cryptoKey, ok := key.(gossh.CryptoPublicKey)
+	if !ok {
+		return keyType, fmt.Errorf("unsupported public key type %s", key.Type())
+	}
+	switch public := cryptoKey.CryptoPublicKey().(type) {
+	case ed25519.PublicKey:
+		return KeyType{Algorithm: KeyAlgorithmED25519}, nil
+	case *ecdsa.PublicKey:
+		return KeyType{Algorithm: KeyAlgorithmECDSA, Bits: public.Curve.Params().BitSize}, nil
+	case *rsa.PublicKey:
+		return KeyType{Algorithm: KeyAlgorithmRSA, Bits: public.N.BitLen()}, nil
+	}
+	return keyType, fmt.Errorf("unsupported public key type %s", key.Type())
+}
@@ -0,0 +1,93 @@
+package utils
+
+import (
+	"strings"
+	"testing"
+
+	gossh "golang.org/x/crypto/ssh"
+)
+
+func TestParseKeyType(t *testing.T) {
+	cases := []struct {
+		value    string
+		keyType  KeyType
+		rendered string
+		err      bool
+	}{
+		{value: "ed25519", keyType: KeyType{Algorithm: KeyAlgorithmED25519}, rendered: "ed25519"},
+		{value: " ED25519 ", keyType: KeyType{Algorithm: KeyAlgorithmED25519}, rendered: "ed25519"},
+		{value: "ecdsa", keyType: KeyType{Algorithm: KeyAlgorithmECDSA, Bits: 256}, rendered: "ecdsa-256"},
+		{value: "ecdsa-521", keyType: KeyType{Algorithm: KeyAlgorithmECDSA, Bits: 521}, rendered: "ecdsa-521"},
+		{value: "rsa", keyType: KeyType{Algorithm: KeyAlgorithmRSA, Bits: 3072}, rendered: "rsa-3072"},
+		{value: "rsa-4096", keyType: KeyType{Algorithm: KeyAlgorithmRSA, Bits: 4096}, rendered: "rsa-4096"},
+		{value: "ed25519-256", err: true},
+		{value: "ecdsa-512", err: true},
+		{value: "rsa-1024", err: true},
+		{value: "rsa-16384", err: true},
+		{value: "rsa-big", err: true},
+		{value: "dsa", err: true},
+		{value: "", err: true},
+	}
+	for _, c := range cases {
+		keyType, err := ParseKeyType(c.value)
+		if c.err {
+			if err == nil {
+				t.Errorf("expected key type %q to be invalid, got %s", c.value, keyType)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("expected key type %q to be valid: %v", c.value, err)
+			continue
+		}
+		if keyType != c.keyType || keyType.String() != c.rendered {
+			t.Errorf("expected key type %q to be %s, got %s", c.value, c.rendered, keyType)
+		}
+	}
+}
+
+func TestGenerateKeyPair(t *testing.T) {
+	cases := []struct {
+		keyType   KeyType
+		algorithm string
+		pemType   string
+	}{
+		{KeyType{Algorithm: KeyAlgorithmED25519}, gossh.KeyAlgoED25519, "PRIVATE KEY"},
+		{KeyType{Algorithm: KeyAlgorithmECDSA, Bits: 256}, gossh.KeyAlgoECDSA256, "EC PRIVATE KEY"},
+		{KeyType{Algorithm: KeyAlgorithmECDSA, Bits: 384}, gossh.KeyAlgoECDSA384, "EC PRIVATE KEY"},
+		{KeyType{Algorithm: KeyAlgorithmECDSA, Bits: 521}, gossh.KeyAlgoECDSA521, "EC PRIVATE KEY"},
+		{KeyType{Algorithm: KeyAlgorithmRSA, Bits: 2048}, gossh.KeyAlgoRSA, "RSA PRIVATE KEY"},
+	}
+	for _, c := range cases {
+		t.Run(c.keyType.String(), func(t *testing.T) {
+			pubKey, privKey, err := GenerateKeyPair(c.keyType)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !strings.HasPrefix(privKey, "-----BEGIN "+c.pemType+"-----") {
+				t.Fatalf("expected a PEM encoded %s, got %s", c.pemType, privKey)
+			}
+			signer, err := gossh.ParsePrivateKey([]byte(privKey))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(gossh.MarshalAuthorizedKey(signer.PublicKey())) != pubKey {
+				t.Fatalf("expected the public key of the private key, got %s", pubKey)
+			}
+			if signer.PublicKey().Type() != c.algorithm {
+				t.Fatalf("expected a %s key, got %s", c.algorithm, signer.PublicKey().Type())
+			}
+			keyType, err := PublicKeyType(pubKey)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if keyType != c.keyType {
+				t.Fatalf("expected the public key to be %s, got %s", c.keyType, keyType)
+			}
+		})
+	}
+
+	if _, _, err := GenerateKeyPair(KeyType{Algorithm: KeyAlgorithmECDSA, Bits: 512}); err == nil {
+		t.Fatal("expected unsupported key types to fail")
+	}
+}
@@ -0,0 +1,69 @@
+package utils
+
+import (
+	"bytes"
+	"fmt"
+
+	gossh "golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+// HostKeyMismatchError is returned for a host key which is not among the known host keys of an instance
+type HostKeyMismatchError struct {
+	Address string
+	Key     gossh.PublicKey
+}
+
+func (e *HostKeyMismatchError) Error() string {
+	return fmt.Sprintf("host key %s %s of %s does not match the known host keys", e.Key.Type(),
+		gossh.FingerprintSHA256(e.Key), e.Address)
+}
+
+// VerifyHostKey checks the host key presented by address against knownHosts, a known_hosts file of a single
+// instance. Its keys are trusted at any address, as the addresses of an instance change when it is started again.
+// Without known keys, the key is trusted on first use, unless the instance reported its host keys beforehand as the
+// authorized_keys lines of reported. It returns knownHosts with an entry for address and key.
+func VerifyHostKey(knownHosts []byte, reported []byte, address string, key gossh.PublicKey) ([]byte, error) {
+	host := knownhosts.Normalize(address)
+	known, listed := false, false
+	for rest := knownHosts; len(rest) > 0; {
+		_, hosts, knownKey, _, next, err := gossh.ParseKnownHosts(rest)
+		if err != nil {
+			break
+		}
+		rest = next
+		if !bytes.Equal(knownKey.Marshal(), key.Marshal()) {
+			continue
+		}
+		known = true
+		for _, h := range hosts {
+			if h == host {
+				listed = true
+			}
+		}
+	}
+
+	switch {
+	case listed:
+		return knownHosts, nil
+	case !known && len(knownHosts) > 0:
+		return knownHosts, &HostKeyMismatchError{Address: address, Key: key}
+	case !known && len(reported) > 0:
+		trusted := false
+		for rest := reported; len(rest) > 0; {
+			reportedKey, _, _, next, err := gossh.ParseAuthorizedKey(rest)
+			if err != nil {
+				break
+			}
+			rest = next
+			if bytes.Equal(reportedKey.Marshal(), key.Marshal()) {
+				trusted = true
+			}
+		}
+		if !trusted {
+			return knownHosts, &HostKeyMismatchError{Address: address, Key: key}
+		}
+	}
+	line := knownhosts.Line([]string{host}, key) + "\n"
+	return append(append([]byte{}, knownHosts...), line...), nil
+}
@@ -0,0 +1,159 @@
+package utils
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+
+	gossh "golang.org/x/crypto/ssh"
+)
+
+// certificateClockSkew backdates certificates, so instances with a clock running behind accept them
+const certificateClockSkew = 5 * time.Minute
+
+// certificateExtensions are the permissions of an ssh session granted to the holders of user certificates, as
+// ssh-keygen grants them by default
+var certificateExtensions = map[string]string{
+	"permit-X11-forwarding":   "",
+	"permit-agent-forwarding": "",
+	"permit-port-forwarding":  "",
+	"permit-pty":              "",
+	"permit-user-rc":          "",
+}
+
+// rsaSHA2Signer signs with rsa-sha2-512 instead of the ssh-rsa signatures sshd no longer accepts from certificate
+// authorities
+type rsaSHA2Signer struct {
+	gossh.AlgorithmSigner
+}
+
+func (s rsaSHA2Signer) Sign(rand io.Reader, data []byte) (*gossh.Signature, error) {
+	return s.SignWithAlgorithm(rand, data, gossh.SigAlgoRSASHA2512)
+}
+
+// parseCAKey parses caKey, the PEM encoded private key of an ssh certificate authority
+func parseCAKey(caKey []byte) (gossh.Signer, error) {
+	signer, err := gossh.ParsePrivateKey(caKey)
+	if err != nil {
+		return signer, fmt.Errorf("error parsing certificate authority key: %v", err)
+	}
+	if algorithmSigner, ok := signer.(gossh.AlgorithmSigner); ok && signer.PublicKey().Type() == gossh.KeyAlgoRSA {
+		return rsaSHA2Signer{algorithmSigner}, nil
+	}
+	return signer, nil
+}
+
+// CAPublicKey returns the public key of caKey, the PEM encoded private key of an ssh certificate authority, in
+// authorized_keys format as sshd reads it from TrustedUserCAKeys
+func CAPublicKey(caKey []byte) (string, error) {
+	signer, err := parseCAKey(caKey)
+	if err != nil {
+		return "", err
+	}
+	return string(gossh.MarshalAuthorizedKey(signer.PublicKey())), nil
+}
+
+// SignUserCertificate signs pubKey, an authorized_keys line, into a user certificate of the certificate authority
+// caKey. The certificate is valid for principals from now on until validity passed, and identified by keyID in
+// the logs of sshd. It is returned in authorized_keys format.
+func SignUserCertificate(caKey []byte, pubKey string, keyID string, principals []string,
+	validity time.Duration) (string, error) {
+	signer, err := parseCAKey(caKey)
+	if err != nil {
+		return "", err
+	}
+	key, _, _, _, err := gossh.ParseAuthorizedKey([]byte(pubKey))
+	if err != nil {
+		return "", err
+	}
+	serial := make([]byte, 8)
+	if _, err = rand.Read(serial); err != nil {
+		return "", err
+	}
+
+	now := time.Now()
+	cert := &gossh.Certificate{
+		Key:             key,
+		Serial:          binary.BigEndian.Uint64(serial),
+		CertType:        gossh.UserCert,
+		KeyId:           keyID,
+		ValidPrincipals: principals,
+		ValidAfter:      uint64(now.Add(-certificateClockSkew).Unix()),
+		ValidBefore:     uint64(now.Add(validity).Unix()),
+		Permissions:     gossh.Permissions{Extensions: certificateExtensions},
+	}
+	if err = cert.SignCert(rand.Reader, signer); err != nil {
+		return "", err
+	}
+	return string(gossh.MarshalAuthorizedKey(cert)), nil
+}
+
+// CheckUserCertificate checks that certificate, a user certificate in authorized_keys format, certifies pubKey
+// for principals and was signed by the certificate authority caPubKey. It returns when the certificate expires.
+func CheckUserCertificate(certificate string, caPubKey string, pubKey string,
+	principals []string) (validBefore time.Time, err error) {
+	cert, err := parseCertificate(certificate)
+	if err != nil {
+		return validBefore, err
+	}
+	caKey, _, _, _, err := gossh.ParseAuthorizedKey([]byte(caPubKey))
+	if err != nil {
+		return validBefore, err
+	}
+	key, _, _, _, err := gossh.ParseAuthorizedKey([]byte(pubKey))
+	if err != nil {
+		return validBefore, err
+	}
+
+	switch {
+	case cert.CertType != gossh.UserCert:
+		return validBefore, fmt.Errorf("certificate %s is no user certificate", cert.KeyId)
+	case !bytes.Equal(cert.SignatureKey.Marshal(), caKey.Marshal()):
+		return validBefore, fmt.Errorf("certificate %s is signed by another certificate authority", cert.KeyId)
+	case !bytes.Equal(cert.Key.Marshal(), key.Marshal()):
+		return validBefore, fmt.Errorf("certificate %s certifies another key", cert.KeyId)
+	case strings.Join(cert.ValidPrincipals, ",") != strings.Join(principals, ","):
+		return validBefore, fmt.Errorf("certificate %s is valid for %s", cert.KeyId,
+			strings.Join(cert.ValidPrincipals, ", "))
+	}
+	return time.Unix(int64(cert.ValidBefore), 0), nil
+}
+
+// parseCertificate parses certificate, an ssh certificate in authorized_keys format
+func parseCertificate(certificate string) (*gossh.Certificate, error) {
+	key, _, _, _, err := gossh.ParseAuthorizedKey([]byte(certificate))
+	if err != nil {
+		return nil, err
+	}
+	cert, ok := key.(*gossh.Certificate)
+	if !ok {
+		return nil, fmt.Errorf("%s key is no certificate", key.Type())
+	}
+	return cert, nil
+}
+
+// certificateAuth authenticates with privateKey, the base64 encoded private key, presenting certificate
+func certificateAuth(privateKey string, certificate string) (gossh.AuthMethod, error) {
+	cert, err := parseCertificate(certificate)
+	if err != nil {
+		return nil, err
+	}
+	decoded, err := base64.StdEncoding.DecodeString(privateKey)
+	if err != nil {
+		return nil, err
+	}
+	signer, err := gossh.ParsePrivateKey(decoded)
+	if err != nil {
+		return nil, err
+	}
+	certSigner, err := gossh.NewCertSigner(cert, signer)
+	if err != nil {
+		return nil, err
+	}
+	return gossh.PublicKeys(certSigner), nil
+}
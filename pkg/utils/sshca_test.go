@@ -0,0 +1,127 @@
+package utils
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	gossh "golang.org/x/crypto/ssh"
+)
+
+// generateKey generates a keypair of keyType, e.g. ed25519
+func generateKey(t *testing.T, keyType string) (pubKey string, privKey string) {
+	t.Helper()
+	parsed, err := ParseKeyType(keyType)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if pubKey, privKey, err = GenerateKeyPair(parsed); err != nil {
+		t.Fatal(err)
+	}
+	return pubKey, privKey
+}
+
+func TestSignUserCertificate(t *testing.T) {
+	cases := []struct {
+		caKeyType string
+		signature string
+	}{
+		{"ed25519", gossh.KeyAlgoED25519},
+		{"ecdsa-384", gossh.KeyAlgoECDSA384},
+		{"rsa-2048", gossh.SigAlgoRSASHA2512},
+	}
+	pubKey, _ := generateKey(t, "ed25519")
+	for _, c := range cases {
+		t.Run(c.caKeyType, func(t *testing.T) {
+			_, caKey := generateKey(t, c.caKeyType)
+			caPubKey, err := CAPublicKey([]byte(caKey))
+			if err != nil {
+				t.Fatal(err)
+			}
+			certificate, err := SignUserCertificate([]byte(caKey), pubKey, "vm-test", []string{"ubuntu"}, time.Hour)
+			if err != nil {
+				t.Fatal(err)
+			}
+			cert, err := parseCertificate(certificate)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if cert.Signature.Format != c.signature {
+				t.Fatalf("expected a %s signature, got %s", c.signature, cert.Signature.Format)
+			}
+			if validAfter := time.Unix(int64(cert.ValidAfter), 0); time.Until(validAfter) > -certificateClockSkew+time.Minute {
+				t.Fatalf("expected the certificate to be backdated, got valid after %s", validAfter)
+			}
+			validBefore, err := CheckUserCertificate(certificate, caPubKey, pubKey, []string{"ubuntu"})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if validity := time.Until(validBefore); validity > time.Hour || validity < 59*time.Minute {
+				t.Fatalf("expected the certificate to be valid for 1h, got %s", validity)
+			}
+		})
+	}
+}
+
+func TestCheckUserCertificate(t *testing.T) {
+	pubKey, _ := generateKey(t, "ed25519")
+	otherPubKey, _ := generateKey(t, "ed25519")
+	_, caKey := generateKey(t, "ed25519")
+	_, otherCAKey := generateKey(t, "ed25519")
+	caPubKey, err := CAPublicKey([]byte(caKey))
+	if err != nil {
+		t.Fatal(err)
+	}
+	otherCAPubKey, err := CAPublicKey([]byte(otherCAKey))
+	if err != nil {
+		t.Fatal(err)
+	}
+	sign := func(validity time.Duration) string {
+		certificate, err := SignUserCertificate([]byte(caKey), pubKey, "vm-test", []string{"ubuntu"}, validity)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return certificate
+	}
+
+	cases := []struct {
+		name        string
+		certificate string
+		caPubKey    string
+		pubKey      string
+		principals  []string
+		err         string
+		expired     bool
+	}{
+		{name: "valid", certificate: sign(time.Hour), caPubKey: caPubKey, pubKey: pubKey,
+			principals: []string{"ubuntu"}},
+		{name: "expired", certificate: sign(-time.Hour), caPubKey: caPubKey, pubKey: pubKey,
+			principals: []string{"ubuntu"}, expired: true},
+		{name: "wrong certificate authority", certificate: sign(time.Hour), caPubKey: otherCAPubKey, pubKey: pubKey,
+			principals: []string{"ubuntu"}, err: "another certificate authority"},
+		{name: "wrong key", certificate: sign(time.Hour), caPubKey: caPubKey, pubKey: otherPubKey,
+			principals: []string{"ubuntu"}, err: "certifies another key"},
+		{name: "wrong principal", certificate: sign(time.Hour), caPubKey: caPubKey, pubKey: pubKey,
+			principals: []string{"root"}, err: "is valid for ubuntu"},
+		{name: "no certificate", certificate: pubKey, caPubKey: caPubKey, pubKey: pubKey,
+			principals: []string{"ubuntu"}, err: "is no certificate"},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			validBefore, err := CheckUserCertificate(c.certificate, c.caPubKey, c.pubKey, c.principals)
+			if len(c.err) != 0 {
+				if err == nil || !strings.Contains(err.Error(), c.err) {
+					t.Fatalf("expected an error containing %q, got %v", c.err, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			// expired certificates are checked, the caller renews them by when they expire
+			if expired := validBefore.Before(time.Now()); expired != c.expired {
+				t.Fatalf("expected the certificate to be expired %t, got valid before %s", c.expired, validBefore)
+			}
+		})
+	}
+}
@@ -2,8 +2,10 @@ package utils
 
 import (
 	"encoding/base64"
+	"errors"
 
 	"github.com/ibrokethecloud/k3s-operator/pkg/ssh"
+	gossh "golang.org/x/crypto/ssh"
 
 	"gopkg.in/yaml.v2"
 )
@@ -40,16 +42,68 @@ func MergeCloudInit(pubKey string, cloudInit string) (mergedCloudInit string, er
 }
 
 // Perform SSH based liveness checks on the instance
-func PerformLivenessCheck(address string, userName string, privateKey string, command string) (ready bool, err error) {
+func PerformLivenessCheck(address string, userName string, privateKey string, certificate string, command string,
+	hostKeyCallback gossh.HostKeyCallback, bastion *Bastion) (ready bool, err error) {
+	_, err = RunCommand(address, userName, privateKey, certificate, command, hostKeyCallback, bastion)
+	if err != nil {
+		return ready, err
+	}
+	ready = true
+	return ready, nil
+}
 
+// RunCommand runs command on the instance over SSH and returns its output. hostKeyCallback verifies the host key
+// of the instance, any host key is accepted without one. The connection is tunnelled through bastion when it is set.
+// certificate, an ssh user certificate of privateKey, is presented instead of the plain key when it is set.
+func RunCommand(address string, userName string, privateKey string, certificate string, command string,
+	hostKeyCallback gossh.HostKeyCallback, bastion *Bastion) (output string, err error) {
 	rc, err := ssh.NewRemoteConnection(address, userName, privateKey)
 	if err != nil {
-		return ready, err
+		return output, err
+	}
+	if len(certificate) > 0 {
+		auth, err := certificateAuth(privateKey, certificate)
+		if err != nil {
+			return output, err
+		}
+		rc.Config.Auth = []gossh.AuthMethod{auth}
+	}
+	if hostKeyCallback != nil {
+		rc.Config.HostKeyCallback = hostKeyCallback
+	}
+	if bastion == nil {
+		out, err := rc.Remote(command)
+		return string(out), err
 	}
-	_, err = rc.Remote(command)
+
+	client, jump, err := bastion.dial(address, &rc.Config)
 	if err != nil {
-		return ready, err
+		return output, err
 	}
-	ready = true
-	return ready, nil
+	defer jump.Close()
+	defer client.Close()
+	session, err := client.NewSession()
+	if err != nil {
+		return output, err
+	}
+	defer session.Close()
+	out, err := session.Output(command)
+	return string(out), err
+}
+
+// CommandFailed reports if err is the non-zero exit status of a command run over SSH, rather than an error
+// connecting to the instance
+func CommandFailed(err error) bool {
+	_, ok := ExitStatus(err)
+	return ok
+}
+
+// ExitStatus returns the exit status of a command run over SSH which failed with err, and false when err is an
+// error connecting to the instance
+func ExitStatus(err error) (status int, ok bool) {
+	var exitErr *gossh.ExitError
+	if !errors.As(err, &exitErr) {
+		return status, false
+	}
+	return exitErr.ExitStatus(), true
 }